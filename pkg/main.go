@@ -2,6 +2,8 @@ package main
 
 import (
 	"os"
+	// Embed the zone database so the timeZone setting works on hosts without one.
+	_ "time/tzdata"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
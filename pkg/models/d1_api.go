@@ -1,29 +1,78 @@
 package models
 
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
 // D1QueryRequest is the payload for a D1 query.
 // We don't strictly need this if we always send `{"sql": "..."}` directly,
 // but it's good practice to define request structs as well.
 type D1QueryRequest struct {
-	SQL string `json:"sql"`
+	SQL    string        `json:"sql"`
+	Params []interface{} `json:"params,omitempty"` // Values bound to the statement's ? placeholders, in order
+	// Bookmark asks D1 to read at least as recent a state as the session bookmark names.
+	Bookmark string `json:"bookmark,omitempty"`
 }
 
 // D1SuccessResult represents the actual query results and metadata from a successful D1 query.
 type D1SuccessResult struct {
-	Results []map[string]interface{} `json:"results"` // Array of row objects (map of colName:value)
-	Meta    D1Meta                   `json:"meta"`
-	Success bool                     `json:"success"`
+	Results []D1Row `json:"results"` // Array of row objects, keeping their column order
+	Meta    D1Meta  `json:"meta"`
+	Success bool    `json:"success"`
+	Error   string  `json:"error,omitempty"` // Why the statement failed, when reported per statement
+}
+
+// D1Row is one row object of a /query result. Unlike a map it keeps the columns in the
+// order D1 returned them, which is the order of the SELECT list.
+type D1Row struct {
+	Columns []string
+	Values  []interface{}
+}
+
+// UnmarshalJSON decodes a JSON object into r, preserving the order of its keys.
+func (r *D1Row) UnmarshalJSON(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("D1 row must be a JSON object, got %v", tok)
+	}
+	dec.UseNumber()
+	r.Columns, r.Values = nil, nil
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var value interface{}
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+		r.Columns = append(r.Columns, tok.(string))
+		r.Values = append(r.Values, decodeNumbers(value))
+	}
+	_, err = dec.Token()
+	return err
 }
 
 // D1Meta contains metadata about the D1 query execution.
 type D1Meta struct {
-	ServedBy    string  `json:"served_by"`
-	Duration    float64 `json:"duration"`
-	Changes     int     `json:"changes"`
-	LastRowID   int     `json:"last_row_id"` // D1 docs show last_row_id, but results often have it as 0 if not an INSERT
-	ChangedDB   bool    `json:"changed_db"`
-	SizeAfter   int     `json:"size_after"`
-	RowsRead    int     `json:"rows_read"`
-	RowsWritten int     `json:"rows_written"`
+	ServedBy       string  `json:"served_by"`
+	ServedByRegion string  `json:"served_by_region"` // Location of the database instance, e.g. WEUR
+	Duration       float64 `json:"duration"`
+	Changes        int     `json:"changes"`
+	LastRowID      int     `json:"last_row_id"` // D1 docs show last_row_id, but results often have it as 0 if not an INSERT
+	ChangedDB      bool    `json:"changed_db"`
+	SizeAfter      int     `json:"size_after"`
+	RowsRead       int     `json:"rows_read"`
+	RowsWritten    int     `json:"rows_written"`
+	Bookmark       string  `json:"bookmark,omitempty"` // Session bookmark of the state the statement saw, when D1 returns one
 }
 
 // D1APIResponse is the top-level structure for a D1 API response.
@@ -54,12 +103,66 @@ type D1RawQueryActualResult struct {
 	Rows    [][]interface{} `json:"rows"`
 }
 
+// UnmarshalJSON decodes the result, keeping integers float64 can't represent exactly.
+func (r *D1RawQueryActualResult) UnmarshalJSON(b []byte) error {
+	var result struct {
+		Columns []string        `json:"columns"`
+		Rows    [][]interface{} `json:"rows"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&result); err != nil {
+		return err
+	}
+	for _, row := range result.Rows {
+		for i, value := range row {
+			row[i] = decodeNumbers(value)
+		}
+	}
+	r.Columns, r.Rows = result.Columns, result.Rows
+	return nil
+}
+
+// MaxExactInteger is the largest integer magnitude every float64 represents exactly (2^53).
+const MaxExactInteger = 1 << 53
+
+// decodeNumbers replaces the json.Numbers in a value decoded with UseNumber. Numbers are
+// float64, as encoding/json decodes them by default, except integers beyond 2^53, which
+// float64 would round: those are int64, or the decimal string when they overflow int64.
+func decodeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			if i > MaxExactInteger || i < -MaxExactInteger {
+				return i
+			}
+		} else if errors.Is(err, strconv.ErrRange) {
+			return string(v)
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return string(v)
+		}
+		return f
+	case []interface{}:
+		for i := range v {
+			v[i] = decodeNumbers(v[i])
+		}
+	case map[string]interface{}:
+		for key := range v {
+			v[key] = decodeNumbers(v[key])
+		}
+	}
+	return value
+}
+
 // D1RawResultItem represents one item in the 'result' array from a D1 /raw query.
 // This structure holds the actual query results (columns and rows) and metadata.
 type D1RawResultItem struct {
 	Results *D1RawQueryActualResult `json:"results,omitempty"` // Pointer to handle DDL statements that don't return rows/columns
 	Meta    D1Meta                  `json:"meta"`
 	Success bool                    `json:"success"`
+	Error   string                  `json:"error,omitempty"` // Why the statement failed, when reported per statement
 }
 
 // D1RawAPIResponse is the top-level structure for a D1 /raw API response.
@@ -69,4 +172,39 @@ type D1RawAPIResponse struct {
 	Success  bool              `json:"success"`
 	Errors   []D1Error         `json:"errors"`
 	Messages []D1Message       `json:"messages"`
-} 
\ No newline at end of file
+}
+
+// D1Database is one entry of the account's D1 database list.
+type D1Database struct {
+	UUID string `json:"uuid"`
+	Name string `json:"name"`
+}
+
+// D1ResultInfo is the pagination metadata of a Cloudflare list response.
+type D1ResultInfo struct {
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	Count      int `json:"count"`
+	TotalCount int `json:"total_count"`
+}
+
+// CloudflareResponse is the envelope of Cloudflare v4 API responses. Result is decoded by
+// the caller into the endpoint's result type.
+type CloudflareResponse struct {
+	Result     json.RawMessage `json:"result"`
+	ResultInfo D1ResultInfo    `json:"result_info"`
+	Success    bool            `json:"success"`
+	Errors     []D1Error       `json:"errors"`
+}
+
+// TokenVerification is the result of GET /user/tokens/verify.
+type TokenVerification struct {
+	ID     string `json:"id"`
+	Status string `json:"status"` // active, disabled or expired
+}
+
+// CloudflareAccount is the result of GET /accounts/{id}.
+type CloudflareAccount struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
@@ -1,22 +1,229 @@
 package models
 
 import (
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 )
 
+// Supported values for PluginSettings.Jurisdiction.
+const (
+	JurisdictionDefault = "default"
+	JurisdictionEU      = "eu"
+	JurisdictionFedRAMP = "fedramp"
+)
+
+// jurisdictionHosts maps each supported jurisdiction to its Cloudflare API host.
+var jurisdictionHosts = map[string]string{
+	JurisdictionDefault: "api.cloudflare.com",
+	JurisdictionEU:      "eu.api.cloudflare.com",
+	JurisdictionFedRAMP: "api.fed.cloudflare.com",
+}
+
+// Supported values for PluginSettings.DefaultNullColumnType.
+const (
+	NullColumnTypeString  = "string"
+	NullColumnTypeFloat64 = "float64"
+	NullColumnTypeInt64   = "int64"
+)
+
+// Supported values for PluginSettings.DecimalSeparator.
+const (
+	DecimalSeparatorPoint = "."
+	DecimalSeparatorComma = ","
+)
+
+// Supported values for PluginSettings.Endpoint.
+const (
+	EndpointRaw   = "raw"
+	EndpointQuery = "query"
+)
+
+// Supported values for PluginSettings.LogLevel. Warnings and errors are logged at every level.
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+)
+
+// DefaultHealthCheckQuery is the statement CheckHealth runs when healthCheckQuery is not configured.
+const DefaultHealthCheckQuery = "SELECT 1;"
+
+// DefaultMaxSQLLength is the maximum SQL length in characters when maxSqlLength is not configured.
+const DefaultMaxSQLLength = 100000
+
+// DefaultQueryConcurrency is how many queries of a request run in parallel when queryConcurrency is not configured.
+const DefaultQueryConcurrency = 4
+
+// DefaultRateLimitWarningThreshold is the remaining API request count below which queries
+// warn when rateLimitWarningThreshold is not configured.
+const DefaultRateLimitWarningThreshold = 100
+
+// DefaultQueryTimeoutSeconds is how long a query may run when neither the query nor
+// queryTimeoutSeconds sets a timeout.
+const DefaultQueryTimeoutSeconds = 10
+
+// DefaultMaxQueryTimeoutSeconds caps per-query timeouts when maxQueryTimeoutSeconds is not configured.
+const DefaultMaxQueryTimeoutSeconds = 60
+
+// DefaultDialTimeoutSeconds bounds connecting to the API when dialTimeoutSeconds is not
+// configured.
+const DefaultDialTimeoutSeconds = 30
+
+// DefaultTLSHandshakeTimeoutSeconds bounds the TLS handshake with the API when
+// tlsHandshakeTimeoutSeconds is not configured.
+const DefaultTLSHandshakeTimeoutSeconds = 10
+
+// DefaultMaxRows is the number of result rows kept per query when maxRows is not configured.
+const DefaultMaxRows = 100000
+
+// DefaultTimeZone is the zone naive timestamp strings are read in when timeZone is not configured.
+const DefaultTimeZone = "UTC"
+
+// DefaultCircuitBreakerCooldownSeconds is how long an open circuit breaker rejects
+// queries when circuitBreakerCooldownSeconds is not configured.
+const DefaultCircuitBreakerCooldownSeconds = 30
+
+// DefaultMaxAttempts is how often a D1 request is tried, including retries, when
+// maxAttempts is not configured.
+const DefaultMaxAttempts = 3
+
 type PluginSettings struct {
-	AccountID  string                `json:"accountId"`
-	DatabaseID string                `json:"databaseId"`
-	Secrets    *SecretPluginSettings `json:"-"`
+	AccountID  string `json:"accountId"`
+	DatabaseID string `json:"databaseId"`
+	// ReplicaDatabaseID is a copy of the database that read queries fail over to when
+	// the primary database can't be reached or fails with a server error.
+	ReplicaDatabaseID string `json:"replicaDatabaseId"`
+	// URLTemplate replaces the standard D1 database URL, for tokens and gateways needing a
+	// different path. {database} is required; {account} and {endpoint} are optional.
+	URLTemplate string `json:"urlTemplate"`
+	// Jurisdiction is one of default, eu or fedramp and selects the API host.
+	Jurisdiction string `json:"jurisdiction"`
+	// Endpoint is the D1 endpoint, raw or query, that queries without an endpoint of
+	// their own and the health check are sent to.
+	Endpoint string `json:"endpoint"`
+	// MaxRows is the number of rows kept per query before results are truncated.
+	MaxRows int `json:"maxRows"`
+	// HealthCheckQuery is run by the health check, e.g. to verify access to a specific table.
+	HealthCheckQuery string `json:"healthCheckQuery"`
+	// ReadOnly rejects statements other than SELECT, WITH, PRAGMA and EXPLAIN.
+	ReadOnly bool `json:"readOnly"`
+	// CacheTTLSeconds is how long query results are cached; 0 disables caching.
+	CacheTTLSeconds int `json:"cacheTTLSeconds"`
+	// AccessClientID is the client ID of a Cloudflare Access service token.
+	AccessClientID string `json:"accessClientId"`
+	// MaxSQLLength is the longest SQL, in characters, sent to D1; 0 means unlimited.
+	// It is loaded separately because an explicit 0 differs from an unset value.
+	MaxSQLLength int `json:"-"`
+	// QueryConcurrency bounds how many queries of a single request run in parallel.
+	QueryConcurrency int `json:"queryConcurrency"`
+	// MaxConcurrentRequests bounds the D1 requests in flight at once across all requests
+	// of the datasource; 0 means unlimited.
+	MaxConcurrentRequests int `json:"maxConcurrentRequests"`
+	// DefaultNullColumnType is the field type of columns whose values are all NULL.
+	DefaultNullColumnType string `json:"defaultNullColumnType"`
+	// DecimalSeparator is "." or "," and is used to read the numeric string columns a
+	// query lists; the other one separates thousands.
+	DecimalSeparator string `json:"decimalSeparator"`
+	// EmptyStringAsNull returns empty strings in string columns as NULL.
+	EmptyStringAsNull bool `json:"emptyStringAsNull"`
+	// NonFiniteAsNull returns NaN and infinite numbers, which D1 sends as strings such as
+	// "NaN" or "Infinity", as NULL.
+	NonFiniteAsNull bool `json:"nonFiniteAsNull"`
+	// DisableTimeParsing keeps every string column a string, even if it looks like a timestamp.
+	DisableTimeParsing bool `json:"disableTimeParsing"`
+	// SuppressTimeParseNotice hides the notice naming string columns parsed as timestamps.
+	SuppressTimeParseNotice bool `json:"suppressTimeParseNotice"`
+	// NumericsAsFloat returns every numeric column as float64, turning off integer detection.
+	NumericsAsFloat bool `json:"numericsAsFloat"`
+	// PrettifyColumnNames shows column names like total_bytes as Total Bytes.
+	PrettifyColumnNames bool `json:"prettifyColumnNames"`
+	// EmptyInMatchesAll makes $__in with no values match every row instead of none.
+	EmptyInMatchesAll bool `json:"emptyInMatchesAll"`
+	// WarnOnUnboundedSelect adds a warning to results of SELECTs without a LIMIT clause.
+	WarnOnUnboundedSelect bool `json:"warnOnUnboundedSelect"`
+	// DeduplicateColumns renames repeated column names of a result, e.g. from
+	// SELECT a.id, b.id, to id, id_1. On by default, so it is loaded with MaxSQLLength.
+	DeduplicateColumns bool `json:"-"`
+	// MaxResponseBytes caps the size of D1 and Cloudflare API response bodies, after
+	// decompression; 0 derives the cap from MaxRows.
+	MaxResponseBytes int64 `json:"maxResponseBytes"`
+	// MaxColumns is the number of columns kept per result; 0 means unlimited.
+	MaxColumns int `json:"maxColumns"`
+	// QueryTimeoutSeconds is the default time a query may take, including the D1 request.
+	QueryTimeoutSeconds int `json:"queryTimeoutSeconds"`
+	// MaxQueryTimeoutSeconds caps the timeoutSeconds a query may ask for.
+	MaxQueryTimeoutSeconds int `json:"maxQueryTimeoutSeconds"`
+	// TotalTimeoutSeconds bounds the time all queries of a single request may take
+	// together; 0 means only the per-query timeouts apply.
+	TotalTimeoutSeconds int `json:"totalTimeoutSeconds"`
+	// DialTimeoutSeconds bounds establishing a connection to the API, so an unreachable
+	// host fails fast without limiting how long a response may take to download.
+	DialTimeoutSeconds int `json:"dialTimeoutSeconds"`
+	// TLSHandshakeTimeoutSeconds bounds the TLS handshake of a new API connection.
+	TLSHandshakeTimeoutSeconds int `json:"tlsHandshakeTimeoutSeconds"`
+	// RateLimitWarningThreshold is the remaining API request count below which queries
+	// carry a warning; 0 disables the warning. Loaded with MaxSQLLength.
+	RateLimitWarningThreshold int `json:"-"`
+	// CustomHeaders are static headers added to every D1 API request, e.g. for an egress gateway.
+	CustomHeaders map[string]string `json:"customHeaders,omitempty"`
+	// RetryOnConnectionError retries D1 requests that failed to connect, on a refused
+	// connection, DNS failure or dial timeout, up to MaxAttempts. Failures after connecting
+	// are not retried, as the request may already have been applied.
+	RetryOnConnectionError bool `json:"retryOnConnectionError"`
+	// MaxAttempts caps how often a D1 request is tried, including the first attempt.
+	MaxAttempts int `json:"maxAttempts"`
+	// CircuitBreakerThreshold is the number of consecutive failed D1 requests after which
+	// queries fail at once for CircuitBreakerCooldownSeconds; 0 disables the breaker.
+	CircuitBreakerThreshold int `json:"circuitBreakerThreshold"`
+	// CircuitBreakerCooldownSeconds is how long an open breaker waits before letting a
+	// query through to test whether the API has recovered.
+	CircuitBreakerCooldownSeconds int `json:"circuitBreakerCooldownSeconds"`
+	// AllowedQueryPatterns are regular expressions of which a query must match at least
+	// one to be run; empty allows every query.
+	AllowedQueryPatterns []string `json:"allowedQueryPatterns,omitempty"`
+	// AllowedQueries are the compiled AllowedQueryPatterns, loaded by LoadPluginSettings.
+	AllowedQueries []*regexp.Regexp `json:"-"`
+	// MandatoryFilter is a condition added to the outermost WHERE clause of every query,
+	// e.g. tenant_id = 'x'. It only scopes the outermost SELECTs, so queries other than
+	// SELECT, and SELECTs with subqueries or WITH clauses, are rejected when it is set.
+	MandatoryFilter string `json:"mandatoryFilter"`
+	// TLSCACert is a PEM bundle of CA certificates trusted for API requests in addition
+	// to the system pool, e.g. that of a TLS-intercepting proxy.
+	TLSCACert string `json:"tlsCACert"`
+	// TLSSkipVerify disables TLS certificate verification of API requests.
+	TLSSkipVerify bool `json:"tlsSkipVerify"`
+	// RootCAs is the system pool with TLSCACert added, loaded by LoadPluginSettings; nil
+	// without a TLSCACert.
+	RootCAs *x509.CertPool `json:"-"`
+	// LogLevel is the least severe level of the plugin's log lines for this datasource.
+	LogLevel string `json:"logLevel"`
+	// TimeZone is the IANA name of the zone timestamp strings without an offset are in.
+	TimeZone string `json:"timeZone"`
+	// Location is TimeZone, loaded by LoadPluginSettings.
+	Location *time.Location `json:"-"`
+
+	Secrets *SecretPluginSettings `json:"-"`
 }
 
 type SecretPluginSettings struct {
-	APIToken string `json:"apiToken"`
+	APIToken           string `json:"apiToken"`
+	AccessClientSecret string `json:"accessClientSecret"`
 }
 
+// legacyAPITokenKey is the secure setting older provisioning files stored the API
+// token under. It is only read when apiToken is unset.
+const legacyAPITokenKey = "apiKey"
+
 func LoadPluginSettings(source backend.DataSourceInstanceSettings) (*PluginSettings, error) {
 	settings := PluginSettings{}
 	err := json.Unmarshal(source.JSONData, &settings)
@@ -24,15 +231,286 @@ func LoadPluginSettings(source backend.DataSourceInstanceSettings) (*PluginSetti
 		return nil, fmt.Errorf("could not unmarshal PluginSettings json: %w", err)
 	}
 
+	if settings.Jurisdiction == "" {
+		settings.Jurisdiction = JurisdictionDefault
+	}
+	if err := validateJurisdiction(settings.Jurisdiction); err != nil {
+		return nil, err
+	}
+
+	if settings.DefaultNullColumnType == "" {
+		settings.DefaultNullColumnType = NullColumnTypeString
+	}
+	if err := validateNullColumnType(settings.DefaultNullColumnType); err != nil {
+		return nil, err
+	}
+
+	if settings.DecimalSeparator == "" {
+		settings.DecimalSeparator = DecimalSeparatorPoint
+	}
+	if err := validateDecimalSeparator(settings.DecimalSeparator); err != nil {
+		return nil, err
+	}
+
+	if settings.Endpoint == "" {
+		settings.Endpoint = EndpointRaw
+	}
+	if err := validateEndpoint(settings.Endpoint); err != nil {
+		return nil, err
+	}
+
+	if err := validateURLTemplate(settings.URLTemplate); err != nil {
+		return nil, err
+	}
+
+	if settings.LogLevel == "" {
+		settings.LogLevel = LogLevelDebug
+	}
+	if err := validateLogLevel(settings.LogLevel); err != nil {
+		return nil, err
+	}
+
+	for _, pattern := range settings.AllowedQueryPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowedQueryPatterns entry %q: %w", pattern, err)
+		}
+		settings.AllowedQueries = append(settings.AllowedQueries, re)
+	}
+
+	if settings.TLSCACert != "" {
+		pool, err := loadCACertPool(settings.TLSCACert)
+		if err != nil {
+			return nil, err
+		}
+		settings.RootCAs = pool
+	}
+
+	if settings.TimeZone == "" {
+		settings.TimeZone = DefaultTimeZone
+	}
+	location, err := time.LoadLocation(settings.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeZone %q: %w", settings.TimeZone, err)
+	}
+	settings.Location = location
+
+	if settings.MaxRows <= 0 {
+		settings.MaxRows = DefaultMaxRows
+	}
+	if settings.MaxColumns < 0 {
+		return nil, fmt.Errorf("maxColumns must not be negative, got %d", settings.MaxColumns)
+	}
+	if settings.MaxResponseBytes < 0 {
+		return nil, fmt.Errorf("maxResponseBytes must not be negative, got %d", settings.MaxResponseBytes)
+	}
+	if settings.TotalTimeoutSeconds < 0 {
+		return nil, fmt.Errorf("totalTimeoutSeconds must not be negative, got %d", settings.TotalTimeoutSeconds)
+	}
+	if settings.QueryTimeoutSeconds <= 0 {
+		settings.QueryTimeoutSeconds = DefaultQueryTimeoutSeconds
+	}
+	if settings.DialTimeoutSeconds <= 0 {
+		settings.DialTimeoutSeconds = DefaultDialTimeoutSeconds
+	}
+	if settings.TLSHandshakeTimeoutSeconds <= 0 {
+		settings.TLSHandshakeTimeoutSeconds = DefaultTLSHandshakeTimeoutSeconds
+	}
+	if settings.MaxQueryTimeoutSeconds <= 0 {
+		settings.MaxQueryTimeoutSeconds = DefaultMaxQueryTimeoutSeconds
+	}
+	if settings.MaxConcurrentRequests < 0 {
+		return nil, fmt.Errorf("maxConcurrentRequests must not be negative, got %d", settings.MaxConcurrentRequests)
+	}
+	if settings.QueryConcurrency <= 0 {
+		settings.QueryConcurrency = DefaultQueryConcurrency
+	}
+	if settings.MaxAttempts <= 0 {
+		settings.MaxAttempts = DefaultMaxAttempts
+	}
+	if settings.CircuitBreakerThreshold < 0 {
+		return nil, fmt.Errorf("circuitBreakerThreshold must not be negative, got %d", settings.CircuitBreakerThreshold)
+	}
+	if settings.CircuitBreakerCooldownSeconds < 0 {
+		return nil, fmt.Errorf("circuitBreakerCooldownSeconds must not be negative, got %d", settings.CircuitBreakerCooldownSeconds)
+	}
+	if settings.CircuitBreakerCooldownSeconds == 0 {
+		settings.CircuitBreakerCooldownSeconds = DefaultCircuitBreakerCooldownSeconds
+	}
+	if strings.TrimSpace(settings.HealthCheckQuery) == "" {
+		settings.HealthCheckQuery = DefaultHealthCheckQuery
+	}
+
+	// Settings where zero is meaningful are decoded as pointers to tell unset from zero.
+	var explicit struct {
+		MaxSQLLength              *int  `json:"maxSqlLength"`
+		RateLimitWarningThreshold *int  `json:"rateLimitWarningThreshold"`
+		DeduplicateColumns        *bool `json:"deduplicateColumns"`
+	}
+	if err := json.Unmarshal(source.JSONData, &explicit); err != nil {
+		return nil, fmt.Errorf("could not unmarshal PluginSettings json: %w", err)
+	}
+	settings.MaxSQLLength = DefaultMaxSQLLength
+	if explicit.MaxSQLLength != nil {
+		if *explicit.MaxSQLLength < 0 {
+			return nil, fmt.Errorf("maxSqlLength must not be negative, got %d", *explicit.MaxSQLLength)
+		}
+		settings.MaxSQLLength = *explicit.MaxSQLLength
+	}
+	settings.RateLimitWarningThreshold = DefaultRateLimitWarningThreshold
+	if explicit.RateLimitWarningThreshold != nil {
+		if *explicit.RateLimitWarningThreshold < 0 {
+			return nil, fmt.Errorf("rateLimitWarningThreshold must not be negative, got %d", *explicit.RateLimitWarningThreshold)
+		}
+		settings.RateLimitWarningThreshold = *explicit.RateLimitWarningThreshold
+	}
+	settings.DeduplicateColumns = explicit.DeduplicateColumns == nil || *explicit.DeduplicateColumns
+
 	// Initialize Secrets to avoid nil pointer dereference if DecryptedSecureJSONData is empty
 	settings.Secrets = &SecretPluginSettings{}
 	if source.DecryptedSecureJSONData != nil {
 		settings.Secrets.APIToken = source.DecryptedSecureJSONData["apiToken"]
+		// Older provisioning files stored the token as apiKey.
+		if legacy := source.DecryptedSecureJSONData[legacyAPITokenKey]; settings.Secrets.APIToken == "" && legacy != "" {
+			log.DefaultLogger.Warn("The apiKey secure setting is deprecated; provision the API token as apiToken instead", "datasource", source.Name)
+			settings.Secrets.APIToken = legacy
+		}
+		settings.Secrets.AccessClientSecret = source.DecryptedSecureJSONData["accessClientSecret"]
 	}
 
 	return &settings, nil
 }
 
+// Validate checks that the settings are complete and consistent and returns every
+// problem found, or nil if there are none.
+func (s *PluginSettings) Validate() []error {
+	var errs []error
+	if s.AccountID == "" && s.NeedsAccountID() {
+		errs = append(errs, errors.New("account ID is missing"))
+	}
+	if s.DatabaseID == "" {
+		errs = append(errs, errors.New("database ID is missing"))
+	}
+	// An Access service token can stand in for the API token.
+	if (s.Secrets == nil || s.Secrets.APIToken == "") && !s.HasAccessCredentials() {
+		errs = append(errs, errors.New("API token is missing"))
+	}
+	if err := validateJurisdiction(s.Jurisdiction); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateNullColumnType(s.DefaultNullColumnType); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func validateJurisdiction(jurisdiction string) error {
+	if _, ok := jurisdictionHosts[jurisdiction]; !ok {
+		return fmt.Errorf("unknown jurisdiction %q: must be one of default, eu, fedramp", jurisdiction)
+	}
+	return nil
+}
+
+func validateNullColumnType(columnType string) error {
+	switch columnType {
+	case NullColumnTypeString, NullColumnTypeFloat64, NullColumnTypeInt64:
+		return nil
+	}
+	return fmt.Errorf("unknown defaultNullColumnType %q: must be one of string, float64, int64", columnType)
+}
+
+func validateDecimalSeparator(separator string) error {
+	switch separator {
+	case DecimalSeparatorPoint, DecimalSeparatorComma:
+		return nil
+	}
+	return fmt.Errorf("unknown decimalSeparator %q: must be one of ., ,", separator)
+}
+
+func validateEndpoint(endpoint string) error {
+	switch endpoint {
+	case EndpointRaw, EndpointQuery:
+		return nil
+	}
+	return fmt.Errorf("unknown endpoint %q: must be one of raw, query", endpoint)
+}
+
+// validateURLTemplate checks that a configured urlTemplate is an absolute HTTP(S) URL
+// with a {database} placeholder.
+func validateURLTemplate(template string) error {
+	if template == "" {
+		return nil
+	}
+	if !strings.Contains(template, "{database}") {
+		return fmt.Errorf("urlTemplate %q must contain the {database} placeholder", template)
+	}
+	u, err := url.Parse(template)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("urlTemplate %q must be an absolute http or https URL", template)
+	}
+	return nil
+}
+
+// loadCACertPool returns the system certificate pool with the certificates of the PEM
+// bundle added. The bundle must hold at least one certificate and nothing else.
+func loadCACertPool(bundle string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	rest := []byte(strings.TrimSpace(bundle))
+	certs := 0
+	for len(rest) > 0 {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, errors.New("tlsCACert is not a valid PEM bundle")
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("tlsCACert must only contain certificates, got a %s block", block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate in tlsCACert: %w", err)
+		}
+		pool.AddCert(cert)
+		certs++
+		rest = []byte(strings.TrimSpace(string(rest)))
+	}
+	if certs == 0 {
+		return nil, errors.New("tlsCACert is not a valid PEM bundle")
+	}
+	return pool, nil
+}
+
+// NeedsAccountID reports whether database requests include the account ID, which a
+// urlTemplate without an {account} placeholder leaves out.
+func (s *PluginSettings) NeedsAccountID() bool {
+	return s.URLTemplate == "" || strings.Contains(s.URLTemplate, "{account}")
+}
+
+func validateLogLevel(level string) error {
+	switch level {
+	case LogLevelDebug, LogLevelInfo, LogLevelWarn:
+		return nil
+	}
+	return fmt.Errorf("unknown logLevel %q: must be one of debug, info, warn", level)
+}
+
+// HasAccessCredentials reports whether a Cloudflare Access service token is configured.
+func (s *PluginSettings) HasAccessCredentials() bool {
+	return s.AccessClientID != "" && s.Secrets != nil && s.Secrets.AccessClientSecret != ""
+}
+
+// APIBaseURL returns the Cloudflare v4 API base URL for the configured jurisdiction.
+func (s *PluginSettings) APIBaseURL() string {
+	host, ok := jurisdictionHosts[s.Jurisdiction]
+	if !ok {
+		host = jurisdictionHosts[JurisdictionDefault]
+	}
+	return "https://" + host + "/client/v4"
+}
+
 // loadSecretPluginSettings is no longer needed as logic is moved into LoadPluginSettings
 // We can remove it or keep it if we anticipate more complex secret loading later.
 // For now, let's comment it out to simplify.
@@ -0,0 +1,111 @@
+package plugin
+
+import (
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// States of a circuitBreaker, as reported by /metrics.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// circuitBreaker stops sending queries to D1 after threshold consecutive requests failed
+// without a response or with a server error, so an outage isn't made worse by every
+// panel retrying. While open, queries fail at once; after cooldown a single query is let
+// through to probe the API, closing the breaker again if it succeeds. It is safe for
+// concurrent use.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    string
+	failures int       // Consecutive failures while closed
+	openedAt time.Time // When the breaker last opened
+	probing  bool      // Whether the half-open probe is in flight
+	trips    int64
+	rejected int64
+}
+
+// breakerSnapshot is the state of a circuitBreaker at one point, as served by /metrics.
+type breakerSnapshot struct {
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutiveFailures"`
+	Trips               int64  `json:"trips"`
+	Rejected            int64  `json:"rejected"`
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now, state: breakerClosed}
+}
+
+// allow returns an error if a request must not be sent now. A nil error must be followed
+// by a call to record with the request's outcome.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && !b.now().Before(b.openedAt.Add(b.cooldown)) {
+		b.state = breakerHalfOpen
+	}
+	switch {
+	case b.state == breakerOpen:
+		b.rejected++
+		return backend.DownstreamErrorf("circuit open: the D1 API failed %d consecutive requests; queries are paused until %s",
+			b.threshold, b.openedAt.Add(b.cooldown).UTC().Format(time.RFC3339))
+	case b.state == breakerHalfOpen && b.probing:
+		b.rejected++
+		return backend.DownstreamErrorf("circuit open: waiting for a query to confirm the D1 API has recovered")
+	case b.state == breakerHalfOpen:
+		b.probing = true
+	}
+	return nil
+}
+
+// record reports the outcome of a request allow let through. failed is true for requests
+// that got no response, including those that timed out, or a server error. A request
+// whose caller canceled it is neither: it says nothing about the API, so only a running
+// probe is released.
+func (b *circuitBreaker) record(failed, canceled bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if canceled {
+		b.probing = false
+		return
+	}
+	if !failed {
+		b.state, b.failures, b.probing = breakerClosed, 0, false
+		return
+	}
+	if b.state == breakerHalfOpen {
+		b.trip()
+		return
+	}
+	b.failures++
+	if b.state == breakerClosed && b.failures >= b.threshold {
+		b.trip()
+	}
+}
+
+// trip opens the breaker. b.mu must be held.
+func (b *circuitBreaker) trip() {
+	b.state, b.failures, b.probing = breakerOpen, 0, false
+	b.openedAt = b.now()
+	b.trips++
+}
+
+// snapshot returns the current state and counters.
+func (b *circuitBreaker) snapshot() breakerSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := b.state
+	if state == breakerOpen && !b.now().Before(b.openedAt.Add(b.cooldown)) {
+		state = breakerHalfOpen
+	}
+	return breakerSnapshot{State: state, ConsecutiveFailures: b.failures, Trips: b.trips, Rejected: b.rejected}
+}
@@ -0,0 +1,223 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/olipayne/grafana-cloudflare-d1-datasource/pkg/models"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b := newCircuitBreaker(3, time.Minute)
+	b.now = func() time.Time { return now }
+
+	fail := func() {
+		t.Helper()
+		if err := b.allow(); err != nil {
+			t.Fatalf("expected the request to be allowed, got %v", err)
+		}
+		b.record(true, false)
+	}
+
+	// A success in between resets the count.
+	fail()
+	fail()
+	if err := b.allow(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b.record(false, false)
+	fail()
+	fail()
+	if got := b.snapshot().State; got != breakerClosed {
+		t.Fatalf("expected the breaker to stay closed, got %s", got)
+	}
+
+	fail()
+	if err := b.allow(); err == nil || !strings.Contains(err.Error(), "circuit open") {
+		t.Fatalf("expected a circuit open error, got %v", err)
+	}
+
+	// After the cooldown a single probe is let through; a failing one reopens the breaker.
+	now = now.Add(time.Minute)
+	if err := b.allow(); err != nil {
+		t.Fatalf("expected a probe after the cooldown, got %v", err)
+	}
+	if err := b.allow(); err == nil {
+		t.Fatal("expected a second request to wait for the probe")
+	}
+	b.record(true, false)
+	if err := b.allow(); err == nil {
+		t.Fatal("expected a failed probe to reopen the breaker")
+	}
+
+	// A cancelled probe says nothing about the API, so another probe may follow.
+	now = now.Add(time.Minute)
+	if err := b.allow(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b.record(false, true)
+	if err := b.allow(); err != nil {
+		t.Fatalf("expected another probe after a cancelled one, got %v", err)
+	}
+	b.record(false, false)
+	if err := b.allow(); err != nil {
+		t.Fatalf("expected a successful probe to close the breaker, got %v", err)
+	}
+	b.record(false, false)
+
+	if got, want := b.snapshot(), (breakerSnapshot{State: breakerClosed, Trips: 2, Rejected: 3}); got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestQueryCircuitBreaker(t *testing.T) {
+	requests := 0
+	healthy := false
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","circuitBreakerThreshold":2,"circuitBreakerCooldownSeconds":60}`, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if !healthy {
+			http.Error(w, "upstream unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		rawResponse([]string{"n"}, [][]interface{}{{float64(1)}})(w, r)
+	})
+	now := time.Now()
+	ds.breaker.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if res := runQuery(t, ds, `{"queryText":"SELECT 1 AS n"}`); res.Error == nil {
+			t.Fatal("expected the failing API to fail the query")
+		}
+	}
+	res := runQuery(t, ds, `{"queryText":"SELECT 1 AS n"}`)
+	if res.Error == nil || !strings.Contains(res.Error.Error(), "circuit open") {
+		t.Fatalf("expected a circuit open error, got %v", res.Error)
+	}
+	if requests != 2 {
+		t.Errorf("expected the open circuit not to reach the API, got %d requests", requests)
+	}
+
+	// /metrics reports the open breaker and the query it rejected.
+	var metrics metricsResponse
+	if err := json.Unmarshal(callResource(t, ds, "/metrics").Body, &metrics); err != nil {
+		t.Fatalf("invalid metrics response: %v", err)
+	}
+	if metrics.CircuitBreaker == nil || metrics.CircuitBreaker.State != breakerOpen || metrics.CircuitBreaker.Trips != 1 || metrics.CircuitBreaker.Rejected != 1 {
+		t.Errorf("unexpected breaker metrics %+v", metrics.CircuitBreaker)
+	}
+
+	healthy = true
+	now = now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		if res := runQuery(t, ds, `{"queryText":"SELECT 1 AS n"}`); res.Error != nil {
+			t.Fatalf("expected the recovered API to close the breaker, got %v", res.Error)
+		}
+	}
+	if requests != 4 {
+		t.Errorf("expected 4 requests, got %d", requests)
+	}
+}
+
+func TestQueryCircuitBreakerCountsTimeouts(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","circuitBreakerThreshold":2}`, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release // Never answers while the test runs
+	})
+	t.Cleanup(func() { close(release) })
+
+	// A caller giving up says nothing about the API.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ds.QueryData(ctx, &backend.QueryDataRequest{Queries: []backend.DataQuery{{RefID: "A", JSON: []byte(`{"queryText":"SELECT 1"}`)}}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if snapshot := ds.breaker.snapshot(); snapshot.ConsecutiveFailures != 0 {
+		t.Errorf("expected a canceled query not to count as a failure, got %+v", snapshot)
+	}
+
+	for i := 0; i < 2; i++ {
+		res := runQuery(t, ds, `{"queryText":"SELECT 1","timeoutSeconds":1}`)
+		if res.Error == nil || !strings.Contains(res.Error.Error(), "timed out") {
+			t.Fatalf("expected a timeout, got %v", res.Error)
+		}
+	}
+	if snapshot := ds.breaker.snapshot(); snapshot.State != breakerOpen || snapshot.Trips != 1 {
+		t.Fatalf("expected the timeouts to trip the breaker, got %+v", snapshot)
+	}
+	sent := requests.Load()
+	if res := runQuery(t, ds, `{"queryText":"SELECT 1","timeoutSeconds":1}`); res.Error == nil || !strings.Contains(res.Error.Error(), "circuit open") {
+		t.Errorf("expected a circuit open error, got %v", res.Error)
+	}
+	if requests.Load() != sent {
+		t.Error("expected the open circuit not to reach the API")
+	}
+
+	// A half-open probe that times out opens the breaker again.
+	now := time.Now().Add(time.Hour)
+	ds.breaker.now = func() time.Time { return now }
+	if res := runQuery(t, ds, `{"queryText":"SELECT 1","timeoutSeconds":1}`); res.Error == nil || !strings.Contains(res.Error.Error(), "timed out") {
+		t.Fatalf("expected the probe to time out, got %v", res.Error)
+	}
+	if snapshot := ds.breaker.snapshot(); snapshot.State != breakerOpen || snapshot.Trips != 2 {
+		t.Errorf("expected the timed out probe to reopen the breaker, got %+v", snapshot)
+	}
+}
+
+func TestLookupsUseBreakerAndUsage(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","circuitBreakerThreshold":1}`, func(w http.ResponseWriter, r *http.Request) {
+		var payload models.D1QueryRequest
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		sent = append(sent, payload.SQL)
+		mu.Unlock()
+		_ = json.NewEncoder(w).Encode(models.D1RawAPIResponse{Success: true, Result: []models.D1RawResultItem{{
+			Success: true,
+			Meta:    models.D1Meta{RowsRead: 10},
+			Results: &models.D1RawQueryActualResult{Columns: []string{"n"}, Rows: [][]interface{}{{float64(0)}}},
+		}}})
+	})
+
+	// The validation and the plan are counted in the usage metrics.
+	if res := runQuery(t, ds, `{"queryText":"SELECT n FROM t","validateOnly":true}`); res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if res := postResource(t, ds, "explain", `{"sql":"SELECT n FROM t"}`); res.Status != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", res.Status, res.Body)
+	}
+	if got := ds.usage.snapshot(); got.Statements != 2 || got.RowsRead != 20 {
+		t.Errorf("expected the lookups in the usage metrics, got %+v", got)
+	}
+
+	// While the breaker is open, no lookup reaches D1.
+	ds.breaker.mu.Lock()
+	ds.breaker.trip()
+	ds.breaker.mu.Unlock()
+	before := len(sent)
+	if res := runQuery(t, ds, `{"queryText":"SELECT n FROM t","validateOnly":true}`); res.Error == nil || !strings.Contains(res.Error.Error(), "circuit open") {
+		t.Errorf("expected the validation to be refused, got %v", res.Error)
+	}
+	if res := postResource(t, ds, "explain", `{"sql":"SELECT n FROM t"}`); !strings.Contains(string(res.Body), "circuit open") {
+		t.Errorf("expected the plan to be refused, got %d: %s", res.Status, res.Body)
+	}
+	if _, _, ok := ds.tableRowCount(context.Background(), "SELECT n FROM t"); ok {
+		t.Error("expected the row count to be unavailable")
+	}
+	if kinds := ds.schemaKinds(context.Background(), "SELECT n FROM t"); kinds != nil {
+		t.Errorf("expected the schema to be unavailable, got %v", kinds)
+	}
+	if len(sent) != before {
+		t.Errorf("expected no lookups while the breaker is open, got %v", sent[before:])
+	}
+}
@@ -0,0 +1,125 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// queryCache is an in-memory cache of query results that expire after a TTL.
+// It is safe for concurrent use.
+type queryCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	frames  data.Frames
+	expires time.Time
+}
+
+func newQueryCache(ttl time.Duration) *queryCache {
+	return &queryCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+// get returns the frames cached under key if they have not expired yet.
+func (c *queryCache) get(key string) (data.Frames, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.frames, true
+}
+
+// set caches frames under key for the cache TTL. Expired entries are pruned so the
+// cache doesn't grow with queries that are never repeated.
+func (c *queryCache) set(key string, frames data.Frames) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for k, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry{frames: frames, expires: now.Add(c.ttl)}
+}
+
+// delete drops the entry cached under key, if any.
+func (c *queryCache) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// clear drops every cached entry.
+func (c *queryCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]cacheEntry)
+}
+
+// queryCacheKey identifies a query result by database, final SQL, time range and the
+// query options that affect how frames are built, including the number of points they
+// are downsampled to. noCache is left out, so a query bypassing the cache refreshes the
+// entry the same query without it reads.
+func queryCacheKey(databaseID, sql string, timeRange backend.TimeRange, qm queryModel, maxDataPoints int64) string {
+	qm.NoCache = false
+	options, _ := json.Marshal(qm)
+	h := sha256.New()
+	for _, part := range []string{
+		databaseID,
+		sql,
+		strconv.FormatInt(timeRange.From.UnixNano(), 10),
+		strconv.FormatInt(timeRange.To.UnixNano(), 10),
+		string(options),
+		strconv.FormatInt(maxDataPoints, 10),
+	} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// renameFrames returns shallow copies of frames named after refID, so cached frames
+// shared between panels are never mutated. The frames of a batch, one per statement,
+// are also named after their statement index. A last_row_id frame keeps its name.
+func renameFrames(frames data.Frames, refID string) data.Frames {
+	statements := 0
+	for _, frame := range frames {
+		if frame.Name != lastRowIDFrameName {
+			statements++
+		}
+	}
+	renamed := make(data.Frames, len(frames))
+	for i, frame := range frames {
+		copied := *frame
+		if frame.Name != lastRowIDFrameName {
+			copied.Name = refID
+			if statements > 1 {
+				copied.Name = statementFrameName(refID, i)
+			}
+		}
+		renamed[i] = &copied
+	}
+	return renamed
+}
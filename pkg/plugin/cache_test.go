@@ -0,0 +1,104 @@
+package plugin
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestQueryCacheExpires(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cache := newQueryCache(time.Minute)
+	cache.now = func() time.Time { return now }
+
+	cache.set("k", data.Frames{data.NewFrame("A")})
+	if _, ok := cache.get("k"); !ok {
+		t.Fatal("expected cache hit within TTL")
+	}
+	now = now.Add(time.Minute)
+	if _, ok := cache.get("k"); ok {
+		t.Fatal("expected cache miss after TTL")
+	}
+}
+
+func TestQueryCacheKeyIncludesTimeRange(t *testing.T) {
+	from := time.Unix(1700000000, 0)
+	qm := queryModel{QueryText: "SELECT 1"}
+	a := queryCacheKey("db", "SELECT 1", backend.TimeRange{From: from, To: from.Add(time.Hour)}, qm, 0)
+	b := queryCacheKey("db", "SELECT 1", backend.TimeRange{From: from, To: from.Add(2 * time.Hour)}, qm, 0)
+	if a == b {
+		t.Error("expected different time ranges to produce different cache keys")
+	}
+}
+
+func TestQueryUsesCacheWithinTTL(t *testing.T) {
+	requests := 0
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","cacheTTLSeconds":60}`, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		rawResponse([]string{"n"}, [][]interface{}{{float64(1)}})(w, r)
+	})
+
+	first := runQuery(t, ds, `{"queryText":"SELECT n FROM t"}`)
+	second := runQuery(t, ds, `{"queryText":"SELECT n FROM t"}`)
+	if first.Error != nil || second.Error != nil {
+		t.Fatalf("unexpected errors: %v, %v", first.Error, second.Error)
+	}
+	if requests != 1 {
+		t.Errorf("expected 1 request to D1, got %d", requests)
+	}
+	if second.Frames[0].Rows() != 1 {
+		t.Errorf("expected cached frame with 1 row, got %d", second.Frames[0].Rows())
+	}
+
+	runQuery(t, ds, `{"queryText":"SELECT n FROM other"}`)
+	if requests != 2 {
+		t.Errorf("expected a different query to miss the cache, got %d requests", requests)
+	}
+
+	ds.Dispose()
+	runQuery(t, ds, `{"queryText":"SELECT n FROM t"}`)
+	if requests != 3 {
+		t.Errorf("expected Dispose to clear the cache, got %d requests", requests)
+	}
+}
+
+func TestQueryNoCacheRefreshesCachedResult(t *testing.T) {
+	requests, failing := 0, false
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","cacheTTLSeconds":60}`, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rawResponse([]string{"n"}, [][]interface{}{{float64(requests)}})(w, r)
+	})
+	value := func(res backend.DataResponse) interface{} {
+		t.Helper()
+		if res.Error != nil {
+			t.Fatalf("unexpected error: %v", res.Error)
+		}
+		v, _ := res.Frames[0].Fields[0].ConcreteAt(0)
+		return v
+	}
+
+	value(runQuery(t, ds, `{"queryText":"SELECT n FROM t"}`))
+	if v := value(runQuery(t, ds, `{"queryText":"SELECT n FROM t","noCache":true}`)); requests != 2 || v != int64(2) {
+		t.Fatalf("expected noCache to make a fresh request, got %d requests and value %v", requests, v)
+	}
+	if v := value(runQuery(t, ds, `{"queryText":"SELECT n FROM t"}`)); requests != 2 || v != int64(2) {
+		t.Errorf("expected the refreshed value 2 from the cache, got %d requests and value %v", requests, v)
+	}
+
+	// A failed noCache query still invalidates the cached result.
+	failing = true
+	if res := runQuery(t, ds, `{"queryText":"SELECT n FROM t","noCache":true}`); res.Error == nil {
+		t.Fatal("expected the failing request to return an error")
+	}
+	failing = false
+	if v := value(runQuery(t, ds, `{"queryText":"SELECT n FROM t"}`)); requests != 4 || v != int64(4) {
+		t.Errorf("expected the invalidated entry to be fetched again, got %d requests and value %v", requests, v)
+	}
+}
@@ -0,0 +1,297 @@
+package plugin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"github.com/olipayne/grafana-cloudflare-d1-datasource/pkg/models"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// D1Response is a response of the D1 API with its fully read body.
+type D1Response struct {
+	StatusCode int
+	Status     string // e.g. "200 OK"
+	Header     http.Header
+	RequestID  string // ID sent with the request, for matching errors with logs
+	Body       []byte
+}
+
+// D1Client sends SQL to the configured D1 database. The Datasource only talks to D1
+// through it, so tests can replace the HTTP implementation with canned responses.
+type D1Client interface {
+	// Send POSTs payload to the given database endpoint ("raw" or "query"). An error is
+	// only returned when no response was received; API errors are left in the response.
+	Send(ctx context.Context, endpoint string, payload models.D1QueryRequest) (*D1Response, error)
+}
+
+// httpD1Client is the D1Client calling the Cloudflare REST API.
+type httpD1Client struct {
+	settings   *models.PluginSettings
+	transport  http.RoundTripper // Shared with the datasource's other API requests
+	baseURL    string            // Cloudflare API base URL, derived from the configured jurisdiction
+	databaseID string            // Database the client queries: the configured one or its replica
+	logger     leveledLogger
+}
+
+var _ D1Client = (*httpD1Client)(nil)
+
+func newHTTPD1Client(settings *models.PluginSettings, transport http.RoundTripper, baseURL, databaseID string) *httpD1Client {
+	return &httpD1Client{
+		settings:   settings,
+		transport:  transport,
+		baseURL:    baseURL,
+		databaseID: databaseID,
+		logger:     newLeveledLogger(settings.LogLevel),
+	}
+}
+
+// newHTTPTransport returns the transport of a datasource's API requests, trusting the
+// configured tlsCACert in addition to the system pool, or skipping verification
+// altogether with tlsSkipVerify. Connecting and the TLS handshake have timeouts of their
+// own; the time a whole request may take is bounded by the query's context instead.
+func newHTTPTransport(settings *models.PluginSettings) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if settings.DialTimeoutSeconds > 0 {
+		transport.DialContext = (&net.Dialer{
+			Timeout:   time.Duration(settings.DialTimeoutSeconds) * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+	if settings.TLSHandshakeTimeoutSeconds > 0 {
+		transport.TLSHandshakeTimeout = time.Duration(settings.TLSHandshakeTimeoutSeconds) * time.Second
+	}
+	if settings.RootCAs != nil || settings.TLSSkipVerify {
+		transport.TLSClientConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			RootCAs:    settings.RootCAs,
+			// Only ever enabled explicitly, with a warning logged when the datasource starts.
+			InsecureSkipVerify: settings.TLSSkipVerify,
+		}
+	}
+	return transport
+}
+
+// requestIDHeader carries the ID generated for every D1 request, so failures reported to
+// Grafana can be matched with plugin logs and Cloudflare's side.
+const requestIDHeader = "X-Request-Id"
+
+// setRequestHeaders sets the headers shared by every request made to the D1 API.
+func setRequestHeaders(req *http.Request, settings *models.PluginSettings) {
+	for name, value := range settings.CustomHeaders {
+		if !isProtectedHeader(name) {
+			req.Header.Set(name, value)
+		}
+	}
+	if settings.Secrets.APIToken != "" {
+		req.Header.Set("Authorization", "Bearer "+settings.Secrets.APIToken)
+	}
+	// Deployments fronting the API with Cloudflare Access also need the service token headers.
+	if settings.HasAccessCredentials() {
+		req.Header.Set("CF-Access-Client-Id", settings.AccessClientID)
+		req.Header.Set("CF-Access-Client-Secret", settings.Secrets.AccessClientSecret)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+}
+
+// databaseURL builds the URL of a D1 database endpoint (e.g. "raw" or "query")
+// for the configured account and the client's database. A configured urlTemplate is
+// expanded instead; without an {endpoint} placeholder the endpoint is appended.
+func (c *httpD1Client) databaseURL(endpoint string) string {
+	if template := c.settings.URLTemplate; template != "" {
+		if !strings.Contains(template, "{endpoint}") {
+			template = strings.TrimSuffix(template, "/") + "/{endpoint}"
+		}
+		return strings.NewReplacer(
+			"{account}", url.PathEscape(c.settings.AccountID),
+			"{database}", url.PathEscape(c.databaseID),
+			"{endpoint}", endpoint,
+		).Replace(template)
+	}
+	return fmt.Sprintf("%s/accounts/%s/d1/database/%s/%s",
+		c.baseURL, url.PathEscape(c.settings.AccountID), url.PathEscape(c.databaseID), endpoint)
+}
+
+// Send POSTs payload as JSON to the given D1 database endpoint and returns the response
+// together with its fully read body. The call is wrapped in a tracing span recording the
+// database, SQL length in characters, HTTP status and duration; the span is a no-op when
+// Grafana has no tracer configured.
+func (c *httpD1Client) Send(ctx context.Context, endpoint string, payload models.D1QueryRequest) (*D1Response, error) {
+	ctx, span := tracing.DefaultTracer().Start(ctx, "CloudflareD1."+endpoint, trace.WithAttributes(
+		attribute.String("d1.database_id", c.databaseID),
+		attribute.String("d1.endpoint", endpoint),
+		attribute.Int("d1.sql_length", utf8.RuneCountInString(payload.SQL)),
+	))
+	defer span.End()
+
+	jsonBody, err := json.Marshal(payload)
+	if err != nil {
+		return nil, tracing.Errorf(span, "error marshalling D1 query payload: %w", err)
+	}
+
+	// Retries of the request keep its ID, so they show up as one request in the logs.
+	reqID := uuid.NewString()
+	span.SetAttributes(attribute.String("d1.request_id", reqID))
+
+	// The request is bounded by the deadline of ctx, which callers derive from the query timeout.
+	httpClient := &http.Client{Transport: c.transport}
+	start := time.Now()
+	var httpResp *http.Response
+	for attempt := 1; ; attempt++ {
+		httpReq, err := http.NewRequestWithContext(ctx, "POST", c.databaseURL(endpoint), bytes.NewReader(jsonBody))
+		if err != nil {
+			return nil, tracing.Errorf(span, "error creating HTTP request for D1: %w", err)
+		}
+		setRequestHeaders(httpReq, c.settings)
+		// Setting Accept-Encoding explicitly disables the transport's transparent decompression,
+		// so readResponseBody decodes gzip itself with a size cap.
+		httpReq.Header.Set("Accept-Encoding", "gzip")
+		httpReq.Header.Set(requestIDHeader, reqID)
+
+		httpResp, err = httpClient.Do(httpReq)
+		if err == nil {
+			span.SetAttributes(attribute.Int("d1.attempts", attempt))
+			break
+		}
+		if c.settings.RetryOnConnectionError && attempt < c.settings.MaxAttempts && isConnectionError(ctx, err) {
+			c.logger.Warn("D1 API request failed to connect, retrying", "requestId", reqID, "attempt", attempt, "error", err)
+			if waitErr := waitBeforeRetry(ctx, attempt); waitErr == nil {
+				continue
+			}
+		}
+		span.SetAttributes(
+			attribute.Int("d1.attempts", attempt),
+			attribute.Int64("d1.duration_ms", time.Since(start).Milliseconds()),
+		)
+		c.logger.Debug("D1 API request failed", "requestId", reqID, "endpoint", endpoint, "error", err)
+		return nil, backend.DownstreamError(tracing.Errorf(span, "error executing D1 API request (request ID %s): %w", reqID, err))
+	}
+	defer httpResp.Body.Close()
+
+	bodyBytes, err := readResponseBody(httpResp, responseSizeLimit(c.settings))
+	span.SetAttributes(
+		attribute.Int("http.status_code", httpResp.StatusCode),
+		attribute.Int64("d1.duration_ms", time.Since(start).Milliseconds()),
+	)
+	c.logger.Debug("D1 API request finished", "requestId", reqID, "endpoint", endpoint, "status", httpResp.StatusCode)
+	if err != nil {
+		return nil, backend.DownstreamError(tracing.Errorf(span, "error reading D1 API response body (request ID %s): %w", reqID, err))
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		span.SetStatus(codes.Error, httpResp.Status)
+	}
+	return &D1Response{
+		StatusCode: httpResp.StatusCode,
+		Status:     httpResp.Status,
+		Header:     httpResp.Header,
+		RequestID:  reqID,
+		Body:       bodyBytes,
+	}, nil
+}
+
+// connectionRetryDelay is the pause before the first retry of a failed connection; it
+// grows linearly with each further attempt.
+var connectionRetryDelay = 100 * time.Millisecond
+
+// waitBeforeRetry pauses before the retry following attempt, returning early with the
+// context's error if ctx ends first.
+var waitBeforeRetry = func(ctx context.Context, attempt int) error {
+	timer := time.NewTimer(time.Duration(attempt) * connectionRetryDelay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// isConnectionError reports whether err, returned by an HTTP request made with ctx, is a
+// failure to connect worth retrying: a refused connection, a DNS failure or a dial
+// timeout. Errors after the connection was made, such as a reset, are not retried, as the
+// request may already have reached D1 and a write would be applied twice. Cancellation
+// and deadlines of ctx are never retried: a query that was simply slow would only run
+// again.
+func isConnectionError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// bytesPerRowBudget is the response size allowed per row of maxRows.
+const bytesPerRowBudget = 4 << 10
+
+// minResponseSizeLimit keeps small maxRows settings from rejecting ordinary responses.
+const minResponseSizeLimit = 16 << 20
+
+// responseSizeLimit is the largest response body accepted, after decompression, so a
+// huge response or a decompression bomb can't exhaust memory. It is the maxResponseBytes
+// setting, or derived from the maxRows setting when that is unset.
+func responseSizeLimit(settings *models.PluginSettings) int64 {
+	if settings.MaxResponseBytes > 0 {
+		return settings.MaxResponseBytes
+	}
+	limit := int64(settings.MaxRows) * bytesPerRowBudget
+	if limit < minResponseSizeLimit {
+		limit = minResponseSizeLimit
+	}
+	return limit
+}
+
+// readResponseBody reads the full response body, transparently decoding gzip responses.
+// Bodies larger than limit bytes, after decoding, are rejected rather than truncated:
+// one byte more than the limit is read to tell an oversized body from one of exactly
+// limit bytes.
+func readResponseBody(resp *http.Response, limit int64) ([]byte, error) {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(body)) > limit {
+			return nil, fmt.Errorf("response exceeds %d bytes; raise the datasource's maxResponseBytes setting to accept it", limit)
+		}
+		return body, nil
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip response: %w", err)
+	}
+	defer gz.Close()
+	body, err := io.ReadAll(io.LimitReader(gz, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip response: %w", err)
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("decompressed response exceeds %d bytes; raise the datasource's maxResponseBytes setting to accept it", limit)
+	}
+	return body, nil
+}
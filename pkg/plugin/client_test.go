@@ -0,0 +1,451 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/olipayne/grafana-cloudflare-d1-datasource/pkg/models"
+)
+
+// fakeD1Client is a D1Client returning canned responses in order and recording the
+// requests it was sent.
+type fakeD1Client struct {
+	responses []*D1Response
+	err       error
+
+	endpoints []string
+	payloads  []models.D1QueryRequest
+}
+
+func (c *fakeD1Client) Send(_ context.Context, endpoint string, payload models.D1QueryRequest) (*D1Response, error) {
+	c.endpoints = append(c.endpoints, endpoint)
+	c.payloads = append(c.payloads, payload)
+	if c.err != nil {
+		return nil, c.err
+	}
+	if len(c.responses) == 0 {
+		return nil, errors.New("fakeD1Client: no canned response left")
+	}
+	resp := c.responses[0]
+	c.responses = c.responses[1:]
+	return resp, nil
+}
+
+// cannedResponse returns a D1 response with the given status whose body is body encoded as JSON.
+func cannedResponse(t *testing.T, statusCode int, body interface{}) *D1Response {
+	t.Helper()
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("could not encode canned response: %v", err)
+	}
+	return &D1Response{
+		StatusCode: statusCode,
+		Status:     http.StatusText(statusCode),
+		Header:     http.Header{},
+		RequestID:  "req-1",
+		Body:       encoded,
+	}
+}
+
+// newFakeDatasource creates a datasource with the given settings that sends its D1
+// requests to client.
+func newFakeDatasource(t *testing.T, jsonData string, client D1Client) *Datasource {
+	t.Helper()
+	inst, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData:                []byte(jsonData),
+		DecryptedSecureJSONData: map[string]string{"apiToken": "test-token"},
+	})
+	if err != nil {
+		t.Fatalf("could not create datasource: %v", err)
+	}
+	ds := inst.(*Datasource)
+	ds.client = client
+	return ds
+}
+
+func TestQueryBuildsFramesFromClientResponse(t *testing.T) {
+	client := &fakeD1Client{responses: []*D1Response{cannedResponse(t, http.StatusOK, models.D1RawAPIResponse{
+		Success: true,
+		Result: []models.D1RawResultItem{{
+			Success: true,
+			Results: &models.D1RawQueryActualResult{
+				Columns: []string{"time", "host", "value"},
+				Rows: [][]interface{}{
+					{"2024-01-01T00:00:00Z", "a", 1.5},
+					{"2024-01-01T00:01:00Z", "b", nil},
+				},
+			},
+			Meta: models.D1Meta{Duration: 0.5, RowsRead: 2},
+		}},
+	})}}
+	ds := newFakeDatasource(t, `{"accountId":"acc","databaseId":"db","suppressTimeParseNotice":true}`, client)
+
+	res := runQuery(t, ds, `{"queryText":"SELECT time, host, value FROM metrics"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if len(client.payloads) != 1 || client.endpoints[0] != endpointRaw || client.payloads[0].SQL != "SELECT time, host, value FROM metrics" {
+		t.Fatalf("unexpected requests: %v %+v", client.endpoints, client.payloads)
+	}
+	if len(res.Frames) != 1 {
+		t.Fatalf("expected 1 frame, got %d", len(res.Frames))
+	}
+	frame := res.Frames[0]
+	if frame.Rows() != 2 || len(frame.Fields) != 3 {
+		t.Fatalf("expected 2 rows and 3 fields, got %d and %d", frame.Rows(), len(frame.Fields))
+	}
+	wantTypes := []data.FieldType{data.FieldTypeNullableTime, data.FieldTypeNullableString, data.FieldTypeNullableFloat64}
+	for i, want := range wantTypes {
+		if got := frame.Fields[i].Type(); got != want {
+			t.Errorf("field %s: expected type %s, got %s", frame.Fields[i].Name, want, got)
+		}
+	}
+	if ts, _ := frame.Fields[0].ConcreteAt(0); !ts.(time.Time).Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected first timestamp %v", ts)
+	}
+	if v, ok := frame.Fields[2].ConcreteAt(1); ok {
+		t.Errorf("expected NULL value, got %v", v)
+	}
+}
+
+func TestQueryBuildsBatchFramesFromClientResponse(t *testing.T) {
+	client := &fakeD1Client{responses: []*D1Response{cannedResponse(t, http.StatusOK, json.RawMessage(`{"success":true,"result":[
+		{"success":true,"results":[{"n":1}]},
+		{"success":true,"results":[{"m":"x"},{"m":"y"}]}
+	]}`))}}
+	ds := newFakeDatasource(t, `{"accountId":"acc","databaseId":"db"}`, client)
+
+	res := runQuery(t, ds, `{"queryText":"SELECT 1 AS n; SELECT m FROM t","endpoint":"query"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if client.endpoints[0] != endpointQuery {
+		t.Errorf("expected the query endpoint, got %q", client.endpoints[0])
+	}
+	if len(res.Frames) != 2 || res.Frames[0].Rows() != 1 || res.Frames[1].Rows() != 2 {
+		t.Fatalf("expected frames of 1 and 2 rows, got %+v", res.Frames)
+	}
+}
+
+func TestQueryReportsClientErrors(t *testing.T) {
+	tests := map[string]struct {
+		client *fakeD1Client
+		want   string
+	}{
+		"D1 error": {
+			client: &fakeD1Client{responses: []*D1Response{cannedResponse(t, http.StatusOK, models.D1RawAPIResponse{
+				Errors: []models.D1Error{{Code: 7500, Message: "no such table: missing"}},
+			})}},
+			want: "D1 API error: Code 7500: no such table: missing (request ID req-1)",
+		},
+		"HTTP status": {
+			client: &fakeD1Client{responses: []*D1Response{cannedResponse(t, http.StatusInternalServerError, map[string]string{})}},
+			want:   "D1 API request failed with status Internal Server Error (request ID req-1)",
+		},
+		"transport": {
+			client: &fakeD1Client{err: backend.DownstreamError(errors.New("connection refused"))},
+			want:   "connection refused",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ds := newFakeDatasource(t, `{"accountId":"acc","databaseId":"db"}`, tt.client)
+			res := runQuery(t, ds, `{"queryText":"SELECT * FROM missing"}`)
+			if res.Error == nil || !strings.Contains(res.Error.Error(), tt.want) {
+				t.Fatalf("expected error containing %q, got %v", tt.want, res.Error)
+			}
+			if res.ErrorSource != backend.ErrorSourceDownstream {
+				t.Errorf("expected downstream error source, got %q", res.ErrorSource)
+			}
+		})
+	}
+}
+
+func TestQueryMalformedResponseAttachesBodySnippet(t *testing.T) {
+	body := `{"success":true,"result":[` + strings.Repeat("x", 2*maxBodySnippetBytes)
+	client := &fakeD1Client{responses: []*D1Response{{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		RequestID:  "req-1",
+		Body:       []byte(body),
+	}}}
+	ds := newFakeDatasource(t, `{"accountId":"acc","databaseId":"db"}`, client)
+
+	res := runQuery(t, ds, `{"queryText":"SELECT 1"}`)
+	if res.Error == nil {
+		t.Fatal("expected a decode error")
+	}
+	if strings.Contains(res.Error.Error(), "xxx") || !strings.Contains(res.Error.Error(), "request ID req-1") {
+		t.Errorf("expected a concise error without the body, got %q", res.Error)
+	}
+	if len(res.Frames) != 1 || !hasNotice(res.Frames[0], "Response body: "+body[:maxBodySnippetBytes]+"…") {
+		t.Fatalf("expected a notice with the start of the body, got %+v", res.Frames)
+	}
+	if notice := res.Frames[0].Meta.Notices[0].Text; len(notice) > maxBodySnippetBytes+64 {
+		t.Errorf("expected the snippet to be capped, got %d bytes", len(notice))
+	}
+}
+
+func TestBodySnippetKeepsCharactersWhole(t *testing.T) {
+	body := []byte(strings.Repeat("a", maxBodySnippetBytes-1) + "é")
+	if got := bodySnippet(body); !strings.HasPrefix(got, strings.Repeat("a", maxBodySnippetBytes-1)+"…") {
+		t.Errorf("expected the cut before the split character, got %q", got[len(got)-20:])
+	}
+	if got := bodySnippet([]byte("short")); got != "short" {
+		t.Errorf("expected short bodies unchanged, got %q", got)
+	}
+}
+
+func TestQueryFailsOverToReplica(t *testing.T) {
+	rows := models.D1RawAPIResponse{
+		Success: true,
+		Result: []models.D1RawResultItem{{
+			Success: true,
+			Results: &models.D1RawQueryActualResult{Columns: []string{"n"}, Rows: [][]interface{}{{1.0}}},
+		}},
+	}
+	settings := `{"accountId":"acc","databaseId":"db","replicaDatabaseId":"replica"}`
+
+	t.Run("primary fails, replica succeeds", func(t *testing.T) {
+		primary := &fakeD1Client{err: backend.DownstreamError(errors.New("connection refused"))}
+		replica := &fakeD1Client{responses: []*D1Response{cannedResponse(t, http.StatusOK, rows)}}
+		ds := newFakeDatasource(t, settings, primary)
+		ds.replica = replica
+
+		res := runQuery(t, ds, `{"queryText":"SELECT 1 AS n"}`)
+		if res.Error != nil {
+			t.Fatalf("expected the replica to answer, got %v", res.Error)
+		}
+		if len(replica.payloads) != 1 || replica.payloads[0].SQL != "SELECT 1 AS n" {
+			t.Errorf("expected the query to be sent to the replica, got %+v", replica.payloads)
+		}
+		if res.Frames[0].Rows() != 1 || !hasNotice(res.Frames[0], "read from the replica") {
+			t.Errorf("expected the replica's row and a notice, got %+v", res.Frames[0])
+		}
+	})
+
+	t.Run("both fail", func(t *testing.T) {
+		primary := &fakeD1Client{responses: []*D1Response{cannedResponse(t, http.StatusBadGateway, map[string]string{})}}
+		replica := &fakeD1Client{err: errors.New("connection refused")}
+		ds := newFakeDatasource(t, settings, primary)
+		ds.replica = replica
+
+		res := runQuery(t, ds, `{"queryText":"SELECT 1 AS n"}`)
+		if res.Error == nil || !strings.Contains(res.Error.Error(), "Bad Gateway") {
+			t.Fatalf("expected the primary's error, got %v", res.Error)
+		}
+		if len(replica.payloads) != 1 {
+			t.Errorf("expected one replica attempt, got %d", len(replica.payloads))
+		}
+	})
+
+	t.Run("writes and SQL errors stay on the primary", func(t *testing.T) {
+		for sql, primary := range map[string]*fakeD1Client{
+			"DELETE FROM t": {err: errors.New("connection refused")},
+			"SELECT * FROM missing": {responses: []*D1Response{cannedResponse(t, http.StatusOK, models.D1RawAPIResponse{
+				Errors: []models.D1Error{{Code: 7500, Message: "no such table: missing"}},
+			})}},
+		} {
+			replica := &fakeD1Client{}
+			ds := newFakeDatasource(t, settings, primary)
+			ds.replica = replica
+
+			if res := runQuery(t, ds, `{"queryText":"`+sql+`"}`); res.Error == nil {
+				t.Errorf("%s: expected an error", sql)
+			}
+			if len(replica.payloads) != 0 {
+				t.Errorf("%s: expected no replica request, got %d", sql, len(replica.payloads))
+			}
+		}
+	})
+}
+
+func TestQueryBindsInMacroValues(t *testing.T) {
+	client := &fakeD1Client{responses: []*D1Response{cannedResponse(t, http.StatusOK, models.D1RawAPIResponse{Success: true})}}
+	ds := newFakeDatasource(t, `{"accountId":"acc","databaseId":"db"}`, client)
+
+	res := runQuery(t, ds, `{"queryText":"SELECT * FROM t WHERE kind = ? AND $__in(status, [\"a\",\"b\"])","params":["x"]}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	got := client.payloads[0]
+	if got.SQL != "SELECT * FROM t WHERE kind = ?1 AND status IN (?2, ?3)" || len(got.Params) != 3 || got.Params[2] != "b" {
+		t.Errorf("unexpected payload %+v", got)
+	}
+
+	// A ? after the macro still binds the query's own param, not one of the macro's.
+	client.responses = []*D1Response{cannedResponse(t, http.StatusOK, models.D1RawAPIResponse{Success: true})}
+	res = runQuery(t, ds, `{"queryText":"SELECT * FROM t WHERE kind = ? AND $__in(status, [\"a\"]) AND n > ? AND id = ?1","params":["x",5]}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	got = client.payloads[1]
+	if want := "SELECT * FROM t WHERE kind = ?1 AND status IN (?3) AND n > ?2 AND id = ?1"; got.SQL != want {
+		t.Errorf("expected %q, got %q", want, got.SQL)
+	}
+	if want := []interface{}{"x", float64(5), "a"}; !reflect.DeepEqual(got.Params, want) {
+		t.Errorf("expected params %v, got %v", want, got.Params)
+	}
+}
+
+func TestQueryCountOnEmpty(t *testing.T) {
+	empty := func() *D1Response {
+		return cannedResponse(t, http.StatusOK, models.D1RawAPIResponse{Success: true, Result: []models.D1RawResultItem{{
+			Success: true,
+			Results: &models.D1RawQueryActualResult{Columns: []string{"id"}, Rows: [][]interface{}{}},
+		}}})
+	}
+	count := cannedResponse(t, http.StatusOK, models.D1RawAPIResponse{Success: true, Result: []models.D1RawResultItem{{
+		Success: true,
+		Results: &models.D1RawQueryActualResult{Columns: []string{"COUNT(*)"}, Rows: [][]interface{}{{120}}},
+	}}})
+
+	client := &fakeD1Client{responses: []*D1Response{empty(), count}}
+	ds := newFakeDatasource(t, `{"accountId":"acc","databaseId":"db"}`, client)
+	res := runQuery(t, ds, `{"queryText":"SELECT id FROM events WHERE id < 0","countOnEmpty":true}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if !hasNotice(res.Frames[0], "Query returned no data: 0 of 120 rows in events matched.") {
+		t.Errorf("expected the matched count in the notice, got %+v", res.Frames[0].Meta.Notices)
+	}
+	if len(client.payloads) != 2 || client.payloads[1].SQL != `SELECT COUNT(*) FROM "events"` {
+		t.Errorf("expected a COUNT(*) of events, got %+v", client.payloads)
+	}
+
+	// Without a single table the count is skipped and the notice left as is.
+	client = &fakeD1Client{responses: []*D1Response{empty()}}
+	ds = newFakeDatasource(t, `{"accountId":"acc","databaseId":"db"}`, client)
+	res = runQuery(t, ds, `{"queryText":"SELECT a.id FROM a JOIN b ON a.id = b.id","countOnEmpty":true}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if len(client.payloads) != 1 || !hasNotice(res.Frames[0], noDataNotice) {
+		t.Errorf("expected only the query and the plain notice, got %+v and %+v", client.payloads, res.Frames[0].Meta.Notices)
+	}
+}
+
+func TestQueryBatchKeepsFramesOfSucceededStatements(t *testing.T) {
+	client := &fakeD1Client{responses: []*D1Response{{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{},
+		RequestID:  "req-1",
+		Body: []byte(`{"success":false,"errors":[{"code":7500,"message":"no such table: missing"}],"result":[
+			{"success":true,"meta":{},"results":[{"n":1}]},
+			{"success":false,"meta":{},"results":[]},
+			{"success":true,"meta":{},"results":[{"n":3}]}
+		]}`),
+	}}}
+	ds := newFakeDatasource(t, `{"accountId":"acc","databaseId":"db"}`, client)
+
+	res := runQuery(t, ds, `{"queryText":"SELECT 1 AS n; SELECT * FROM missing; SELECT 3 AS n","endpoint":"query"}`)
+	if res.Error != nil {
+		t.Fatalf("expected a non-fatal response, got %v", res.Error)
+	}
+	if len(res.Frames) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(res.Frames))
+	}
+	for _, i := range []int{0, 2} {
+		if v, _ := res.Frames[i].Fields[0].ConcreteAt(0); v != int64(i+1) {
+			t.Errorf("frame %d: expected n = %d, got %v", i, i+1, v)
+		}
+	}
+	failed := res.Frames[1]
+	if failed.Name != "A[1]" || len(failed.Fields) != 0 || !hasNotice(failed, "Statement 1 failed: Code 7500: no such table: missing") {
+		t.Errorf("expected an error notice on the failed statement's frame, got %s %+v", failed.Name, failed.Meta)
+	}
+	if hasNotice(res.Frames[0], "failed") || hasNotice(res.Frames[2], "failed") {
+		t.Error("expected the error notice on the failed statement only")
+	}
+}
+
+func TestQueryTLSSettings(t *testing.T) {
+	srv := httptest.NewTLSServer(rawResponse([]string{"n"}, [][]interface{}{{float64(1)}}))
+	t.Cleanup(srv.Close)
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	caJSON, _ := json.Marshal(string(caPEM))
+
+	tests := []struct {
+		name     string
+		jsonData string
+		wantErr  bool
+	}{
+		{"untrusted certificate", `{"accountId":"acc","databaseId":"db"}`, true},
+		{"custom CA", `{"accountId":"acc","databaseId":"db","tlsCACert":` + string(caJSON) + `}`, false},
+		{"skip verify", `{"accountId":"acc","databaseId":"db","tlsSkipVerify":true}`, false},
+	}
+	for _, tt := range tests {
+		ds := newFakeDatasource(t, tt.jsonData, nil)
+		setBaseURL(ds, srv.URL)
+		res := runQuery(t, ds, `{"queryText":"SELECT 1 AS n"}`)
+		if (res.Error != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %t, got %v", tt.name, tt.wantErr, res.Error)
+		}
+	}
+}
+
+func TestHTTPTransportTimeouts(t *testing.T) {
+	ds := newFakeDatasource(t, `{"accountId":"acc","databaseId":"db"}`, nil)
+	if got, want := ds.transport.TLSHandshakeTimeout, models.DefaultTLSHandshakeTimeoutSeconds*time.Second; got != want {
+		t.Errorf("expected the default TLS handshake timeout %s, got %s", want, got)
+	}
+
+	// 10.255.255.1 is a non-routable address: connecting to it never completes.
+	ds = newFakeDatasource(t, `{"accountId":"acc","databaseId":"db","dialTimeoutSeconds":1,"queryTimeoutSeconds":30}`, nil)
+	setBaseURL(ds, "http://10.255.255.1:81")
+	start := time.Now()
+	res := runQuery(t, ds, `{"queryText":"SELECT 1 AS n"}`)
+	if res.Error == nil {
+		t.Fatal("expected the connection to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("expected the dial timeout to end the query, took %s: %v", elapsed, res.Error)
+	}
+}
+
+func TestHTTPTransportTLSHandshakeTimeout(t *testing.T) {
+	// A server accepting connections without ever answering the TLS handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				_ = conn.Close()
+			}
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	ds := newFakeDatasource(t, `{"accountId":"acc","databaseId":"db","tlsHandshakeTimeoutSeconds":1,"queryTimeoutSeconds":30}`, nil)
+	setBaseURL(ds, "https://"+ln.Addr().String())
+	start := time.Now()
+	res := runQuery(t, ds, `{"queryText":"SELECT 1 AS n"}`)
+	if res.Error == nil || !strings.Contains(res.Error.Error(), "TLS handshake timeout") {
+		t.Fatalf("expected a TLS handshake timeout, got %v", res.Error)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("expected the handshake timeout to end the query, took %s", elapsed)
+	}
+}
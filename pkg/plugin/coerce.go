@@ -0,0 +1,450 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/olipayne/grafana-cloudflare-d1-datasource/pkg/models"
+)
+
+// columnKind is the field type a result column is converted to.
+type columnKind int
+
+const (
+	kindString columnKind = iota
+	kindFloat64
+	kindInt64
+	kindBool
+	kindTime
+)
+
+func (k columnKind) String() string {
+	switch k {
+	case kindFloat64:
+		return "float64"
+	case kindInt64:
+		return "int64"
+	case kindBool:
+		return "bool"
+	case kindTime:
+		return "time"
+	default:
+		return "string"
+	}
+}
+
+// declaredColumnKinds maps the type names of a query's columnTypes option to kinds.
+var declaredColumnKinds = map[string]columnKind{
+	"string":  kindString,
+	"float64": kindFloat64,
+	"int64":   kindInt64,
+	"bool":    kindBool,
+	"time":    kindTime,
+}
+
+// checkColumnTypes returns an error unless every type of a columnTypes option is known.
+func checkColumnTypes(columnTypes map[string]string) error {
+	for column, name := range columnTypes {
+		if _, ok := declaredColumnKinds[name]; !ok {
+			return fmt.Errorf("unknown type %q in columnTypes for column %q: must be one of string, float64, int64, bool, time", name, column)
+		}
+	}
+	return nil
+}
+
+// timestampLayouts are the string formats recognized as timestamps, in the order
+// they are tried. The first is what SQLite's CURRENT_TIMESTAMP produces; date-only
+// values (CURRENT_DATE) are read as midnight. Fractional seconds are accepted by all
+// but the date-only layout.
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05",
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05Z07:00", // SQLite's datetime() with an offset appended
+	"2006-01-02T15:04:05",       // ISO 8601 without an offset
+	time.DateOnly,
+}
+
+// parseTimestamp parses s using the first matching layout in timestampLayouts. Values
+// with a UTC offset keep it; those without one are read as times in loc. The result is
+// in UTC either way, so every time field of a frame is in the same zone.
+func parseTimestamp(s string, loc *time.Location) (time.Time, bool) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// nullColumnKinds maps the defaultNullColumnType setting to a column kind.
+var nullColumnKinds = map[string]columnKind{
+	models.NullColumnTypeString:  kindString,
+	models.NullColumnTypeFloat64: kindFloat64,
+	models.NullColumnTypeInt64:   kindInt64,
+}
+
+// sampleColumn returns the first non-nil value of the column at colIdx, or nil if every
+// value in the column is NULL. Strings spelling out NaN or Infinity are only returned
+// when there is no other value, so they don't turn a numeric column into a string one.
+func sampleColumn(rows [][]interface{}, colIdx int) interface{} {
+	var nonFinite interface{}
+	for _, row := range rows {
+		if colIdx >= len(row) || row[colIdx] == nil {
+			continue
+		}
+		if _, ok := nonFiniteString(row[colIdx]); !ok {
+			return row[colIdx]
+		}
+		if nonFinite == nil {
+			nonFinite = row[colIdx]
+		}
+	}
+	return nonFinite
+}
+
+// integralColumn reports whether every non-NULL value of the column at colIdx is a whole
+// number decoded from JSON without rounding. Integers beyond 2^53 are decoded as int64
+// by the models package, so float64 values of that magnitude may have been rounded.
+func integralColumn(rows [][]interface{}, colIdx int) bool {
+	for _, row := range rows {
+		if colIdx >= len(row) || row[colIdx] == nil {
+			continue
+		}
+		if _, ok := row[colIdx].(int64); ok {
+			continue
+		}
+		f, ok := row[colIdx].(float64)
+		if !ok || f != math.Trunc(f) || math.Abs(f) > models.MaxExactInteger {
+			return false
+		}
+	}
+	return true
+}
+
+// inferColumnKind picks the field type for a column from a sample value. JSON numbers
+// are decoded as float64, or int64 for integers beyond 2^53, and both start out as
+// float64 columns; strings that parse as timestamps become time fields. Anything else,
+// including a nil sample, defaults to string.
+func inferColumnKind(sample interface{}) columnKind {
+	switch v := sample.(type) {
+	case float64, int64:
+		return kindFloat64
+	case bool:
+		return kindBool
+	case string:
+		if _, ok := parseTimestamp(v, time.UTC); ok {
+			return kindTime
+		}
+	}
+	return kindString
+}
+
+// buildColumnField converts a result column into a field of the given kind. Cells that
+// can't be converted are left nil; the number of such cells is returned as failed.
+// Timestamps without a UTC offset are read as times in loc.
+func buildColumnField(colName string, colIdx int, rows [][]interface{}, kind columnKind, loc *time.Location) (field *data.Field, failed int) {
+	switch kind {
+	case kindFloat64:
+		return buildTypedField(colName, colIdx, rows, toFloat64)
+	case kindInt64:
+		return buildTypedField(colName, colIdx, rows, toInt64)
+	case kindBool:
+		return buildTypedField(colName, colIdx, rows, toBool)
+	case kindTime:
+		return buildTypedField(colName, colIdx, rows, timeIn(loc))
+	default:
+		return buildTypedField(colName, colIdx, rows, toString)
+	}
+}
+
+// buildDeclaredField converts a column into a field of a type declared in the query's
+// columnTypes. Unlike inferred columns, values of another JSON type are converted where
+// SQLite stores them that way: numbers from numeric text, booleans from 0/1 flags and
+// times from Unix epochs.
+func buildDeclaredField(colName string, colIdx int, rows [][]interface{}, kind columnKind, loc *time.Location) (field *data.Field, failed int) {
+	switch kind {
+	case kindTime:
+		return buildTypedField(colName, colIdx, rows, timeOrEpochIn(loc))
+	case kindFloat64:
+		return buildTypedField(colName, colIdx, rows, numberToFloat64)
+	case kindInt64:
+		return buildTypedField(colName, colIdx, rows, numberToInt64)
+	case kindBool:
+		return buildTypedField(colName, colIdx, rows, flagToBool)
+	default:
+		return buildColumnField(colName, colIdx, rows, kind, loc)
+	}
+}
+
+// buildTypedField builds a nullable field by applying convert to every non-nil cell of
+// the column at colIdx. NULL cells stay nil and are not counted as failures.
+func buildTypedField[T any](colName string, colIdx int, rows [][]interface{}, convert func(interface{}) (T, bool)) (*data.Field, int) {
+	failed := 0
+	colData := make([]*T, len(rows))
+	for i, row := range rows {
+		if colIdx >= len(row) || row[colIdx] == nil {
+			continue
+		}
+		v, ok := convert(row[colIdx])
+		if !ok {
+			failed++
+			continue
+		}
+		colData[i] = &v
+	}
+	return data.NewField(colName, nil, colData), failed
+}
+
+// nullEmptyStrings replaces the empty strings of a nullable string field with NULL.
+func nullEmptyStrings(field *data.Field) {
+	for i := 0; i < field.Len(); i++ {
+		if s, ok := field.At(i).(*string); ok && s != nil && *s == "" {
+			field.Set(i, (*string)(nil))
+		}
+	}
+}
+
+// coercionNotice summarizes the cells of a column that could not be converted.
+func coercionNotice(colName string, failed int) data.Notice {
+	return data.Notice{
+		Severity: data.NoticeSeverityWarning,
+		Text:     fmt.Sprintf("%d values could not be converted in column %s", failed, colName),
+	}
+}
+
+// toFloat64 accepts numbers; integers beyond 2^53 are rounded to the nearest float64.
+// JSON has no NaN or infinities, so strings spelling them out are accepted too.
+func toFloat64(v interface{}) (float64, bool) {
+	if i, ok := v.(int64); ok {
+		return float64(i), true
+	}
+	if f, ok := nonFiniteString(v); ok {
+		return f, true
+	}
+	f, ok := v.(float64)
+	return f, ok
+}
+
+// nonFiniteString returns the value of v if it is a string such as "NaN", "Infinity" or
+// "-Infinity", in any case.
+func nonFiniteString(v interface{}) (float64, bool) {
+	s, ok := v.(string)
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	return f, err == nil && (math.IsNaN(f) || math.IsInf(f, 0))
+}
+
+// nullNonFinite replaces NaN and infinite values of the float64 fields of frame with NULL.
+func nullNonFinite(frame *data.Frame) {
+	for _, field := range frame.Fields {
+		if field.Type() != data.FieldTypeNullableFloat64 {
+			continue
+		}
+		for i := 0; i < field.Len(); i++ {
+			if f, ok := field.At(i).(*float64); ok && f != nil && (math.IsNaN(*f) || math.IsInf(*f, 0)) {
+				field.Set(i, (*float64)(nil))
+			}
+		}
+	}
+}
+
+// numberToFloat64 accepts numbers and strings holding a decimal number, such as
+// coordinates stored as TEXT.
+func numberToFloat64(v interface{}) (float64, bool) {
+	if s, ok := v.(string); ok {
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		return f, err == nil
+	}
+	return toFloat64(v)
+}
+
+// thousandsSeparators separate the groups of thousands of numeric strings besides the
+// separator that isn't the decimal one: spaces, including non-breaking ones, and
+// apostrophes.
+const thousandsSeparators = " \u00a0\u202f'"
+
+// localizedNumber returns a converter reading numeric strings written with
+// decimalSeparator, "." or ",", as in 1.234,56, 1 234,56 or 1'234.56. The other of the two
+// separates thousands and is removed, provided the digits are grouped in threes: 1.2.3
+// is not a number. Numbers are converted as they are.
+func localizedNumber(decimalSeparator string) func(interface{}) (float64, bool) {
+	decimal, thousands := ".", ','
+	if decimalSeparator == "," {
+		decimal, thousands = ",", '.'
+	}
+	return func(v interface{}) (float64, bool) {
+		s, ok := v.(string)
+		if !ok {
+			return toFloat64(v)
+		}
+		integer, fraction, hasFraction := strings.Cut(strings.TrimSpace(s), decimal)
+		integer, ok = ungroupThousands(integer, thousands)
+		if !ok {
+			return 0, false
+		}
+		if hasFraction {
+			integer += "." + fraction
+		}
+		f, err := strconv.ParseFloat(integer, 64)
+		return f, err == nil
+	}
+}
+
+// ungroupThousands removes the thousands separators, separator or thousandsSeparators,
+// from the integer part of a number. ok is false unless the first group has one to three
+// characters and every further group exactly three.
+func ungroupThousands(integer string, separator rune) (ungrouped string, ok bool) {
+	digits := strings.TrimLeft(integer, "+-")
+	var groups []string
+	start := 0
+	for i, r := range digits {
+		if r == separator || strings.ContainsRune(thousandsSeparators, r) {
+			groups = append(groups, digits[start:i])
+			start = i + utf8.RuneLen(r)
+		}
+	}
+	if len(groups) == 0 {
+		return integer, true
+	}
+	groups = append(groups, digits[start:])
+	for i, group := range groups {
+		if (i == 0 && (len(group) == 0 || len(group) > 3)) || (i > 0 && len(group) != 3) {
+			return "", false
+		}
+	}
+	return integer[:len(integer)-len(digits)] + strings.Join(groups, ""), true
+}
+
+// toInt64 accepts only integral numbers, since most JSON numbers decode as float64.
+// Floats beyond 2^53 are rejected like in integralColumn: they may have been rounded,
+// and past 2^63 they don't fit at all.
+func toInt64(v interface{}) (int64, bool) {
+	if i, ok := v.(int64); ok {
+		return i, true
+	}
+	f, ok := v.(float64)
+	if !ok || f != math.Trunc(f) || math.Abs(f) > models.MaxExactInteger {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// numberToInt64 accepts integral numbers and strings holding a decimal integer.
+func numberToInt64(v interface{}) (int64, bool) {
+	if s, ok := v.(string); ok {
+		i, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		return i, err == nil
+	}
+	return toInt64(v)
+}
+
+func toBool(v interface{}) (bool, bool) {
+	b, ok := v.(bool)
+	return b, ok
+}
+
+// toString never fails: non-string values use their default formatting.
+func toString(v interface{}) (string, bool) {
+	if s, ok := v.(string); ok {
+		return s, true
+	}
+	return fmt.Sprintf("%v", v), true
+}
+
+// rawString formats a value as it appeared in the D1 response: strings as they are,
+// numbers in plain decimal notation, booleans as true or false, and arrays and objects
+// as JSON. It never fails.
+func rawString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	if b, err := json.Marshal(v); err == nil {
+		return string(b), true
+	}
+	return fmt.Sprintf("%v", v), true
+}
+
+// timeIn returns a converter parsing timestamp strings, reading those without a UTC
+// offset as times in loc.
+func timeIn(loc *time.Location) func(interface{}) (time.Time, bool) {
+	return func(v interface{}) (time.Time, bool) {
+		s, ok := v.(string)
+		if !ok {
+			return time.Time{}, false
+		}
+		return parseTimestamp(s, loc)
+	}
+}
+
+// epochMillisThreshold tells Unix epochs in milliseconds from those in seconds: as
+// seconds it is in the year 5138, as milliseconds in 1973, so real timestamps of either
+// unit fall on their own side of it.
+const epochMillisThreshold = 1e11
+
+// epochToTime converts a Unix epoch in seconds or, from epochMillisThreshold on, in
+// milliseconds to a time in UTC. Fractions are kept to the microsecond, about as fine as
+// float64 resolves current epochs.
+func epochToTime(epoch float64) time.Time {
+	whole := math.Floor(epoch)
+	if math.Abs(epoch) >= epochMillisThreshold {
+		micros := math.Round((epoch - whole) * 1e3)
+		return time.UnixMilli(int64(whole)).Add(time.Duration(micros) * time.Microsecond).UTC()
+	}
+	micros := math.Round((epoch - whole) * 1e6)
+	return time.Unix(int64(whole), 0).Add(time.Duration(micros) * time.Microsecond).UTC()
+}
+
+// timeOrEpochIn returns a converter parsing timestamp strings like timeIn and reading
+// numbers as Unix epochs in seconds or milliseconds, as SQLite often stores times.
+func timeOrEpochIn(loc *time.Location) func(interface{}) (time.Time, bool) {
+	parse := timeIn(loc)
+	return func(v interface{}) (time.Time, bool) {
+		switch n := v.(type) {
+		case float64:
+			if math.IsNaN(n) || math.IsInf(n, 0) {
+				return time.Time{}, false
+			}
+			return epochToTime(n), true
+		case int64:
+			return epochToTime(float64(n)), true
+		}
+		return parse(v)
+	}
+}
+
+// flagToBool converts the values SQLite stores booleans as: integer flags, where 0 is
+// false and any other number is true, and the text true/false/1/0 written by some ORMs,
+// in any case.
+func flagToBool(v interface{}) (bool, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n != 0, true
+	case int64:
+		return n != 0, true
+	case bool:
+		return n, true
+	case string:
+		switch strings.ToLower(strings.TrimSpace(n)) {
+		case "true", "1":
+			return true, true
+		case "false", "0":
+			return false, true
+		}
+	}
+	return false, false
+}
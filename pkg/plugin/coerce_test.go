@@ -0,0 +1,218 @@
+package plugin
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseTimestampDateOnly(t *testing.T) {
+	got, ok := parseTimestamp("2024-01-15", time.UTC)
+	if !ok {
+		t.Fatal("expected a date-only value to parse")
+	}
+	if want := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC); !got.Equal(want) || got.Location() != time.UTC {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if kind := inferColumnKind("2024-01-15"); kind != kindTime {
+		t.Errorf("expected a date-only column to be a time column, got %s", kind)
+	}
+
+	field, failed := buildColumnField("day", 0, [][]interface{}{{"2024-01-15"}, {nil}}, kindTime, time.UTC)
+	if failed != 0 {
+		t.Errorf("expected no conversion failures, got %d", failed)
+	}
+	if v, ok := field.At(0).(*time.Time); !ok || v == nil || v.Hour() != 0 || v.Day() != 15 {
+		t.Errorf("expected a *time.Time at midnight, got %v", field.At(0))
+	}
+}
+
+func TestParseTimestampNearMisses(t *testing.T) {
+	for _, s := range []string{
+		"2024 budget",
+		"2024-01",
+		"2024-1-5",
+		"2024-01-15 budget",
+		"2024-13-01",
+		"20240115",
+	} {
+		if _, ok := parseTimestamp(s, time.UTC); ok {
+			t.Errorf("%q must not parse as a timestamp", s)
+		}
+		if kind := inferColumnKind(s); kind != kindString {
+			t.Errorf("%q: expected a string column, got %s", s, kind)
+		}
+	}
+}
+
+func TestParseTimestampTimeZone(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("could not load zone: %v", err)
+	}
+	tests := []struct {
+		loc  *time.Location
+		want time.Time
+	}{
+		{time.UTC, time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC)},
+		{newYork, time.Date(2024, 1, 15, 15, 30, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, ok := parseTimestamp("2024-01-15 10:30:00", tt.loc)
+		if !ok || !got.Equal(tt.want) || got.Location() != time.UTC {
+			t.Errorf("%s: expected %v, got %v", tt.loc, tt.want, got)
+		}
+	}
+
+	// Timestamps carrying an offset are unaffected by the zone.
+	got, ok := parseTimestamp("2024-01-15T10:30:00Z", newYork)
+	if want := time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC); !ok || !got.Equal(want) {
+		t.Errorf("expected %v for an RFC3339 timestamp, got %v", want, got)
+	}
+}
+
+func TestParseTimestampOffsets(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("could not load zone: %v", err)
+	}
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		// Offsets are kept whatever the configured zone.
+		{"2024-01-01T00:00:00+02:00", time.Date(2023, 12, 31, 22, 0, 0, 0, time.UTC)},
+		{"2024-01-01 00:00:00+02:00", time.Date(2023, 12, 31, 22, 0, 0, 0, time.UTC)},
+		{"2024-01-01T00:00:00Z", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// Naive values are in the configured zone, one hour ahead of UTC in winter.
+		{"2024-01-01 00:00:00", time.Date(2023, 12, 31, 23, 0, 0, 0, time.UTC)},
+		{"2024-01-01T00:00:00", time.Date(2023, 12, 31, 23, 0, 0, 0, time.UTC)},
+		{"2024-01-01 00:00:00.5", time.Date(2023, 12, 31, 23, 0, 0, 5e8, time.UTC)},
+		{"2024-01-01", time.Date(2023, 12, 31, 23, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, ok := parseTimestamp(tt.value, berlin)
+		if !ok || !got.Equal(tt.want) || got.Location() != time.UTC {
+			t.Errorf("%q: expected %v, got %v (ok %t)", tt.value, tt.want, got, ok)
+		}
+		if kind := inferColumnKind(tt.value); kind != kindTime {
+			t.Errorf("%q: expected a time column, got %s", tt.value, kind)
+		}
+	}
+}
+
+func TestTimeOrEpoch(t *testing.T) {
+	convert := timeOrEpochIn(time.UTC)
+	tests := []struct {
+		value interface{}
+		want  time.Time
+	}{
+		{float64(1704067200), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{float64(1704067200123), time.Date(2024, 1, 1, 0, 0, 0, 123e6, time.UTC)},
+		{1704067200.5, time.Date(2024, 1, 1, 0, 0, 0, 5e8, time.UTC)},
+		{float64(-86400), time.Date(1969, 12, 31, 0, 0, 0, 0, time.UTC)},
+		{"2024-01-01 00:00:00", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, ok := convert(tt.value)
+		if !ok || !got.Equal(tt.want) || got.Location() != time.UTC {
+			t.Errorf("%v: expected %v, got %v (ok %t)", tt.value, tt.want, got, ok)
+		}
+	}
+	for _, value := range []interface{}{math.NaN(), math.Inf(1), "not a time", true} {
+		if got, ok := convert(value); ok {
+			t.Errorf("%v: expected no time, got %v", value, got)
+		}
+	}
+}
+
+func TestLocalizedNumber(t *testing.T) {
+	tests := []struct {
+		separator string
+		value     interface{}
+		want      float64
+		ok        bool
+	}{
+		{",", "1.234,56", 1234.56, true},
+		{",", "-0,5", -0.5, true},
+		{",", "1 234 567,8", 1234567.8, true},
+		{",", "1\u00a0234,5", 1234.5, true},
+		{",", " 12 ", 12, true},
+		{",", float64(3.5), 3.5, true},
+		{",", "1,2,3", 0, false},
+		{",", "n/a", 0, false},
+		{".", "1,234.56", 1234.56, true},
+		{".", "1'234'567.25", 1234567.25, true},
+		{".", "1.234", 1.234, true},
+		{"", "1,234.5", 1234.5, true},
+		{",", "-1.234.567", -1234567, true},
+		{".", "12,345,678", 12345678, true},
+		// Thousands separators must group the digits in threes.
+		{",", "1.2.3", 0, false},
+		{",", "1.23", 0, false},
+		{",", "1.2345,6", 0, false},
+		{",", "1234.567", 0, false},
+		{",", ".123", 0, false},
+		{",", "1..234", 0, false},
+		{",", "1.234.", 0, false},
+		{".", "1,23.5", 0, false},
+		{".", "1 2 3", 0, false},
+		{",", "1,234.5", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := localizedNumber(tt.separator)(tt.value)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("separator %q, %#v: expected %v (%v), got %v (%v)", tt.separator, tt.value, tt.want, tt.ok, got, ok)
+		}
+	}
+}
+
+func TestToFloat64NonFinite(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		check func(float64) bool
+		ok    bool
+	}{
+		{"NaN", math.IsNaN, true},
+		{"nan", math.IsNaN, true},
+		{"Infinity", func(f float64) bool { return math.IsInf(f, 1) }, true},
+		{" -Infinity ", func(f float64) bool { return math.IsInf(f, -1) }, true},
+		{"-inf", func(f float64) bool { return math.IsInf(f, -1) }, true},
+		{float64(2), func(f float64) bool { return f == 2 }, true},
+		// Other numeric strings aren't numbers of an inferred column.
+		{"1.5", nil, false},
+		{"Infinite", nil, false},
+	}
+	for _, tt := range tests {
+		got, ok := toFloat64(tt.value)
+		if ok != tt.ok || (ok && !tt.check(got)) {
+			t.Errorf("%#v: expected ok=%v, got %v (%v)", tt.value, tt.ok, got, ok)
+		}
+	}
+}
+
+func TestRawString(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{"text", "text"},
+		{"", ""},
+		{float64(42), "42"},
+		{1.5, "1.5"},
+		{0.0000012, "0.0000012"},
+		{1e21, "1000000000000000000000"},
+		{float64(-3), "-3"},
+		{int64(9007199254740993), "9007199254740993"},
+		{true, "true"},
+		{false, "false"},
+		{[]interface{}{float64(1), "a"}, `[1,"a"]`},
+		{map[string]interface{}{"k": nil}, `{"k":null}`},
+	}
+	for _, tt := range tests {
+		got, ok := rawString(tt.value)
+		if !ok || got != tt.want {
+			t.Errorf("%#v: expected %q, got %q (%v)", tt.value, tt.want, got, ok)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// buildJSONField builds a string field for a column holding JSON documents.
+// Valid documents are re-serialized as compact canonical JSON (object keys sorted);
+// invalid ones are kept as-is and counted in the returned invalid total.
+func buildJSONField(colName string, colIdx int, rows [][]interface{}) (*data.Field, int) {
+	invalid := 0
+	colData := make([]*string, len(rows))
+	for i, row := range rows {
+		if colIdx >= len(row) || row[colIdx] == nil {
+			continue
+		}
+		var raw string
+		switch v := row[colIdx].(type) {
+		case string:
+			raw = v
+		default:
+			// Non-string values were already decoded from the D1 response; encode them back.
+			b, err := json.Marshal(v)
+			if err != nil {
+				invalid++
+				continue
+			}
+			raw = string(b)
+		}
+
+		normalized, err := canonicalJSON(raw)
+		if err != nil {
+			invalid++
+			normalized = raw
+		}
+		colData[i] = &normalized
+	}
+	return data.NewField(colName, nil, colData), invalid
+}
+
+var errInvalidJSON = errors.New("invalid JSON")
+
+// canonicalJSON re-serializes a JSON document in compact form with object keys sorted.
+// Numbers are kept verbatim so large integers don't lose precision.
+func canonicalJSON(s string) (string, error) {
+	if !json.Valid([]byte(s)) {
+		return "", errInvalidJSON
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// applyFieldConfig sets the unit and display name configured per column on the
+// matching frame fields. Columns not present in the frame are ignored.
+func applyFieldConfig(frame *data.Frame, configs map[string]columnConfig, logger leveledLogger) {
+	for colName, cfg := range configs {
+		field, _ := frame.FieldByName(colName)
+		if field == nil {
+			logger.Debug("Ignoring field config for unknown column", "column", colName)
+			continue
+		}
+		if field.Config == nil {
+			field.Config = &data.FieldConfig{}
+		}
+		if cfg.Unit != "" {
+			field.Config.Unit = cfg.Unit
+		}
+		if cfg.DisplayName != "" {
+			field.Config.DisplayNameFromDS = cfg.DisplayName
+		}
+	}
+}
+
+// prettifyColumnNames gives the fields of frame a human-friendly display name derived
+// from their column names, leaving the field names transformations refer to unchanged.
+// Fields with labels are skipped, as their series names come from the labels.
+func prettifyColumnNames(frame *data.Frame) {
+	for _, field := range frame.Fields {
+		if len(field.Labels) > 0 {
+			continue
+		}
+		pretty := prettyColumnName(field.Name)
+		if pretty == field.Name {
+			continue
+		}
+		if field.Config == nil {
+			field.Config = &data.FieldConfig{}
+		}
+		field.Config.DisplayNameFromDS = pretty
+	}
+}
+
+// setGeoDisplayNames names the coordinate fields of frame latitude and longitude, the
+// display names the geomap panel's auto location mode looks for. Display names from the
+// query's field config still take precedence.
+func setGeoDisplayNames(frame *data.Frame, latColumn, lonColumn string) {
+	for _, field := range frame.Fields {
+		var name string
+		switch field.Name {
+		case latColumn:
+			name = "latitude"
+		case lonColumn:
+			name = "longitude"
+		default:
+			continue
+		}
+		if field.Config == nil {
+			field.Config = &data.FieldConfig{}
+		}
+		field.Config.DisplayNameFromDS = name
+	}
+}
+
+// prettyColumnName turns a column name like total_bytes_sent into Total Bytes Sent.
+// Words are split on underscores, hyphens and spaces. Lowercase words are capitalized;
+// words that already contain capitals (ID, userId) are kept as written.
+func prettyColumnName(name string) string {
+	words := strings.FieldsFunc(name, func(r rune) bool {
+		return r == '_' || r == '-' || unicode.IsSpace(r)
+	})
+	if len(words) == 0 {
+		return name
+	}
+	for i, word := range words {
+		if strings.ToLower(word) == word {
+			first, size := utf8.DecodeRuneInString(word)
+			words[i] = string(unicode.ToUpper(first)) + word[size:]
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// applyColumnLabels turns fields named in the name{label=value,...} convention, e.g.
+// value{host="a",region=x}, into fields called name with those labels. Fields whose
+// names don't follow the convention are left as they are.
+func applyColumnLabels(frame *data.Frame) {
+	for _, field := range frame.Fields {
+		name, labels, ok := parseLabeledColumnName(field.Name)
+		if !ok {
+			continue
+		}
+		field.Name = name
+		if field.Labels == nil {
+			field.Labels = data.Labels{}
+		}
+		for key, value := range labels {
+			field.Labels[key] = value
+		}
+	}
+}
+
+// parseLabeledColumnName splits a column name like value{host="a",region=x} into its
+// name and labels. Values may be quoted, with \" and \\ escapes, to contain commas,
+// braces or surrounding spaces. ok is false for names that aren't of this form, have no
+// labels, or repeat a label.
+func parseLabeledColumnName(column string) (name string, labels data.Labels, ok bool) {
+	open := strings.IndexByte(column, '{')
+	if open <= 0 || !strings.HasSuffix(column, "}") {
+		return "", nil, false
+	}
+	name = strings.TrimSpace(column[:open])
+	rest := column[open+1 : len(column)-1]
+	if name == "" || strings.TrimSpace(rest) == "" {
+		return "", nil, false
+	}
+
+	labels = data.Labels{}
+	for {
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			return "", nil, false
+		}
+		key := strings.TrimSpace(rest[:eq])
+		if key == "" || strings.ContainsAny(key, `{}",`) {
+			return "", nil, false
+		}
+		if _, repeated := labels[key]; repeated {
+			return "", nil, false
+		}
+		rest = strings.TrimLeft(rest[eq+1:], " ")
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			if i == len(rest) {
+				return "", nil, false // Unterminated quote
+			}
+			value = b.String()
+			rest = strings.TrimLeft(rest[i+1:], " ")
+			if rest != "" && rest[0] != ',' {
+				return "", nil, false
+			}
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value = strings.TrimSpace(rest[:end])
+			if strings.ContainsAny(value, `{}"=`) {
+				return "", nil, false
+			}
+			rest = rest[end:]
+		}
+		labels[key] = value
+
+		if rest == "" {
+			return name, labels, true
+		}
+		rest = rest[1:] // The comma before the next label
+	}
+}
@@ -0,0 +1,97 @@
+package plugin
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestPrettyColumnName(t *testing.T) {
+	tests := map[string]string{
+		"total_bytes_sent": "Total Bytes Sent",
+		"count":            "Count",
+		"user_ID":          "User ID",
+		"HTTP_status":      "HTTP Status",
+		"userId":           "userId",
+		"Already Pretty":   "Already Pretty",
+		"__private__":      "Private",
+		"cache-hit ratio":  "Cache Hit Ratio",
+		"élan_vital":       "Élan Vital",
+		"p99":              "P99",
+		"_":                "_",
+		"":                 "",
+	}
+	for in, want := range tests {
+		if got := prettyColumnName(in); got != want {
+			t.Errorf("prettyColumnName(%q): expected %q, got %q", in, want, got)
+		}
+	}
+}
+
+func TestPrettifyColumnNamesKeepsFieldNames(t *testing.T) {
+	frame := data.NewFrame("A",
+		data.NewField("total_bytes", nil, []float64{1}),
+		data.NewField("Name", nil, []string{"a"}),
+		data.NewField("value", data.Labels{"host": "a"}, []float64{1}),
+	)
+	prettifyColumnNames(frame)
+	applyFieldConfig(frame, map[string]columnConfig{"Name": {DisplayName: "Customer"}}, leveledLogger{})
+
+	if frame.Fields[0].Name != "total_bytes" || frame.Fields[0].Config.DisplayNameFromDS != "Total Bytes" {
+		t.Errorf("expected field total_bytes displayed as Total Bytes, got %q/%+v", frame.Fields[0].Name, frame.Fields[0].Config)
+	}
+	if frame.Fields[1].Config.DisplayNameFromDS != "Customer" {
+		t.Errorf("expected the configured display name to win, got %+v", frame.Fields[1].Config)
+	}
+	if frame.Fields[2].Config != nil {
+		t.Errorf("expected labeled fields to keep label-based names, got %+v", frame.Fields[2].Config)
+	}
+}
+
+func TestParseLabeledColumnName(t *testing.T) {
+	tests := []struct {
+		column string
+		name   string
+		labels data.Labels
+	}{
+		{`value{host=a,region=x}`, "value", data.Labels{"host": "a", "region": "x"}},
+		{`value{ host = a , region = x }`, "value", data.Labels{"host": "a", "region": "x"}},
+		{`requests{path="/a,b",note="say \"hi\" {x}"}`, "requests", data.Labels{"path": "/a,b", "note": `say "hi" {x}`}},
+		{`value{host=}`, "value", data.Labels{"host": ""}},
+		// Names outside the convention are left alone.
+		{`value`, "", nil},
+		{`value{}`, "", nil},
+		{`{host=a}`, "", nil},
+		{`value{host}`, "", nil},
+		{`value{host=a,host=b}`, "", nil},
+		{`value{host="a}`, "", nil},
+		{`value{host="a"b}`, "", nil},
+		{`value{host=a}x`, "", nil},
+		{`COUNT(x)`, "", nil},
+	}
+	for _, tt := range tests {
+		name, labels, ok := parseLabeledColumnName(tt.column)
+		if ok != (tt.labels != nil) || name != tt.name || !reflect.DeepEqual(labels, tt.labels) {
+			t.Errorf("%s: expected %q %v, got %q %v (%t)", tt.column, tt.name, tt.labels, name, labels, ok)
+		}
+	}
+}
+
+func TestApplyColumnLabels(t *testing.T) {
+	frame := data.NewFrame("A",
+		data.NewField("time", nil, []int64{1}),
+		data.NewField(`cpu{host=a}`, nil, []float64{1}),
+		data.NewField(`cpu{host=b}`, nil, []float64{2}),
+	)
+	applyColumnLabels(frame)
+	if name := frame.Fields[0].Name; name != "time" || frame.Fields[0].Labels != nil {
+		t.Errorf("expected the unlabeled field to be left alone, got %q %v", name, frame.Fields[0].Labels)
+	}
+	for i, host := range []string{"a", "b"} {
+		field := frame.Fields[i+1]
+		if field.Name != "cpu" || !reflect.DeepEqual(field.Labels, data.Labels{"host": host}) {
+			t.Errorf("expected cpu with host=%s, got %q %v", host, field.Name, field.Labels)
+		}
+	}
+}
@@ -1,18 +1,24 @@
 package plugin
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
+	"net/url"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"github.com/grafana/grafana-plugin-sdk-go/build/buildinfo"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
 	"github.com/olipayne/grafana-cloudflare-d1-datasource/pkg/models"
@@ -26,9 +32,26 @@ import (
 var (
 	_ backend.QueryDataHandler      = (*Datasource)(nil)
 	_ backend.CheckHealthHandler    = (*Datasource)(nil)
+	_ backend.CallResourceHandler   = (*Datasource)(nil)
+	_ backend.StreamHandler         = (*Datasource)(nil)
 	_ instancemgmt.InstanceDisposer = (*Datasource)(nil)
 )
 
+// userAgentProduct identifies the plugin in the User-Agent header of outbound requests.
+const userAgentProduct = "grafana-cloudflare-d1-datasource"
+
+// userAgent is sent on every D1 API request. The version comes from the build info
+// compiled into the binary by the plugin SDK build tooling.
+var userAgent = buildUserAgent(buildinfo.GetBuildInfo)
+
+func buildUserAgent(getter buildinfo.Getter) string {
+	version := "dev"
+	if info, err := getter.GetInfo(); err == nil && info.Version != "" {
+		version = info.Version
+	}
+	return userAgentProduct + "/" + version
+}
+
 // NewDatasource creates a new datasource instance.
 func NewDatasource(ctx context.Context, settings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
 	pluginSettings, err := models.LoadPluginSettings(settings)
@@ -36,15 +59,387 @@ func NewDatasource(ctx context.Context, settings backend.DataSourceInstanceSetti
 		return nil, fmt.Errorf("could not load plugin settings: %w", err)
 	}
 
-	return &Datasource{
-		settings: pluginSettings,
-	}, nil
+	// Incomplete settings don't prevent the instance from starting: the config editor
+	// needs resource routes before a database is chosen, and CheckHealth reports them.
+	for _, problem := range pluginSettings.Validate() {
+		log.DefaultLogger.Warn("Datasource settings are incomplete", "problem", problem)
+	}
+
+	for name := range pluginSettings.CustomHeaders {
+		if isProtectedHeader(name) {
+			log.DefaultLogger.Warn("Ignoring custom header that would override a header set by the plugin", "header", name)
+		}
+	}
+
+	if pluginSettings.MandatoryFilter != "" {
+		if err := checkFilterExpression(pluginSettings.MandatoryFilter); err != nil {
+			return nil, fmt.Errorf("invalid mandatoryFilter: %w", err)
+		}
+	}
+
+	if pluginSettings.TLSSkipVerify {
+		log.DefaultLogger.Warn("TLS certificate verification is DISABLED for this datasource (tlsSkipVerify); API requests are open to interception. Use tlsCACert to trust a proxy's CA instead.")
+	}
+
+	ds := &Datasource{
+		settings:  pluginSettings,
+		baseURL:   pluginSettings.APIBaseURL(),
+		transport: newHTTPTransport(pluginSettings),
+		logger:    newLeveledLogger(pluginSettings.LogLevel),
+	}
+	if pluginSettings.MaxConcurrentRequests > 0 {
+		ds.limiter = newRequestLimiter(pluginSettings.MaxConcurrentRequests)
+	}
+	ds.client = ds.limit(newHTTPD1Client(pluginSettings, ds.transport, ds.baseURL, pluginSettings.DatabaseID))
+	if pluginSettings.ReplicaDatabaseID != "" {
+		ds.replica = ds.limit(newHTTPD1Client(pluginSettings, ds.transport, ds.baseURL, pluginSettings.ReplicaDatabaseID))
+	}
+	ds.CallResourceHandler = httpadapter.New(ds.newResourceMux())
+	ds.frames = newFrameMemo()
+	if pluginSettings.CircuitBreakerThreshold > 0 {
+		ds.breaker = newCircuitBreaker(pluginSettings.CircuitBreakerThreshold, time.Duration(pluginSettings.CircuitBreakerCooldownSeconds)*time.Second)
+	}
+	if pluginSettings.CacheTTLSeconds > 0 {
+		ds.cache = newQueryCache(time.Duration(pluginSettings.CacheTTLSeconds) * time.Second)
+	}
+	return ds, nil
 }
 
 // Datasource is an example datasource which can respond to data queries, reports
 // its health and has streaming skills.
-type Datasource struct{
-	settings *models.PluginSettings
+type Datasource struct {
+	backend.CallResourceHandler // Serves the routes registered in newResourceMux
+
+	settings  *models.PluginSettings
+	baseURL   string          // Cloudflare API base URL, derived from the configured jurisdiction
+	transport *http.Transport // Shared by every API request, configured with the TLS settings
+	client    D1Client        // Sends queries to the configured D1 database
+	replica   D1Client        // Sends read queries to the replica database; nil without one
+	cache     *queryCache     // Query result cache; nil when caching is disabled
+	frames    *frameMemo      // Frames of recent results, reused for identical ones
+	breaker   *circuitBreaker // Pauses queries during API outages; nil when disabled
+	limiter   *requestLimiter // Bounds in-flight D1 requests; nil when unlimited
+	logger    leveledLogger
+	usage     usageCounters
+}
+
+// protectedHeaders are set by the plugin itself and can't be overridden by customHeaders.
+var protectedHeaders = map[string]bool{
+	"Authorization":           true,
+	"Cf-Access-Client-Id":     true,
+	"Cf-Access-Client-Secret": true,
+	"Content-Type":            true,
+	"Content-Length":          true,
+	"Accept-Encoding":         true,
+	"Host":                    true,
+	"X-Request-Id":            true,
+}
+
+// isProtectedHeader reports whether name is one of protectedHeaders, in any case.
+func isProtectedHeader(name string) bool {
+	return protectedHeaders[http.CanonicalHeaderKey(name)]
+}
+
+// logQueryOutcome emits one structured log line summarizing a finished query. The API
+// token is never part of it.
+func (d *Datasource) logQueryOutcome(refID string, statusCode int, elapsed time.Duration, cached bool, res backend.DataResponse) {
+	rows := 0
+	for _, frame := range res.Frames {
+		rows += frame.Rows()
+	}
+	args := []interface{}{
+		"refId", refID,
+		"statusCode", statusCode,
+		"durationMs", elapsed.Milliseconds(),
+		"rows", rows,
+		"cached", cached,
+		"error", res.Error != nil,
+	}
+	if res.Error != nil {
+		args = append(args, "errorMessage", res.Error.Error())
+	}
+	d.logger.Info("D1 query finished", args...)
+}
+
+// isWrite reports whether a statement's metadata shows it modified the database.
+func isWrite(meta models.D1Meta) bool {
+	return meta.Changes > 0 || meta.ChangedDB
+}
+
+// writeNotice describes the effect of a write statement from its metadata.
+func writeNotice(meta models.D1Meta) data.Notice {
+	text := fmt.Sprintf("%d rows affected", meta.Changes)
+	if meta.LastRowID > 0 {
+		text += fmt.Sprintf(", last_row_id=%d", meta.LastRowID)
+	}
+	return data.Notice{Severity: data.NoticeSeverityInfo, Text: text}
+}
+
+// frameCustomMeta is the custom meta of the plugin's frames.
+type frameCustomMeta struct {
+	*models.D1Meta               // Execution metadata of a statement without rows; nil otherwise
+	Tables         []string      `json:"tables,omitempty"` // Tables the query read or wrote, for lineage
+	Schema         []fieldSchema `json:"schema,omitempty"` // Field types of a schemaOnly query
+	// The D1 instance that served the statement, set on every frame. The keys match, and
+	// take precedence over, those of D1Meta.
+	ServedBy       string `json:"served_by,omitempty"`
+	ServedByRegion string `json:"served_by_region,omitempty"`
+	// The session bookmark D1 returned, for the next query's sessionBookmark.
+	Bookmark string `json:"bookmark,omitempty"`
+}
+
+// setServedBy records the D1 instance named in meta as the one that served frame.
+func setServedBy(frame *data.Frame, meta models.D1Meta) {
+	if meta.ServedBy == "" && meta.ServedByRegion == "" {
+		return
+	}
+	custom := customMeta(frame)
+	custom.ServedBy, custom.ServedByRegion = meta.ServedBy, meta.ServedByRegion
+}
+
+// setBookmark records the session bookmark returned in meta on frame. An API that ignored
+// the requested bookmark returns none, and the frame is left without one.
+func setBookmark(frame *data.Frame, meta models.D1Meta) {
+	if meta.Bookmark == "" {
+		return
+	}
+	customMeta(frame).Bookmark = meta.Bookmark
+}
+
+// fieldSchema describes a field of a schemaOnly query. Type uses the names of the
+// columnTypes option (string, float64, int64, bool or time) where one applies.
+type fieldSchema struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Nullable bool   `json:"nullable"`
+}
+
+// fieldTypeNames maps field types to the names of the columnTypes option.
+var fieldTypeNames = map[data.FieldType]string{
+	data.FieldTypeString:  "string",
+	data.FieldTypeFloat64: "float64",
+	data.FieldTypeInt64:   "int64",
+	data.FieldTypeBool:    "bool",
+	data.FieldTypeTime:    "time",
+}
+
+// schemaFrame returns frame without its rows, describing its fields in the custom meta.
+func schemaFrame(frame *data.Frame) *data.Frame {
+	schema := make([]fieldSchema, 0, len(frame.Fields))
+	for _, field := range frame.Fields {
+		fieldType := field.Type()
+		name, ok := fieldTypeNames[fieldType.NonNullableType()]
+		if !ok {
+			name = fieldType.NonNullableType().ItemTypeString()
+		}
+		schema = append(schema, fieldSchema{Name: field.Name, Type: name, Nullable: fieldType.Nullable()})
+	}
+	empty := frame.EmptyCopy()
+	empty.Meta = frame.Meta
+	customMeta(empty).Schema = schema
+	return empty
+}
+
+// customMeta returns the custom meta of frame, adding an empty one if it has none.
+func customMeta(frame *data.Frame) *frameCustomMeta {
+	if frame.Meta == nil {
+		frame.Meta = &data.FrameMeta{}
+	}
+	custom, ok := frame.Meta.Custom.(*frameCustomMeta)
+	if !ok {
+		custom = &frameCustomMeta{}
+		frame.Meta.Custom = custom
+	}
+	return custom
+}
+
+// setStatementMeta attaches the execution metadata of a statement to frame: in full as
+// the custom meta, and its duration and row counts as query stats, which Grafana shows
+// in the panel inspector.
+func setStatementMeta(frame *data.Frame, meta models.D1Meta) {
+	customMeta(frame).D1Meta = &meta
+	frame.Meta.Stats = []data.QueryStat{
+		{FieldConfig: data.FieldConfig{DisplayName: "Duration", Unit: "ms"}, Value: meta.Duration},
+		{FieldConfig: data.FieldConfig{DisplayName: "Rows changed"}, Value: float64(meta.Changes)},
+		{FieldConfig: data.FieldConfig{DisplayName: "Rows read"}, Value: float64(meta.RowsRead)},
+		{FieldConfig: data.FieldConfig{DisplayName: "Rows written"}, Value: float64(meta.RowsWritten)},
+	}
+}
+
+// lastRowIDFrameName names the frame returnLastRowId adds after a write.
+const lastRowIDFrameName = "last_row_id"
+
+// lastRowIDFrame returns a one-row frame holding the row ID of the last INSERT among
+// results, for queries that need the ID of a row they just created. It returns false
+// when no write reported a row ID.
+func lastRowIDFrame(results []models.D1RawResultItem) (*data.Frame, bool) {
+	for i := len(results) - 1; i >= 0; i-- {
+		if meta := results[i].Meta; isWrite(meta) && meta.LastRowID > 0 {
+			return data.NewFrame(lastRowIDFrameName,
+				data.NewField(lastRowIDFrameName, nil, []int64{int64(meta.LastRowID)}),
+			), true
+		}
+	}
+	return nil, false
+}
+
+// rateLimitNotice logs the Cloudflare rate-limit headers of a response and returns a warning
+// when the remaining request count is below the configured threshold.
+func (d *Datasource) rateLimitNotice(header http.Header) (data.Notice, bool) {
+	remainingHeader := header.Get("X-RateLimit-Remaining")
+	if remainingHeader == "" {
+		remainingHeader = header.Get("RateLimit-Remaining")
+	}
+	limitHeader := header.Get("X-RateLimit-Limit")
+	if limitHeader == "" {
+		limitHeader = header.Get("RateLimit-Limit")
+	}
+	if remainingHeader == "" {
+		return data.Notice{}, false
+	}
+	d.logger.Debug("Cloudflare API rate limit", "remaining", remainingHeader, "limit", limitHeader)
+
+	remaining, err := strconv.Atoi(remainingHeader)
+	threshold := d.settings.RateLimitWarningThreshold
+	if err != nil || threshold <= 0 || remaining >= threshold {
+		return data.Notice{}, false
+	}
+	text := fmt.Sprintf("Cloudflare API rate limit nearly reached: %d requests remaining", remaining)
+	if limitHeader != "" {
+		text += " of " + limitHeader
+	}
+	return data.Notice{Severity: data.NoticeSeverityWarning, Text: text + "."}, true
+}
+
+// maxBodySnippetBytes caps the part of an undecodable response body shown in a notice.
+const maxBodySnippetBytes = 512
+
+// bodySnippet returns the start of body, cut at maxBodySnippetBytes without splitting a
+// UTF-8 character.
+func bodySnippet(body []byte) string {
+	if len(body) <= maxBodySnippetBytes {
+		return string(body)
+	}
+	cut := maxBodySnippetBytes
+	for cut > 0 && !utf8.RuneStart(body[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s… (%d more bytes)", body[:cut], len(body)-cut)
+}
+
+// formatD1Errors joins the error objects of a D1 API response into a single message.
+func formatD1Errors(errs []models.D1Error) string {
+	messages := make([]string, 0, len(errs))
+	for _, d1Err := range errs {
+		messages = append(messages, fmt.Sprintf("Code %d: %s", d1Err.Code, d1Err.Message))
+	}
+	return strings.Join(messages, "; ")
+}
+
+// d1APIError is a query error reported by the D1 API. It keeps the API's error objects
+// so errorsAsData can return their codes.
+type d1APIError struct {
+	errors []models.D1Error
+	err    error
+}
+
+func (e *d1APIError) Error() string { return e.err.Error() }
+
+func (e *d1APIError) Unwrap() error { return e.err }
+
+// errorsFrame returns a frame with a row for each D1 error behind err, or a single row
+// with a null code for errors that didn't come from the D1 API. It's returned instead of
+// the failing response for queries with errorsAsData set.
+func errorsFrame(refID string, err error) *data.Frame {
+	codes := []*int64{nil}
+	messages := []string{err.Error()}
+	var apiErr *d1APIError
+	if errors.As(err, &apiErr) && len(apiErr.errors) > 0 {
+		codes, messages = codes[:0], messages[:0]
+		for _, d1Err := range apiErr.errors {
+			code := int64(d1Err.Code)
+			codes = append(codes, &code)
+			messages = append(messages, d1Err.Message)
+		}
+	}
+	frame := data.NewFrame(refID,
+		data.NewField("code", nil, codes),
+		data.NewField("message", nil, messages),
+	)
+	frame.AppendNotices(data.Notice{
+		Severity: data.NoticeSeverityError,
+		Text:     "The query failed; its errors are returned as data.",
+	})
+	return frame
+}
+
+// verifyToken checks the API token with Cloudflare's token verification endpoint. It
+// returns true for an active token and an error for a token Cloudflare rejects or reports
+// as disabled or expired. When there is no API token or the endpoint can't be reached,
+// it returns false without error and the health check query decides on its own.
+func (d *Datasource) verifyToken(ctx context.Context) (bool, error) {
+	if d.settings.Secrets.APIToken == "" {
+		return false, nil
+	}
+	var verification models.TokenVerification
+	if _, err := d.apiGet(ctx, "/user/tokens/verify", nil, &verification); err != nil {
+		var apiErr *cloudflareAPIError
+		if errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusBadRequest || apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden) {
+			return false, fmt.Errorf("API token is invalid: %w", err)
+		}
+		d.logger.Debug("Could not verify API token, falling back to the health check query", "error", err)
+		return false, nil
+	}
+	if verification.Status != "active" {
+		return false, fmt.Errorf("API token is %s", verification.Status)
+	}
+	return true, nil
+}
+
+// healthDetails describes the database the health check reached: its name, account and
+// the location that served the query. Lookups that fail (for example because the token
+// lacks account read access) are left out, since the query itself already succeeded.
+func (d *Datasource) healthDetails(ctx context.Context, resp models.D1RawAPIResponse) string {
+	var details string
+	var database models.D1Database
+	if _, err := d.apiGet(ctx, d.accountPath("/d1/database/"+url.PathEscape(d.settings.DatabaseID)), nil, &database); err != nil {
+		d.logger.Debug("Could not look up D1 database for health check", "error", err)
+	} else if database.Name != "" {
+		details = fmt.Sprintf("database %q", database.Name)
+	}
+
+	var extras []string
+	var account models.CloudflareAccount
+	if _, err := d.apiGet(ctx, d.accountPath(""), nil, &account); err != nil {
+		d.logger.Debug("Could not look up Cloudflare account for health check", "error", err)
+	} else if account.Name != "" {
+		extras = append(extras, fmt.Sprintf("account %q", account.Name))
+	}
+	if len(resp.Result) > 0 {
+		meta := resp.Result[0].Meta
+		if servedBy := meta.ServedByRegion; servedBy != "" {
+			extras = append(extras, "served by "+servedBy)
+		} else if meta.ServedBy != "" {
+			extras = append(extras, "served by "+meta.ServedBy)
+		}
+	}
+
+	if len(extras) > 0 {
+		if details != "" {
+			details += " "
+		}
+		details += "(" + strings.Join(extras, ", ") + ")"
+	}
+	return details
+}
+
+// joinErrors joins the messages of errs with "; ".
+func joinErrors(errs []error) string {
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
 }
 
 // Dispose here tells plugin SDK that plugin wants to clean up resources when a new instance
@@ -52,6 +447,11 @@ type Datasource struct{
 // be disposed and a new one will be created using NewSampleDatasource factory function.
 func (d *Datasource) Dispose() {
 	// Clean up datasource instance resources.
+	if d.cache != nil {
+		d.cache.clear()
+	}
+	d.usage.reset()
+	d.transport.CloseIdleConnections()
 }
 
 // QueryData handles multiple queries and returns multiple responses.
@@ -62,32 +462,254 @@ func (d *Datasource) QueryData(ctx context.Context, req *backend.QueryDataReques
 	// create response struct
 	response := backend.NewQueryDataResponse()
 
-	// loop over queries and execute them individually.
+	concurrency := models.DefaultQueryConcurrency
+	if d.settings != nil && d.settings.QueryConcurrency > 0 {
+		concurrency = d.settings.QueryConcurrency
+	}
+
+	// The overall deadline bounds the work of the whole request, however many queries it
+	// has. Queries still running or waiting when it passes fail with a timeout error;
+	// responses that completed in time are kept.
+	var totalTimeout time.Duration
+	if d.settings != nil && d.settings.TotalTimeoutSeconds > 0 {
+		totalTimeout = time.Duration(d.settings.TotalTimeoutSeconds) * time.Second
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, totalTimeout, errPluginTimeout)
+		defer cancel()
+	}
+	totalTimeoutResponse := func() backend.DataResponse {
+		return backend.DataResponse{
+			Error:       backend.DownstreamErrorf("request exceeded the overall timeout of %s", totalTimeout),
+			ErrorSource: backend.ErrorSourceDownstream,
+		}
+	}
+
+	// Execute the queries in parallel, bounded so a large dashboard doesn't hit Cloudflare
+	// rate limits. Each query reports its own error, so one failure never aborts the others.
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		sem = make(chan struct{}, concurrency)
+	)
 	for _, q := range req.Queries {
-		res := d.query(ctx, req.PluginContext, q)
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			// Queries that never got to run only report the timeout.
+			mu.Lock()
+			response.Responses[q.RefID] = totalTimeoutResponse()
+			mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func(q backend.DataQuery) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			res := d.query(ctx, req.PluginContext, q)
+			if res.Error != nil && totalTimeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				res = totalTimeoutResponse()
+			}
 
-		// save the response in a hashmap
-		// based on with RefID as identifier
-		response.Responses[q.RefID] = res
+			// save the response in a hashmap
+			// based on with RefID as identifier
+			mu.Lock()
+			response.Responses[q.RefID] = res
+			mu.Unlock()
+		}(q)
 	}
+	wg.Wait()
 
 	return response, nil
 }
 
-// This queryModel is a simple placeholder from the original scaffold, we might not need it
-// if query.JSON directly contains what we need (e.g. queryText, etc.)
-// For now, we use a local qm struct inside the query method.
-// type queryModel struct{}
+// queryModel is the per-query configuration sent by the query editor in query.JSON.
+type queryModel struct {
+	QueryText string `json:"queryText"`
+	// JSONColumns lists columns holding JSON documents that are normalized to compact JSON.
+	JSONColumns []string `json:"jsonColumns,omitempty"`
+	// BoolColumns lists 0/1 or true/false columns that are returned as boolean fields.
+	BoolColumns []string `json:"boolColumns,omitempty"`
+	// NumericStringColumns lists columns of numbers stored as text with the datasource's
+	// decimal separator, e.g. 1.234,56, that are returned as float64 fields.
+	NumericStringColumns []string `json:"numericStringColumns,omitempty"`
+	// ColumnTypes declares the field type of columns by name, bypassing inference: one of
+	// string, float64, int64, bool or time.
+	ColumnTypes map[string]string `json:"columnTypes,omitempty"`
+	// FieldConfig attaches display metadata to result columns, keyed by column name.
+	FieldConfig map[string]columnConfig `json:"fieldConfig,omitempty"`
+	// Limit and Offset are the values substituted for the $__limit and $__offset macros.
+	Limit  json.RawMessage `json:"limit,omitempty"`
+	Offset json.RawMessage `json:"offset,omitempty"`
+	// ValidateOnly checks the SQL with EXPLAIN instead of running it.
+	ValidateOnly bool `json:"validateOnly,omitempty"`
+	// Params are bound to the ? placeholders of the SQL, in order.
+	Params []interface{} `json:"params,omitempty"`
+	// Format is "table" (the default), "time_series", which alert rules need, or "long".
+	Format string `json:"format,omitempty"`
+	// TimeColumn names the time column of the time_series and long formats, which otherwise
+	// use the first time field.
+	TimeColumn string `json:"timeColumn,omitempty"`
+	// SessionBookmark is forwarded to D1 so the query reads at least the state the bookmark
+	// names, e.g. one returned in the meta of an earlier query.
+	SessionBookmark string `json:"sessionBookmark,omitempty"`
+	// Endpoint is the D1 endpoint the query is sent to: "raw" (the default) or "query".
+	Endpoint string `json:"endpoint,omitempty"`
+	// UseSchemaTypes types columns by their declared SQLite types instead of their values.
+	UseSchemaTypes bool `json:"useSchemaTypes,omitempty"`
+	// SuppressTimeRangeNotice hides the notice on queries that don't use the time range.
+	SuppressTimeRangeNotice bool `json:"suppressTimeRangeNotice,omitempty"`
+	// TimeoutSeconds overrides the datasource's query timeout, up to its configured maximum.
+	TimeoutSeconds float64 `json:"timeoutSeconds,omitempty"`
+	// NoTimeParseColumns lists string columns kept as strings even if they look like timestamps.
+	NoTimeParseColumns []string `json:"noTimeParseColumns,omitempty"`
+	// ReturnLastRowID adds a last_row_id frame with the row ID of the last INSERT.
+	ReturnLastRowID bool `json:"returnLastRowId,omitempty"`
+	// PartitionBy splits the result into one frame per distinct value of this column.
+	PartitionBy string `json:"partitionBy,omitempty"`
+	// LatColumn and LonColumn name the coordinate columns shown by the geomap panel.
+	LatColumn string `json:"latColumn,omitempty"`
+	LonColumn string `json:"lonColumn,omitempty"`
+	// CountOnEmpty counts the rows of the queried table when the result is empty, telling
+	// an empty table apart from filters that excluded every row.
+	CountOnEmpty bool `json:"countOnEmpty,omitempty"`
+	// NoCache bypasses the result cache and replaces the cached result of the query.
+	NoCache bool `json:"noCache,omitempty"`
+	// Transpose returns a single-row result as column and value pairs.
+	Transpose bool `json:"transpose,omitempty"`
+	// SchemaOnly runs the query for a single row and returns its fields without rows,
+	// with their inferred types in the custom meta.
+	SchemaOnly bool `json:"schemaOnly,omitempty"`
+	// RawStrings returns every column as a string field holding the values as D1 sent
+	// them, bypassing type inference and every typing option.
+	RawStrings bool `json:"rawStrings,omitempty"`
+	// DatabaseIDs runs the query against each of these databases instead of the
+	// configured one and merges their rows, adding a __database column.
+	DatabaseIDs []string `json:"databaseIds,omitempty"`
+	// ColumnLabels parses column names like value{host="a"} into a field called value
+	// with the labels inside the braces.
+	ColumnLabels bool `json:"columnLabels,omitempty"`
+	// ErrorsAsData returns a failing query's errors as a frame with code and message
+	// fields instead of as the response error, for panels that show them as a table.
+	ErrorsAsData bool `json:"errorsAsData,omitempty"`
+	// Downsample reduces time_series frames with more rows than the panel's max data
+	// points to that many points, keeping the shape of the series.
+	Downsample bool `json:"downsample,omitempty"`
+}
+
+// queryTimeout returns how long qm may run: its own timeout if set, otherwise the
+// datasource default, clamped to the configured maximum.
+func (d *Datasource) queryTimeout(qm queryModel) time.Duration {
+	timeout := time.Duration(d.settings.QueryTimeoutSeconds) * time.Second
+	if qm.TimeoutSeconds > 0 {
+		timeout = time.Duration(qm.TimeoutSeconds * float64(time.Second))
+	}
+	if maxTimeout := time.Duration(d.settings.MaxQueryTimeoutSeconds) * time.Second; timeout > maxTimeout {
+		timeout = maxTimeout
+	}
+	return timeout
+}
+
+// checkSQLLength returns an error if sql is longer than the configured maximum.
+func (d *Datasource) checkSQLLength(sql string) error {
+	if maxLen := d.settings.MaxSQLLength; maxLen > 0 {
+		if length := utf8.RuneCountInString(sql); length > maxLen {
+			return fmt.Errorf("query is %d characters long, which exceeds the configured maximum of %d", length, maxLen)
+		}
+	}
+	return nil
+}
+
+// checkAllowedQuery returns an error if allowed query patterns are configured and sql
+// matches none of them.
+func (d *Datasource) checkAllowedQuery(sql string) error {
+	if len(d.settings.AllowedQueries) == 0 {
+		return nil
+	}
+	for _, re := range d.settings.AllowedQueries {
+		if re.MatchString(sql) {
+			return nil
+		}
+	}
+	return errors.New("query does not match any of the datasource's allowed query patterns")
+}
+
+// applyMandatoryFilter adds the configured mandatory filter to sql, if there is one.
+func (d *Datasource) applyMandatoryFilter(sql string) (string, error) {
+	if d.settings.MandatoryFilter == "" {
+		return sql, nil
+	}
+	return addFilter(sql, d.settings.MandatoryFilter)
+}
+
+// columnConfig is the display metadata that can be attached to a result column.
+type columnConfig struct {
+	Unit        string `json:"unit,omitempty"`
+	DisplayName string `json:"displayName,omitempty"`
+}
 
-func (d *Datasource) query(_ context.Context, pCtx backend.PluginContext, query backend.DataQuery) backend.DataResponse {
-	log.DefaultLogger.Info("Cloudflare D1 Plugin: query function invoked", "RefID", query.RefID, "PluginVersion", "1.0.1-dev-macro-test") // Test log
-	dataResponse := backend.DataResponse{}
+// deduplicateColumnNames returns names with each repeated name suffixed by _1, _2, ...
+// in order of appearance, skipping suffixes taken by other columns, and describes each
+// renaming as "old to new". names itself is not modified.
+func deduplicateColumnNames(names []string) ([]string, []string) {
+	taken := make(map[string]bool, len(names))
+	for _, name := range names {
+		taken[name] = true
+	}
+	seen := make(map[string]bool, len(names))
+	unique := make([]string, len(names))
+	var renamed []string
+	for i, name := range names {
+		unique[i] = name
+		if seen[name] {
+			for n := 1; ; n++ {
+				candidate := fmt.Sprintf("%s_%d", name, n)
+				if !taken[candidate] {
+					unique[i] = candidate
+					taken[candidate] = true
+					renamed = append(renamed, name+" to "+candidate)
+					break
+				}
+			}
+		}
+		seen[name] = true
+	}
+	return unique, renamed
+}
 
-	var qm struct {
-		QueryText string `json:"queryText"`
-		// We might need other fields from the query model in the future,
-		// for example, to pass to sqlutil.Interpolate if needed for other macros.
+// containsColumn reports whether name is listed in columns.
+func containsColumn(columns []string, name string) bool {
+	for _, c := range columns {
+		if c == name {
+			return true
+		}
 	}
+	return false
+}
+
+func (d *Datasource) query(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery) (dataResponse backend.DataResponse) {
+	// Log the outcome of every query with the same keys so operators can build log dashboards.
+	start := time.Now()
+	statusCode := 0 // Stays 0 when no request was made to D1
+	cached := false
+	var qm queryModel
+	// Registered first so it runs last: the failure is still logged and classified.
+	defer func() {
+		if qm.ErrorsAsData && dataResponse.Error != nil {
+			dataResponse = backend.DataResponse{Frames: data.Frames{errorsFrame(query.RefID, dataResponse.Error)}}
+		}
+	}()
+	defer func() {
+		// Classify errors so Grafana doesn't count upstream failures and invalid user input
+		// against the plugin's error budget: errors wrapped with backend.DownstreamError
+		// come from the network, the D1 API or the query itself; anything else is a plugin error.
+		if dataResponse.Error != nil && dataResponse.ErrorSource == "" {
+			dataResponse.ErrorSource = backend.ErrorSourcePlugin
+			if backend.IsDownstreamError(dataResponse.Error) {
+				dataResponse.ErrorSource = backend.ErrorSourceDownstream
+			}
+		}
+		d.logQueryOutcome(query.RefID, statusCode, time.Since(start), cached, dataResponse)
+	}()
 
 	if err := json.Unmarshal(query.JSON, &qm); err != nil {
 		dataResponse.Error = fmt.Errorf("json unmarshal query: %w", err)
@@ -95,118 +717,674 @@ func (d *Datasource) query(_ context.Context, pCtx backend.PluginContext, query
 	}
 
 	if qm.QueryText == "" {
-		dataResponse.Error = fmt.Errorf("empty query text")
+		dataResponse.Error = backend.DownstreamErrorf("empty query text")
 		return dataResponse
 	}
 
-	// Create a sqlutil.Query object for macro interpolation
-	sqlQuery := sqlutil.Query{
-		RawSQL:    qm.QueryText,
-		TimeRange: query.TimeRange,
-		Interval:  query.Interval,
+	if qm.PartitionBy != "" && (qm.Format == formatTimeSeries || qm.Format == formatLong) {
+		dataResponse.Error = backend.DownstreamErrorf("partitionBy can't be combined with the %s format, which already splits series by their string columns", qm.Format)
+		return dataResponse
 	}
 
-	// Interpolate Grafana macros
-	interpolatedQuery, err := sqlutil.Interpolate(&sqlQuery, sqlutil.DefaultMacros)
-	if err != nil {
-		dataResponse.Error = fmt.Errorf("error interpolating query: %w", err)
+	if qm.Transpose && (qm.PartitionBy != "" || qm.Format == formatTimeSeries || qm.Format == formatLong) {
+		dataResponse.Error = backend.DownstreamErrorf("transpose can't be combined with partitionBy or the time_series and long formats")
 		return dataResponse
 	}
 
-	log.DefaultLogger.Debug("Executing D1 query", "InterpolatedQueryText", interpolatedQuery, "AccountID", d.settings.AccountID)
+	if qm.TimeColumn != "" && qm.Format != formatTimeSeries && qm.Format != formatLong {
+		dataResponse.Error = backend.DownstreamErrorf("timeColumn requires the time_series or long format")
+		return dataResponse
+	}
 
-	apiURL := fmt.Sprintf("https://api.cloudflare.com/client/v4/accounts/%s/d1/database/%s/raw",
-		d.settings.AccountID, d.settings.DatabaseID)
+	if err := checkColumnTypes(qm.ColumnTypes); err != nil {
+		dataResponse.Error = backend.DownstreamError(err)
+		return dataResponse
+	}
 
-	queryPayload := models.D1QueryRequest{SQL: interpolatedQuery}
-	jsonBody, err := json.Marshal(queryPayload)
-	if err != nil {
-		dataResponse.Error = fmt.Errorf("error marshalling D1 query payload: %w", err)
+	if (qm.LatColumn == "") != (qm.LonColumn == "") {
+		dataResponse.Error = backend.DownstreamErrorf("latColumn and lonColumn must be set together")
 		return dataResponse
 	}
 
-	httpClient := &http.Client{Timeout: 10 * time.Second}
-	httpReq, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(jsonBody))
-	if err != nil {
-		dataResponse.Error = fmt.Errorf("error creating HTTP request for D1: %w", err)
+	if qm.Endpoint == "" {
+		qm.Endpoint = defaultEndpoint(d.settings)
+	}
+	if err := checkEndpoint(qm.Endpoint); err != nil {
+		dataResponse.Error = backend.DownstreamError(err)
 		return dataResponse
 	}
 
-	httpReq.Header.Set("Authorization", "Bearer "+d.settings.Secrets.APIToken)
-	httpReq.Header.Set("Content-Type", "application/json")
+	if err := checkDatabaseIDs(qm); err != nil {
+		dataResponse.Error = backend.DownstreamError(err)
+		return dataResponse
+	}
 
-	httpResp, err := httpClient.Do(httpReq)
+	// Interpolate Grafana macros
+	interpolatedQuery, err := d.interpolateQuery(&qm, query)
 	if err != nil {
-		dataResponse.Error = fmt.Errorf("error executing D1 API request: %w", err)
+		dataResponse.Error = backend.DownstreamErrorf("error interpolating query: %w", err)
+		return dataResponse
+	}
+
+	// Fail with a clear message rather than letting the API reject an oversized statement opaquely.
+	if err := d.checkSQLLength(interpolatedQuery); err != nil {
+		dataResponse.Error = backend.DownstreamError(err)
 		return dataResponse
 	}
-	defer httpResp.Body.Close()
 
-	bodyBytes, err := io.ReadAll(httpResp.Body)
+	// Bound parameters keep variable values out of the SQL text; catch a mismatch before
+	// D1 rejects the statement.
+	placeholders, err := countPlaceholders(interpolatedQuery)
 	if err != nil {
-		dataResponse.Error = fmt.Errorf("error reading D1 API response body: %w", err)
+		dataResponse.Error = backend.DownstreamError(err)
+		return dataResponse
+	}
+	if placeholders != len(qm.Params) {
+		dataResponse.Error = backend.DownstreamErrorf("query has %d placeholders but %d params were provided", placeholders, len(qm.Params))
 		return dataResponse
 	}
 
-	if httpResp.StatusCode != http.StatusOK {
-		log.DefaultLogger.Error("D1 API request failed", "status", httpResp.Status, "body", string(bodyBytes))
-		dataResponse.Error = fmt.Errorf("D1 API request failed with status %s. Response: %s", httpResp.Status, string(bodyBytes))
+	if d.settings.ReadOnly {
+		if err := checkReadOnly(interpolatedQuery); err != nil {
+			dataResponse.Error = backend.DownstreamError(err)
+			return dataResponse
+		}
+	}
+
+	// Writes aren't fanned out: a failure halfway would leave the databases diverged.
+	if len(qm.DatabaseIDs) > 0 {
+		if err := checkReadOnly(interpolatedQuery); err != nil {
+			dataResponse.Error = backend.DownstreamErrorf("databaseIds: %w", err)
+			return dataResponse
+		}
+	}
+
+	if err := d.checkAllowedQuery(interpolatedQuery); err != nil {
+		dataResponse.Error = backend.DownstreamError(err)
 		return dataResponse
 	}
 
-	var d1Response models.D1RawAPIResponse
-	if err := json.Unmarshal(bodyBytes, &d1Response); err != nil {
-		log.DefaultLogger.Error("Error unmarshalling D1 raw response", "error", err, "body", string(bodyBytes))
-		dataResponse.Error = fmt.Errorf("error unmarshalling D1 API raw response: %w. Body: %s", err, string(bodyBytes))
+	if interpolatedQuery, err = d.applyMandatoryFilter(interpolatedQuery); err != nil {
+		dataResponse.Error = backend.DownstreamError(err)
 		return dataResponse
 	}
 
-	if !d1Response.Success {
-		var errorMessages string
-		for _, d1Err := range d1Response.Errors {
-			errorMessages += fmt.Sprintf("Code %d: %s ", d1Err.Code, d1Err.Message)
+	// Each query gets its own deadline: its timeoutSeconds option or the datasource default,
+	// never more than the configured maximum.
+	timeout := d.queryTimeout(qm)
+	ctx, cancel := context.WithTimeoutCause(ctx, timeout, errPluginTimeout)
+	defer cancel()
+	defer func() {
+		if dataResponse.Error != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			dataResponse.Error = backend.DownstreamErrorf("query timed out after %s", timeout)
 		}
-		log.DefaultLogger.Error("D1 API call reported not successful", "errors", errorMessages)
-		dataResponse.Error = fmt.Errorf("D1 API error: %s", errorMessages)
+	}()
+
+	if qm.ValidateOnly {
+		dataResponse, statusCode = d.validateQuery(ctx, query.RefID, interpolatedQuery)
 		return dataResponse
 	}
 
-	// Start DataFrame conversion
-	// Create a new DataFrame. The RefID from the query is used to link this Frame back to the specific query panel in Grafana.
-	frame := data.NewFrame(query.RefID)
+	// One row is enough to infer the field types.
+	if qm.SchemaOnly {
+		if interpolatedQuery, err = limitToOneRow(interpolatedQuery); err != nil {
+			dataResponse.Error = backend.DownstreamErrorf("schemaOnly: %w", err)
+			return dataResponse
+		}
+	}
+
+	// Serve repeated identical queries from the cache when it is enabled. A noCache query
+	// drops the cached result instead, and caches its own fresh one if it succeeds.
+	var cacheKey string
+	if d.cache != nil {
+		cacheKey = queryCacheKey(d.settings.DatabaseID, interpolatedQuery, query.TimeRange, qm, downsampleTarget(qm, query))
+		if qm.NoCache {
+			d.cache.delete(cacheKey)
+		} else if frames, ok := d.cache.get(cacheKey); ok {
+			d.logger.Debug("Serving D1 query from cache", "RefID", query.RefID)
+			cached = true
+			dataResponse.Frames = renameFrames(frames, query.RefID)
+			return dataResponse
+		}
+	}
+
+	dataResponse, statusCode = d.executeQuery(ctx, query, qm, interpolatedQuery)
+	if qm.SchemaOnly && dataResponse.Error == nil {
+		for i, frame := range dataResponse.Frames {
+			dataResponse.Frames[i] = schemaFrame(frame)
+		}
+	}
+	// Explain why changing the dashboard time range doesn't change the results.
+	if dataResponse.Error == nil && len(dataResponse.Frames) > 0 && !qm.SuppressTimeRangeNotice &&
+		!query.TimeRange.From.IsZero() && !usesTimeMacro(qm.QueryText) {
+		dataResponse.Frames[0].AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityInfo,
+			Text:     "This query ignores the dashboard time range. Use $__timeFilter(column) to restrict results to it.",
+		})
+	}
+	if d.cache != nil && dataResponse.Error == nil {
+		d.cache.set(cacheKey, dataResponse.Frames)
+	}
+	return dataResponse
+}
 
-	// Check if the D1 response contains any result sets or any actual results in the first result item.
-	if len(d1Response.Result) == 0 || d1Response.Result[0].Results == nil || len(d1Response.Result[0].Results.Rows) == 0 {
+// downsampleTarget returns the number of points the frames of qm are downsampled to, or
+// 0 if they are returned as they are.
+func downsampleTarget(qm queryModel, query backend.DataQuery) int64 {
+	if !qm.Downsample || qm.Format != formatTimeSeries {
+		return 0
+	}
+	return query.MaxDataPoints
+}
+
+// interpolateQuery expands the macros of the query's SQL for its time range, interval
+// and max data points. Macros binding values, such as $__in, append them to qm.Params.
+func (d *Datasource) interpolateQuery(qm *queryModel, query backend.DataQuery) (string, error) {
+	rawSQL := qm.QueryText
+	// $__in binds its values as ?NNN after the query's own params. A bare ? following it
+	// would be numbered after those, so the query's placeholders are numbered first.
+	if strings.Contains(rawSQL, "$__in") {
+		rawSQL = numberPlaceholders(rawSQL)
+	}
+	sqlQuery := sqlutil.Query{
+		RawSQL:        rawSQL,
+		TimeRange:     query.TimeRange,
+		Interval:      query.Interval,
+		MaxDataPoints: query.MaxDataPoints,
+	}
+	return sqlutil.Interpolate(&sqlQuery, queryMacros(qm, d.settings))
+}
+
+// validateQuery checks that every statement of the interpolated SQL compiles by running
+// it under EXPLAIN, which prepares the statement without executing it. No data rows are
+// returned; a notice reports success and syntax errors are returned as the query error.
+func (d *Datasource) validateQuery(ctx context.Context, refID string, interpolatedQuery string) (dataResponse backend.DataResponse, statusCode int) {
+	statements := splitStatements(interpolatedQuery)
+	explained := make([]string, len(statements))
+	for i, stmt := range statements {
+		explained[i] = "EXPLAIN " + stmt.text
+	}
+
+	apiResp, err := d.sendLookup(ctx, models.D1QueryRequest{SQL: strings.Join(explained, ";\n")})
+	if err != nil {
+		dataResponse.Error = err
+		return dataResponse, statusCode
+	}
+	statusCode = apiResp.StatusCode
+
+	var d1Response models.D1RawAPIResponse
+	decodeErr := json.Unmarshal(apiResp.Body, &d1Response)
+	if apiResp.StatusCode != http.StatusOK || decodeErr != nil || !d1Response.Success {
+		reason := formatD1Errors(d1Response.Errors)
+		if reason == "" {
+			reason = fmt.Sprintf("D1 API request failed with status %s. Response: %s", apiResp.Status, string(apiResp.Body))
+		}
+		dataResponse.Error = backend.DownstreamErrorf("query is invalid: %s (request ID %s)", reason, apiResp.RequestID)
+		return dataResponse, statusCode
+	}
+
+	frame := data.NewFrame(refID)
+	frame.AppendNotices(data.Notice{
+		Severity: data.NoticeSeverityInfo,
+		Text:     fmt.Sprintf("Query is valid (%d statements parsed successfully); it was not executed.", len(statements)),
+	})
+	dataResponse.Frames = append(dataResponse.Frames, frame)
+	return dataResponse, statusCode
+}
+
+// d1Result is a successful D1 response to a query, decoded into the /raw shape.
+type d1Result struct {
+	response    models.D1RawAPIResponse
+	requestID   string
+	header      http.Header
+	statusCode  int  // HTTP status of the response, or 0 if none was received
+	fromReplica bool // Whether the response came from the replica database
+}
+
+// sendFunc sends a query to D1, reporting whether the response came from the replica.
+type sendFunc func(ctx context.Context, endpoint string, payload models.D1QueryRequest) (*D1Response, bool, error)
+
+// fetchResult sends the interpolated SQL with send and decodes the response. A failed
+// request, an undecodable response or a failure reported by the API is returned as a
+// response with its Error set.
+func (d *Datasource) fetchResult(ctx context.Context, refID string, qm queryModel, interpolatedQuery string, send sendFunc) (fetched d1Result, dataResponse backend.DataResponse) {
+	queryPayload := models.D1QueryRequest{SQL: interpolatedQuery, Params: qm.Params, Bookmark: qm.SessionBookmark}
+	apiResp, usedReplica, err := send(ctx, qm.Endpoint, queryPayload)
+	if err != nil {
+		dataResponse.Error = err
+		return fetched, dataResponse
+	}
+	fetched.statusCode = apiResp.StatusCode
+	fetched.header = apiResp.Header
+	fetched.fromReplica = usedReplica
+
+	reqID := apiResp.RequestID
+	fetched.requestID = reqID
+
+	if apiResp.StatusCode != http.StatusOK {
+		d.logger.Error("D1 API request failed", "requestId", reqID, "status", apiResp.Status, "body", string(apiResp.Body))
+		err := backend.DownstreamErrorf("D1 API request failed with status %s (request ID %s). Response: %s", apiResp.Status, reqID, string(apiResp.Body))
+		// Failed requests usually still carry the API's error objects.
+		var failed models.D1RawAPIResponse
+		if json.Unmarshal(apiResp.Body, &failed) == nil && len(failed.Errors) > 0 {
+			err = &d1APIError{errors: failed.Errors, err: err}
+		}
+		dataResponse.Error = err
+		return fetched, dataResponse
+	}
+
+	// /query responses are converted to the /raw shape, so the rest of the conversion is shared.
+	d1Response, err := decodeD1Response(qm.Endpoint, apiResp.Body)
+	if err != nil {
+		d.logger.Error("Error unmarshalling D1 response", "requestId", reqID, "endpoint", qm.Endpoint, "error", err, "body", string(apiResp.Body))
+		dataResponse.Error = fmt.Errorf("error unmarshalling D1 API %s response (request ID %s): %w", qm.Endpoint, reqID, err)
+		// The full body is only logged; the notice shows its start for a quick diagnosis.
+		frame := data.NewFrame(refID)
+		frame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityError,
+			Text:     "Response body: " + bodySnippet(apiResp.Body),
+		})
+		dataResponse.Frames = append(dataResponse.Frames, frame)
+		return fetched, dataResponse
+	}
+
+	d.usage.record(d1Response.Result)
+
+	// A batch whose failure is reported per statement still returns the results of the
+	// statements that succeeded; the failed ones get a frame with an error notice.
+	batch := qm.Endpoint == endpointQuery && len(d1Response.Result) > 1
+	if !d1Response.Success && !(batch && anyStatementSucceeded(d1Response.Result)) {
+		errorMessages := formatD1Errors(d1Response.Errors)
+		d.logger.Error("D1 API call reported not successful", "requestId", reqID, "errors", errorMessages)
+		dataResponse.Error = &d1APIError{
+			errors: d1Response.Errors,
+			err:    backend.DownstreamErrorf("D1 API error: %s (request ID %s)", errorMessages, reqID),
+		}
+		return fetched, dataResponse
+	}
+	fetched.response = d1Response
+	return fetched, dataResponse
+}
+
+// executeQuery sends the interpolated SQL to the query's D1 endpoint (/raw or /query)
+// and converts the result into data frames. The HTTP status of the D1 response is
+// returned alongside, or 0 if no response was received.
+func (d *Datasource) executeQuery(ctx context.Context, query backend.DataQuery, qm queryModel, interpolatedQuery string) (dataResponse backend.DataResponse, statusCode int) {
+	d.logger.Debug("Executing D1 query", "InterpolatedQueryText", interpolatedQuery, "AccountID", d.settings.AccountID)
+
+	var fetched d1Result
+	if len(qm.DatabaseIDs) > 0 {
+		var notices []data.Notice
+		fetched, notices, dataResponse = d.fanOut(ctx, query.RefID, qm, interpolatedQuery)
+		defer func() {
+			if len(dataResponse.Frames) > 0 {
+				dataResponse.Frames[0].AppendNotices(notices...)
+			}
+		}()
+	} else {
+		fetched, dataResponse = d.fetchResult(ctx, query.RefID, qm, interpolatedQuery, d.withBreaker(d.sendWithFailover))
+	}
+	statusCode = fetched.statusCode
+	if dataResponse.Error != nil {
+		return dataResponse, statusCode
+	}
+	d1Response, reqID, usedReplica := fetched.response, fetched.requestID, fetched.fromReplica
+	batch := qm.Endpoint == endpointQuery && len(d1Response.Result) > 1
+
+	// A batch sent to /query yields one frame per statement, named after the RefID and the
+	// statement index. Otherwise the first statement's result becomes the query's frame.
+	var frames data.Frames
+	memoKey := queryCacheKey(d.settings.DatabaseID, interpolatedQuery, backend.TimeRange{}, qm, 0)
+	if batch {
+		for i := range d1Response.Result {
+			result := &d1Response.Result[i]
+			name := statementFrameName(query.RefID, i)
+			if !result.Success {
+				reason := result.Error
+				if reason == "" {
+					reason = formatD1Errors(d1Response.Errors)
+				}
+				d.logger.Warn("D1 batch statement failed", "requestId", reqID, "statement", i, "error", reason)
+				frames = append(frames, statementErrorFrame(name, i, reason))
+				continue
+			}
+			frame, err := d.buildResultFrame(memoKey, i, name, result, qm, func() map[string]columnKind { return nil })
+			if err != nil {
+				d.logger.Warn("D1 batch statement result could not be converted", "requestId", reqID, "statement", i, "error", err)
+				frames = append(frames, statementErrorFrame(name, i, err.Error()))
+				continue
+			}
+			setServedBy(frame, result.Meta)
+			setBookmark(frame, result.Meta)
+			frames = append(frames, frame)
+		}
+	} else {
+		var result *models.D1RawResultItem
+		if len(d1Response.Result) > 0 {
+			result = &d1Response.Result[0]
+		}
+		schema := func() map[string]columnKind {
+			if set := resultSet(result); qm.UseSchemaTypes && set != nil && len(set.Rows) > 0 {
+				return d.schemaKinds(ctx, interpolatedQuery)
+			}
+			return nil
+		}
+		frame, err := d.buildResultFrame(memoKey, 0, query.RefID, result, qm, schema)
+		if err != nil {
+			dataResponse.Error = err
+			return dataResponse, statusCode
+		}
+		// The count would only cover the configured database, not those of databaseIds.
+		if qm.CountOnEmpty && frame.Rows() == 0 && len(qm.DatabaseIDs) == 0 {
+			d.addMatchedCount(ctx, frame, interpolatedQuery)
+		}
+		frames = data.Frames{frame}
+		if qm.PartitionBy != "" {
+			if frames, err = partitionFrame(frame, qm.PartitionBy); err != nil {
+				dataResponse.Error = backend.DownstreamError(err)
+				return dataResponse, statusCode
+			}
+		}
+		// Set after building, as a reused frame may have been served by another instance.
+		if result != nil {
+			for _, frame := range frames {
+				setServedBy(frame, result.Meta)
+				setBookmark(frame, result.Meta)
+			}
+		}
+	}
+	if qm.ReturnLastRowID {
+		if frame, ok := lastRowIDFrame(d1Response.Result); ok {
+			frames = append(frames, frame)
+		}
+	}
+
+	if target := downsampleTarget(qm, query); target > 0 {
+		for i, frame := range frames {
+			frames[i] = downsampleFrame(frame, int(target))
+		}
+	}
+
+	if tables := referencedTables(interpolatedQuery); len(tables) > 0 {
+		for _, frame := range frames {
+			customMeta(frame).Tables = tables
+		}
+	}
+
+	if usedReplica {
+		frames[0].AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     "The primary database failed; results were read from the replica database.",
+		})
+	}
+	if d.settings.WarnOnUnboundedSelect && hasUnboundedSelect(interpolatedQuery) {
+		frames[0].AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     "The query has no LIMIT clause and may return more rows than needed. Consider adding one.",
+		})
+	}
+	if notice, ok := d.rateLimitNotice(fetched.header); ok {
+		frames[0].AppendNotices(notice)
+	}
+	dataResponse.Frames = frames
+	return dataResponse, statusCode
+}
+
+// anyStatementSucceeded reports whether at least one statement of a batch succeeded.
+func anyStatementSucceeded(results []models.D1RawResultItem) bool {
+	for _, result := range results {
+		if result.Success {
+			return true
+		}
+	}
+	return false
+}
+
+// buildResultFrame returns the frame of the statement at index of the query identified
+// by memoKey, reusing the frame built for the statement's previous result when the new
+// one has the same columns and rows. schema is only called when a frame is built.
+func (d *Datasource) buildResultFrame(memoKey string, index int, name string, result *models.D1RawResultItem, qm queryModel, schema func() map[string]columnKind) (*data.Frame, error) {
+	if d.frames == nil || !memoizable(result) {
+		return d.resultFrame(name, result, qm, schema())
+	}
+	key := memoKey + "/" + strconv.Itoa(index)
+	hash := hashResultSet(result.Results)
+	if frame, ok := d.frames.get(key, hash); ok {
+		d.logger.Debug("Reusing the frame of an identical D1 result", "frame", name)
+		frame.Name = name
+		return frame, nil
+	}
+	frame, err := d.resultFrame(name, result, qm, schema())
+	if err != nil {
+		return nil, err
+	}
+	d.frames.set(key, hash, frame)
+	return frame, nil
+}
+
+// resultSet returns the columns and rows of result, or nil if there are none. D1 has been
+// seen to answer with a null result list, null result items and null results, so any of
+// them may be missing.
+func resultSet(result *models.D1RawResultItem) *models.D1RawQueryActualResult {
+	if result == nil {
+		return nil
+	}
+	return result.Results
+}
+
+// statementErrorFrame is the frame of a failed batch statement: it has no fields and
+// carries the failure as an error notice, so the other statements' frames are kept.
+func statementErrorFrame(name string, index int, reason string) *data.Frame {
+	frame := data.NewFrame(name)
+	if reason == "" {
+		reason = "no error details were reported"
+	}
+	frame.AppendNotices(data.Notice{
+		Severity: data.NoticeSeverityError,
+		Text:     fmt.Sprintf("Statement %d failed: %s", index, reason),
+	})
+	return frame
+}
+
+// noDataNotice is the notice on results of a query that returned no rows.
+const noDataNotice = "Query returned no data."
+
+// addMatchedCount extends the no-data notice of frame with the row count of the table
+// sql reads from, e.g. "Query returned no data: 0 of 120 rows in events matched." The
+// notice is left as is when the table or its row count can't be determined.
+func (d *Datasource) addMatchedCount(ctx context.Context, frame *data.Frame, sql string) {
+	if frame.Meta == nil {
+		return
+	}
+	for i, notice := range frame.Meta.Notices {
+		if notice.Text != noDataNotice {
+			continue
+		}
+		if table, count, ok := d.tableRowCount(ctx, sql); ok {
+			frame.Meta.Notices[i].Text = fmt.Sprintf("Query returned no data: 0 of %d rows in %s matched.", count, table)
+		}
+		return
+	}
+}
+
+// sendWithFailover sends payload to the primary database and, when that fails with a
+// connection or server error, to the replica database if one is configured. Statements
+// that may write are never sent to the replica. It reports whether the returned response
+// came from the replica; when both databases fail, the primary's outcome is returned.
+func (d *Datasource) sendWithFailover(ctx context.Context, endpoint string, payload models.D1QueryRequest) (*D1Response, bool, error) {
+	resp, err := d.client.Send(ctx, endpoint, payload)
+	if d.replica == nil || !isFailoverError(ctx, resp, err) || checkReadOnly(payload.SQL) != nil {
+		return resp, false, err
+	}
+	d.logger.Warn("Primary D1 database failed, querying the replica", "primaryError", failureReason(resp, err))
+
+	replicaResp, replicaErr := d.replica.Send(ctx, endpoint, payload)
+	if isFailoverError(ctx, replicaResp, replicaErr) {
+		d.logger.Error("Replica D1 database failed too", "replicaError", failureReason(replicaResp, replicaErr))
+		return resp, false, err
+	}
+	return replicaResp, true, replicaErr
+}
+
+// withBreaker returns send guarded by the datasource's circuit breaker, if one is
+// configured: the outcome of every request counts towards it, and nothing is sent while
+// it is open.
+func (d *Datasource) withBreaker(send sendFunc) sendFunc {
+	if d.breaker == nil {
+		return send
+	}
+	return func(ctx context.Context, endpoint string, payload models.D1QueryRequest) (resp *D1Response, fromReplica bool, err error) {
+		if err := d.breaker.allow(); err != nil {
+			d.logger.Warn("Circuit breaker is open, not sending the query to D1", "error", err)
+			return nil, false, err
+		}
+		defer func() {
+			// A request cut off by the plugin's own deadline is a failure of the API: an
+			// outage often shows as requests hanging until they time out.
+			timedOut := err != nil && errors.Is(context.Cause(ctx), errPluginTimeout)
+			d.breaker.record(timedOut || isFailoverError(ctx, resp, err), ctx.Err() != nil && !timedOut)
+		}()
+		return send(ctx, endpoint, payload)
+	}
+}
+
+// sendLookup sends a request the plugin makes besides a query's own, such as a schema or
+// row count lookup, to the raw endpoint of the configured database the way queries are
+// sent: guarded by the circuit breaker, with its statements counted in the usage metrics.
+func (d *Datasource) sendLookup(ctx context.Context, payload models.D1QueryRequest) (*D1Response, error) {
+	send := d.withBreaker(func(ctx context.Context, endpoint string, payload models.D1QueryRequest) (*D1Response, bool, error) {
+		resp, err := d.client.Send(ctx, endpoint, payload)
+		return resp, false, err
+	})
+	resp, _, err := send(ctx, endpointRaw, payload)
+	if err == nil && resp.StatusCode == http.StatusOK {
+		if decoded, decodeErr := decodeD1Response(endpointRaw, resp.Body); decodeErr == nil {
+			d.usage.record(decoded.Result)
+		}
+	}
+	return resp, err
+}
+
+// errPluginTimeout is the cause of the deadlines the plugin sets itself, telling a request
+// that ran out of time apart from one whose caller gave up.
+var errPluginTimeout = errors.New("plugin timeout")
+
+// isFailoverError reports whether a D1 request made with ctx failed in a way another
+// database could avoid: no response arrived or the API answered with a server error.
+// SQL errors are not among them, since the replica would report them just the same.
+func isFailoverError(ctx context.Context, resp *D1Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return err != nil || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// failureReason describes a failed D1 request for the logs.
+func failureReason(resp *D1Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("status %s (request ID %s)", resp.Status, resp.RequestID)
+}
+
+// statementFrameName names the frame of one statement of a batch, e.g. A[0].
+func statementFrameName(refID string, index int) string {
+	return fmt.Sprintf("%s[%d]", refID, index)
+}
+
+// resultFrame converts the result of one statement into a data frame called name.
+// result is nil when D1 returned no result at all. Columns listed in schema get the
+// kind of their declared type instead of an inferred one.
+func (d *Datasource) resultFrame(name string, result *models.D1RawResultItem, qm queryModel, schema map[string]columnKind) (*data.Frame, error) {
+	// The name is derived from the query's RefID, which links the frame back to its panel query in Grafana.
+	frame := data.NewFrame(name)
+
+	// Confirm successful writes with the affected row count from the statement's metadata.
+	wroteRows := false
+	if result != nil && isWrite(result.Meta) {
+		wroteRows = true
+		frame.AppendNotices(writeNotice(result.Meta))
+	}
+
+	// Check if the D1 response contains a result set with any actual rows.
+	set := resultSet(result)
+	if set == nil || len(set.Rows) == 0 {
+		// Without rows, the statement's metadata is all there is to show.
+		if result != nil {
+			setStatementMeta(frame, result.Meta)
+		}
+		// A write without RETURNING rows is fully described by its write notice.
+		if wroteRows {
+			return frame, nil
+		}
 		// Also check if there are no columns, which can happen for DDL or empty results from `SELECT`s that genuinely return no rows.
-		if len(d1Response.Result) > 0 && d1Response.Result[0].Results != nil && len(d1Response.Result[0].Results.Columns) == 0 && len(d1Response.Result[0].Results.Rows) == 0 {
+		// Columns that are null rather than an empty list are a missing result set, not a DDL result.
+		if set != nil && set.Columns != nil && len(set.Columns) == 0 {
 			// This case could be a successful DDL query (like CREATE TABLE) which returns no columns/rows
 			// or a SELECT that returns no rows AND no columns (less common).
-			if d1Response.Result[0].Success {
+			if result.Success {
 				frame.AppendNotices(data.Notice{Severity: data.NoticeSeverityInfo, Text: "Query executed successfully, no data returned (e.g., DDL statement)."})
 			} else {
 				// If not successful, it might be an error that didn't get caught by d1Response.Success check earlier.
-				log.DefaultLogger.Debug("D1 query returned no results or an error in the result item", "QueryText", qm.QueryText)
+				d.logger.Debug("D1 query returned no results or an error in the result item", "QueryText", qm.QueryText)
 				frame.AppendNotices(data.Notice{Severity: data.NoticeSeverityWarning, Text: "Query returned no data or an error occurred in the result processing."})
 			}
 		} else {
-			log.DefaultLogger.Debug("D1 query returned no result rows", "QueryText", qm.QueryText)
-			frame.AppendNotices(data.Notice{Severity: data.NoticeSeverityInfo, Text: "Query returned no data."}) 
+			d.logger.Debug("D1 query returned no result rows", "QueryText", qm.QueryText)
+			frame.AppendNotices(data.Notice{Severity: data.NoticeSeverityInfo, Text: noDataNotice})
 		}
-		dataResponse.Frames = append(dataResponse.Frames, frame)
-		return dataResponse
+		return frame, nil
 	}
 
-	// Get the actual query results from the D1 /raw response.
-	// We assume a single SQL statement in the query, so we take the first result item.
-	d1RawActualResults := d1Response.Result[0].Results
-	colNames := d1RawActualResults.Columns
-	d1Rows := d1RawActualResults.Rows
+	colNames := set.Columns
+	d1Rows := set.Rows
+
+	// Enforce the row limit before any per-column slices are allocated so memory stays bounded.
+	if maxRows := d.settings.MaxRows; maxRows > 0 && len(d1Rows) > maxRows {
+		d.logger.Warn("D1 query result truncated", "frame", name, "rows", len(d1Rows), "maxRows", maxRows)
+		frame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("Results truncated to %d of %d rows. Add a LIMIT clause or raise the datasource's max rows setting.", maxRows, len(d1Rows)),
+		})
+		d1Rows = d1Rows[:maxRows]
+	}
 	rowCount := len(d1Rows)
 
+	// Very wide results (SELECT * on a wide table) are cut down to the leading columns so
+	// panels aren't overwhelmed; the retained columns keep their order.
+	if maxColumns := d.settings.MaxColumns; maxColumns > 0 && len(colNames) > maxColumns {
+		omitted := colNames[maxColumns:]
+		d.logger.Warn("D1 query columns truncated", "frame", name, "columns", len(colNames), "maxColumns", maxColumns)
+		frame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text: fmt.Sprintf("%d columns were omitted because the result exceeds the datasource's max columns setting of %d: %s. Select fewer columns instead of using SELECT *.",
+				len(omitted), maxColumns, strings.Join(omitted, ", ")),
+		})
+		colNames = colNames[:maxColumns]
+	}
+
+	// Grafana identifies fields by name, so repeated names, e.g. from SELECT a.id, b.id,
+	// break transformations and field overrides.
+	if d.settings.DeduplicateColumns {
+		var renamed []string
+		if colNames, renamed = deduplicateColumnNames(colNames); len(renamed) > 0 {
+			frame.AppendNotices(data.Notice{
+				Severity: data.NoticeSeverityInfo,
+				Text:     fmt.Sprintf("Duplicate column names were renamed: %s. Use column aliases to choose the names.", strings.Join(renamed, ", ")),
+			})
+		}
+	}
+
 	// If colNames is empty but we have rows, something is wrong (shouldn't happen with /raw)
 	if len(colNames) == 0 && rowCount > 0 {
-		dataResponse.Error = fmt.Errorf("D1 /raw response has rows but no column names")
-		return dataResponse
+		return nil, fmt.Errorf("D1 response has rows but no column names")
+	}
+
+	if qm.LatColumn != "" && !containsColumn(colNames, qm.LatColumn) {
+		return nil, backend.DownstreamErrorf("latColumn %q is not a column of the result", qm.LatColumn)
+	}
+	if qm.LonColumn != "" && !containsColumn(colNames, qm.LonColumn) {
+		return nil, backend.DownstreamErrorf("lonColumn %q is not a column of the result", qm.LonColumn)
 	}
 
 	// Determine column names and their order.
@@ -221,153 +1399,150 @@ func (d *Datasource) query(_ context.Context, pCtx backend.PluginContext, query
 
 	// Create data fields for the DataFrame.
 	// Each field corresponds to a column in the query result, using the order from d1RawActualResults.Columns.
+	var parsedTimeColumns []string // String columns inferred to hold timestamps
 	for colIdx, colName := range colNames {
-		// Infer the data type for the column based on the value in the first row for this column.
-		// This is a simplification; a more robust system might inspect multiple rows
-		// or allow user-defined type mappings, especially for types like timestamps.
-		var field *data.Field
-		var sampleValue interface{}
-		if rowCount > 0 && colIdx < len(d1Rows[0]) {
-			sampleValue = d1Rows[0][colIdx]
-		}
-
-		// Switch on the type of the sample value from the first row to create a typed Field vector.
-		switch v := sampleValue.(type) {
-		case float64: // JSON numbers are typically unmarshalled as float64 by encoding/json
-			log.DefaultLogger.Debug("Column type inference", "column", colName, "type", "float64")
-			colData := make([]*float64, rowCount)
-			for i, row := range d1Rows { // Populate the slice from all rows
-				if colIdx < len(row) {
-					if val := row[colIdx]; val != nil {
-						if fVal, fOk := val.(float64); fOk { // Type assert and assign if not nil
-							colData[i] = &fVal
-						}
-					}
-				}
-			}
-			field = data.NewField(colName, nil, colData)
-		case string:
-			log.DefaultLogger.Debug("Column type inference", "column", colName, "type", "string_from_json")
-			// Define the expected D1/SQLite timestamp format
-			// (YYYY-MM-DD HH:MM:SS commonly returned by SQLite CURRENT_TIMESTAMP)
-			const d1TimestampLayout = "2006-01-02 15:04:05" // Go's reference time format
-
-			// Attempt to parse string values as time.Time
-			// Try D1/SQLite common format first, then RFC3339Nano as a fallback.
-			parsedAsTime := false
-			var errParseCheck error
-
-			// Try parsing with d1TimestampLayout
-			if _, errParseCheck = time.Parse(d1TimestampLayout, v); errParseCheck == nil {
-				parsedAsTime = true
-				log.DefaultLogger.Debug("Column type inference: parsed as D1 format", "column", colName, "value", v)
-			} else {
-				// If D1 format fails, try RFC3339Nano (existing behavior)
-				if _, errParseCheck = time.Parse(time.RFC3339Nano, v); errParseCheck == nil {
-					parsedAsTime = true
-					log.DefaultLogger.Debug("Column type inference: parsed as RFC3339Nano", "column", colName, "value", v)
-				}
-			}
+		// rawStrings overrides every typing option, showing values as D1 sent them.
+		if qm.RawStrings {
+			field, _ := buildTypedField(colName, colIdx, d1Rows, rawString)
+			frame.Fields = append(frame.Fields, field)
+			continue
+		}
 
-			if parsedAsTime {
-				log.DefaultLogger.Debug("Column type inference: creating time.Time field", "column", colName)
-				colData := make([]*time.Time, rowCount)
-				for i, row := range d1Rows {
-					if colIdx < len(row) {
-						if val := row[colIdx]; val != nil {
-							if sVal, sOk := val.(string); sOk {
-								var tValRow time.Time
-								var errParseRow error
-								// Try parsing again with the determined successful layout or both
-								if t, err := time.Parse(d1TimestampLayout, sVal); err == nil {
-									tValRow = t
-									errParseRow = nil
-								} else if t, err := time.Parse(time.RFC3339Nano, sVal); err == nil {
-									tValRow = t
-									errParseRow = nil
-								} else {
-									errParseRow = err // Store the last error
-								}
-
-								if errParseRow == nil {
-									colData[i] = &tValRow
-								} else {
-									log.DefaultLogger.Warn("Failed to parse time string in row, leaving as nil", "column", colName, "row_index", i, "value", sVal, "error", errParseRow)
-								}
-							}
-						}
-					}
-				}
-				field = data.NewField(colName, nil, colData)
-			} else { // If not a parsable time string by any supported format, treat as a regular string.
-				log.DefaultLogger.Debug("Column type inference: treating as regular string", "column", colName, "value", v)
-				colData := make([]*string, rowCount)
-				for i, row := range d1Rows {
-					if colIdx < len(row) {
-						if val := row[colIdx]; val != nil {
-							if sVal, sOk := val.(string); sOk {
-								colData[i] = &sVal
-							}
-						}
-					}
-				}
-				field = data.NewField(colName, nil, colData)
+		// Columns marked as JSON bypass inference and are always string fields.
+		if containsColumn(qm.JSONColumns, colName) {
+			field, invalid := buildJSONField(colName, colIdx, d1Rows)
+			if invalid > 0 {
+				frame.AppendNotices(data.Notice{
+					Severity: data.NoticeSeverityWarning,
+					Text:     fmt.Sprintf("%d values in JSON column %s are not valid JSON and were left unchanged.", invalid, colName),
+				})
 			}
-		case bool:
-			log.DefaultLogger.Debug("Column type inference", "column", colName, "type", "bool")
-			colData := make([]*bool, rowCount)
-			for i, row := range d1Rows {
-				if colIdx < len(row) {
-					if val := row[colIdx]; val != nil {
-						if bVal, bOk := val.(bool); bOk {
-							colData[i] = &bVal
-						}
-					}
+			frame.Fields = append(frame.Fields, field)
+			continue
+		}
+
+		var field *data.Field
+		var failed int
+		if declared, ok := qm.ColumnTypes[colName]; ok {
+			// Declared types bypass every other typing option, including inference.
+			field, failed = buildDeclaredField(colName, colIdx, d1Rows, declaredColumnKinds[declared], d.settings.Location)
+		} else if containsColumn(qm.BoolColumns, colName) {
+			// SQLite has no boolean type, so opted-in 0/1 and true/false columns are coerced explicitly.
+			field, failed = buildTypedField(colName, colIdx, d1Rows, flagToBool)
+		} else if containsColumn(qm.NumericStringColumns, colName) {
+			// Imported data may hold numbers as localized text, which would otherwise stay strings.
+			field, failed = buildTypedField(colName, colIdx, d1Rows, localizedNumber(d.settings.DecimalSeparator))
+		} else if colName == qm.LatColumn || colName == qm.LonColumn {
+			// Coordinates are often stored as text; geomap needs them as numbers.
+			field, failed = buildTypedField(colName, colIdx, d1Rows, numberToFloat64)
+		} else {
+			// Infer the data type for the column from its first non-NULL value. Columns that are
+			// NULL in every row use the configured default type.
+			sampleValue := sampleColumn(d1Rows, colIdx)
+			kind := nullColumnKinds[d.settings.DefaultNullColumnType]
+			if declared, ok := schema[colName]; ok {
+				kind = declared
+			} else if sampleValue != nil {
+				kind = inferColumnKind(sampleValue)
+				// SQLite INTEGER columns arrive as JSON numbers; keep them integers unless the
+				// datasource opts back into float64 for every number.
+				if kind == kindFloat64 && !d.settings.NumericsAsFloat && integralColumn(d1Rows, colIdx) {
+					kind = kindInt64
 				}
-			}
-			field = data.NewField(colName, nil, colData)
-		case nil: // If the sample value (from the first row for this column) is nil.
-			// We need to try to infer from other rows or default to string. For now, default to string if all are nil.
-			// This part of type inference could be more robust.
-			log.DefaultLogger.Debug("Column type inference", "column", colName, "type", "nil_sample, defaulting to string")
-			colData := make([]*string, rowCount) // Defaulting to string for nil-sampled columns
-			// Attempt to populate with actual string values if present in other rows, though type is fixed by sample.
-			for i, row := range d1Rows {
-				if colIdx < len(row) {
-					if val := row[colIdx]; val != nil {
-						if sVal, sOk := val.(string); sOk {
-							colData[i] = &sVal
-						} else {
-							// If it's not nil and not a string, convert to string representation for this default case
-							tempStr := fmt.Sprintf("%v", val)
-							colData[i] = &tempStr
-						}
+				// Date-like strings that aren't timestamps can be kept as strings per query,
+				// or everywhere with disableTimeParsing.
+				if kind == kindTime {
+					if d.settings.DisableTimeParsing || containsColumn(qm.NoTimeParseColumns, colName) {
+						kind = kindString
+					} else {
+						parsedTimeColumns = append(parsedTimeColumns, colName)
 					}
 				}
 			}
-			field = data.NewField(colName, nil, colData)
-
-		default:
-			log.DefaultLogger.Debug("Column type inference", "column", colName, "type", "unknown, defaulting to string", "actual_type", reflect.TypeOf(v))
-			// For any other types, or if type inference is tricky, default to string.
-			// This ensures data is at least displayed, though maybe not optimally typed.
-			colData := make([]*string, rowCount)
-			for i, row := range d1Rows {
-				if colIdx < len(row) {
-					if val := row[colIdx]; val != nil {
-						tempStr := fmt.Sprintf("%v", val) // Convert value to string representation
-						colData[i] = &tempStr
-					}
-				}
+			d.logger.Debug("Column type inference", "column", colName, "type", kind.String(), "sample_type", reflect.TypeOf(sampleValue))
+			field, failed = buildColumnField(colName, colIdx, d1Rows, kind, d.settings.Location)
+			if kind == kindString && d.settings.EmptyStringAsNull {
+				nullEmptyStrings(field)
 			}
-			field = data.NewField(colName, nil, colData)
+		}
+
+		// Cells that can't be converted are left nil; report one summary notice per column.
+		if failed > 0 {
+			d.logger.Debug("Column values could not be converted", "column", colName, "failed", failed)
+			frame.AppendNotices(coercionNotice(colName, failed))
 		}
 		frame.Fields = append(frame.Fields, field)
 	}
 
-	// Append the populated frame to the response.
-	dataResponse.Frames = append(dataResponse.Frames, frame)
-	return dataResponse
+	if d.settings.NonFiniteAsNull {
+		nullNonFinite(frame)
+	}
+
+	// Name the columns whose strings became timestamps, so a surprising conversion can be undone.
+	if len(parsedTimeColumns) > 0 && !d.settings.SuppressTimeParseNotice {
+		frame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityInfo,
+			Text: fmt.Sprintf("Parsed string columns as timestamps: %s. Add them to the query's noTimeParseColumns to keep them as strings.",
+				strings.Join(parsedTimeColumns, ", ")),
+		})
+	}
+
+	// Every column must map to exactly one field, in D1's order; anything else means the
+	// conversion above dropped or duplicated a column.
+	if len(frame.Fields) != len(colNames) {
+		return nil, fmt.Errorf("frame has %d fields but the D1 result has %d columns", len(frame.Fields), len(colNames))
+	}
+
+	// Labels parsed from column names must be in place before time series are split.
+	if qm.ColumnLabels {
+		applyColumnLabels(frame)
+	}
+
+	if qm.TimeColumn != "" {
+		var err error
+		if frame, err = selectTimeColumn(frame, qm.TimeColumn); err != nil {
+			return nil, backend.DownstreamError(err)
+		}
+	}
+
+	switch qm.Format {
+	case formatTimeSeries:
+		var err error
+		frame, err = toTimeSeries(frame)
+		if err != nil {
+			return nil, backend.DownstreamError(err)
+		}
+	case formatLong:
+		var err error
+		frame, err = toLongFormat(frame)
+		if err != nil {
+			return nil, backend.DownstreamError(err)
+		}
+	}
+
+	// Explicit display names from the query's field config take precedence.
+	if d.settings.PrettifyColumnNames {
+		prettifyColumnNames(frame)
+	}
+	if qm.LatColumn != "" {
+		setGeoDisplayNames(frame, qm.LatColumn, qm.LonColumn)
+	}
+	applyFieldConfig(frame, qm.FieldConfig, d.logger)
+
+	if qm.Transpose {
+		var err error
+		frame, err = transposeFrame(frame)
+		if err != nil {
+			return nil, backend.DownstreamError(err)
+		}
+	}
+
+	// The hint only sets the default visualization; panels can still choose another one.
+	if frame.Meta == nil {
+		frame.Meta = &data.FrameMeta{}
+	}
+	frame.Meta.PreferredVisualization = preferredVisualization(frame)
+	return frame, nil
 }
 
 // Helper function to get a pointer to a string
@@ -379,81 +1554,94 @@ func ptrToString(s string) *string {
 // The main use case for these health checks is the test button on the
 // datasource configuration page which allows users to verify that
 // a datasource is working as expected.
-func (d *Datasource) CheckHealth(_ context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
-	log.DefaultLogger.Info("Checking health", "AccountID", d.settings.AccountID)
+func (d *Datasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
+	d.logger.Info("Checking health", "AccountID", d.settings.AccountID)
 
 	var status = backend.HealthStatusOk
 	var message = "Cloudflare D1 plugin is running" // Default message, will be overridden
 
-	apiURL := fmt.Sprintf("https://api.cloudflare.com/client/v4/accounts/%s/d1/database/%s/query",
-		d.settings.AccountID, d.settings.DatabaseID)
-
-	// Basic check: ensure settings are present
-	if d.settings.AccountID == "" || d.settings.DatabaseID == "" || d.settings.Secrets.APIToken == "" {
+	// Basic check: ensure settings are complete, reporting every problem at once.
+	if errs := d.settings.Validate(); len(errs) > 0 {
 		status = backend.HealthStatusError
 		// Ensure the message starts with "Health check failed:" for the e2e test
-		message = "Health check failed: Account ID, Database ID, or API Token is missing in datasource configuration"
-		log.DefaultLogger.Error("Health check failed: missing configuration", "AccountID", d.settings.AccountID, "DatabaseID", d.settings.DatabaseID, "APITokenSet", d.settings.Secrets.APIToken != "")
+		message = "Health check failed: " + joinErrors(errs)
+		d.logger.Error("Health check failed: invalid configuration", "AccountID", d.settings.AccountID, "DatabaseID", d.settings.DatabaseID, "APITokenSet", d.settings.Secrets.APIToken != "", "AccessCredentialsSet", d.settings.HasAccessCredentials())
 		return &backend.CheckHealthResult{
 			Status:  status,
 			Message: message,
 		}, nil
 	}
 
-	// Prepare request body
-	queryPayload := map[string]string{"sql": "SELECT 1;"}
-	jsonBody, err := json.Marshal(queryPayload)
+	// The token check, the test query and the lookups describing the database share the
+	// query timeout, so a slow API can't stretch the health check beyond it.
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(d.settings.QueryTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	// Verifying the token first tells a bad token apart from one missing the D1 permission,
+	// which the query below can only report as a generic authorization error.
+	tokenVerified, err := d.verifyToken(ctx)
 	if err != nil {
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
-			Message: fmt.Sprintf("Error marshalling query payload: %s", err.Error()),
+			Message: fmt.Sprintf("Health check failed: %s", err.Error()),
 		}, nil
 	}
 
-	// Create HTTP client and request
-	httpClient := &http.Client{Timeout: 10 * time.Second}
-	httpReq, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(jsonBody))
+	queryPayload := models.D1QueryRequest{SQL: d.settings.HealthCheckQuery}
+	// The token's permissions may differ per endpoint, so test the one queries use.
+	endpoint := defaultEndpoint(d.settings)
+	// The round-trip time of the test query is reported as a baseline API latency.
+	start := time.Now()
+	resp, err := d.client.Send(ctx, endpoint, queryPayload)
+	latency := time.Since(start)
 	if err != nil {
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
-			Message: fmt.Sprintf("Error creating HTTP request: %s", err.Error()),
+			Message: fmt.Sprintf("Health check failed: %s", err.Error()),
 		}, nil
 	}
 
-	// Set headers
-	httpReq.Header.Set("Authorization", "Bearer "+d.settings.Secrets.APIToken)
-	httpReq.Header.Set("Content-Type", "application/json")
+	// The D1 error objects are the most useful explanation of a failing health check
+	// query, so prefer them over the raw body when the response can be decoded.
+	d1Response, decodeErr := decodeD1Response(endpoint, resp.Body)
+	decoded := decodeErr == nil
 
-	// Execute request
-	resp, err := httpClient.Do(httpReq)
-	if err != nil {
+	// Check response status
+	if tokenVerified && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		message := "Health check failed: API token is valid but lacks D1 read permission"
+		if decoded && len(d1Response.Errors) > 0 {
+			message = fmt.Sprintf("%s (%s)", message, formatD1Errors(d1Response.Errors))
+		}
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
-			Message: fmt.Sprintf("Error executing D1 API request: %s", err.Error()),
+			Message: message,
 		}, nil
 	}
-	defer resp.Body.Close()
-
-	// Check response status
 	if resp.StatusCode != http.StatusOK {
-		// Attempt to read body for more details, but don't fail if unreadable
-		var bodyBytes []byte
-		var bodyReadError error
-		if resp.Body != nil {
-			bodyBytes, bodyReadError = io.ReadAll(resp.Body)
-		}
 		message := fmt.Sprintf("D1 API request failed with status %s", resp.Status)
-		if bodyReadError == nil && len(bodyBytes) > 0 {
-			message = fmt.Sprintf("%s. Response: %s", message, string(bodyBytes))
+		if decoded && len(d1Response.Errors) > 0 {
+			message = fmt.Sprintf("%s: %s", message, formatD1Errors(d1Response.Errors))
+		} else if len(resp.Body) > 0 {
+			message = fmt.Sprintf("%s. Response: %s", message, string(resp.Body))
 		}
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
 			Message: message,
 		}, nil
 	}
+	if decoded && !d1Response.Success {
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusError,
+			Message: fmt.Sprintf("Health check failed: D1 API error: %s", formatD1Errors(d1Response.Errors)),
+		}, nil
+	}
 
 	// If we reach here, the API call was successful
-	message = "Health check successful: Successfully connected to Cloudflare D1."
+	message = "Health check successful: Successfully connected to Cloudflare D1"
+	if details := d.healthDetails(ctx, d1Response); details != "" {
+		message += " " + details
+	}
+	message += fmt.Sprintf(" in %dms.", latency.Milliseconds())
 
 	return &backend.CheckHealthResult{
 		Status:  status,
@@ -1,12 +1,157 @@
 package plugin
 
 import (
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/build/buildinfo"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/olipayne/grafana-cloudflare-d1-datasource/pkg/models"
 )
 
+// newTestDatasource creates a Datasource from the given jsonData settings whose
+// API requests are served by handler.
+func newTestDatasource(t *testing.T, jsonData string, handler http.HandlerFunc) *Datasource {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	inst, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData:                []byte(jsonData),
+		DecryptedSecureJSONData: map[string]string{"apiToken": "test-token"},
+	})
+	if err != nil {
+		t.Fatalf("could not create datasource: %v", err)
+	}
+	ds := inst.(*Datasource)
+	setBaseURL(ds, srv.URL)
+	return ds
+}
+
+// setBaseURL points ds, including its D1 client, at the given Cloudflare API base URL.
+func setBaseURL(ds *Datasource, baseURL string) {
+	ds.baseURL = baseURL
+	ds.client = ds.limit(newHTTPD1Client(ds.settings, ds.transport, baseURL, ds.settings.DatabaseID))
+	if ds.replica != nil {
+		ds.replica = ds.limit(newHTTPD1Client(ds.settings, ds.transport, baseURL, ds.settings.ReplicaDatabaseID))
+	}
+}
+
+// rawResponse returns a handler replying with a successful D1 /raw response.
+func rawResponse(columns []string, rows [][]interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := models.D1RawAPIResponse{
+			Success: true,
+			Result: []models.D1RawResultItem{{
+				Success: true,
+				Results: &models.D1RawQueryActualResult{Columns: columns, Rows: rows},
+			}},
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// runQuery executes a single query with the given query JSON against ds.
+func runQuery(t *testing.T, ds *Datasource, queryJSON string) backend.DataResponse {
+	t.Helper()
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A", JSON: []byte(queryJSON)}},
+	})
+	if err != nil {
+		t.Fatalf("QueryData returned error: %v", err)
+	}
+	return resp.Responses["A"]
+}
+
+// logEntry is a log line captured by testLogger.
+type logEntry struct {
+	level string
+	msg   string
+	args  map[string]interface{}
+}
+
+// testLogger is a log.Logger recording every entry for assertions.
+type testLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+// captureLogs replaces log.DefaultLogger with a testLogger for the duration of the test.
+func captureLogs(t *testing.T) *testLogger {
+	t.Helper()
+	logger := &testLogger{}
+	previous := log.DefaultLogger
+	log.DefaultLogger = logger
+	t.Cleanup(func() { log.DefaultLogger = previous })
+	return logger
+}
+
+func (l *testLogger) record(level, msg string, args []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry := logEntry{level: level, msg: msg, args: map[string]interface{}{}}
+	for i := 0; i+1 < len(args); i += 2 {
+		entry.args[fmt.Sprint(args[i])] = args[i+1]
+	}
+	l.entries = append(l.entries, entry)
+}
+
+// find returns the captured entries with the given message.
+func (l *testLogger) find(msg string) []logEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var found []logEntry
+	for _, e := range l.entries {
+		if e.msg == msg {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+func (l *testLogger) Debug(msg string, args ...interface{})  { l.record("debug", msg, args) }
+func (l *testLogger) Info(msg string, args ...interface{})   { l.record("info", msg, args) }
+func (l *testLogger) Warn(msg string, args ...interface{})   { l.record("warn", msg, args) }
+func (l *testLogger) Error(msg string, args ...interface{})  { l.record("error", msg, args) }
+func (l *testLogger) With(args ...interface{}) log.Logger    { return l }
+func (l *testLogger) Level() log.Level                       { return log.Debug }
+func (l *testLogger) FromContext(context.Context) log.Logger { return l }
+
+// hasNotice reports whether frame carries a notice containing text.
+func hasNotice(frame *data.Frame, text string) bool {
+	if frame.Meta == nil {
+		return false
+	}
+	for _, n := range frame.Meta.Notices {
+		if strings.Contains(n.Text, text) {
+			return true
+		}
+	}
+	return false
+}
+
 func TestQueryData(t *testing.T) {
 	ds := Datasource{}
 
@@ -26,3 +171,2629 @@ func TestQueryData(t *testing.T) {
 		t.Fatal("QueryData must return a response")
 	}
 }
+
+func TestDatabaseURLJurisdiction(t *testing.T) {
+	tests := map[string]string{
+		"default": "https://api.cloudflare.com/client/v4/accounts/acc/d1/database/db/raw",
+		"eu":      "https://eu.api.cloudflare.com/client/v4/accounts/acc/d1/database/db/raw",
+		"fedramp": "https://api.fed.cloudflare.com/client/v4/accounts/acc/d1/database/db/raw",
+	}
+	for jurisdiction, want := range tests {
+		t.Run(jurisdiction, func(t *testing.T) {
+			inst, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+				JSONData: []byte(`{"accountId":"acc","databaseId":"db","jurisdiction":"` + jurisdiction + `"}`),
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := inst.(*Datasource).client.(*httpD1Client).databaseURL("raw"); got != want {
+				t.Errorf("expected %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestQueryTruncatesRowsOverMaxRows(t *testing.T) {
+	rows := make([][]interface{}, 5)
+	for i := range rows {
+		rows[i] = []interface{}{float64(i), fmt.Sprintf("row %d", i)}
+	}
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","maxRows":3}`, rawResponse([]string{"id", "name"}, rows))
+
+	res := runQuery(t, ds, `{"queryText":"SELECT id, name FROM t"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	frame := res.Frames[0]
+	if got := frame.Rows(); got != 3 {
+		t.Errorf("expected 3 rows after truncation, got %d", got)
+	}
+	if !hasNotice(frame, "truncated to 3 of 5 rows") {
+		t.Errorf("expected truncation notice, got %+v", frame.Meta)
+	}
+}
+
+func TestQueryDoesNotTruncateUnderMaxRows(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","maxRows":3}`,
+		rawResponse([]string{"id"}, [][]interface{}{{float64(1)}, {float64(2)}}))
+
+	res := runQuery(t, ds, `{"queryText":"SELECT id FROM t"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if got := res.Frames[0].Rows(); got != 2 {
+		t.Errorf("expected 2 rows, got %d", got)
+	}
+	if hasNotice(res.Frames[0], "truncated") {
+		t.Error("did not expect a truncation notice")
+	}
+}
+
+func TestBuildUserAgent(t *testing.T) {
+	withVersion := buildinfo.GetterFunc(func() (buildinfo.Info, error) {
+		return buildinfo.Info{Version: "1.2.3"}, nil
+	})
+	if got := buildUserAgent(withVersion); got != "grafana-cloudflare-d1-datasource/1.2.3" {
+		t.Errorf("unexpected user agent %q", got)
+	}
+
+	missing := buildinfo.GetterFunc(func() (buildinfo.Info, error) {
+		return buildinfo.Info{}, fmt.Errorf("no build info")
+	})
+	if got := buildUserAgent(missing); got != "grafana-cloudflare-d1-datasource/dev" {
+		t.Errorf("unexpected user agent %q", got)
+	}
+}
+
+func TestRequestsSendUserAgent(t *testing.T) {
+	var agents []string
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, func(w http.ResponseWriter, r *http.Request) {
+		agents = append(agents, r.Header.Get("User-Agent"))
+		rawResponse([]string{"1"}, [][]interface{}{{float64(1)}})(w, r)
+	})
+
+	if res := runQuery(t, ds, `{"queryText":"SELECT 1"}`); res.Error != nil {
+		t.Fatalf("unexpected query error: %v", res.Error)
+	}
+	if _, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{}); err != nil {
+		t.Fatalf("unexpected health check error: %v", err)
+	}
+
+	// The query, and the health check's token verification, query and database and account lookups.
+	if len(agents) != 5 {
+		t.Fatalf("expected 5 requests, got %d", len(agents))
+	}
+	for _, agent := range agents {
+		if agent != userAgent || !strings.HasPrefix(agent, "grafana-cloudflare-d1-datasource/") {
+			t.Errorf("unexpected User-Agent %q", agent)
+		}
+	}
+}
+
+func TestQueryNormalizesJSONColumns(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, rawResponse(
+		[]string{"id", "doc"},
+		[][]interface{}{
+			{float64(1), `{ "b": 2,  "a": [1, 2] }`},
+			{float64(2), `{not json`},
+			{float64(3), nil},
+		},
+	))
+
+	res := runQuery(t, ds, `{"queryText":"SELECT id, doc FROM t","jsonColumns":["doc"]}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	frame := res.Frames[0]
+	field, _ := frame.FieldByName("doc")
+	if field == nil || field.Type() != data.FieldTypeNullableString {
+		t.Fatalf("expected nullable string field for doc, got %v", field)
+	}
+	if got := *field.At(0).(*string); got != `{"a":[1,2],"b":2}` {
+		t.Errorf("expected canonical JSON, got %q", got)
+	}
+	if got := *field.At(1).(*string); got != `{not json` {
+		t.Errorf("expected invalid JSON to be left unchanged, got %q", got)
+	}
+	if field.At(2).(*string) != nil {
+		t.Error("expected NULL to stay nil")
+	}
+	if !hasNotice(frame, "1 values in JSON column doc are not valid JSON") {
+		t.Errorf("expected invalid JSON notice, got %+v", frame.Meta)
+	}
+}
+
+func TestQueryCoercesBoolColumns(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, rawResponse(
+		[]string{"enabled", "count"},
+		[][]interface{}{
+			{float64(0), float64(0)},
+			{float64(1), float64(1)},
+			{nil, float64(2)},
+		},
+	))
+
+	res := runQuery(t, ds, `{"queryText":"SELECT enabled, count FROM t","boolColumns":["enabled"]}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	frame := res.Frames[0]
+	enabled, _ := frame.FieldByName("enabled")
+	if enabled == nil || enabled.Type() != data.FieldTypeNullableBool {
+		t.Fatalf("expected nullable bool field for enabled, got %v", enabled)
+	}
+	if got := enabled.At(0).(*bool); got == nil || *got {
+		t.Errorf("expected 0 to be false, got %v", got)
+	}
+	if got := enabled.At(1).(*bool); got == nil || !*got {
+		t.Errorf("expected 1 to be true, got %v", got)
+	}
+	if enabled.At(2).(*bool) != nil {
+		t.Error("expected NULL to be nil")
+	}
+
+	// Unlisted numeric columns are not reclassified.
+	count, _ := frame.FieldByName("count")
+	if !count.Type().Numeric() {
+		t.Errorf("expected count to stay a number, got %s", count.Type())
+	}
+}
+
+func TestQueryNumericStringColumns(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","decimalSeparator":","}`, rawResponse(
+		[]string{"amount", "label"},
+		[][]interface{}{{"1.234,56", "1.234,56"}, {"-7,5", "x"}, {"n/a", "y"}, {nil, nil}},
+	))
+
+	res := runQuery(t, ds, `{"queryText":"SELECT amount, label FROM t","numericStringColumns":["amount"]}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	frame := res.Frames[0]
+	amount, _ := frame.FieldByName("amount")
+	if amount == nil || amount.Type() != data.FieldTypeNullableFloat64 {
+		t.Fatalf("expected a nullable float64 field for amount, got %v", amount)
+	}
+	for i, want := range []*float64{ptr(1234.56), ptr(-7.5), nil, nil} {
+		if got := amount.At(i).(*float64); !reflect.DeepEqual(got, want) {
+			t.Errorf("row %d: expected %v, got %v", i, want, got)
+		}
+	}
+	if !hasNotice(frame, "amount") {
+		t.Errorf("expected a notice about the unparsable value, got %+v", frame.Meta.Notices)
+	}
+
+	// Unlisted columns are left alone.
+	label, _ := frame.FieldByName("label")
+	if label.Type() != data.FieldTypeNullableString {
+		t.Errorf("expected label to stay a string, got %s", label.Type())
+	}
+
+	if _, err := models.LoadPluginSettings(backend.DataSourceInstanceSettings{JSONData: []byte(`{"decimalSeparator":";"}`)}); err == nil {
+		t.Error("expected an unknown decimal separator to be rejected")
+	}
+}
+
+func TestQueryCoercesTextBoolColumns(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, rawResponse(
+		[]string{"active"},
+		[][]interface{}{{"TRUE"}, {"false"}, {"1"}, {"0"}, {" True "}, {"yes"}, {"garbage"}, {nil}},
+	))
+
+	res := runQuery(t, ds, `{"queryText":"SELECT active FROM t","boolColumns":["active"]}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	frame := res.Frames[0]
+	active := frame.Fields[0]
+	if active.Type() != data.FieldTypeNullableBool {
+		t.Fatalf("expected a nullable bool field, got %s", active.Type())
+	}
+	want := []*bool{ptr(true), ptr(false), ptr(true), ptr(false), ptr(true), nil, nil, nil}
+	for i, w := range want {
+		got := active.At(i).(*bool)
+		if (got == nil) != (w == nil) || (got != nil && *got != *w) {
+			t.Errorf("row %d: expected %v, got %v", i, w, got)
+		}
+	}
+	if !hasNotice(frame, "2 values could not be converted in column active") {
+		t.Errorf("expected a notice counting the unrecognized values, got %+v", frame.Meta.Notices)
+	}
+}
+
+func TestQueryTranspose(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, rawResponse(
+		[]string{"name", "visits"},
+		[][]interface{}{{"home", float64(42)}},
+	))
+
+	res := runQuery(t, ds, `{"queryText":"SELECT name, visits FROM pages WHERE id = 1","transpose":true}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	frame := res.Frames[0]
+	if frame.Rows() != 2 || frame.Fields[0].Name != "column" || frame.Fields[1].Name != "value" {
+		t.Fatalf("expected a column/value frame of 2 rows, got %+v", frame)
+	}
+	if v, _ := frame.Fields[1].ConcreteAt(1); frame.Fields[0].At(1) != "visits" || v != "42" {
+		t.Errorf("expected visits = 42, got %v = %v", frame.Fields[0].At(1), v)
+	}
+
+	ds = newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, rawResponse(
+		[]string{"name"},
+		[][]interface{}{{"home"}, {"about"}},
+	))
+	res = runQuery(t, ds, `{"queryText":"SELECT name FROM pages","transpose":true}`)
+	if res.Error == nil || !strings.Contains(res.Error.Error(), "single row") {
+		t.Errorf("expected a multi-row result to be rejected, got %v", res.Error)
+	}
+}
+
+func TestQueryPartitionBy(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","suppressTimeParseNotice":true}`, rawResponse(
+		[]string{"time", "host", "cpu"},
+		[][]interface{}{
+			{"2024-01-01T00:00:00Z", "a", 1.5},
+			{"2024-01-01T00:00:00Z", "b", 2.5},
+			{"2024-01-01T00:01:00Z", "a", 3.5},
+		},
+	))
+
+	res := runQuery(t, ds, `{"queryText":"SELECT time, host, cpu FROM metrics","partitionBy":"host"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if len(res.Frames) != 2 || res.Frames[0].Rows() != 2 || res.Frames[1].Rows() != 1 {
+		t.Fatalf("expected frames of 2 and 1 rows, got %+v", res.Frames)
+	}
+	if got := res.Frames[1].Fields[1].Labels["host"]; got != "b" {
+		t.Errorf("expected the second frame labelled host=b, got %q", got)
+	}
+
+	res = runQuery(t, ds, `{"queryText":"SELECT time, host, cpu FROM metrics","partitionBy":"host","format":"time_series"}`)
+	if res.Error == nil {
+		t.Error("expected partitionBy with the time_series format to be rejected")
+	}
+}
+
+func TestQueryGeoColumns(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, rawResponse(
+		[]string{"name", "lat", "lng"},
+		[][]interface{}{{"a", float64(51), "-0.1276"}, {"b", float64(48.8566), " 2.35 "}, {"c", nil, "n/a"}},
+	))
+
+	res := runQuery(t, ds, `{"queryText":"SELECT name, lat, lng FROM stores","latColumn":"lat","lonColumn":"lng"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	frame := res.Frames[0]
+	for i, want := range map[int]string{1: "latitude", 2: "longitude"} {
+		field := frame.Fields[i]
+		if field.Type() != data.FieldTypeNullableFloat64 {
+			t.Errorf("%s: expected a nullable float64 field, got %s", field.Name, field.Type())
+		}
+		if field.Config == nil || field.Config.DisplayNameFromDS != want {
+			t.Errorf("%s: expected display name %q, got %+v", field.Name, want, field.Config)
+		}
+	}
+	if lat := frame.Fields[1].At(0).(*float64); lat == nil || *lat != 51 {
+		t.Errorf("expected integral latitude 51, got %v", lat)
+	}
+	if lng := frame.Fields[2].At(1).(*float64); lng == nil || *lng != 2.35 {
+		t.Errorf("expected text longitude 2.35, got %v", lng)
+	}
+	if !hasNotice(frame, "1 values could not be converted in column lng") {
+		t.Errorf("expected a notice for the invalid coordinate, got %+v", frame.Meta.Notices)
+	}
+
+	for query, want := range map[string]string{
+		`{"queryText":"SELECT name, lat, lng FROM stores","latColumn":"lat"}`:                 "must be set together",
+		`{"queryText":"SELECT name, lat, lng FROM stores","latColumn":"y","lonColumn":"lng"}`: `latColumn "y" is not a column`,
+	} {
+		if res := runQuery(t, ds, query); res.Error == nil || !strings.Contains(res.Error.Error(), want) {
+			t.Errorf("%s: expected an error containing %q, got %v", query, want, res.Error)
+		}
+	}
+}
+
+func TestQueryWarnsOnUnboundedSelect(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","warnOnUnboundedSelect":true}`, rawResponse(
+		[]string{"a"},
+		[][]interface{}{{float64(1)}},
+	))
+
+	for query, want := range map[string]bool{
+		`{"queryText":"SELECT a FROM t"}`:         true,
+		`{"queryText":"SELECT a FROM t LIMIT 5"}`: false,
+	} {
+		res := runQuery(t, ds, query)
+		if res.Error != nil {
+			t.Fatalf("%s: unexpected error: %v", query, res.Error)
+		}
+		if got := hasNotice(res.Frames[0], "no LIMIT clause"); got != want {
+			t.Errorf("%s: expected notice %t, got %t", query, want, got)
+		}
+	}
+}
+
+func TestQueryAppliesFieldConfig(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, rawResponse(
+		[]string{"total_bytes", "latency"},
+		[][]interface{}{{float64(1024), float64(12)}},
+	))
+
+	res := runQuery(t, ds, `{
+		"queryText": "SELECT total_bytes, latency FROM t",
+		"fieldConfig": {
+			"total_bytes": {"unit": "bytes", "displayName": "Total bytes"},
+			"latency": {"unit": "ms"},
+			"missing": {"unit": "s"}
+		}
+	}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	frame := res.Frames[0]
+
+	bytesField, _ := frame.FieldByName("total_bytes")
+	if bytesField.Config == nil || bytesField.Config.Unit != "bytes" || bytesField.Config.DisplayNameFromDS != "Total bytes" {
+		t.Errorf("unexpected total_bytes config: %+v", bytesField.Config)
+	}
+	latency, _ := frame.FieldByName("latency")
+	if latency.Config == nil || latency.Config.Unit != "ms" || latency.Config.DisplayNameFromDS != "" {
+		t.Errorf("unexpected latency config: %+v", latency.Config)
+	}
+	if len(frame.Fields) != 2 {
+		t.Errorf("expected unknown columns to be ignored, got %d fields", len(frame.Fields))
+	}
+}
+
+func TestQueryCountsCoercionFailuresPerColumn(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","suppressTimeParseNotice":true}`, rawResponse(
+		[]string{"value", "created_at", "name"},
+		[][]interface{}{
+			{float64(1), "2024-01-01 10:00:00", "a"},
+			{"n/a", "not a time", "b"},
+			{"unknown", "2024-01-02T10:00:00Z", "c"},
+			{"?", "yesterday", nil},
+			{float64(5), nil, "e"},
+		},
+	))
+
+	res := runQuery(t, ds, `{"queryText":"SELECT value, created_at, name FROM t"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	frame := res.Frames[0]
+
+	value, _ := frame.FieldByName("value")
+	if value.Type() != data.FieldTypeNullableFloat64 {
+		t.Fatalf("expected value to be a number field, got %s", value.Type())
+	}
+	if got := value.At(4).(*float64); got == nil || *got != 5 {
+		t.Errorf("expected good values to be kept, got %v", got)
+	}
+	if value.At(1).(*float64) != nil {
+		t.Error("expected unconvertible value to be nil")
+	}
+	created, _ := frame.FieldByName("created_at")
+	if created.Type() != data.FieldTypeNullableTime {
+		t.Fatalf("expected created_at to be a time field, got %s", created.Type())
+	}
+
+	if !hasNotice(frame, "3 values could not be converted in column value") {
+		t.Errorf("expected notice for value column, got %+v", frame.Meta.Notices)
+	}
+	if !hasNotice(frame, "2 values could not be converted in column created_at") {
+		t.Errorf("expected notice for created_at column, got %+v", frame.Meta.Notices)
+	}
+	if hasNotice(frame, "column name") {
+		t.Error("did not expect a notice for a column without failures")
+	}
+	if len(frame.Meta.Notices) != 2 {
+		t.Errorf("expected exactly one notice per affected column, got %d", len(frame.Meta.Notices))
+	}
+}
+
+func TestQueryTimeParseNotice(t *testing.T) {
+	handler := rawResponse(
+		[]string{"created_at", "version", "name"},
+		[][]interface{}{{"2024-01-01 10:00:00", "2024-01-02", "a"}},
+	)
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, handler)
+
+	res := runQuery(t, ds, `{"queryText":"SELECT created_at, version, name FROM t"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	frame := res.Frames[0]
+	if !hasNotice(frame, "Parsed string columns as timestamps: created_at, version.") {
+		t.Errorf("expected a notice naming the parsed columns, got %+v", frame.Meta.Notices)
+	}
+
+	// Opted-out columns stay strings and are no longer named.
+	res = runQuery(t, ds, `{"queryText":"SELECT created_at, version, name FROM t","noTimeParseColumns":["version"]}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	frame = res.Frames[0]
+	if got := frame.Fields[1].Type(); got != data.FieldTypeNullableString {
+		t.Errorf("expected version to stay a string field, got %s", got)
+	}
+	if got := frame.Fields[0].Type(); got != data.FieldTypeNullableTime {
+		t.Errorf("expected created_at to still be parsed, got %s", got)
+	}
+	if !hasNotice(frame, "Parsed string columns as timestamps: created_at.") {
+		t.Errorf("expected the notice to name only created_at, got %+v", frame.Meta.Notices)
+	}
+
+	ds = newTestDatasource(t, `{"accountId":"acc","databaseId":"db","suppressTimeParseNotice":true}`, handler)
+	res = runQuery(t, ds, `{"queryText":"SELECT created_at, version, name FROM t"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if hasNotice(res.Frames[0], "Parsed string columns as timestamps") {
+		t.Error("expected the notice to be suppressed")
+	}
+}
+
+func TestQueryDisableTimeParsing(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","disableTimeParsing":true}`, rawResponse(
+		[]string{"created_at", "value"},
+		[][]interface{}{{"2024-01-01 10:00:00", float64(1)}},
+	))
+	res := runQuery(t, ds, `{"queryText":"SELECT created_at, value FROM t"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	field := res.Frames[0].Fields[0]
+	if field.Type() != data.FieldTypeNullableString {
+		t.Fatalf("expected created_at to stay a string field, got %s", field.Type())
+	}
+	if got := field.At(0).(*string); got == nil || *got != "2024-01-01 10:00:00" {
+		t.Errorf("expected the raw string, got %v", got)
+	}
+	if hasNotice(res.Frames[0], "Parsed string columns as timestamps") {
+		t.Error("expected no timestamp parsing notice")
+	}
+}
+
+func TestURLTemplate(t *testing.T) {
+	var paths []string
+	var mu sync.Mutex
+	ds := newTestDatasource(t, `{"databaseId":"my db"}`, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.EscapedPath())
+		mu.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/gateway/") {
+			_ = json.NewEncoder(w).Encode(models.D1APIResponse{Success: true, Result: []models.D1SuccessResult{{Success: true}}})
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+	ds.settings.URLTemplate = ds.baseURL + "/gateway/d1/{database}/{endpoint}?v=1"
+
+	runQuery(t, ds, `{"queryText":"SELECT 1","endpoint":"query"}`)
+	res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Status != backend.HealthStatusOk {
+		t.Errorf("expected healthy status without an account ID, got %v: %s", res.Status, res.Message)
+	}
+	for _, want := range []string{"/gateway/d1/my%20db/raw", "/gateway/d1/my%20db/query"} {
+		found := false
+		for _, p := range paths {
+			found = found || p == want
+		}
+		if !found {
+			t.Errorf("expected a request to %s, got %v", want, paths)
+		}
+	}
+
+	// Without an {endpoint} placeholder, the endpoint is appended.
+	ds.settings.AccountID = "acc"
+	ds.settings.URLTemplate = "https://d1.example.com/{account}/{database}/"
+	if got, want := ds.client.(*httpD1Client).databaseURL("query"), "https://d1.example.com/acc/my%20db/query"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestCheckHealthCustomQuery(t *testing.T) {
+	var sent models.D1QueryRequest
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","healthCheckQuery":"SELECT 1 FROM events LIMIT 1"}`,
+		func(w http.ResponseWriter, r *http.Request) {
+			_ = json.NewDecoder(r.Body).Decode(&sent)
+			_ = json.NewEncoder(w).Encode(models.D1APIResponse{Success: true, Result: []models.D1SuccessResult{{Success: true}}})
+		})
+
+	res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Status != backend.HealthStatusOk {
+		t.Errorf("expected healthy status, got %v: %s", res.Status, res.Message)
+	}
+	if sent.SQL != "SELECT 1 FROM events LIMIT 1" {
+		t.Errorf("expected custom health check query to be sent, got %q", sent.SQL)
+	}
+}
+
+func TestCheckHealthCustomQueryFailure(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","healthCheckQuery":"SELECT 1 FROM missing"}`,
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(models.D1APIResponse{
+				Errors: []models.D1Error{{Code: 7500, Message: "no such table: missing: SQLITE_ERROR"}},
+			})
+		})
+
+	res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Status != backend.HealthStatusError {
+		t.Errorf("expected error status, got %v", res.Status)
+	}
+	if !strings.Contains(res.Message, "Code 7500: no such table: missing") {
+		t.Errorf("expected D1 error in message, got %q", res.Message)
+	}
+}
+
+func TestCheckHealthUsesConfiguredEndpoint(t *testing.T) {
+	for _, endpoint := range []string{endpointRaw, endpointQuery} {
+		t.Run(endpoint, func(t *testing.T) {
+			var paths []string
+			ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","endpoint":"`+endpoint+`"}`, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				paths = append(paths, r.URL.Path)
+				// The token may only be allowed to use one of the endpoints.
+				switch {
+				case !strings.HasSuffix(r.URL.Path, "/"+endpoint):
+					w.WriteHeader(http.StatusForbidden)
+					_ = json.NewEncoder(w).Encode(models.D1APIResponse{Errors: []models.D1Error{{Code: 10000, Message: "Authentication error"}}})
+				case endpoint == endpointQuery:
+					_, _ = w.Write([]byte(`{"success":true,"result":[{"success":true,"results":[{"1":1}],"meta":{"served_by_region":"WEUR"}}]}`))
+				default:
+					_ = json.NewEncoder(w).Encode(models.D1RawAPIResponse{Success: true, Result: []models.D1RawResultItem{{
+						Success: true,
+						Results: &models.D1RawQueryActualResult{Columns: []string{"1"}, Rows: [][]interface{}{{float64(1)}}},
+						Meta:    models.D1Meta{ServedByRegion: "WEUR"},
+					}}})
+				}
+			})
+
+			res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Status != backend.HealthStatusOk {
+				t.Fatalf("expected healthy status, got %v: %s", res.Status, res.Message)
+			}
+			if !strings.Contains(res.Message, "served by WEUR") {
+				t.Errorf("expected the response meta to be decoded, got %q", res.Message)
+			}
+			if len(paths) != 1 || !strings.HasSuffix(paths[0], "/"+endpoint) {
+				t.Errorf("expected the health check to use the %s endpoint, got %v", endpoint, paths)
+			}
+
+			// Queries without an endpoint of their own use the configured one too.
+			if res := runQuery(t, ds, `{"queryText":"SELECT 1"}`); res.Error != nil {
+				t.Errorf("unexpected query error: %v", res.Error)
+			}
+		})
+	}
+}
+
+func TestQueryReadOnlyRejectsWritesBeforeRequest(t *testing.T) {
+	requests := 0
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","readOnly":true}`, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		rawResponse([]string{"1"}, [][]interface{}{{float64(1)}})(w, r)
+	})
+
+	res := runQuery(t, ds, `{"queryText":"DELETE FROM users"}`)
+	if res.Error == nil || !strings.Contains(res.Error.Error(), "read-only mode") {
+		t.Errorf("expected read-only error, got %v", res.Error)
+	}
+	if requests != 0 {
+		t.Errorf("expected no request to D1, got %d", requests)
+	}
+
+	if res := runQuery(t, ds, `{"queryText":"SELECT 1"}`); res.Error != nil {
+		t.Errorf("expected SELECT to be allowed, got %v", res.Error)
+	}
+}
+
+func TestQueryAllowedQueryPatterns(t *testing.T) {
+	requests := 0
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","allowedQueryPatterns":["^SELECT .* FROM reports\\b","^SELECT 1$"]}`, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		rawResponse([]string{"1"}, [][]interface{}{{float64(1)}})(w, r)
+	})
+
+	for _, sql := range []string{"SELECT * FROM users", "DELETE FROM reports"} {
+		res := runQuery(t, ds, `{"queryText":"`+sql+`"}`)
+		if res.Error == nil || !strings.Contains(res.Error.Error(), "allowed query patterns") {
+			t.Errorf("expected %q to be rejected, got %v", sql, res.Error)
+		}
+	}
+	if requests != 0 {
+		t.Errorf("expected no request to D1, got %d", requests)
+	}
+
+	for _, sql := range []string{"SELECT day, total FROM reports WHERE $__timeFilter(day)", "SELECT 1"} {
+		if res := runQuery(t, ds, `{"queryText":"`+sql+`"}`); res.Error != nil {
+			t.Errorf("expected %q to be allowed, got %v", sql, res.Error)
+		}
+	}
+}
+
+func TestQueryMandatoryFilter(t *testing.T) {
+	var sent models.D1QueryRequest
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","mandatoryFilter":"tenant_id = 'acme'"}`, func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&sent)
+		rawResponse([]string{"n"}, [][]interface{}{{float64(1)}})(w, r)
+	})
+
+	res := runQuery(t, ds, `{"queryText":"SELECT host, COUNT(*) AS n FROM logs WHERE level = 'error' OR level = 'warn' GROUP BY host ORDER BY n DESC"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	want := "SELECT host, COUNT(*) AS n FROM logs WHERE (level = 'error' OR level = 'warn') AND (tenant_id = 'acme') GROUP BY host ORDER BY n DESC"
+	if sent.SQL != want {
+		t.Errorf("expected the filter in the outermost WHERE, got %q", sent.SQL)
+	}
+
+	if res := runQuery(t, ds, `{"queryText":"DELETE FROM logs"}`); res.Error == nil || !strings.Contains(res.Error.Error(), "mandatory filter") {
+		t.Errorf("expected a write to be rejected, got %v", res.Error)
+	}
+	sent = models.D1QueryRequest{}
+	res = runQuery(t, ds, `{"queryText":"SELECT host, (SELECT COUNT(*) FROM logs) AS total FROM logs"}`)
+	if res.Error == nil || !strings.Contains(res.Error.Error(), "subqueries") {
+		t.Errorf("expected a subquery to be rejected, got %v", res.Error)
+	}
+	if sent.SQL != "" {
+		t.Errorf("expected the rejected query not to be sent, got %q", sent.SQL)
+	}
+
+	_, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"mandatoryFilter":"tenant_id = 'acme') OR (1 = 1"}`),
+	})
+	if err == nil {
+		t.Error("expected a filter escaping its parentheses to be rejected")
+	}
+}
+
+func TestRequestsSendAccessHeaders(t *testing.T) {
+	var headers http.Header
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+		rawResponse([]string{"1"}, [][]interface{}{{float64(1)}})(w, r)
+	}
+
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","accessClientId":"client-id.access"}`, handler)
+	ds.settings.Secrets.AccessClientSecret = "client-secret"
+	if res := runQuery(t, ds, `{"queryText":"SELECT 1"}`); res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if got := headers.Get("Authorization"); got != "Bearer test-token" {
+		t.Errorf("expected bearer token to be kept, got %q", got)
+	}
+	if got := headers.Get("CF-Access-Client-Id"); got != "client-id.access" {
+		t.Errorf("unexpected CF-Access-Client-Id %q", got)
+	}
+	if got := headers.Get("CF-Access-Client-Secret"); got != "client-secret" {
+		t.Errorf("unexpected CF-Access-Client-Secret %q", got)
+	}
+
+	// Without Access credentials only the bearer token is sent.
+	ds = newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, handler)
+	if res := runQuery(t, ds, `{"queryText":"SELECT 1"}`); res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if headers.Get("Authorization") != "Bearer test-token" || headers.Get("CF-Access-Client-Id") != "" || headers.Get("CF-Access-Client-Secret") != "" {
+		t.Errorf("unexpected headers without Access credentials: %v", headers)
+	}
+}
+
+func TestQueryMaxSQLLength(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","maxSqlLength":12}`,
+		rawResponse([]string{"1"}, [][]interface{}{{float64(1)}}))
+
+	// Characters, not bytes, are counted: "SELECT 'é1'" is 11 characters but 12 bytes.
+	if res := runQuery(t, ds, `{"queryText":"SELECT 'é12'"}`); res.Error != nil {
+		t.Errorf("expected a query of exactly the limit to be allowed, got %v", res.Error)
+	}
+	if res := runQuery(t, ds, `{"queryText":"SELECT 'é1'"}`); res.Error != nil {
+		t.Errorf("expected a query under the limit to be allowed, got %v", res.Error)
+	}
+	res := runQuery(t, ds, `{"queryText":"SELECT 'é123'"}`)
+	if res.Error == nil || !strings.Contains(res.Error.Error(), "13 characters long, which exceeds the configured maximum of 12") {
+		t.Errorf("expected a query over the limit to be rejected, got %v", res.Error)
+	}
+}
+
+func TestQueryLogLevel(t *testing.T) {
+	tests := map[string]struct {
+		settings            string
+		wantDebug, wantInfo bool
+	}{
+		"default": {`{"accountId":"acc","databaseId":"db"}`, true, true},
+		"info":    {`{"accountId":"acc","databaseId":"db","logLevel":"info"}`, false, true},
+		"warn":    {`{"accountId":"acc","databaseId":"db","logLevel":"warn"}`, false, false},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			logs := captureLogs(t)
+			ds := newTestDatasource(t, tt.settings, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			})
+
+			runQuery(t, ds, `{"queryText":"SELECT 1"}`)
+
+			if got := len(logs.find("Executing D1 query")) > 0; got != tt.wantDebug {
+				t.Errorf("expected debug lines %t, got %t", tt.wantDebug, got)
+			}
+			if got := len(logs.find("D1 query finished")) > 0; got != tt.wantInfo {
+				t.Errorf("expected info lines %t, got %t", tt.wantInfo, got)
+			}
+			if len(logs.find("D1 API request failed")) == 0 {
+				t.Error("expected errors to be logged at every level")
+			}
+		})
+	}
+}
+
+func TestQueryLogsOutcome(t *testing.T) {
+	logs := captureLogs(t)
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`,
+		rawResponse([]string{"n"}, [][]interface{}{{float64(1)}, {float64(2)}}))
+
+	runQuery(t, ds, `{"queryText":"SELECT n FROM t"}`)
+	runQuery(t, ds, `{"queryText":""}`)
+
+	entries := logs.find("D1 query finished")
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 outcome log entries, got %d", len(entries))
+	}
+	for _, e := range entries {
+		if e.level != "info" {
+			t.Errorf("expected info level, got %s", e.level)
+		}
+		for _, key := range []string{"refId", "statusCode", "durationMs", "rows", "cached", "error"} {
+			if _, ok := e.args[key]; !ok {
+				t.Errorf("expected key %q in %v", key, e.args)
+			}
+		}
+		for key, value := range e.args {
+			if strings.Contains(fmt.Sprint(value), "test-token") {
+				t.Errorf("API token leaked in log key %q", key)
+			}
+		}
+	}
+
+	ok, failed := entries[0].args, entries[1].args
+	if ok["statusCode"] != http.StatusOK || ok["rows"] != 2 || ok["error"] != false {
+		t.Errorf("unexpected successful query log: %v", ok)
+	}
+	if failed["statusCode"] != 0 || failed["error"] != true {
+		t.Errorf("unexpected failed query log: %v", failed)
+	}
+}
+
+func TestQueryWriteNotice(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(models.D1RawAPIResponse{
+			Success: true,
+			Result: []models.D1RawResultItem{{
+				Success: true,
+				Results: &models.D1RawQueryActualResult{Columns: []string{}, Rows: [][]interface{}{}},
+				Meta:    models.D1Meta{Changes: 3, LastRowID: 42, ChangedDB: true},
+			}},
+		})
+	})
+
+	res := runQuery(t, ds, `{"queryText":"INSERT INTO t (a) VALUES (1), (2), (3)"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	frame := res.Frames[0]
+	if !hasNotice(frame, "3 rows affected, last_row_id=42") {
+		t.Errorf("expected write notice, got %+v", frame.Meta)
+	}
+	if hasNotice(frame, "no data returned") {
+		t.Error("did not expect the generic no data notice for a write")
+	}
+}
+
+func TestQueryReturnLastRowID(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","cacheTTLSeconds":60}`, func(w http.ResponseWriter, r *http.Request) {
+		var sent models.D1QueryRequest
+		_ = json.NewDecoder(r.Body).Decode(&sent)
+		meta := models.D1Meta{Changes: 1, LastRowID: 42, ChangedDB: true}
+		if strings.HasPrefix(sent.SQL, "SELECT") {
+			meta = models.D1Meta{}
+		}
+		_ = json.NewEncoder(w).Encode(models.D1RawAPIResponse{
+			Success: true,
+			Result: []models.D1RawResultItem{{
+				Success: true,
+				Results: &models.D1RawQueryActualResult{Columns: []string{}, Rows: [][]interface{}{}},
+				Meta:    meta,
+			}},
+		})
+	})
+
+	// The second run is served from the cache and must keep the frame names.
+	for i := 0; i < 2; i++ {
+		res := runQuery(t, ds, `{"queryText":"INSERT INTO t (a) VALUES (1)","returnLastRowId":true}`)
+		if res.Error != nil {
+			t.Fatalf("unexpected error: %v", res.Error)
+		}
+		if len(res.Frames) != 2 || res.Frames[0].Name != "A" {
+			t.Fatalf("expected the statement frame and a last_row_id frame, got %d frames", len(res.Frames))
+		}
+		frame := res.Frames[1]
+		if frame.Name != "last_row_id" || len(frame.Fields) != 1 || frame.Rows() != 1 {
+			t.Fatalf("expected a one-row, one-field last_row_id frame, got %q with %d fields and %d rows", frame.Name, len(frame.Fields), frame.Rows())
+		}
+		if frame.Fields[0].Name != "last_row_id" || frame.Fields[0].At(0) != int64(42) {
+			t.Errorf("expected last_row_id 42, got %s=%v", frame.Fields[0].Name, frame.Fields[0].At(0))
+		}
+	}
+
+	res := runQuery(t, ds, `{"queryText":"INSERT INTO t (a) VALUES (2)"}`)
+	if res.Error != nil || len(res.Frames) != 1 {
+		t.Errorf("expected no last_row_id frame without the flag, got %d frames (%v)", len(res.Frames), res.Error)
+	}
+	res = runQuery(t, ds, `{"queryText":"SELECT 1","returnLastRowId":true}`)
+	if res.Error != nil || len(res.Frames) != 1 {
+		t.Errorf("expected no last_row_id frame for a read, got %d frames (%v)", len(res.Frames), res.Error)
+	}
+}
+
+func TestQueryDDLAndPragmaResults(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, func(w http.ResponseWriter, r *http.Request) {
+		var sent models.D1QueryRequest
+		_ = json.NewDecoder(r.Body).Decode(&sent)
+		if strings.HasPrefix(sent.SQL, "PRAGMA") {
+			rawResponse([]string{"cid", "name", "type"}, [][]interface{}{
+				{float64(0), "id", "INTEGER"},
+				{float64(1), "name", "TEXT"},
+			})(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(models.D1RawAPIResponse{
+			Success: true,
+			Result: []models.D1RawResultItem{{
+				Success: true,
+				Results: &models.D1RawQueryActualResult{Columns: []string{}, Rows: [][]interface{}{}},
+				Meta:    models.D1Meta{Duration: 1.5, RowsWritten: 2, SizeAfter: 8192},
+			}},
+		})
+	})
+
+	res := runQuery(t, ds, `{"queryText":"CREATE TABLE t (id INTEGER PRIMARY KEY, name TEXT)"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	frame := res.Frames[0]
+	if len(frame.Fields) != 0 || !hasNotice(frame, "no data returned (e.g., DDL statement)") {
+		t.Errorf("expected a DDL notice without fields, got %d fields and %+v", len(frame.Fields), frame.Meta)
+	}
+	if meta, ok := frame.Meta.Custom.(*frameCustomMeta); !ok || meta.D1Meta == nil || meta.Duration != 1.5 || meta.SizeAfter != 8192 {
+		t.Errorf("expected the statement meta as custom meta, got %+v", frame.Meta.Custom)
+	}
+	if len(frame.Meta.Stats) != 4 || frame.Meta.Stats[0].DisplayName != "Duration" || frame.Meta.Stats[0].Value != 1.5 || frame.Meta.Stats[3].Value != 2 {
+		t.Errorf("unexpected query stats: %+v", frame.Meta.Stats)
+	}
+
+	res = runQuery(t, ds, `{"queryText":"PRAGMA table_info(t)"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	frame = res.Frames[0]
+	if len(frame.Fields) != 3 || frame.Rows() != 2 {
+		t.Fatalf("expected PRAGMA rows like a SELECT, got %d fields and %d rows", len(frame.Fields), frame.Rows())
+	}
+	if got := frame.Fields[1].At(1).(*string); got == nil || *got != "name" {
+		t.Errorf("expected the column names as data, got %v", got)
+	}
+	if hasNotice(frame, "no data returned") {
+		t.Error("did not expect a no data notice for PRAGMA rows")
+	}
+}
+
+func TestQueryRequestID(t *testing.T) {
+	var ids []string
+	fail := false
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","customHeaders":{"X-Request-Id":"fixed"}}`, func(w http.ResponseWriter, r *http.Request) {
+		ids = append(ids, r.Header.Get("X-Request-Id"))
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"success":false,"errors":[{"code":7500,"message":"internal error"}]}`))
+			return
+		}
+		rawResponse([]string{"n"}, [][]interface{}{{float64(1)}})(w, r)
+	})
+
+	if res := runQuery(t, ds, `{"queryText":"SELECT 1 AS n"}`); res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	fail = true
+	res := runQuery(t, ds, `{"queryText":"SELECT 2 AS n"}`)
+	if len(ids) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(ids))
+	}
+	for _, id := range ids {
+		if _, err := uuid.Parse(id); err != nil {
+			t.Errorf("expected a generated UUID request ID, got %q", id)
+		}
+	}
+	if ids[0] == ids[1] {
+		t.Error("expected every request to get its own ID")
+	}
+	if res.Error == nil || !strings.Contains(res.Error.Error(), "(request ID "+ids[1]+")") {
+		t.Errorf("expected the request ID %s in the error, got %v", ids[1], res.Error)
+	}
+}
+
+func TestQueryDataBoundsConcurrency(t *testing.T) {
+	var inFlight, maxInFlight int32
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","queryConcurrency":2}`, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		rawResponse([]string{"n"}, [][]interface{}{{float64(1)}})(w, r)
+	})
+
+	var queries []backend.DataQuery
+	for i := 0; i < 8; i++ {
+		queries = append(queries, backend.DataQuery{RefID: fmt.Sprintf("Q%d", i), JSON: []byte(`{"queryText":"SELECT 1"}`)})
+	}
+	// A failing query must not abort the others.
+	queries = append(queries, backend.DataQuery{RefID: "BAD", JSON: []byte(`{"queryText":""}`)})
+
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: queries})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(resp.Responses) != len(queries) {
+		t.Fatalf("expected %d responses, got %d", len(queries), len(resp.Responses))
+	}
+	for i := 0; i < 8; i++ {
+		refID := fmt.Sprintf("Q%d", i)
+		if res := resp.Responses[refID]; res.Error != nil || len(res.Frames) != 1 || res.Frames[0].Name != refID {
+			t.Errorf("unexpected response for %s: %+v", refID, res)
+		}
+	}
+	if resp.Responses["BAD"].Error == nil {
+		t.Error("expected an error for the empty query")
+	}
+	if got := atomic.LoadInt32(&maxInFlight); got > 2 {
+		t.Errorf("expected at most 2 concurrent requests, got %d", got)
+	}
+}
+
+// gzipHandler replies with body gzip-encoded, checking that the client accepts gzip.
+func gzipHandler(t *testing.T, body []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			t.Errorf("expected Accept-Encoding: gzip, got %q", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		_, _ = gz.Write(body)
+		_ = gz.Close()
+	}
+}
+
+func TestQueryDecodesGzipResponse(t *testing.T) {
+	body, _ := json.Marshal(models.D1RawAPIResponse{
+		Success: true,
+		Result: []models.D1RawResultItem{{
+			Success: true,
+			Results: &models.D1RawQueryActualResult{Columns: []string{"name"}, Rows: [][]interface{}{{"gzipped"}}},
+		}},
+	})
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, gzipHandler(t, body))
+
+	res := runQuery(t, ds, `{"queryText":"SELECT name FROM t"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if got := *res.Frames[0].Fields[0].At(0).(*string); got != "gzipped" {
+		t.Errorf("expected decoded value, got %q", got)
+	}
+}
+
+func TestQueryRejectsGzipBomb(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","maxRows":1}`,
+		gzipHandler(t, make([]byte, minResponseSizeLimit+1)))
+
+	res := runQuery(t, ds, `{"queryText":"SELECT 1"}`)
+	if res.Error == nil || !strings.Contains(res.Error.Error(), "decompressed response exceeds") {
+		t.Errorf("expected decompression size error, got %v", res.Error)
+	}
+}
+
+func TestQueryRejectsOversizedResponse(t *testing.T) {
+	body := []byte(`{"success":true,"result":[{"success":true,"results":{"columns":["n"],"rows":[[1]]}}]}`)
+	handler := func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write(body) }
+
+	// A body of exactly the limit is accepted.
+	ds := newTestDatasource(t, fmt.Sprintf(`{"accountId":"acc","databaseId":"db","maxResponseBytes":%d}`, len(body)), handler)
+	if res := runQuery(t, ds, `{"queryText":"SELECT 1 AS n"}`); res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+
+	ds = newTestDatasource(t, fmt.Sprintf(`{"accountId":"acc","databaseId":"db","maxResponseBytes":%d}`, len(body)-1), handler)
+	want := fmt.Sprintf("response exceeds %d bytes", len(body)-1)
+	if res := runQuery(t, ds, `{"queryText":"SELECT 1 AS n"}`); res.Error == nil || !strings.Contains(res.Error.Error(), want) {
+		t.Errorf("expected an error containing %q, got %v", want, res.Error)
+	}
+	res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Status != backend.HealthStatusError || !strings.Contains(res.Message, "response exceeds") {
+		t.Errorf("expected the health check to fail on the oversized response, got %v %q", res.Status, res.Message)
+	}
+}
+
+func TestQueryErrorSource(t *testing.T) {
+	d1Error := func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(models.D1RawAPIResponse{Errors: []models.D1Error{{Code: 7500, Message: "syntax error"}}})
+	}
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		queryJSON string
+		want      backend.ErrorSource
+	}{
+		{
+			name:      "invalid query JSON",
+			queryJSON: `{"queryText":`,
+			want:      backend.ErrorSourcePlugin,
+		},
+		{
+			name: "malformed D1 response",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(`{"result": [`))
+			},
+			queryJSON: `{"queryText":"SELECT 1"}`,
+			want:      backend.ErrorSourcePlugin,
+		},
+		{
+			name: "non-200 status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadGateway)
+			},
+			queryJSON: `{"queryText":"SELECT 1"}`,
+			want:      backend.ErrorSourceDownstream,
+		},
+		{
+			name:      "D1 API error",
+			handler:   d1Error,
+			queryJSON: `{"queryText":"SELEC 1"}`,
+			want:      backend.ErrorSourceDownstream,
+		},
+		{
+			name:      "empty query",
+			queryJSON: `{"queryText":""}`,
+			want:      backend.ErrorSourceDownstream,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, tt.handler)
+			res := runQuery(t, ds, tt.queryJSON)
+			if res.Error == nil {
+				t.Fatal("expected an error")
+			}
+			if res.ErrorSource != tt.want {
+				t.Errorf("expected error source %q, got %q", tt.want, res.ErrorSource)
+			}
+		})
+	}
+
+	t.Run("network failure", func(t *testing.T) {
+		ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, nil)
+		setBaseURL(ds, "http://127.0.0.1:1")
+		if res := runQuery(t, ds, `{"queryText":"SELECT 1"}`); res.ErrorSource != backend.ErrorSourceDownstream {
+			t.Errorf("expected downstream error source, got %q (%v)", res.ErrorSource, res.Error)
+		}
+	})
+}
+
+func TestQueryValidateOnly(t *testing.T) {
+	var sent models.D1QueryRequest
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&sent)
+		if strings.Contains(sent.SQL, "SELEC ") {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(models.D1RawAPIResponse{
+				Errors: []models.D1Error{{Code: 7500, Message: `near "SELEC": syntax error`}},
+			})
+			return
+		}
+		rawResponse([]string{"addr", "opcode"}, [][]interface{}{{float64(0), "Init"}})(w, r)
+	})
+
+	res := runQuery(t, ds, `{"queryText":"SELECT * FROM t; SELECT 2","validateOnly":true}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if sent.SQL != "EXPLAIN SELECT * FROM t;\nEXPLAIN SELECT 2" {
+		t.Errorf("expected statements to be wrapped with EXPLAIN, got %q", sent.SQL)
+	}
+	frame := res.Frames[0]
+	if len(frame.Fields) != 0 {
+		t.Errorf("expected no data fields, got %d", len(frame.Fields))
+	}
+	if !hasNotice(frame, "Query is valid") {
+		t.Errorf("expected validation notice, got %+v", frame.Meta)
+	}
+
+	res = runQuery(t, ds, `{"queryText":"SELEC * FROM t","validateOnly":true}`)
+	if res.Error == nil || !strings.Contains(res.Error.Error(), `near "SELEC": syntax error`) {
+		t.Errorf("expected syntax error, got %v", res.Error)
+	}
+	if len(res.Frames) != 0 {
+		t.Errorf("expected no frames for an invalid query, got %d", len(res.Frames))
+	}
+}
+
+func TestD1QueryRequestMarshalsParams(t *testing.T) {
+	body, err := json.Marshal(models.D1QueryRequest{SQL: "SELECT * FROM t WHERE a = ? AND b = ?", Params: []interface{}{"x", float64(2)}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := `{"sql":"SELECT * FROM t WHERE a = ? AND b = ?","params":["x",2]}`; string(body) != want {
+		t.Errorf("expected %s, got %s", want, body)
+	}
+
+	body, _ = json.Marshal(models.D1QueryRequest{SQL: "SELECT 1"})
+	if want := `{"sql":"SELECT 1"}`; string(body) != want {
+		t.Errorf("expected params to be omitted when empty, got %s", body)
+	}
+}
+
+func TestQuerySendsParams(t *testing.T) {
+	var sent map[string]interface{}
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&sent)
+		rawResponse([]string{"n"}, [][]interface{}{{float64(1)}})(w, r)
+	})
+
+	res := runQuery(t, ds, `{"queryText":"SELECT n FROM t WHERE status = ? AND n > ?","params":["active",10]}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	params, ok := sent["params"].([]interface{})
+	if !ok || len(params) != 2 || params[0] != "active" || params[1] != float64(10) {
+		t.Errorf("unexpected params in payload: %v", sent)
+	}
+
+	res = runQuery(t, ds, `{"queryText":"SELECT n FROM t WHERE status = ?","params":["a","b"]}`)
+	if res.Error == nil || !strings.Contains(res.Error.Error(), "1 placeholders but 2 params") {
+		t.Errorf("expected placeholder count mismatch error, got %v", res.Error)
+	}
+}
+
+func TestQueryTimestampTimeZone(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","timeZone":"Europe/Berlin"}`, rawResponse(
+		[]string{"offset", "naive"},
+		[][]interface{}{{"2024-01-01T00:00:00+02:00", "2024-01-01 00:00:00"}},
+	))
+	res := runQuery(t, ds, `{"queryText":"SELECT offset, naive FROM t"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	for i, want := range []time.Time{
+		time.Date(2023, 12, 31, 22, 0, 0, 0, time.UTC),
+		time.Date(2023, 12, 31, 23, 0, 0, 0, time.UTC),
+	} {
+		field := res.Frames[0].Fields[i]
+		got, ok := field.At(0).(*time.Time)
+		if !ok || got == nil || !got.Equal(want) || got.Location() != time.UTC {
+			t.Errorf("%s: expected %v in UTC, got %v", field.Name, want, field.At(0))
+		}
+	}
+}
+
+func TestQueryTimeColumn(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, rawResponse(
+		[]string{"created_at", "updated_at", "host", "requests"},
+		[][]interface{}{
+			{"2024-01-01 00:00:00", "2024-01-03 00:00:00", "a", float64(1)},
+			{"2024-01-02 00:00:00", "2024-01-01 00:00:00", "a", float64(2)},
+		},
+	))
+	firstRequests := func(t *testing.T, query string) (string, float64) {
+		t.Helper()
+		res := runQuery(t, ds, query)
+		if res.Error != nil {
+			t.Fatalf("unexpected error: %v", res.Error)
+		}
+		frame := res.Frames[0]
+		schema := frame.TimeSeriesSchema()
+		if schema.Type != data.TimeSeriesTypeWide {
+			t.Fatalf("expected a wide time series frame, got %s", schema.Type)
+		}
+		requests, _ := frame.FieldByName("requests")
+		if requests == nil {
+			t.Fatalf("expected a requests field, got %v", frame.Fields)
+		}
+		v, _ := requests.FloatAt(0)
+		return frame.Fields[schema.TimeIndex].Name, v
+	}
+
+	if name, v := firstRequests(t, `{"queryText":"SELECT * FROM t","format":"time_series","timeColumn":"updated_at"}`); name != "updated_at" || v != 2 {
+		t.Errorf("expected rows sorted by updated_at, got time column %s with first value %v", name, v)
+	}
+	if name, v := firstRequests(t, `{"queryText":"SELECT * FROM t","format":"time_series"}`); name != "created_at" || v != 1 {
+		t.Errorf("expected rows sorted by the first time column, got time column %s with first value %v", name, v)
+	}
+
+	res := runQuery(t, ds, `{"queryText":"SELECT * FROM t","format":"long","timeColumn":"updated_at"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if name := res.Frames[0].Fields[0].Name; name != "updated_at" {
+		t.Errorf("expected updated_at as the long frame's time column, got %s", name)
+	}
+
+	for query, want := range map[string]string{
+		`{"queryText":"SELECT * FROM t","format":"time_series","timeColumn":"host"}`:    `timeColumn "host" is not a time field but string`,
+		`{"queryText":"SELECT * FROM t","format":"time_series","timeColumn":"missing"}`: `timeColumn "missing" is not a column of the result`,
+		`{"queryText":"SELECT * FROM t","timeColumn":"updated_at"}`:                     "timeColumn requires the time_series or long format",
+	} {
+		res := runQuery(t, ds, query)
+		if res.Error == nil || !strings.Contains(res.Error.Error(), want) {
+			t.Errorf("%s: expected an error containing %q, got %v", query, want, res.Error)
+		}
+	}
+}
+
+func TestD1QueryRequestMarshalsBookmark(t *testing.T) {
+	body, err := json.Marshal(models.D1QueryRequest{SQL: "SELECT 1", Bookmark: "0000002c-00000003-00004f5a-9f0b"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := `{"sql":"SELECT 1","bookmark":"0000002c-00000003-00004f5a-9f0b"}`; string(body) != want {
+		t.Errorf("expected %s, got %s", want, body)
+	}
+}
+
+func TestQuerySessionBookmark(t *testing.T) {
+	var sent map[string]interface{}
+	returned := "0000002c-00000004-00004f5a-9f0b"
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, func(w http.ResponseWriter, r *http.Request) {
+		sent = nil
+		_ = json.NewDecoder(r.Body).Decode(&sent)
+		_ = json.NewEncoder(w).Encode(models.D1RawAPIResponse{
+			Success: true,
+			Result: []models.D1RawResultItem{{
+				Success: true,
+				Meta:    models.D1Meta{Bookmark: returned},
+				Results: &models.D1RawQueryActualResult{Columns: []string{"n"}, Rows: [][]interface{}{{float64(1)}}},
+			}},
+		})
+	})
+
+	res := runQuery(t, ds, `{"queryText":"SELECT n FROM t","sessionBookmark":"0000002c-00000003-00004f5a-9f0b"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if sent["bookmark"] != "0000002c-00000003-00004f5a-9f0b" {
+		t.Errorf("expected the bookmark in the payload, got %v", sent)
+	}
+	custom, ok := res.Frames[0].Meta.Custom.(*frameCustomMeta)
+	if !ok || custom.Bookmark != returned {
+		t.Errorf("expected the returned bookmark in the frame meta, got %+v", res.Frames[0].Meta.Custom)
+	}
+
+	res = runQuery(t, ds, `{"queryText":"SELECT n FROM t"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if _, ok := sent["bookmark"]; ok {
+		t.Errorf("expected no bookmark in the payload without sessionBookmark, got %v", sent)
+	}
+
+	// An API ignoring the bookmark returns none; the query still succeeds without one.
+	returned = ""
+	res = runQuery(t, ds, `{"queryText":"SELECT n FROM t","sessionBookmark":"0000002c-00000003-00004f5a-9f0b"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if custom, ok := res.Frames[0].Meta.Custom.(*frameCustomMeta); ok && custom.Bookmark != "" {
+		t.Errorf("expected no bookmark in the frame meta, got %q", custom.Bookmark)
+	}
+}
+
+func TestQueryPreservesColumnOrder(t *testing.T) {
+	columns := []string{"zebra", "apple", "mango"}
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, rawResponse(columns, [][]interface{}{
+		{"z", float64(1), true},
+		{"y", float64(2), false},
+	}))
+
+	res := runQuery(t, ds, `{"queryText":"SELECT zebra, apple, mango FROM fruit"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	frame := res.Frames[0]
+	if len(frame.Fields) != len(columns) {
+		t.Fatalf("expected %d fields, got %d", len(columns), len(frame.Fields))
+	}
+	for i, name := range columns {
+		if frame.Fields[i].Name != name {
+			t.Errorf("field %d: expected %s, got %s", i, name, frame.Fields[i].Name)
+		}
+	}
+}
+
+func TestQueryAllNullColumnUsesDefaultType(t *testing.T) {
+	rows := [][]interface{}{{nil, nil}, {nil, 3.5}}
+	tests := []struct {
+		setting string
+		want    data.FieldType
+	}{
+		{"", data.FieldTypeNullableString},
+		{"string", data.FieldTypeNullableString},
+		{"float64", data.FieldTypeNullableFloat64},
+		{"int64", data.FieldTypeNullableInt64},
+	}
+	for _, tt := range tests {
+		ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","defaultNullColumnType":"`+tt.setting+`"}`,
+			rawResponse([]string{"empty", "late"}, rows))
+		res := runQuery(t, ds, `{"queryText":"SELECT empty, late FROM t"}`)
+		if res.Error != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.setting, res.Error)
+		}
+		fields := res.Frames[0].Fields
+		if got := fields[0].Type(); got != tt.want {
+			t.Errorf("%q: expected all-NULL column type %s, got %s", tt.setting, tt.want, got)
+		}
+		// A column with a non-NULL value further down is inferred from that value.
+		if got := fields[1].Type(); got != data.FieldTypeNullableFloat64 {
+			t.Errorf("%q: expected late column to be float64, got %s", tt.setting, got)
+		}
+	}
+}
+
+func TestQueryDataAlertingTimeSeries(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, rawResponse(
+		[]string{"time", "requests"},
+		[][]interface{}{
+			{"2024-01-01 00:01:00", float64(7)},
+			{"2024-01-01 00:00:00", float64(5)},
+		},
+	))
+
+	// Alert rules evaluate queries in the backend, flagged with the FromAlert header.
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Headers: map[string]string{"FromAlert": "true"},
+		Queries: []backend.DataQuery{{
+			RefID:         "A",
+			JSON:          []byte(`{"queryText":"SELECT time, requests FROM metrics","format":"time_series"}`),
+			Interval:      time.Minute,
+			MaxDataPoints: 43200,
+			TimeRange:     backend.TimeRange{From: time.Now().Add(-time.Hour), To: time.Now()},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	res := resp.Responses["A"]
+	if res.Error != nil {
+		t.Fatalf("unexpected query error: %v", res.Error)
+	}
+	frame := res.Frames[0]
+	if frame.TimeSeriesSchema().Type != data.TimeSeriesTypeWide {
+		t.Fatalf("expected a wide time series frame, got %s", frame.TimeSeriesSchema().Type)
+	}
+	if !frame.Fields[1].Type().Numeric() {
+		t.Errorf("expected a numeric value field, got %s", frame.Fields[1].Type())
+	}
+	first, _ := frame.Fields[0].ConcreteAt(0)
+	if !first.(time.Time).Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected rows sorted by time, first is %v", first)
+	}
+}
+
+func TestQueryDownsample(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, rawResponse(
+		[]string{"time", "requests"},
+		[][]interface{}{
+			{"2024-01-01 00:00:00", float64(5)},
+			{"2024-01-01 00:01:00", float64(7)},
+			{"2024-01-01 00:02:00", float64(1)},
+			{"2024-01-01 00:03:00", float64(6)},
+			{"2024-01-01 00:04:00", float64(2)},
+		},
+	))
+
+	for format, want := range map[string]int{"time_series": 3, "table": 5} {
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{
+				RefID:         "A",
+				JSON:          []byte(`{"queryText":"SELECT time, requests FROM metrics","format":"` + format + `","downsample":true}`),
+				MaxDataPoints: 3,
+			}},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		res := resp.Responses["A"]
+		if res.Error != nil {
+			t.Fatalf("%s: unexpected query error: %v", format, res.Error)
+		}
+		if got := res.Frames[0].Rows(); got != want {
+			t.Errorf("%s: expected %d rows, got %d", format, want, got)
+		}
+	}
+}
+
+func TestQueryDeduplicateColumns(t *testing.T) {
+	handler := rawResponse([]string{"id", "id", "id_1", "id"}, [][]interface{}{{float64(1), float64(2), "x", float64(3)}})
+
+	res := runQuery(t, newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, handler), `{"queryText":"SELECT a.id, b.id, a.id_1, c.id FROM a JOIN b JOIN c"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	frame := res.Frames[0]
+	var names []string
+	for _, field := range frame.Fields {
+		names = append(names, field.Name)
+	}
+	if want := []string{"id", "id_2", "id_1", "id_3"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("expected fields %v, got %v", want, names)
+	}
+	if got := frame.Fields[3].At(0).(*int64); got == nil || *got != 3 {
+		t.Errorf("expected the renamed field to keep its values, got %v", got)
+	}
+	if !hasNotice(frame, "Duplicate column names were renamed: id to id_2, id to id_3.") {
+		t.Errorf("expected a notice naming the renamed columns, got %+v", frame.Meta.Notices)
+	}
+
+	res = runQuery(t, newTestDatasource(t, `{"accountId":"acc","databaseId":"db","deduplicateColumns":false}`, handler), `{"queryText":"SELECT a.id, b.id, a.id_1, c.id FROM a JOIN b JOIN c"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if got := res.Frames[0].Fields[1].Name; got != "id" {
+		t.Errorf("expected names to be kept with deduplicateColumns off, got %q", got)
+	}
+}
+
+func TestQueryNilResultShapes(t *testing.T) {
+	// D1 has answered with null in place of every level of the result; none of them may
+	// panic or fail the query.
+	tests := []struct {
+		name     string
+		endpoint string
+		body     string
+	}{
+		{"null result", "raw", `{"success":true,"result":null}`},
+		{"missing result", "raw", `{"success":true}`},
+		{"empty result", "raw", `{"success":true,"result":[]}`},
+		{"null result item", "raw", `{"success":true,"result":[null]}`},
+		{"empty result item", "raw", `{"success":true,"result":[{}]}`},
+		{"null results", "raw", `{"success":true,"result":[{"success":true,"results":null}]}`},
+		{"null columns and rows", "raw", `{"success":true,"result":[{"success":true,"results":{"columns":null,"rows":null}}]}`},
+		{"null columns", "raw", `{"success":true,"result":[{"success":true,"results":{"columns":null,"rows":[]}}]}`},
+		{"null rows", "raw", `{"success":true,"result":[{"success":true,"results":{"columns":["a"],"rows":null}}]}`},
+		{"query endpoint null result", "query", `{"success":true,"result":null}`},
+		{"query endpoint null result item", "query", `{"success":true,"result":[null]}`},
+		{"query endpoint null results", "query", `{"success":true,"result":[{"success":true,"results":null}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(tt.body))
+			})
+			res := runQuery(t, ds, `{"queryText":"SELECT a FROM t","endpoint":"`+tt.endpoint+`"}`)
+			if res.Error != nil {
+				t.Fatalf("unexpected error: %v", res.Error)
+			}
+			if len(res.Frames) != 1 || res.Frames[0].Rows() != 0 {
+				t.Fatalf("expected a single empty frame, got %+v", res.Frames)
+			}
+			if !hasNotice(res.Frames[0], noDataNotice) {
+				t.Errorf("expected the no data notice, got %+v", res.Frames[0].Meta.Notices)
+			}
+		})
+	}
+}
+
+func TestQuerySchemaOnly(t *testing.T) {
+	var sent models.D1QueryRequest
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&sent)
+		rawResponse(
+			[]string{"id", "ratio", "host", "created_at", "note"},
+			[][]interface{}{{float64(7), 0.5, "a", "2024-01-01T00:00:00Z", nil}},
+		)(w, r)
+	})
+
+	res := runQuery(t, ds, `{"queryText":"SELECT id, ratio, host, created_at, note FROM t ORDER BY id LIMIT 100;","schemaOnly":true}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if want := "SELECT * FROM (SELECT id, ratio, host, created_at, note FROM t ORDER BY id LIMIT 100) LIMIT 1"; sent.SQL != want {
+		t.Errorf("expected the query to be limited to one row, got %q", sent.SQL)
+	}
+	frame := res.Frames[0]
+	if frame.Rows() != 0 {
+		t.Errorf("expected no rows, got %d", frame.Rows())
+	}
+	wantTypes := []data.FieldType{
+		data.FieldTypeNullableInt64, data.FieldTypeNullableFloat64, data.FieldTypeNullableString,
+		data.FieldTypeNullableTime, data.FieldTypeNullableString,
+	}
+	for i, want := range wantTypes {
+		if got := frame.Fields[i].Type(); got != want {
+			t.Errorf("field %s: expected %s, got %s", frame.Fields[i].Name, want, got)
+		}
+	}
+	custom, ok := frame.Meta.Custom.(*frameCustomMeta)
+	if !ok {
+		t.Fatalf("expected custom meta, got %T", frame.Meta.Custom)
+	}
+	wantSchema := []fieldSchema{
+		{Name: "id", Type: "int64", Nullable: true},
+		{Name: "ratio", Type: "float64", Nullable: true},
+		{Name: "host", Type: "string", Nullable: true},
+		{Name: "created_at", Type: "time", Nullable: true},
+		{Name: "note", Type: "string", Nullable: true},
+	}
+	if !reflect.DeepEqual(custom.Schema, wantSchema) {
+		t.Errorf("expected schema %+v, got %+v", wantSchema, custom.Schema)
+	}
+
+	for _, sql := range []string{"DELETE FROM t", "SELECT 1; SELECT 2"} {
+		if res := runQuery(t, ds, `{"queryText":"`+sql+`","schemaOnly":true}`); res.Error == nil {
+			t.Errorf("expected schemaOnly to reject %q", sql)
+		}
+	}
+}
+
+func TestQueryEmptyStringAsNull(t *testing.T) {
+	rows := [][]interface{}{{"a"}, {""}, {nil}}
+	for _, enabled := range []bool{false, true} {
+		ds := newTestDatasource(t, fmt.Sprintf(`{"accountId":"acc","databaseId":"db","emptyStringAsNull":%t}`, enabled),
+			rawResponse([]string{"name"}, rows))
+		res := runQuery(t, ds, `{"queryText":"SELECT name FROM t"}`)
+		if res.Error != nil {
+			t.Fatalf("unexpected error: %v", res.Error)
+		}
+		field := res.Frames[0].Fields[0]
+		if got := field.At(0).(*string); got == nil || *got != "a" {
+			t.Errorf("enabled=%t: expected non-empty string to be kept, got %v", enabled, got)
+		}
+		got := field.At(1).(*string)
+		if enabled && got != nil {
+			t.Errorf("expected empty string to become NULL, got %q", *got)
+		}
+		if !enabled && (got == nil || *got != "") {
+			t.Errorf("expected empty string to be kept when disabled, got %v", got)
+		}
+	}
+}
+
+func TestQueryRateLimitNotice(t *testing.T) {
+	tests := []struct {
+		jsonData   string
+		remaining  string
+		wantNotice bool
+	}{
+		{`{"accountId":"acc","databaseId":"db"}`, "50", true},
+		{`{"accountId":"acc","databaseId":"db"}`, "500", false},
+		{`{"accountId":"acc","databaseId":"db","rateLimitWarningThreshold":1000}`, "500", true},
+		{`{"accountId":"acc","databaseId":"db","rateLimitWarningThreshold":0}`, "1", false},
+		{`{"accountId":"acc","databaseId":"db"}`, "", false},
+	}
+	for _, tt := range tests {
+		remaining := tt.remaining
+		ds := newTestDatasource(t, tt.jsonData, func(w http.ResponseWriter, r *http.Request) {
+			if remaining != "" {
+				w.Header().Set("X-RateLimit-Remaining", remaining)
+				w.Header().Set("X-RateLimit-Limit", "1200")
+			}
+			rawResponse([]string{"n"}, [][]interface{}{{float64(1)}})(w, r)
+		})
+		res := runQuery(t, ds, `{"queryText":"SELECT 1 AS n"}`)
+		if res.Error != nil {
+			t.Fatalf("unexpected error: %v", res.Error)
+		}
+		got := hasNotice(res.Frames[0], "rate limit nearly reached")
+		if got != tt.wantNotice {
+			t.Errorf("%s with %q remaining: expected notice %t, got %t", tt.jsonData, tt.remaining, tt.wantNotice, got)
+		}
+	}
+}
+
+func TestCheckHealthReportsAllSettingsProblems(t *testing.T) {
+	inst, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{JSONData: []byte(`{"accountId":"acc"}`)})
+	if err != nil {
+		t.Fatalf("incomplete settings must not prevent the instance from starting: %v", err)
+	}
+	res, err := inst.(*Datasource).CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Status != backend.HealthStatusError {
+		t.Fatalf("expected an error status, got %v", res.Status)
+	}
+	want := "Health check failed: database ID is missing; API token is missing"
+	if res.Message != want {
+		t.Errorf("expected message %q, got %q", want, res.Message)
+	}
+}
+
+func TestRequestsSendCustomHeaders(t *testing.T) {
+	logs := captureLogs(t)
+	var headers []http.Header
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","customHeaders":{"X-Team":"data","authorization":"Bearer stolen"}}`,
+		func(w http.ResponseWriter, r *http.Request) {
+			headers = append(headers, r.Header.Clone())
+			if strings.HasSuffix(r.URL.Path, "/query") {
+				_ = json.NewEncoder(w).Encode(models.D1APIResponse{Success: true, Result: []models.D1SuccessResult{{Success: true}}})
+				return
+			}
+			rawResponse([]string{"n"}, [][]interface{}{{float64(1)}})(w, r)
+		})
+
+	if res := runQuery(t, ds, `{"queryText":"SELECT 1 AS n"}`); res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{}); err != nil || res.Status != backend.HealthStatusOk {
+		t.Fatalf("unexpected health check result %v, %v", res, err)
+	}
+
+	// The query, and the health check's token verification, query and database and account lookups.
+	if len(headers) != 5 {
+		t.Fatalf("expected 5 requests, got %d", len(headers))
+	}
+	for i, h := range headers {
+		if got := h.Get("X-Team"); got != "data" {
+			t.Errorf("request %d: expected X-Team header, got %q", i, got)
+		}
+		if got := h.Get("Authorization"); got != "Bearer test-token" {
+			t.Errorf("request %d: Authorization must not be overridden, got %q", i, got)
+		}
+	}
+	if len(logs.find("Ignoring custom header that would override a header set by the plugin")) != 1 {
+		t.Error("expected a warning about the ignored Authorization header")
+	}
+}
+
+func TestQuerySetsPreferredVisualization(t *testing.T) {
+	tests := []struct {
+		columns []string
+		row     []interface{}
+		want    data.VisType
+	}{
+		{[]string{"time", "value"}, []interface{}{"2024-01-01 00:00:00", float64(1)}, data.VisTypeGraph},
+		{[]string{"name", "value"}, []interface{}{"a", float64(1)}, data.VisTypeTable},
+	}
+	for _, tt := range tests {
+		ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, rawResponse(tt.columns, [][]interface{}{tt.row}))
+		res := runQuery(t, ds, `{"queryText":"SELECT * FROM t"}`)
+		if res.Error != nil {
+			t.Fatalf("unexpected error: %v", res.Error)
+		}
+		if got := res.Frames[0].Meta.PreferredVisualization; got != tt.want {
+			t.Errorf("%v: expected %s, got %s", tt.columns, tt.want, got)
+		}
+	}
+}
+
+func TestQueryEndpoints(t *testing.T) {
+	var paths []string
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/query") {
+			// Row objects list their keys in SELECT order, which isn't alphabetical here.
+			_, _ = w.Write([]byte(`{"success":true,"errors":[],"messages":[],"result":[{"success":true,"meta":{},"results":[
+				{"zebra":"z","apple":1,"mango":true},
+				{"zebra":"y","apple":2,"mango":false}
+			]}]}`))
+			return
+		}
+		rawResponse([]string{"zebra", "apple", "mango"}, [][]interface{}{
+			{"z", float64(1), true},
+			{"y", float64(2), false},
+		})(w, r)
+	})
+
+	raw := runQuery(t, ds, `{"queryText":"SELECT zebra, apple, mango FROM t"}`)
+	query := runQuery(t, ds, `{"queryText":"SELECT zebra, apple, mango FROM t","endpoint":"query"}`)
+	for name, res := range map[string]backend.DataResponse{"raw": raw, "query": query} {
+		if res.Error != nil {
+			t.Fatalf("%s: unexpected error: %v", name, res.Error)
+		}
+	}
+	if !strings.HasSuffix(paths[0], "/raw") || !strings.HasSuffix(paths[1], "/query") {
+		t.Errorf("unexpected request paths %v", paths)
+	}
+
+	rawFrame, queryFrame := raw.Frames[0], query.Frames[0]
+	if len(rawFrame.Fields) != 3 || len(queryFrame.Fields) != 3 {
+		t.Fatalf("expected 3 fields from both endpoints, got %d and %d", len(rawFrame.Fields), len(queryFrame.Fields))
+	}
+	for i := range rawFrame.Fields {
+		rf, qf := rawFrame.Fields[i], queryFrame.Fields[i]
+		if rf.Name != qf.Name || rf.Type() != qf.Type() {
+			t.Errorf("field %d: raw %s (%s) differs from query %s (%s)", i, rf.Name, rf.Type(), qf.Name, qf.Type())
+		}
+		for row := 0; row < rf.Len(); row++ {
+			rv, _ := rf.ConcreteAt(row)
+			qv, _ := qf.ConcreteAt(row)
+			if rv != qv {
+				t.Errorf("field %s row %d: raw %v differs from query %v", rf.Name, row, rv, qv)
+			}
+		}
+	}
+
+	if res := runQuery(t, ds, `{"queryText":"SELECT 1","endpoint":"batch"}`); res.Error == nil {
+		t.Error("expected an unknown endpoint to be rejected")
+	}
+}
+
+func TestCheckHealthDescribesDatabase(t *testing.T) {
+	apiResult := func(w http.ResponseWriter, result interface{}) {
+		body, _ := json.Marshal(result)
+		_ = json.NewEncoder(w).Encode(models.CloudflareResponse{Success: true, Result: body})
+	}
+	handler := func(lookups bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodPost:
+				_ = json.NewEncoder(w).Encode(models.D1APIResponse{Success: true, Result: []models.D1SuccessResult{{
+					Success: true,
+					Meta:    models.D1Meta{ServedBy: "v3-prod", ServedByRegion: "WEUR"},
+				}}})
+			case r.URL.Path == "/user/tokens/verify":
+				apiResult(w, models.TokenVerification{ID: "token", Status: "active"})
+			case !lookups:
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"success":false,"errors":[{"code":9109,"message":"Unauthorized to access requested resource"}]}`))
+			case r.URL.Path == "/accounts/acc/d1/database/db":
+				apiResult(w, models.D1Database{UUID: "db", Name: "analytics"})
+			case r.URL.Path == "/accounts/acc":
+				apiResult(w, models.CloudflareAccount{ID: "acc", Name: "Example Corp"})
+			default:
+				t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			}
+		}
+	}
+
+	tests := []struct {
+		lookups bool
+		want    string
+	}{
+		{true, `Health check successful: Successfully connected to Cloudflare D1 database "analytics" (account "Example Corp", served by WEUR) in 0ms.`},
+		// Failed lookups leave the names out but don't fail the health check.
+		{false, `Health check successful: Successfully connected to Cloudflare D1 (served by WEUR) in 0ms.`},
+	}
+	for _, tt := range tests {
+		ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, handler(tt.lookups))
+		res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res.Status != backend.HealthStatusOk || withoutLatency(res.Message) != tt.want {
+			t.Errorf("lookups=%t: expected %q, got %v %q", tt.lookups, tt.want, res.Status, res.Message)
+		}
+	}
+}
+
+func TestQueryBatchReturnsFramePerStatement(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","cacheTTLSeconds":60}`, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"success":true,"errors":[],"messages":[],"result":[
+			{"success":true,"meta":{"changes":0},"results":[{"id":1,"name":"a"}]},
+			{"success":true,"meta":{"changes":2,"last_row_id":7,"changed_db":true},"results":[]},
+			{"success":true,"meta":{"changes":0},"results":[{"total":3}]}
+		]}`))
+	})
+
+	queryJSON := `{"queryText":"SELECT id, name FROM t; INSERT INTO t (name) VALUES ('b'), ('c'); SELECT COUNT(*) AS total FROM t","endpoint":"query"}`
+	for _, cached := range []bool{false, true} {
+		res := runQuery(t, ds, queryJSON)
+		if res.Error != nil {
+			t.Fatalf("cached=%t: unexpected error: %v", cached, res.Error)
+		}
+		if len(res.Frames) != 3 {
+			t.Fatalf("cached=%t: expected one frame per statement, got %d", cached, len(res.Frames))
+		}
+		for i, want := range []string{"A[0]", "A[1]", "A[2]"} {
+			if res.Frames[i].Name != want {
+				t.Errorf("cached=%t: frame %d: expected name %s, got %s", cached, i, want, res.Frames[i].Name)
+			}
+		}
+		if len(res.Frames[0].Fields) != 2 || res.Frames[0].Fields[1].Name != "name" {
+			t.Errorf("cached=%t: unexpected fields of the first SELECT: %v", cached, res.Frames[0].Fields)
+		}
+		if len(res.Frames[1].Fields) != 0 || !hasNotice(res.Frames[1], "2 rows affected, last_row_id=7") {
+			t.Errorf("cached=%t: expected a notice-only frame for the INSERT, got %+v", cached, res.Frames[1])
+		}
+		if v, _ := res.Frames[2].Fields[0].ConcreteAt(0); v != int64(3) {
+			t.Errorf("cached=%t: expected total 3, got %v", cached, v)
+		}
+	}
+}
+
+func TestQueryIntegerDetection(t *testing.T) {
+	rows := [][]interface{}{
+		{float64(1), 1.5, 1e17},
+		{nil, float64(2), float64(4)},
+		{float64(-3), nil, nil},
+	}
+	tests := []struct {
+		jsonData string
+		want     []data.FieldType
+	}{
+		// Whole numbers become int64, including integer literals too large for float64 to
+		// hold exactly; a column with a fraction stays float64.
+		{`{"accountId":"acc","databaseId":"db"}`, []data.FieldType{data.FieldTypeNullableInt64, data.FieldTypeNullableFloat64, data.FieldTypeNullableInt64}},
+		{`{"accountId":"acc","databaseId":"db","numericsAsFloat":true}`, []data.FieldType{data.FieldTypeNullableFloat64, data.FieldTypeNullableFloat64, data.FieldTypeNullableFloat64}},
+	}
+	for _, tt := range tests {
+		ds := newTestDatasource(t, tt.jsonData, rawResponse([]string{"id", "ratio", "big"}, rows))
+		res := runQuery(t, ds, `{"queryText":"SELECT id, ratio, big FROM t"}`)
+		if res.Error != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.jsonData, res.Error)
+		}
+		for i, want := range tt.want {
+			if got := res.Frames[0].Fields[i].Type(); got != want {
+				t.Errorf("%s: field %s: expected %s, got %s", tt.jsonData, res.Frames[0].Fields[i].Name, want, got)
+			}
+		}
+	}
+
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, rawResponse([]string{"id"}, rows))
+	res := runQuery(t, ds, `{"queryText":"SELECT id FROM t"}`)
+	if v, _ := res.Frames[0].Fields[0].ConcreteAt(2); v != int64(-3) {
+		t.Errorf("expected -3 as int64, got %v (%T)", v, v)
+	}
+}
+
+func TestQueryColumnTypes(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, rawResponse(
+		[]string{"s", "f", "i", "b", "t", "inferred"},
+		[][]interface{}{
+			{float64(1), "1.5", float64(7), float64(1), "2024-01-01 00:00:00", float64(1)},
+			{"x", "abc", "8", "yes", "not a time", float64(2)},
+			{nil, float64(2), 1.5, "false", float64(0), nil},
+			{nil, nil, 1e21, nil, nil, nil},
+		},
+	))
+
+	res := runQuery(t, ds, `{"queryText":"SELECT * FROM t","columnTypes":{"s":"string","f":"float64","i":"int64","b":"bool","t":"time"}}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	frame := res.Frames[0]
+	tests := []struct {
+		field  string
+		typ    data.FieldType
+		values []interface{}
+		failed int
+	}{
+		{"s", data.FieldTypeNullableString, []interface{}{"1", "x", nil, nil}, 0},
+		{"f", data.FieldTypeNullableFloat64, []interface{}{1.5, nil, 2.0, nil}, 1},
+		{"i", data.FieldTypeNullableInt64, []interface{}{int64(7), int64(8), nil, nil}, 2},
+		{"b", data.FieldTypeNullableBool, []interface{}{true, nil, false, nil}, 1},
+		{"t", data.FieldTypeNullableTime, []interface{}{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), nil, time.Unix(0, 0).UTC(), nil}, 1},
+		{"inferred", data.FieldTypeNullableInt64, []interface{}{int64(1), int64(2), nil, nil}, 0},
+	}
+	for i, tt := range tests {
+		field := frame.Fields[i]
+		if field.Name != tt.field || field.Type() != tt.typ {
+			t.Errorf("field %d: expected %s of type %s, got %s of type %s", i, tt.field, tt.typ, field.Name, field.Type())
+			continue
+		}
+		for row, want := range tt.values {
+			got, ok := field.ConcreteAt(row)
+			if !ok {
+				got = nil
+			}
+			if got != want {
+				t.Errorf("%s row %d: expected %v, got %v", tt.field, row, want, got)
+			}
+		}
+		if tt.failed > 0 && !hasNotice(frame, fmt.Sprintf("%d values could not be converted in column %s", tt.failed, tt.field)) {
+			t.Errorf("%s: expected a notice for %d failed conversions, got %+v", tt.field, tt.failed, frame.Meta.Notices)
+		}
+	}
+
+	res = runQuery(t, ds, `{"queryText":"SELECT * FROM t","columnTypes":{"s":"text"}}`)
+	if res.Error == nil || !strings.Contains(res.Error.Error(), `unknown type "text"`) {
+		t.Errorf("expected an unknown type to be rejected, got %v", res.Error)
+	}
+}
+
+func TestQueryFrameMetaTables(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, rawResponse([]string{"id"}, [][]interface{}{{float64(1)}}))
+
+	res := runQuery(t, ds, `{"queryText":"WITH recent AS (SELECT * FROM events) SELECT r.id FROM recent r JOIN main.users u ON u.id = r.user_id"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	encoded, err := json.Marshal(res.Frames[0].Meta.Custom)
+	if err != nil {
+		t.Fatalf("could not encode custom meta: %v", err)
+	}
+	if want := `{"tables":["events","main.users"]}`; string(encoded) != want {
+		t.Errorf("expected custom meta %s, got %s", want, encoded)
+	}
+}
+
+func TestQueryKeepsBigIntegers(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"success":true,"result":[{"success":true,"results":{"columns":["id"],"rows":[[9007199254740993],[7]]}}]}`))
+	})
+	res := runQuery(t, ds, `{"queryText":"SELECT id FROM t"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	field := res.Frames[0].Fields[0]
+	if field.Type() != data.FieldTypeNullableInt64 {
+		t.Fatalf("expected a nullable int64 field, got %s", field.Type())
+	}
+	if v, _ := field.ConcreteAt(0); v != int64(9007199254740993) {
+		t.Errorf("expected 9007199254740993 to survive intact, got %v", v)
+	}
+}
+
+func TestQueryTruncatesColumnsOverMaxColumns(t *testing.T) {
+	columns := []string{"z", "b", "y", "a", "x"}
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","maxColumns":3}`,
+		rawResponse(columns, [][]interface{}{{"1", "2", "3", "4", "5"}}))
+
+	res := runQuery(t, ds, `{"queryText":"SELECT * FROM wide"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	frame := res.Frames[0]
+	if len(frame.Fields) != 3 {
+		t.Fatalf("expected 3 fields, got %d", len(frame.Fields))
+	}
+	for i, name := range columns[:3] {
+		if frame.Fields[i].Name != name {
+			t.Errorf("field %d: expected %s, got %s", i, name, frame.Fields[i].Name)
+		}
+		if v, _ := frame.Fields[i].ConcreteAt(0); v != fmt.Sprint(i+1) {
+			t.Errorf("field %s: expected value %d, got %v", name, i+1, v)
+		}
+	}
+	if !hasNotice(frame, "2 columns were omitted") || !hasNotice(frame, ": a, x.") {
+		t.Errorf("expected a notice about the omitted columns, got %+v", frame.Meta.Notices)
+	}
+}
+
+// healthLatency matches the round-trip time reported by a successful health check.
+var healthLatency = regexp.MustCompile(` in \d+ms\.$`)
+
+// withoutLatency zeroes the latency in a health check message, which varies between runs.
+func withoutLatency(message string) string {
+	return healthLatency.ReplaceAllString(message, " in 0ms.")
+}
+
+func TestCheckHealthReportsLatency(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			time.Sleep(20 * time.Millisecond)
+			_, _ = w.Write([]byte(`{"success":true,"errors":[],"result":[{"success":true,"meta":{}}]}`))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+	res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	match := regexp.MustCompile(`^Health check successful: .* in (\d+)ms\.$`).FindStringSubmatch(res.Message)
+	if match == nil {
+		t.Fatalf("expected a latency figure in the message, got %q", res.Message)
+	}
+	if ms, _ := strconv.Atoi(match[1]); ms < 20 {
+		t.Errorf("expected a latency of at least 20ms, got %s", match[1])
+	}
+}
+
+func TestCheckHealthVerifiesToken(t *testing.T) {
+	d1Forbidden := `{"success":false,"errors":[{"code":7403,"message":"The given account is not valid or is not authorized to access this service"}]}`
+	tests := []struct {
+		name         string
+		verifyStatus int
+		verifyBody   string
+		queryStatus  int
+		queryBody    string
+		want         string
+	}{
+		{
+			name:         "valid token",
+			verifyStatus: http.StatusOK,
+			verifyBody:   `{"success":true,"errors":[],"result":{"id":"t","status":"active"}}`,
+			queryStatus:  http.StatusOK,
+			queryBody:    `{"success":true,"errors":[],"result":[{"success":true,"meta":{}}]}`,
+			want:         "Health check successful: Successfully connected to Cloudflare D1 in 0ms.",
+		},
+		{
+			name:         "invalid token",
+			verifyStatus: http.StatusUnauthorized,
+			verifyBody:   `{"success":false,"errors":[{"code":1000,"message":"Invalid API Token"}]}`,
+			want:         "Health check failed: API token is invalid: Code 1000: Invalid API Token",
+		},
+		{
+			name:         "expired token",
+			verifyStatus: http.StatusOK,
+			verifyBody:   `{"success":true,"errors":[],"result":{"id":"t","status":"expired"}}`,
+			want:         "Health check failed: API token is expired",
+		},
+		{
+			name:         "insufficient scope",
+			verifyStatus: http.StatusOK,
+			verifyBody:   `{"success":true,"errors":[],"result":{"id":"t","status":"active"}}`,
+			queryStatus:  http.StatusForbidden,
+			queryBody:    d1Forbidden,
+			want:         "Health check failed: API token is valid but lacks D1 read permission (Code 7403: The given account is not valid or is not authorized to access this service)",
+		},
+		{
+			// Without a verification result the query's own error is reported as before.
+			name:         "verification unavailable",
+			verifyStatus: http.StatusServiceUnavailable,
+			verifyBody:   `upstream unavailable`,
+			queryStatus:  http.StatusForbidden,
+			queryBody:    d1Forbidden,
+			want:         "D1 API request failed with status 403 Forbidden: Code 7403: The given account is not valid or is not authorized to access this service",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queried := false
+			ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.URL.Path == "/user/tokens/verify":
+					w.WriteHeader(tt.verifyStatus)
+					_, _ = w.Write([]byte(tt.verifyBody))
+				case r.Method == http.MethodPost:
+					queried = true
+					w.WriteHeader(tt.queryStatus)
+					_, _ = w.Write([]byte(tt.queryBody))
+				default:
+					w.WriteHeader(http.StatusNotFound)
+					_, _ = w.Write([]byte(`{"success":false,"errors":[]}`))
+				}
+			})
+			res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if withoutLatency(res.Message) != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, res.Message)
+			}
+			if tt.queryStatus == 0 && queried {
+				t.Error("expected the health check query to be skipped for a rejected token")
+			}
+		})
+	}
+}
+
+func TestCheckHealthBoundedByQueryTimeout(t *testing.T) {
+	release := make(chan struct{})
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","queryTimeoutSeconds":1}`, func(w http.ResponseWriter, r *http.Request) {
+		<-release // Neither the token check nor the query answers while the test runs
+	})
+	t.Cleanup(func() { close(release) })
+
+	start := time.Now()
+	res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("expected the health check to give up after the 1s query timeout, took %s", elapsed)
+	}
+	if res.Status != backend.HealthStatusError {
+		t.Errorf("expected a failed health check, got %v: %s", res.Status, res.Message)
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","queryTimeoutSeconds":10,"maxQueryTimeoutSeconds":30}`, rawResponse(nil, nil))
+	tests := []struct {
+		name           string
+		timeoutSeconds float64
+		want           time.Duration
+	}{
+		{"no override", 0, 10 * time.Second},
+		{"override below max", 5, 5 * time.Second},
+		{"override above max", 120, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := ds.queryTimeout(queryModel{TimeoutSeconds: tt.timeoutSeconds}); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestQueryTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	// Registered after the server's cleanup so it runs first and lets the handler return.
+	t.Cleanup(func() { close(release) })
+
+	res := runQuery(t, ds, `{"queryText":"SELECT * FROM big","timeoutSeconds":0.05}`)
+	if res.Error == nil || res.Error.Error() != "query timed out after 50ms" {
+		t.Fatalf("expected a timeout error, got %v", res.Error)
+	}
+	if res.ErrorSource != backend.ErrorSourceDownstream {
+		t.Errorf("expected a downstream error, got %s", res.ErrorSource)
+	}
+}
+
+func TestQueryDataTotalTimeout(t *testing.T) {
+	release := make(chan struct{})
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","queryConcurrency":1,"totalTimeoutSeconds":1}`, func(w http.ResponseWriter, r *http.Request) {
+		var sent models.D1QueryRequest
+		_ = json.NewDecoder(r.Body).Decode(&sent)
+		if sent.SQL != "SELECT 1 AS n" {
+			<-release
+			return
+		}
+		rawResponse([]string{"n"}, [][]interface{}{{float64(1)}})(w, r)
+	})
+	// Registered after the server's cleanup so it runs first and lets the handlers return.
+	t.Cleanup(func() { close(release) })
+
+	start := time.Now()
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{RefID: "A", JSON: []byte(`{"queryText":"SELECT 1 AS n"}`)},
+			{RefID: "B", JSON: []byte(`{"queryText":"SELECT * FROM slow"}`)},
+			{RefID: "C", JSON: []byte(`{"queryText":"SELECT * FROM slower"}`)},
+			{RefID: "D", JSON: []byte(`{"queryText":"SELECT * FROM slowest"}`)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("QueryData returned error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the overall timeout to stop the request, took %s", elapsed)
+	}
+
+	if res := resp.Responses["A"]; res.Error != nil || len(res.Frames) != 1 {
+		t.Errorf("expected the query finished in time to keep its result, got %v", res.Error)
+	}
+	for _, refID := range []string{"B", "C", "D"} {
+		res := resp.Responses[refID]
+		if res.Error == nil || res.Error.Error() != "request exceeded the overall timeout of 1s" {
+			t.Errorf("%s: expected the overall timeout error, got %v", refID, res.Error)
+		}
+		if res.ErrorSource != backend.ErrorSourceDownstream {
+			t.Errorf("%s: expected a downstream error, got %s", refID, res.ErrorSource)
+		}
+	}
+}
+
+func TestQueryTimeRangeIgnoredNotice(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, rawResponse([]string{"n"}, [][]interface{}{{float64(1)}}))
+	now := time.Now()
+	tests := []struct {
+		queryJSON  string
+		timeRange  backend.TimeRange
+		wantNotice bool
+	}{
+		{`{"queryText":"SELECT n FROM t"}`, backend.TimeRange{From: now.Add(-time.Hour), To: now}, true},
+		{`{"queryText":"SELECT n FROM t WHERE $__timeFilter(created_at)"}`, backend.TimeRange{From: now.Add(-time.Hour), To: now}, false},
+		{`{"queryText":"SELECT n FROM t WHERE created_at > $__timeFrom()"}`, backend.TimeRange{From: now.Add(-time.Hour), To: now}, false},
+		{`{"queryText":"SELECT n FROM t","suppressTimeRangeNotice":true}`, backend.TimeRange{From: now.Add(-time.Hour), To: now}, false},
+		{`{"queryText":"SELECT n FROM t"}`, backend.TimeRange{}, false},
+	}
+	for _, tt := range tests {
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{RefID: "A", JSON: []byte(tt.queryJSON), TimeRange: tt.timeRange}},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		res := resp.Responses["A"]
+		if res.Error != nil {
+			t.Fatalf("%s: unexpected query error: %v", tt.queryJSON, res.Error)
+		}
+		if got := hasNotice(res.Frames[0], "ignores the dashboard time range"); got != tt.wantNotice {
+			t.Errorf("%s: expected notice %t, got %t", tt.queryJSON, tt.wantNotice, got)
+		}
+	}
+}
+
+// closedPortURL returns the URL of a local port nothing listens on, so connecting to it
+// is refused.
+func closedPortURL(t *testing.T) (string, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not reserve a port: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return "http://" + addr, addr
+}
+
+func TestQueryRetriesConnectionRefused(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","retryOnConnectionError":true}`, nil)
+	baseURL, addr := closedPortURL(t)
+	setBaseURL(ds, baseURL)
+
+	// The server only starts listening while the first retry waits, so the first
+	// attempt is refused and the second succeeds.
+	waits := 0
+	original := waitBeforeRetry
+	t.Cleanup(func() { waitBeforeRetry = original })
+	waitBeforeRetry = func(ctx context.Context, attempt int) error {
+		waits++
+		if waits == 1 {
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				t.Errorf("could not listen on %s: %v", addr, err)
+				return err
+			}
+			srv := httptest.NewUnstartedServer(rawResponse([]string{"n"}, [][]interface{}{{float64(1)}}))
+			srv.Listener.Close()
+			srv.Listener = l
+			srv.Start()
+			t.Cleanup(srv.Close)
+		}
+		return nil
+	}
+
+	res := runQuery(t, ds, `{"queryText":"SELECT 1 AS n"}`)
+	if res.Error != nil {
+		t.Fatalf("expected the retry to succeed, got %v", res.Error)
+	}
+	if waits != 1 || res.Frames[0].Rows() != 1 {
+		t.Errorf("expected one retry returning a row, got %d retries and %d rows", waits, res.Frames[0].Rows())
+	}
+}
+
+func TestQueryConnectionRetriesAreOptInAndCapped(t *testing.T) {
+	waits := 0
+	original := waitBeforeRetry
+	t.Cleanup(func() { waitBeforeRetry = original })
+	waitBeforeRetry = func(ctx context.Context, attempt int) error {
+		waits++
+		return nil
+	}
+
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, nil)
+	baseURL, _ := closedPortURL(t)
+	setBaseURL(ds, baseURL)
+	if res := runQuery(t, ds, `{"queryText":"SELECT 1"}`); res.Error == nil || waits != 0 {
+		t.Errorf("expected a failure without retries, got %d retries (%v)", waits, res.Error)
+	}
+
+	ds = newTestDatasource(t, `{"accountId":"acc","databaseId":"db","retryOnConnectionError":true,"maxAttempts":4}`, nil)
+	baseURL, _ = closedPortURL(t)
+	setBaseURL(ds, baseURL)
+	if res := runQuery(t, ds, `{"queryText":"SELECT 1"}`); res.Error == nil || waits != 3 {
+		t.Errorf("expected a failure after 3 retries, got %d retries (%v)", waits, res.Error)
+	}
+}
+
+func TestQueryWriteNotResentAfterReset(t *testing.T) {
+	waits := 0
+	original := waitBeforeRetry
+	t.Cleanup(func() { waitBeforeRetry = original })
+	waitBeforeRetry = func(ctx context.Context, attempt int) error {
+		waits++
+		return nil
+	}
+
+	// The server reads the whole request, so it may have been applied, then resets the
+	// connection instead of answering.
+	var requests atomic.Int32
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","retryOnConnectionError":true}`, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_, _ = io.Copy(io.Discard, r.Body)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("could not hijack the connection: %v", err)
+			return
+		}
+		_ = conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	})
+
+	res := runQuery(t, ds, `{"queryText":"INSERT INTO t (n) VALUES (1)"}`)
+	if res.Error == nil {
+		t.Fatal("expected the reset to fail the query")
+	}
+	if n := requests.Load(); n != 1 || waits != 0 {
+		t.Errorf("expected the write to be sent once without retries, got %d requests and %d retries", n, waits)
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	refused := &url.Error{Op: "Post", URL: "http://x", Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}
+	dns := &url.Error{Op: "Post", URL: "http://x", Err: &net.DNSError{Err: "no such host", Name: "x", IsTimeout: true}}
+	canceled := &url.Error{Op: "Post", URL: "http://x", Err: context.Canceled}
+	deadline := &url.Error{Op: "Post", URL: "http://x", Err: context.DeadlineExceeded}
+	dialTimeout := &url.Error{Op: "Post", URL: "http://x", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("i/o timeout")}}
+	reset := &url.Error{Op: "Post", URL: "http://x", Err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}}
+	other := &url.Error{Op: "Post", URL: "http://x", Err: errors.New("tls: bad certificate")}
+
+	ctx := context.Background()
+	if !isConnectionError(ctx, refused) || !isConnectionError(ctx, dns) || !isConnectionError(ctx, dialTimeout) {
+		t.Error("expected refused connections, DNS failures and dial timeouts to be retryable")
+	}
+	if isConnectionError(ctx, canceled) || isConnectionError(ctx, deadline) || isConnectionError(ctx, other) {
+		t.Error("expected cancellation, deadlines and non-network errors not to be retryable")
+	}
+	if isConnectionError(ctx, reset) {
+		t.Error("expected a reset after connecting not to be retryable")
+	}
+
+	done, cancel := context.WithCancel(ctx)
+	cancel()
+	if isConnectionError(done, refused) {
+		t.Error("expected no retry once the context is done")
+	}
+}
+
+func TestQueryErrorsAsData(t *testing.T) {
+	status := http.StatusOK
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(models.D1RawAPIResponse{
+			Success: false,
+			Errors:  []models.D1Error{{Code: 7500, Message: "no such table: t"}, {Code: 7501, Message: "second"}},
+		})
+	})
+
+	// Without the option the query fails as before.
+	if res := runQuery(t, ds, `{"queryText":"SELECT * FROM t"}`); res.Error == nil {
+		t.Fatal("expected an error without errorsAsData")
+	}
+
+	for _, s := range []int{http.StatusOK, http.StatusBadRequest} {
+		status = s
+		res := runQuery(t, ds, `{"queryText":"SELECT * FROM t","errorsAsData":true}`)
+		if res.Error != nil {
+			t.Fatalf("status %d: expected the error as data, got %v", s, res.Error)
+		}
+		frame := res.Frames[0]
+		if frame.Rows() != 2 {
+			t.Fatalf("status %d: expected a row per error, got %d", s, frame.Rows())
+		}
+		if code := frame.Fields[0].At(0).(*int64); code == nil || *code != 7500 {
+			t.Errorf("status %d: expected code 7500, got %v", s, code)
+		}
+		if got := frame.Fields[1].At(0); got != "no such table: t" {
+			t.Errorf("status %d: unexpected message %q", s, got)
+		}
+		if got := frame.Fields[1].At(1); got != "second" {
+			t.Errorf("status %d: unexpected message %q", s, got)
+		}
+	}
+
+	// Errors raised before D1 is called have no code.
+	res := runQuery(t, ds, `{"queryText":"SELECT * FROM t","latColumn":"lat","errorsAsData":true}`)
+	if res.Error != nil {
+		t.Fatalf("expected the error as data, got %v", res.Error)
+	}
+	frame := res.Frames[0]
+	if frame.Rows() != 1 || frame.Fields[0].At(0).(*int64) != nil {
+		t.Fatalf("expected a single row with a null code, got %d rows", frame.Rows())
+	}
+	if got := frame.Fields[1].At(0).(string); !strings.Contains(got, "latColumn and lonColumn") {
+		t.Errorf("unexpected message %q", got)
+	}
+}
+
+func TestQueryColumnLabels(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, rawResponse(
+		[]string{"time", `cpu{host=a}`, `cpu{host=b}`},
+		[][]interface{}{{"2024-01-01T00:00:00Z", float64(1), float64(2)}},
+	))
+
+	res := runQuery(t, ds, `{"queryText":"SELECT time, a AS \"cpu{host=a}\", b AS \"cpu{host=b}\" FROM metrics"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if name := res.Frames[0].Fields[1].Name; name != `cpu{host=a}` {
+		t.Errorf("expected column names to be kept without columnLabels, got %q", name)
+	}
+
+	res = runQuery(t, ds, `{"queryText":"SELECT time, a AS \"cpu{host=a}\", b AS \"cpu{host=b}\" FROM metrics","columnLabels":true}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	for i, host := range []string{"a", "b"} {
+		field := res.Frames[0].Fields[i+1]
+		if field.Name != "cpu" || field.Labels["host"] != host {
+			t.Errorf("expected cpu with host=%s, got %q %v", host, field.Name, field.Labels)
+		}
+	}
+}
+
+func TestQueryNonFiniteNumbers(t *testing.T) {
+	handler := rawResponse([]string{"ratio"}, [][]interface{}{{"NaN"}, {1.5}, {"Infinity"}, {"-Infinity"}, {nil}})
+
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, handler)
+	res := runQuery(t, ds, `{"queryText":"SELECT ratio FROM t"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	field := res.Frames[0].Fields[0]
+	if field.Type() != data.FieldTypeNullableFloat64 {
+		t.Fatalf("expected a float64 field, got %s", field.Type())
+	}
+	checks := []func(*float64) bool{
+		func(f *float64) bool { return f != nil && math.IsNaN(*f) },
+		func(f *float64) bool { return f != nil && *f == 1.5 },
+		func(f *float64) bool { return f != nil && math.IsInf(*f, 1) },
+		func(f *float64) bool { return f != nil && math.IsInf(*f, -1) },
+		func(f *float64) bool { return f == nil },
+	}
+	for i, check := range checks {
+		if got := field.At(i).(*float64); !check(got) {
+			t.Errorf("row %d: unexpected value %v", i, got)
+		}
+	}
+	if hasNotice(res.Frames[0], "could not be converted") {
+		t.Error("expected non-finite strings to convert")
+	}
+
+	ds = newTestDatasource(t, `{"accountId":"acc","databaseId":"db","nonFiniteAsNull":true}`, handler)
+	res = runQuery(t, ds, `{"queryText":"SELECT ratio FROM t"}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	field = res.Frames[0].Fields[0]
+	for i := 0; i < field.Len(); i++ {
+		if got := field.At(i).(*float64); (got != nil) != (i == 1) {
+			t.Errorf("row %d: expected only finite values to be kept, got %v", i, got)
+		}
+	}
+}
+
+func TestQueryNumericNullability(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, rawResponse(
+		[]string{"ratio", "count", "declared"},
+		[][]interface{}{
+			{0.0, float64(0), float64(0)},
+			{nil, nil, nil},
+			{1.5, float64(3), "bad"},
+			{"bad", nil, 2.5},
+		},
+	))
+	res := runQuery(t, ds, `{"queryText":"SELECT ratio, count, declared FROM t","columnTypes":{"declared":"float64"}}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	frame := res.Frames[0]
+
+	wantFloats := map[string][]*float64{
+		"ratio":    {ptr(0.0), nil, ptr(1.5), nil},
+		"declared": {ptr(0.0), nil, nil, ptr(2.5)},
+	}
+	for name, want := range wantFloats {
+		field, _ := frame.FieldByName(name)
+		if field == nil || field.Type() != data.FieldTypeNullableFloat64 {
+			t.Fatalf("expected %s to be a nullable float64 field, got %v", name, field)
+		}
+		for i, w := range want {
+			if got := field.At(i).(*float64); !reflect.DeepEqual(got, w) {
+				t.Errorf("%s row %d: expected %v, got %v", name, i, w, got)
+			}
+		}
+		if !hasNotice(frame, "1 values could not be converted in column "+name) {
+			t.Errorf("expected a notice counting the failed value of %s, got %+v", name, frame.Meta.Notices)
+		}
+	}
+
+	count, _ := frame.FieldByName("count")
+	if count == nil || count.Type() != data.FieldTypeNullableInt64 {
+		t.Fatalf("expected count to be a nullable int64 field, got %v", count)
+	}
+	for i, w := range []*int64{ptr(int64(0)), nil, ptr(int64(3)), nil} {
+		if got := count.At(i).(*int64); !reflect.DeepEqual(got, w) {
+			t.Errorf("count row %d: expected %v, got %v", i, w, got)
+		}
+	}
+}
+
+func TestQueryRawStrings(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, rawResponse(
+		[]string{"id", "ratio", "active", "created_at", "note"},
+		[][]interface{}{
+			{float64(7), 0.00001, true, "2024-01-01T00:00:00Z", nil},
+			{float64(8), 2.5, false, "2024-01-02T00:00:00Z", "x"},
+		},
+	))
+
+	res := runQuery(t, ds, `{"queryText":"SELECT * FROM t","rawStrings":true,"columnTypes":{"id":"int64"}}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	frame := res.Frames[0]
+	want := [][]*string{
+		{ptr("7"), ptr("0.00001"), ptr("true"), ptr("2024-01-01T00:00:00Z"), nil},
+		{ptr("8"), ptr("2.5"), ptr("false"), ptr("2024-01-02T00:00:00Z"), ptr("x")},
+	}
+	for _, field := range frame.Fields {
+		if field.Type() != data.FieldTypeNullableString {
+			t.Errorf("field %s: expected a string field, got %s", field.Name, field.Type())
+		}
+	}
+	for row, values := range want {
+		for col, value := range values {
+			if got := frame.Fields[col].At(row).(*string); !reflect.DeepEqual(got, value) {
+				t.Errorf("row %d, field %s: expected %v, got %v", row, frame.Fields[col].Name, value, got)
+			}
+		}
+	}
+	if hasNotice(frame, "Parsed string columns as timestamps") {
+		t.Error("expected no timestamp parsing with rawStrings")
+	}
+}
+
+func TestQueryServedByMeta(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(models.D1RawAPIResponse{
+			Success: true,
+			Result: []models.D1RawResultItem{{
+				Success: true,
+				Meta:    models.D1Meta{ServedBy: "v3-prod", ServedByRegion: "WEUR"},
+				Results: &models.D1RawQueryActualResult{Columns: []string{"host", "n"}, Rows: [][]interface{}{{"a", float64(1)}, {"b", float64(2)}}},
+			}},
+		})
+	})
+
+	for _, query := range []string{
+		`{"queryText":"SELECT host, n FROM t"}`,
+		`{"queryText":"SELECT host, n FROM t","partitionBy":"host"}`,
+	} {
+		res := runQuery(t, ds, query)
+		if res.Error != nil {
+			t.Fatalf("%s: unexpected error: %v", query, res.Error)
+		}
+		for _, frame := range res.Frames {
+			custom, ok := frame.Meta.Custom.(*frameCustomMeta)
+			if !ok || custom.ServedBy != "v3-prod" || custom.ServedByRegion != "WEUR" {
+				t.Errorf("%s: expected frame %s to name the serving instance, got %+v", query, frame.Name, frame.Meta.Custom)
+			}
+			for _, field := range frame.Fields {
+				if field.Name == "served_by" || field.Labels["served_by"] != "" {
+					t.Errorf("%s: expected served_by to stay out of the data", query)
+				}
+			}
+		}
+	}
+
+	encoded, err := json.Marshal(runQuery(t, ds, `{"queryText":"SELECT host, n FROM t"}`).Frames[0].Meta.Custom)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(string(encoded), `"served_by":"v3-prod","served_by_region":"WEUR"`) {
+		t.Errorf("expected served_by in the encoded meta, got %s", encoded)
+	}
+}
@@ -0,0 +1,88 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/olipayne/grafana-cloudflare-d1-datasource/pkg/models"
+)
+
+// Supported values of the per-query endpoint option.
+const (
+	endpointRaw   = models.EndpointRaw   // rows as ordered arrays; the default
+	endpointQuery = models.EndpointQuery // rows as objects keyed by column name
+)
+
+// defaultEndpoint is the endpoint of queries without an endpoint option: the configured
+// one, or raw.
+func defaultEndpoint(settings *models.PluginSettings) string {
+	if settings.Endpoint == "" {
+		return endpointRaw
+	}
+	return settings.Endpoint
+}
+
+// checkEndpoint returns an error unless endpoint is a supported D1 query endpoint.
+func checkEndpoint(endpoint string) error {
+	if endpoint != endpointRaw && endpoint != endpointQuery {
+		return fmt.Errorf("unknown endpoint %q: must be raw or query", endpoint)
+	}
+	return nil
+}
+
+// decodeD1Response decodes a response body of the given endpoint. /query responses are
+// converted to the /raw shape so both are turned into frames the same way.
+func decodeD1Response(endpoint string, body []byte) (models.D1RawAPIResponse, error) {
+	var rawResponse models.D1RawAPIResponse
+	if endpoint == endpointRaw {
+		err := json.Unmarshal(body, &rawResponse)
+		return rawResponse, err
+	}
+
+	var queryResponse models.D1APIResponse
+	if err := json.Unmarshal(body, &queryResponse); err != nil {
+		return rawResponse, err
+	}
+	rawResponse = models.D1RawAPIResponse{
+		Success:  queryResponse.Success,
+		Errors:   queryResponse.Errors,
+		Messages: queryResponse.Messages,
+	}
+	for _, result := range queryResponse.Result {
+		item := models.D1RawResultItem{
+			Meta:    result.Meta,
+			Success: result.Success,
+			Error:   result.Error,
+		}
+		// Null results stay missing rather than becoming an empty result set.
+		if result.Results != nil {
+			item.Results = rowObjectsToRaw(result.Results)
+		}
+		rawResponse.Result = append(rawResponse.Result, item)
+	}
+	return rawResponse, nil
+}
+
+// rowObjectsToRaw converts /query row objects into ordered columns and rows. Columns
+// keep the order of the first row they appear in; a column missing from a row is NULL
+// in that row.
+func rowObjectsToRaw(rows []models.D1Row) *models.D1RawQueryActualResult {
+	result := &models.D1RawQueryActualResult{Columns: []string{}, Rows: make([][]interface{}, 0, len(rows))}
+	index := map[string]int{}
+	for _, row := range rows {
+		for _, col := range row.Columns {
+			if _, ok := index[col]; !ok {
+				index[col] = len(result.Columns)
+				result.Columns = append(result.Columns, col)
+			}
+		}
+	}
+	for _, row := range rows {
+		values := make([]interface{}, len(result.Columns))
+		for i, col := range row.Columns {
+			values[index[col]] = row.Values[i]
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	return result
+}
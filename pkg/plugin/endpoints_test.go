@@ -0,0 +1,40 @@
+package plugin
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/olipayne/grafana-cloudflare-d1-datasource/pkg/models"
+)
+
+func TestRowObjectsToRawFillsMissingColumns(t *testing.T) {
+	var rows []models.D1Row
+	if err := json.Unmarshal([]byte(`[{"b":1,"a":"x"},{"a":"y","c":null}]`), &rows); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	result := rowObjectsToRaw(rows)
+	if want := []string{"b", "a", "c"}; !reflect.DeepEqual(result.Columns, want) {
+		t.Errorf("expected columns %v, got %v", want, result.Columns)
+	}
+	if want := [][]interface{}{{float64(1), "x", nil}, {nil, "y", nil}}; !reflect.DeepEqual(result.Rows, want) {
+		t.Errorf("expected rows %v, got %v", want, result.Rows)
+	}
+}
+
+func TestDecodeD1ResponseKeepsBigIntegers(t *testing.T) {
+	bodies := map[string]string{
+		endpointRaw:   `{"success":true,"result":[{"success":true,"results":{"columns":["id","small","huge"],"rows":[[9007199254740993,1.5,123456789012345678901]]}}]}`,
+		endpointQuery: `{"success":true,"result":[{"success":true,"results":[{"id":9007199254740993,"small":1.5,"huge":123456789012345678901}]}]}`,
+	}
+	for endpoint, body := range bodies {
+		resp, err := decodeD1Response(endpoint, []byte(body))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", endpoint, err)
+		}
+		want := []interface{}{int64(9007199254740993), 1.5, "123456789012345678901"}
+		if got := resp.Result[0].Results.Rows[0]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected row %#v, got %#v", endpoint, want, got)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/olipayne/grafana-cloudflare-d1-datasource/pkg/models"
+)
+
+// databaseColumn is the column a query with databaseIds adds to its result, naming the
+// database each row came from.
+const databaseColumn = "__database"
+
+// databaseIDPattern matches a plain D1 database ID. Anything else, such as a path or
+// query string, would change the URL the API token is sent to.
+var databaseIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// checkDatabaseIDs returns an error if the databaseIds of qm can't be queried.
+func checkDatabaseIDs(qm queryModel) error {
+	if len(qm.DatabaseIDs) == 0 {
+		return nil
+	}
+	if qm.Endpoint == endpointQuery {
+		return fmt.Errorf("databaseIds can't be combined with the query endpoint; only the raw endpoint's first statement is merged")
+	}
+	if qm.SessionBookmark != "" {
+		return fmt.Errorf("databaseIds can't be combined with sessionBookmark, as a bookmark belongs to a single database")
+	}
+	seen := make(map[string]bool, len(qm.DatabaseIDs))
+	for _, id := range qm.DatabaseIDs {
+		if strings.TrimSpace(id) == "" {
+			return fmt.Errorf("databaseIds must not contain empty IDs")
+		}
+		if !databaseIDPattern.MatchString(id) {
+			return fmt.Errorf("databaseIds contains %q, which is not a D1 database ID", id)
+		}
+		if seen[id] {
+			return fmt.Errorf("databaseIds lists database %q more than once", id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// clientFor returns the client sending queries to the database with the given ID, other
+// than the configured one.
+func (d *Datasource) clientFor(databaseID string) D1Client {
+	return d.limit(newHTTPD1Client(d.settings, d.transport, d.baseURL, databaseID))
+}
+
+// fanOut runs the interpolated SQL against each of qm.DatabaseIDs, at most
+// QueryConcurrency at a time, and merges the rows of their first statement into one
+// result with a __database column. A database that fails, or whose columns differ from
+// those of the first one, is left out with a warning notice; only when every database
+// fails does the query fail, with the first database's error.
+func (d *Datasource) fanOut(ctx context.Context, refID string, qm queryModel, interpolatedQuery string) (d1Result, []data.Notice, backend.DataResponse) {
+	type outcome struct {
+		fetched d1Result
+		failed  backend.DataResponse
+	}
+	outcomes := make([]outcome, len(qm.DatabaseIDs))
+
+	concurrency := d.settings.QueryConcurrency
+	if concurrency <= 0 {
+		concurrency = models.DefaultQueryConcurrency
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for i, id := range qm.DatabaseIDs {
+		// The configured database fails over to its replica and is guarded by the breaker,
+		// as it is without databaseIds. A dead other database must not trip the breaker for
+		// every other query; its failures are already notices.
+		send := d.withBreaker(d.sendWithFailover)
+		if id != d.settings.DatabaseID {
+			client := d.clientFor(id)
+			send = func(ctx context.Context, endpoint string, payload models.D1QueryRequest) (*D1Response, bool, error) {
+				resp, err := client.Send(ctx, endpoint, payload)
+				return resp, false, err
+			}
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			outcomes[i].fetched, outcomes[i].failed = d.fetchResult(ctx, refID, qm, interpolatedQuery, send)
+		}(i)
+	}
+	wg.Wait()
+
+	var (
+		merged      d1Result
+		columns     []string
+		firstID     string
+		rows        [][]interface{}
+		meta        models.D1Meta
+		notices     []data.Notice
+		succeeded   int
+		firstFailed = -1
+	)
+	for i, o := range outcomes {
+		id := qm.DatabaseIDs[i]
+		if o.failed.Error != nil {
+			d.logger.Warn("Database of a fanned-out query failed", "databaseId", id, "error", o.failed.Error)
+			notices = append(notices, data.Notice{
+				Severity: data.NoticeSeverityWarning,
+				Text:     fmt.Sprintf("Database %s failed and is missing from the result: %s", id, o.failed.Error),
+			})
+			if firstFailed < 0 {
+				firstFailed = i
+			}
+			continue
+		}
+		succeeded++
+
+		var result *models.D1RawResultItem
+		if len(o.fetched.response.Result) > 0 {
+			result = &o.fetched.response.Result[0]
+		}
+		set := resultSet(result)
+		if set == nil {
+			continue
+		}
+		if columns == nil {
+			merged, columns, firstID = o.fetched, set.Columns, id
+			meta = result.Meta
+		} else if !equalColumns(columns, set.Columns) {
+			notices = append(notices, data.Notice{
+				Severity: data.NoticeSeverityWarning,
+				Text: fmt.Sprintf("Database %s is missing from the result: its columns (%s) differ from those of database %s (%s).",
+					id, strings.Join(set.Columns, ", "), firstID, strings.Join(columns, ", ")),
+			})
+			continue
+		} else {
+			// The databases were queried concurrently, so the slowest one took the query's time.
+			meta.RowsRead += result.Meta.RowsRead
+			if result.Meta.Duration > meta.Duration {
+				meta.Duration = result.Meta.Duration
+			}
+		}
+		for _, row := range set.Rows {
+			rows = append(rows, append(append(make([]interface{}, 0, len(row)+1), row...), id))
+		}
+	}
+
+	if succeeded == 0 {
+		failed := outcomes[firstFailed].failed
+		failed.Error = fmt.Errorf("every database of databaseIds failed; %s: %w", qm.DatabaseIDs[firstFailed], failed.Error)
+		return outcomes[firstFailed].fetched, nil, failed
+	}
+	if columns == nil {
+		// No database returned a result set, e.g. for PRAGMA statements without output.
+		for _, o := range outcomes {
+			if o.failed.Error == nil {
+				return o.fetched, notices, backend.DataResponse{}
+			}
+		}
+	}
+	merged.response.Result = []models.D1RawResultItem{{
+		Success: true,
+		Meta:    meta,
+		Results: &models.D1RawQueryActualResult{
+			Columns: append(append([]string(nil), columns...), databaseColumn),
+			Rows:    rows,
+		},
+	}}
+	return merged, notices, backend.DataResponse{}
+}
+
+// equalColumns reports whether a and b name the same columns in the same order.
+func equalColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
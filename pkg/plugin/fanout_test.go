@@ -0,0 +1,165 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/olipayne/grafana-cloudflare-d1-datasource/pkg/models"
+)
+
+// shardHandler serves a /raw response per database, taken from the last path segment
+// before the endpoint. Databases missing from results fail with a server error.
+func shardHandler(results map[string]http.HandlerFunc) (http.HandlerFunc, *[]string) {
+	var mu sync.Mutex
+	var queried []string
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimSuffix(r.URL.Path, "/raw"), "/")
+		db := parts[len(parts)-1]
+		mu.Lock()
+		queried = append(queried, db)
+		mu.Unlock()
+		if handler, ok := results[db]; ok {
+			handler(w, r)
+			return
+		}
+		http.Error(w, "database unavailable", http.StatusServiceUnavailable)
+	}, &queried
+}
+
+func TestQueryDatabaseIDs(t *testing.T) {
+	handler, queried := shardHandler(map[string]http.HandlerFunc{
+		"shard-a": rawResponse([]string{"host", "n"}, [][]interface{}{{"x", float64(1)}, {"y", float64(2)}}),
+		"shard-b": rawResponse([]string{"host", "n"}, [][]interface{}{{"z", float64(3)}}),
+		"shard-c": rawResponse([]string{"other"}, [][]interface{}{{"w"}}),
+	})
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, handler)
+
+	res := runQuery(t, ds, `{"queryText":"SELECT host, n FROM t","databaseIds":["shard-a","shard-b"]}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if len(*queried) != 2 {
+		t.Errorf("expected one request per database, got %v", *queried)
+	}
+	frame := res.Frames[0]
+	if frame.Rows() != 3 {
+		t.Fatalf("expected the rows of both databases, got %d", frame.Rows())
+	}
+	field, _ := frame.FieldByName(databaseColumn)
+	if field == nil {
+		t.Fatalf("expected a %s field", databaseColumn)
+	}
+	for i, want := range []string{"shard-a", "shard-a", "shard-b"} {
+		if got := field.At(i).(*string); got == nil || *got != want {
+			t.Errorf("row %d: expected database %s, got %v", i, want, got)
+		}
+	}
+
+	// Failing databases and those with other columns are left out with a notice.
+	res = runQuery(t, ds, `{"queryText":"SELECT host, n FROM t","databaseIds":["shard-a","down","shard-c"]}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	frame = res.Frames[0]
+	if frame.Rows() != 2 {
+		t.Errorf("expected the rows of shard-a only, got %d", frame.Rows())
+	}
+	if !hasNotice(frame, "Database down failed") {
+		t.Error("expected a notice naming the failed database")
+	}
+	if !hasNotice(frame, "Database shard-c is missing from the result: its columns (other) differ") {
+		t.Error("expected a notice naming the database with other columns")
+	}
+
+	// The query only fails when every database does.
+	res = runQuery(t, ds, `{"queryText":"SELECT host, n FROM t","databaseIds":["down","gone"]}`)
+	if res.Error == nil || !strings.Contains(res.Error.Error(), "every database of databaseIds failed") {
+		t.Errorf("expected every database to fail, got %v", res.Error)
+	}
+}
+
+func TestQueryDatabaseIDsBypassBreaker(t *testing.T) {
+	handler, queried := shardHandler(map[string]http.HandlerFunc{
+		"db":      rawResponse([]string{"n"}, [][]interface{}{{float64(1)}}),
+		"shard-a": rawResponse([]string{"n"}, [][]interface{}{{float64(2)}}),
+	})
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","circuitBreakerThreshold":1}`, handler)
+
+	for i := 0; i < 3; i++ {
+		res := runQuery(t, ds, `{"queryText":"SELECT n FROM t","databaseIds":["shard-a","down"]}`)
+		if res.Error != nil || !hasNotice(res.Frames[0], "Database down failed") {
+			t.Fatalf("expected the failing database to be left out with a notice, got %v", res.Error)
+		}
+	}
+	if snapshot := ds.breaker.snapshot(); snapshot.State != breakerClosed || snapshot.ConsecutiveFailures != 0 {
+		t.Errorf("expected other databases not to count towards the breaker, got %+v", snapshot)
+	}
+	if res := runQuery(t, ds, `{"queryText":"SELECT n FROM t"}`); res.Error != nil {
+		t.Errorf("expected queries of the configured database to run, got %v", res.Error)
+	}
+	if n := len(*queried); n != 7 {
+		t.Errorf("expected every request to be sent, got %v", *queried)
+	}
+}
+
+func TestQueryDatabaseIDsRejected(t *testing.T) {
+	handler, queried := shardHandler(nil)
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, handler)
+
+	for query, want := range map[string]string{
+		`{"queryText":"DELETE FROM t","databaseIds":["a","b"]}`:                  "databaseIds: read-only mode",
+		`{"queryText":"SELECT 1","databaseIds":["a","a"]}`:                       "more than once",
+		`{"queryText":"SELECT 1","databaseIds":["a",""]}`:                        "empty IDs",
+		`{"queryText":"SELECT 1","databaseIds":["a","x/../../tokens/verify?"]}`:  "not a D1 database ID",
+		`{"queryText":"SELECT 1","databaseIds":["a",".."]}`:                      "not a D1 database ID",
+		`{"queryText":"SELECT 1","databaseIds":["a","b"],"endpoint":"query"}`:    "query endpoint",
+		`{"queryText":"SELECT 1","databaseIds":["a","b"],"sessionBookmark":"x"}`: "sessionBookmark",
+	} {
+		res := runQuery(t, ds, query)
+		if res.Error == nil || !strings.Contains(res.Error.Error(), want) {
+			t.Errorf("%s: expected an error containing %q, got %v", query, want, res.Error)
+		}
+	}
+	if len(*queried) != 0 {
+		t.Errorf("expected rejected queries not to be sent, got %v", *queried)
+	}
+}
+
+func TestDatabaseURLEscapesIDs(t *testing.T) {
+	var requested []string
+	ds := newTestDatasource(t, `{"accountId":"acc/x","databaseId":"db"}`, func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.RequestURI)
+		rawResponse([]string{"n"}, nil)(w, r)
+	})
+
+	client := newHTTPD1Client(ds.settings, ds.transport, ds.baseURL, "x/../../../tokens/verify?")
+	if _, err := client.Send(context.Background(), endpointRaw, models.D1QueryRequest{SQL: "SELECT 1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "/accounts/acc%2Fx/d1/database/x%2F..%2F..%2F..%2Ftokens%2Fverify%3F/raw"
+	if len(requested) != 1 || requested[0] != want {
+		t.Errorf("expected a request to %s, got %v", want, requested)
+	}
+}
+
+func TestQueryDatabaseIDsFailOverToReplica(t *testing.T) {
+	handler, queried := shardHandler(map[string]http.HandlerFunc{
+		"replica": rawResponse([]string{"n"}, [][]interface{}{{float64(1)}}),
+		"shard-b": rawResponse([]string{"n"}, [][]interface{}{{float64(2)}}),
+	})
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","replicaDatabaseId":"replica"}`, handler)
+
+	res := runQuery(t, ds, `{"queryText":"SELECT n FROM t","databaseIds":["db","shard-b"]}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if rows := res.Frames[0].Rows(); rows != 2 {
+		t.Errorf("expected the replica's and shard-b's rows, got %d rows: %v", rows, *queried)
+	}
+	if !hasNotice(res.Frames[0], "read from the replica") {
+		t.Errorf("expected a replica notice, got %+v", res.Frames[0].Meta)
+	}
+}
@@ -0,0 +1,164 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/olipayne/grafana-cloudflare-d1-datasource/pkg/models"
+)
+
+const (
+	// frameMemoWindow is how long a built frame is kept for reuse by the next identical result.
+	frameMemoWindow = 5 * time.Minute
+	// maxFrameMemoEntries bounds the frames kept, since each may hold up to maxRows rows.
+	maxFrameMemoEntries = 32
+)
+
+// frameMemo remembers the frame built from the last result of each statement together
+// with a hash of the result's columns and rows. Dashboards refreshing a query whose data
+// didn't change get the same result again; comparing hashes lets them skip type
+// inference and field construction. Unlike queryCache, D1 is still queried every time.
+// It is safe for concurrent use.
+type frameMemo struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]frameMemoEntry
+}
+
+type frameMemoEntry struct {
+	hash    [sha256.Size]byte
+	frame   *data.Frame
+	expires time.Time
+}
+
+func newFrameMemo() *frameMemo {
+	return &frameMemo{now: time.Now, entries: make(map[string]frameMemoEntry)}
+}
+
+// get returns a copy of the frame remembered under key if it was built from a result
+// with the given hash and hasn't expired.
+func (m *frameMemo) get(key string, hash [sha256.Size]byte) (*data.Frame, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[key]
+	if !ok || entry.hash != hash || !m.now().Before(entry.expires) {
+		return nil, false
+	}
+	return copyFrame(entry.frame), true
+}
+
+// set remembers a copy of frame, built from a result with the given hash, under key.
+// Expired entries are pruned; when the memo is still full, an arbitrary entry makes room.
+func (m *frameMemo) set(key string, hash [sha256.Size]byte, frame *data.Frame) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	for k, entry := range m.entries {
+		if !now.Before(entry.expires) {
+			delete(m.entries, k)
+		}
+	}
+	if _, ok := m.entries[key]; !ok && len(m.entries) >= maxFrameMemoEntries {
+		for k := range m.entries {
+			delete(m.entries, k)
+			break
+		}
+	}
+	m.entries[key] = frameMemoEntry{hash: hash, frame: copyFrame(frame), expires: now.Add(frameMemoWindow)}
+}
+
+// copyFrame returns a copy of frame whose metadata and field list can be changed without
+// affecting frame. The fields themselves are shared; nothing changes them once built.
+func copyFrame(frame *data.Frame) *data.Frame {
+	copied := *frame
+	copied.Fields = append([]*data.Field(nil), frame.Fields...)
+	if frame.Meta != nil {
+		meta := *frame.Meta
+		meta.Notices = append([]data.Notice(nil), frame.Meta.Notices...)
+		meta.Stats = append([]data.QueryStat(nil), frame.Meta.Stats...)
+		if custom, ok := frame.Meta.Custom.(*frameCustomMeta); ok {
+			c := *custom
+			meta.Custom = &c
+		}
+		copied.Meta = &meta
+	}
+	return &copied
+}
+
+// memoizable reports whether the frame of result depends only on its columns and rows.
+// Frames of writes and empty results carry the statement's metadata, which changes with
+// every execution.
+func memoizable(result *models.D1RawResultItem) bool {
+	set := resultSet(result)
+	return set != nil && len(set.Rows) > 0 && !isWrite(result.Meta)
+}
+
+// hashResultSet returns a hash of the columns and rows of set. Values are hashed with
+// their type, so 1 and "1" differ.
+func hashResultSet(set *models.D1RawQueryActualResult) [sha256.Size]byte {
+	h := sha256.New()
+	// Values are encoded into a buffer that is hashed in chunks; writing each value to the
+	// hash separately costs more than the hashing itself.
+	buf := make([]byte, 0, 64*1024)
+	buf = appendInt(buf, int64(len(set.Columns)))
+	for _, col := range set.Columns {
+		buf = appendString(buf, col)
+	}
+	buf = appendInt(buf, int64(len(set.Rows)))
+	for _, row := range set.Rows {
+		buf = appendInt(buf, int64(len(row)))
+		for _, v := range row {
+			buf = appendValue(buf, v)
+		}
+		if len(buf) >= 60*1024 {
+			h.Write(buf)
+			buf = buf[:0]
+		}
+	}
+	h.Write(buf)
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// appendValue appends a type tag and the value of v to buf.
+func appendValue(buf []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(buf, 0)
+	case string:
+		return appendString(append(buf, 1), v)
+	case float64:
+		return appendInt(append(buf, 2), int64(math.Float64bits(v)))
+	case int64:
+		return appendInt(append(buf, 3), v)
+	case bool:
+		if v {
+			return append(buf, 4, 1)
+		}
+		return append(buf, 4, 0)
+	default:
+		// Nested arrays and objects are rare enough to hash as JSON.
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			encoded = []byte(fmt.Sprintf("%#v", v))
+		}
+		return appendString(append(buf, 5), string(encoded))
+	}
+}
+
+func appendInt(buf []byte, n int64) []byte {
+	return binary.LittleEndian.AppendUint64(buf, uint64(n))
+}
+
+// appendString appends s to buf prefixed with its length, so adjacent strings can't run together.
+func appendString(buf []byte, s string) []byte {
+	return append(appendInt(buf, int64(len(s))), s...)
+}
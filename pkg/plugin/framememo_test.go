@@ -0,0 +1,160 @@
+package plugin
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/olipayne/grafana-cloudflare-d1-datasource/pkg/models"
+)
+
+func TestQueryReusesFrameOfIdenticalResult(t *testing.T) {
+	rows := [][]interface{}{{"2024-01-01 00:00:00", "a", float64(1)}, {"2024-01-01 00:01:00", "b", float64(2)}}
+	duration := 0.0
+	client := &fakeD1Client{}
+	respond := func() {
+		// D1 reports a different duration every time, so only the rows can be compared.
+		duration++
+		client.responses = append(client.responses, cannedResponse(t, http.StatusOK, models.D1RawAPIResponse{
+			Success: true,
+			Result: []models.D1RawResultItem{{
+				Success: true,
+				Meta:    models.D1Meta{Duration: duration},
+				Results: &models.D1RawQueryActualResult{Columns: []string{"time", "host", "value"}, Rows: rows},
+			}},
+		}))
+	}
+	ds := newFakeDatasource(t, `{"accountId":"acc","databaseId":"db","warnOnUnboundedSelect":true}`, client)
+	query := `{"queryText":"SELECT time, host, value FROM metrics"}`
+
+	respond()
+	first := runQuery(t, ds, query)
+	respond()
+	second := runQuery(t, ds, query)
+	if first.Error != nil || second.Error != nil {
+		t.Fatalf("unexpected errors: %v, %v", first.Error, second.Error)
+	}
+	if first.Frames[0].Fields[0] != second.Frames[0].Fields[0] {
+		t.Error("expected the frame of an identical result to be reused")
+	}
+	if got, want := len(second.Frames[0].Meta.Notices), len(first.Frames[0].Meta.Notices); got != want {
+		t.Errorf("expected notices not to accumulate on reused frames, got %d, want %d", got, want)
+	}
+
+	// Other options build their own frame.
+	respond()
+	grouped := runQuery(t, ds, `{"queryText":"SELECT time, host, value FROM metrics","format":"time_series"}`)
+	if grouped.Error != nil {
+		t.Fatalf("unexpected error: %v", grouped.Error)
+	}
+	if grouped.Frames[0].Fields[0] == first.Frames[0].Fields[0] {
+		t.Error("expected a query with other options not to reuse the frame")
+	}
+
+	// Changed rows are converted again.
+	rows = [][]interface{}{{"2024-01-01 00:00:00", "a", float64(1)}, {"2024-01-01 00:01:00", "b", float64(3)}}
+	respond()
+	changed := runQuery(t, ds, query)
+	if changed.Error != nil {
+		t.Fatalf("unexpected error: %v", changed.Error)
+	}
+	if changed.Frames[0].Fields[0] == first.Frames[0].Fields[0] {
+		t.Error("expected a changed result to be converted again")
+	}
+	if got := changed.Frames[0].Fields[2].At(1).(*int64); got == nil || *got != 3 {
+		t.Errorf("expected the changed value, got %v", got)
+	}
+}
+
+func TestFrameMemoExpires(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	memo := newFrameMemo()
+	memo.now = func() time.Time { return now }
+	set := &models.D1RawQueryActualResult{Columns: []string{"a"}, Rows: [][]interface{}{{float64(1)}}}
+	frame, err := (&Datasource{settings: &models.PluginSettings{}, logger: newLeveledLogger("debug")}).resultFrame("A", &models.D1RawResultItem{Success: true, Results: set}, queryModel{}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	memo.set("k", hashResultSet(set), frame)
+	if _, ok := memo.get("k", hashResultSet(set)); !ok {
+		t.Fatal("expected a hit within the window")
+	}
+	now = now.Add(frameMemoWindow)
+	if _, ok := memo.get("k", hashResultSet(set)); ok {
+		t.Fatal("expected a miss after the window")
+	}
+
+	for i := 0; i < maxFrameMemoEntries+10; i++ {
+		memo.set(fmt.Sprint(i), hashResultSet(set), frame)
+	}
+	if len(memo.entries) > maxFrameMemoEntries {
+		t.Errorf("expected at most %d entries, got %d", maxFrameMemoEntries, len(memo.entries))
+	}
+}
+
+func TestHashResultSet(t *testing.T) {
+	hash := func(columns []string, rows ...[]interface{}) [32]byte {
+		return hashResultSet(&models.D1RawQueryActualResult{Columns: columns, Rows: rows})
+	}
+	base := hash([]string{"a", "b"}, []interface{}{float64(1), "x"})
+	if base != hash([]string{"a", "b"}, []interface{}{float64(1), "x"}) {
+		t.Error("expected identical results to hash alike")
+	}
+	for name, other := range map[string][32]byte{
+		"value":       hash([]string{"a", "b"}, []interface{}{float64(2), "x"}),
+		"type":        hash([]string{"a", "b"}, []interface{}{"1", "x"}),
+		"null":        hash([]string{"a", "b"}, []interface{}{nil, "x"}),
+		"column":      hash([]string{"a", "c"}, []interface{}{float64(1), "x"}),
+		"boundary":    hash([]string{"ab", ""}, []interface{}{float64(1), "x"}),
+		"row count":   hash([]string{"a", "b"}, []interface{}{float64(1), "x"}, []interface{}{float64(1), "x"}),
+		"nested json": hash([]string{"a", "b"}, []interface{}{[]interface{}{float64(1)}, "x"}),
+	} {
+		if other == base {
+			t.Errorf("expected a different %s to change the hash", name)
+		}
+	}
+}
+
+// benchmarkResult is a 10,000 row result with time, string, float and integer columns.
+func benchmarkResult() *models.D1RawResultItem {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rows := make([][]interface{}, 10000)
+	for i := range rows {
+		rows[i] = []interface{}{t0.Add(time.Duration(i) * time.Second).Format(time.RFC3339), fmt.Sprintf("host-%d", i%10), float64(i) / 3, float64(i)}
+	}
+	return &models.D1RawResultItem{
+		Success: true,
+		Results: &models.D1RawQueryActualResult{Columns: []string{"time", "host", "ratio", "count"}, Rows: rows},
+	}
+}
+
+// BenchmarkResultFrame measures converting a result into a frame from scratch.
+func BenchmarkResultFrame(b *testing.B) {
+	ds := &Datasource{settings: &models.PluginSettings{MaxRows: models.DefaultMaxRows, Location: time.UTC}, logger: newLeveledLogger("warn")}
+	result := benchmarkResult()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ds.resultFrame("A", result, queryModel{}, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkResultFrameReused measures the same conversion when the previous result was
+// identical: hashing the rows and copying the remembered frame.
+func BenchmarkResultFrameReused(b *testing.B) {
+	ds := &Datasource{settings: &models.PluginSettings{MaxRows: models.DefaultMaxRows, Location: time.UTC}, logger: newLeveledLogger("warn"), frames: newFrameMemo()}
+	result := benchmarkResult()
+	noSchema := func() map[string]columnKind { return nil }
+	if _, err := ds.buildResultFrame("key", 0, "A", result, queryModel{}, noSchema); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ds.buildResultFrame("key", 0, "A", result, queryModel{}, noSchema); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/olipayne/grafana-cloudflare-d1-datasource/pkg/models"
+)
+
+// requestLimiter bounds the D1 requests of a datasource instance that are in flight at
+// once, across all QueryData calls, so a busy Grafana can't overwhelm the API. It is safe
+// for concurrent use.
+type requestLimiter struct {
+	slots chan struct{}
+}
+
+func newRequestLimiter(size int) *requestLimiter {
+	return &requestLimiter{slots: make(chan struct{}, size)}
+}
+
+// acquire waits for a free slot, returning an error if ctx ends first. A nil error must
+// be followed by a call to release.
+func (l *requestLimiter) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for one of the %d concurrent D1 requests allowed by maxConcurrentRequests: %w", cap(l.slots), ctx.Err())
+	}
+}
+
+func (l *requestLimiter) release() {
+	<-l.slots
+}
+
+// limitedClient is a D1Client taking a slot of a requestLimiter for each request.
+type limitedClient struct {
+	client  D1Client
+	limiter *requestLimiter
+}
+
+var _ D1Client = (*limitedClient)(nil)
+
+// Send waits for a free slot, then sends payload with the wrapped client. The slot is
+// held until the response body has been read.
+func (c *limitedClient) Send(ctx context.Context, endpoint string, payload models.D1QueryRequest) (*D1Response, error) {
+	if err := c.limiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer c.limiter.release()
+	return c.client.Send(ctx, endpoint, payload)
+}
+
+// limit returns client bounded by the datasource's request limiter, or client itself
+// when the number of concurrent requests is unlimited.
+func (d *Datasource) limit(client D1Client) D1Client {
+	if d.limiter == nil {
+		return client
+	}
+	return &limitedClient{client: client, limiter: d.limiter}
+}
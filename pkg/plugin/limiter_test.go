@@ -0,0 +1,81 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestMaxConcurrentRequestsBoundsQueries(t *testing.T) {
+	var inFlight, peak int32
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","queryConcurrency":8,"maxConcurrentRequests":2}`, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		rawResponse([]string{"n"}, [][]interface{}{{float64(1)}})(w, r)
+	})
+
+	// Two dashboards querying at once share the instance's limit.
+	var wg sync.WaitGroup
+	for dashboard := 0; dashboard < 2; dashboard++ {
+		req := &backend.QueryDataRequest{}
+		for i := 0; i < 8; i++ {
+			body, _ := json.Marshal(map[string]string{"queryText": fmt.Sprintf("SELECT %d AS n", i)})
+			req.Queries = append(req.Queries, backend.DataQuery{RefID: fmt.Sprint(i), JSON: body})
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := ds.QueryData(context.Background(), req)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			for refID, res := range resp.Responses {
+				if res.Error != nil {
+					t.Errorf("query %s: unexpected error: %v", refID, res.Error)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if peak > 2 {
+		t.Errorf("expected at most 2 requests in flight, got %d", peak)
+	}
+	if peak < 2 {
+		t.Errorf("expected the requests to use both slots, got %d", peak)
+	}
+}
+
+func TestRequestLimiterRespectsCancellation(t *testing.T) {
+	limiter := newRequestLimiter(1)
+	if err := limiter.acquire(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := limiter.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a queued request to give up with its context, got %v", err)
+	}
+
+	limiter.release()
+	if err := limiter.acquire(context.Background()); err != nil {
+		t.Fatalf("expected the released slot to be free, got %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package plugin
+
+import (
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/olipayne/grafana-cloudflare-d1-datasource/pkg/models"
+)
+
+// leveledLogger writes to log.DefaultLogger, dropping debug and info lines below the
+// logLevel of a datasource instance so a busy instance can be quieted on its own.
+// Warnings and errors are always written.
+type leveledLogger struct {
+	level log.Level
+}
+
+// newLeveledLogger returns the logger for the given logLevel setting.
+func newLeveledLogger(level string) leveledLogger {
+	switch level {
+	case models.LogLevelInfo:
+		return leveledLogger{level: log.Info}
+	case models.LogLevelWarn:
+		return leveledLogger{level: log.Warn}
+	default:
+		return leveledLogger{level: log.Debug}
+	}
+}
+
+func (l leveledLogger) Debug(msg string, args ...interface{}) {
+	if l.level <= log.Debug {
+		log.DefaultLogger.Debug(msg, args...)
+	}
+}
+
+func (l leveledLogger) Info(msg string, args ...interface{}) {
+	if l.level <= log.Info {
+		log.DefaultLogger.Info(msg, args...)
+	}
+}
+
+func (l leveledLogger) Warn(msg string, args ...interface{}) {
+	log.DefaultLogger.Warn(msg, args...)
+}
+
+func (l leveledLogger) Error(msg string, args ...interface{}) {
+	log.DefaultLogger.Error(msg, args...)
+}
@@ -0,0 +1,221 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/gtime"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/olipayne/grafana-cloudflare-d1-datasource/pkg/models"
+)
+
+// queryMacros returns the plugin's own macros, applied on top of sqlutil.DefaultMacros.
+// $__in appends the values it binds to qm.Params.
+func queryMacros(qm *queryModel, settings *models.PluginSettings) sqlutil.Macros {
+	return sqlutil.Macros{
+		"in":              macroIn(&qm.Params, settings.EmptyInMatchesAll),
+		"limit":           pageMacro("limit", qm.Limit),
+		"offset":          pageMacro("offset", qm.Offset),
+		"maxDataPoints":   macroMaxDataPoints,
+		"timeGroup":       macroTimeGroup,
+		"unixEpochFilter": macroUnixEpochFilter,
+		"unixEpochFrom":   macroUnixEpochFrom,
+		"unixEpochTo":     macroUnixEpochTo,
+	}
+}
+
+// macroIn expands $__in(column, values) to column IN (?N, ...), binding each value as a
+// parameter appended to params instead of copying it into the SQL. values is a JSON
+// array, which is how the query editor passes multi-value template variables, or a list
+// of literals. An empty list expands to a predicate matching all or no rows, depending
+// on matchAllWhenEmpty. Numbered placeholders keep the params of the query in place; a
+// repeated identical $__in reuses its placeholders.
+func macroIn(params *[]interface{}, matchAllWhenEmpty bool) sqlutil.MacroFunc {
+	expanded := map[string]string{}
+	return func(_ *sqlutil.Query, args []string) (string, error) {
+		if len(args) < 2 || strings.TrimSpace(args[0]) == "" {
+			return "", fmt.Errorf("$__in: expected a column and a list of values, received %d arguments", len(args))
+		}
+		key := strings.Join(args, ",")
+		if sql, ok := expanded[key]; ok {
+			return sql, nil
+		}
+		values, err := parseInValues(args[1:])
+		if err != nil {
+			return "", fmt.Errorf("$__in: %w", err)
+		}
+		if len(values) == 0 {
+			if matchAllWhenEmpty {
+				return "1 = 1", nil
+			}
+			return "1 = 0", nil
+		}
+		placeholders := make([]string, len(values))
+		for i, value := range values {
+			*params = append(*params, value)
+			placeholders[i] = "?" + strconv.Itoa(len(*params))
+		}
+		sql := fmt.Sprintf("%s IN (%s)", strings.TrimSpace(args[0]), strings.Join(placeholders, ", "))
+		expanded[key] = sql
+		return sql, nil
+	}
+}
+
+// parseInValues returns the values of a $__in list. sqlutil splits the macro arguments
+// at commas, so a JSON array arrives in pieces and is joined back together first; the
+// query editor escapes commas and parentheses inside its strings for this reason.
+// Otherwise every argument is one value: a JSON number, boolean or string, or text,
+// with SQL single quotes removed.
+func parseInValues(args []string) ([]interface{}, error) {
+	joined := strings.TrimSpace(strings.Join(args, ","))
+	if joined == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(joined, "[") {
+		var values []interface{}
+		if err := json.Unmarshal([]byte(joined), &values); err != nil {
+			return nil, fmt.Errorf("invalid value list %s: %w", joined, err)
+		}
+		for _, value := range values {
+			switch value.(type) {
+			case string, float64, bool:
+			default:
+				return nil, fmt.Errorf("unsupported value %v in list %s", value, joined)
+			}
+		}
+		return values, nil
+	}
+
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		arg = strings.TrimSpace(arg)
+		var value interface{}
+		if err := json.Unmarshal([]byte(arg), &value); err == nil && value != nil {
+			switch value.(type) {
+			case string, float64, bool:
+				values[i] = value
+				continue
+			}
+		}
+		values[i] = unquoteLiteral(arg)
+	}
+	return values, nil
+}
+
+// macroUnixEpochFilter expands $__unixEpochFilter(column) to a range condition on a
+// column holding integer Unix seconds, the epoch counterpart of $__timeFilter.
+func macroUnixEpochFilter(query *sqlutil.Query, args []string) (string, error) {
+	if len(args) != 1 || strings.TrimSpace(args[0]) == "" {
+		return "", fmt.Errorf("$__unixEpochFilter: expected 1 argument, received %d", len(args))
+	}
+	column := strings.TrimSpace(args[0])
+	return fmt.Sprintf("%s >= %d AND %s <= %d", column, query.TimeRange.From.Unix(), column, query.TimeRange.To.Unix()), nil
+}
+
+// macroUnixEpochFrom expands $__unixEpochFrom() to the start of the time range in Unix seconds.
+func macroUnixEpochFrom(query *sqlutil.Query, _ []string) (string, error) {
+	return strconv.FormatInt(query.TimeRange.From.Unix(), 10), nil
+}
+
+// macroUnixEpochTo expands $__unixEpochTo() to the end of the time range in Unix seconds.
+func macroUnixEpochTo(query *sqlutil.Query, _ []string) (string, error) {
+	return strconv.FormatInt(query.TimeRange.To.Unix(), 10), nil
+}
+
+// macroMaxDataPoints expands $__maxDataPoints to the number of points the panel can show.
+func macroMaxDataPoints(query *sqlutil.Query, _ []string) (string, error) {
+	if query.MaxDataPoints <= 0 {
+		return "", fmt.Errorf("$__maxDataPoints: no max data points set for this query")
+	}
+	return strconv.FormatInt(query.MaxDataPoints, 10), nil
+}
+
+// macroTimeGroup replaces the SDK's SQL Server flavoured $__timeGroup with SQLite:
+// $__timeGroup(column[, interval]) rounds column down to a multiple of interval and
+// returns it as a timestamp string. interval is a duration such as 5m or 1d; when it is
+// omitted, $__interval or auto, the panel interval is used, widened so the time range
+// yields at most MaxDataPoints buckets.
+func macroTimeGroup(query *sqlutil.Query, args []string) (string, error) {
+	if len(args) < 1 || len(args) > 2 || strings.TrimSpace(args[0]) == "" {
+		return "", fmt.Errorf("$__timeGroup: expected a column and an optional interval, received %d arguments", len(args))
+	}
+	interval := groupInterval(query)
+	if len(args) == 2 {
+		switch arg := strings.TrimSpace(args[1]); arg {
+		case "", "$__interval", "auto":
+		default:
+			parsed, err := gtime.ParseInterval(arg)
+			if err != nil || parsed <= 0 {
+				return "", fmt.Errorf("$__timeGroup: invalid interval %q", arg)
+			}
+			interval = parsed
+		}
+	}
+	seconds := int64(interval.Round(time.Second) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return fmt.Sprintf("datetime((CAST(strftime('%%s', %s) AS INTEGER) / %d) * %d, 'unixepoch')",
+		strings.TrimSpace(args[0]), seconds, seconds), nil
+}
+
+// groupInterval returns the panel interval, or the time range divided by MaxDataPoints
+// when that is wider, so grouped results never exceed the points the panel can show.
+func groupInterval(query *sqlutil.Query) time.Duration {
+	interval := query.Interval
+	if query.MaxDataPoints > 0 {
+		span := query.TimeRange.To.Sub(query.TimeRange.From)
+		perPoint := (span + time.Duration(query.MaxDataPoints) - 1) / time.Duration(query.MaxDataPoints)
+		if perPoint > interval {
+			interval = perPoint
+		}
+	}
+	return interval
+}
+
+// timeMacroPattern matches the macros that make a query depend on the panel time range.
+var timeMacroPattern = regexp.MustCompile(`\$__(timeFilter|timeFrom|timeTo|timeGroup|timeGroupAlias|unixEpoch\w*)\b`)
+
+// usesTimeMacro reports whether sql, before interpolation, refers to the time range.
+func usesTimeMacro(sql string) bool {
+	return timeMacroPattern.MatchString(sql)
+}
+
+// pageMacro expands $__limit/$__offset to the non-negative integer configured in the
+// query options. Values are validated and re-formatted, so nothing from the options is
+// ever copied into the SQL verbatim.
+func pageMacro(name string, raw json.RawMessage) sqlutil.MacroFunc {
+	return func(_ *sqlutil.Query, _ []string) (string, error) {
+		n, err := parsePageValue(raw)
+		if err != nil {
+			return "", fmt.Errorf("$__%s: %w", name, err)
+		}
+		return strconv.FormatInt(n, 10), nil
+	}
+}
+
+// parsePageValue accepts a JSON number or a string of digits.
+func parsePageValue(raw json.RawMessage) (int64, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return 0, fmt.Errorf("no value set in the query options")
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err != nil {
+		text = string(raw)
+	}
+	text = strings.TrimSpace(text)
+	for _, c := range text {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("%q is not a non-negative integer", text)
+		}
+	}
+	n, err := strconv.ParseInt(text, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a non-negative integer", text)
+	}
+	return n, nil
+}
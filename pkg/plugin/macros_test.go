@@ -0,0 +1,210 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/olipayne/grafana-cloudflare-d1-datasource/pkg/models"
+)
+
+func interpolate(t *testing.T, sql string, qm queryModel) (string, error) {
+	t.Helper()
+	return sqlutil.Interpolate(&sqlutil.Query{RawSQL: sql}, queryMacros(&qm, &models.PluginSettings{}))
+}
+
+func TestPageMacros(t *testing.T) {
+	qm := queryModel{Limit: json.RawMessage(`50`), Offset: json.RawMessage(`"100"`)}
+	got, err := interpolate(t, "SELECT * FROM t LIMIT $__limit OFFSET $__offset", qm)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "SELECT * FROM t LIMIT 50 OFFSET 100"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestPageMacrosAbsentLeaveSQLUnchanged(t *testing.T) {
+	sql := "SELECT * FROM t LIMIT 10"
+	got, err := interpolate(t, sql, queryModel{Limit: json.RawMessage(`"junk"`)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != sql {
+		t.Errorf("expected SQL to be unchanged, got %q", got)
+	}
+}
+
+func TestPageMacrosRejectInvalidValues(t *testing.T) {
+	for _, raw := range []string{`"10; DROP TABLE t"`, `-1`, `1.5`, `"abc"`, `null`} {
+		_, err := interpolate(t, "SELECT * FROM t LIMIT $__limit", queryModel{Limit: json.RawMessage(raw)})
+		if err == nil {
+			t.Errorf("expected limit %s to be rejected", raw)
+		}
+	}
+	if _, err := interpolate(t, "SELECT * FROM t OFFSET $__offset", queryModel{}); err == nil {
+		t.Error("expected a missing offset to be rejected")
+	}
+}
+
+func TestMaxDataPointsMacro(t *testing.T) {
+	query := &sqlutil.Query{RawSQL: "SELECT * FROM t LIMIT $__maxDataPoints", MaxDataPoints: 500}
+	got, err := sqlutil.Interpolate(query, queryMacros(&queryModel{}, &models.PluginSettings{}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "SELECT * FROM t LIMIT 500"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	query.MaxDataPoints = 0
+	if _, err := sqlutil.Interpolate(query, queryMacros(&queryModel{}, &models.PluginSettings{})); err == nil {
+		t.Error("expected an error without max data points")
+	}
+}
+
+func TestTimeGroupIntervalScalesWithMaxDataPoints(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		span          time.Duration
+		interval      time.Duration
+		maxDataPoints int64
+		arg           string
+		wantSeconds   int
+	}{
+		{"panel interval is wide enough", time.Hour, time.Minute, 1000, "", 60},
+		{"max data points widen the interval", 24 * time.Hour, time.Minute, 100, "", 864},
+		{"fewer points, wider buckets", 24 * time.Hour, time.Minute, 24, "$__interval", 3600},
+		{"longer range, wider buckets", 7 * 24 * time.Hour, time.Minute, 24, "auto", 25200},
+		{"partial seconds round up", time.Minute, 0, 7, "", 9},
+		{"no max data points", 24 * time.Hour, 30 * time.Second, 0, "", 30},
+		{"below one second", time.Second, 0, 1000, "", 1},
+		{"explicit interval wins", 24 * time.Hour, time.Minute, 10, "5m", 300},
+		{"explicit days", 24 * time.Hour, time.Minute, 10, "1d", 86400},
+	}
+	for _, tt := range tests {
+		sql := "SELECT $__timeGroup(created_at) AS time FROM t"
+		if tt.arg != "" {
+			sql = "SELECT $__timeGroup(created_at, " + tt.arg + ") AS time FROM t"
+		}
+		query := &sqlutil.Query{
+			RawSQL:        sql,
+			TimeRange:     backend.TimeRange{From: from, To: from.Add(tt.span)},
+			Interval:      tt.interval,
+			MaxDataPoints: tt.maxDataPoints,
+		}
+		got, err := sqlutil.Interpolate(query, queryMacros(&queryModel{}, &models.PluginSettings{}))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		want := fmt.Sprintf("SELECT datetime((CAST(strftime('%%s', created_at) AS INTEGER) / %d) * %d, 'unixepoch') AS time FROM t", tt.wantSeconds, tt.wantSeconds)
+		if got != want {
+			t.Errorf("%s: expected %q, got %q", tt.name, want, got)
+		}
+	}
+}
+
+func TestTimeGroupRejectsInvalidArguments(t *testing.T) {
+	for _, sql := range []string{"$__timeGroup()", "$__timeGroup(a, 1m, 0)", "$__timeGroup(a, soon)", "$__timeGroup(a, 0s)"} {
+		if _, err := interpolate(t, sql, queryModel{}); err == nil {
+			t.Errorf("%s: expected an error", sql)
+		}
+	}
+}
+
+func TestUnixEpochMacros(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(6 * time.Hour)
+	query := &sqlutil.Query{
+		RawSQL:    "SELECT * FROM t WHERE $__unixEpochFilter(created) AND $__unixEpochFrom() < $__unixEpochTo()",
+		TimeRange: backend.TimeRange{From: from, To: to},
+	}
+	got, err := sqlutil.Interpolate(query, queryMacros(&queryModel{}, &models.PluginSettings{}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "SELECT * FROM t WHERE created >= 1704067200 AND created <= 1704088800 AND 1704067200 < 1704088800"
+	if got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	for _, sql := range []string{"$__unixEpochFilter()", "$__unixEpochFilter(a, b)"} {
+		if _, err := interpolate(t, sql, queryModel{}); err == nil {
+			t.Errorf("%s: expected an error", sql)
+		}
+	}
+}
+
+func TestInMacro(t *testing.T) {
+	tests := []struct {
+		name       string
+		sql        string
+		params     []interface{}
+		matchAll   bool
+		wantSQL    string
+		wantParams []interface{}
+	}{
+		{
+			name:       "single value",
+			sql:        `SELECT * FROM t WHERE $__in(status, ["active"])`,
+			wantSQL:    "SELECT * FROM t WHERE status IN (?1)",
+			wantParams: []interface{}{"active"},
+		},
+		{
+			name:       "multiple values after existing params",
+			sql:        `SELECT * FROM t WHERE a = ? AND $__in(status, ["a\u002c b","c\u0029"])`,
+			params:     []interface{}{1.0},
+			wantSQL:    "SELECT * FROM t WHERE a = ? AND status IN (?2, ?3)",
+			wantParams: []interface{}{1.0, "a, b", "c)"},
+		},
+		{
+			name:       "literal values",
+			sql:        `SELECT * FROM t WHERE $__in(code, 'it''s', 5, "x")`,
+			wantSQL:    "SELECT * FROM t WHERE code IN (?1, ?2, ?3)",
+			wantParams: []interface{}{"it's", 5.0, "x"},
+		},
+		{
+			name:       "repeated macro reuses placeholders",
+			sql:        `SELECT * FROM t WHERE $__in(s, ["a"]) OR $__in(s, ["a"])`,
+			wantSQL:    "SELECT * FROM t WHERE s IN (?1) OR s IN (?1)",
+			wantParams: []interface{}{"a"},
+		},
+		{
+			name:    "empty selection matches nothing",
+			sql:     `SELECT * FROM t WHERE $__in(status, [])`,
+			wantSQL: "SELECT * FROM t WHERE 1 = 0",
+		},
+		{
+			name:     "empty selection matches all",
+			sql:      `SELECT * FROM t WHERE $__in(status, [])`,
+			matchAll: true,
+			wantSQL:  "SELECT * FROM t WHERE 1 = 1",
+		},
+	}
+	for _, tt := range tests {
+		qm := queryModel{Params: tt.params}
+		got, err := sqlutil.Interpolate(&sqlutil.Query{RawSQL: tt.sql}, queryMacros(&qm, &models.PluginSettings{EmptyInMatchesAll: tt.matchAll}))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if got != tt.wantSQL {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.wantSQL, got)
+		}
+		if !reflect.DeepEqual(qm.Params, tt.wantParams) {
+			t.Errorf("%s: expected params %v, got %v", tt.name, tt.wantParams, qm.Params)
+		}
+	}
+
+	for _, sql := range []string{"$__in(status)", "$__in(, [1])", `$__in(s, [{"a":1}])`, `$__in(s, [1`} {
+		if _, err := interpolate(t, sql, queryModel{}); err == nil {
+			t.Errorf("%s: expected an error", sql)
+		}
+	}
+}
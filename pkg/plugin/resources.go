@@ -0,0 +1,315 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/olipayne/grafana-cloudflare-d1-datasource/pkg/models"
+)
+
+// databaseListPageSize is the page size requested from the Cloudflare database list.
+const databaseListPageSize = 100
+
+// newResourceMux returns the routes served through CallResource.
+func (d *Datasource) newResourceMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/databases", d.handleDatabases)
+	mux.HandleFunc("/explain", d.handleExplain)
+	mux.HandleFunc("/interpolate", d.handleInterpolate)
+	mux.HandleFunc("/metrics", d.handleMetrics)
+	return mux
+}
+
+// handleDatabases lists the D1 databases of the configured account as [{uuid, name}].
+// Only the account ID and credentials are needed, so the config editor can use it
+// before a database has been selected.
+func (d *Datasource) handleDatabases(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if d.settings.AccountID == "" {
+		http.Error(w, "account ID is not configured", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(d.settings.QueryTimeoutSeconds)*time.Second)
+	defer cancel()
+	databases, err := d.listDatabases(ctx)
+	if err != nil {
+		d.logger.Error("Failed to list D1 databases", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(databases); err != nil {
+		d.logger.Error("Failed to write D1 database list", "error", err)
+	}
+}
+
+// metricsResponse is the body of a /metrics response.
+type metricsResponse struct {
+	usageSnapshot
+	CircuitBreaker *breakerSnapshot `json:"circuitBreaker,omitempty"`
+}
+
+// handleMetrics returns the D1 usage of queries run by this datasource instance since it
+// was created, as {statements, rowsRead, rowsWritten} counters. Cached results don't count.
+// With a circuit breaker configured, its state and counters are included.
+func (d *Datasource) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	metrics := metricsResponse{usageSnapshot: d.usage.snapshot()}
+	if d.breaker != nil {
+		snapshot := d.breaker.snapshot()
+		metrics.CircuitBreaker = &snapshot
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(metrics); err != nil {
+		d.logger.Error("Failed to write usage metrics", "error", err)
+	}
+}
+
+// interpolateRequest is the body of an /interpolate request: a query as the panel sends
+// it, before its template variables are replaced, with the variables and the
+// dashboard's time range.
+type interpolateRequest struct {
+	Query      json.RawMessage      `json:"query"`
+	ScopedVars map[string]scopedVar `json:"scopedVars"`
+	Range      struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	IntervalMs    int64 `json:"intervalMs"`
+	MaxDataPoints int64 `json:"maxDataPoints"`
+}
+
+// interpolateResponse is the SQL and params a query would send to D1.
+type interpolateResponse struct {
+	SQL    string        `json:"sql"`
+	Params []interface{} `json:"params"`
+}
+
+// handleInterpolate returns the SQL and params the POSTed query would be sent to D1 with,
+// after replacing its template variables and expanding its macros, without running it.
+func (d *Datasource) handleInterpolate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req interpolateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var qm queryModel
+	if err := json.Unmarshal(req.Query, &qm); err != nil {
+		http.Error(w, "invalid query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	queryText, err := applyScopedVars(qm.QueryText, req.ScopedVars)
+	if err != nil {
+		http.Error(w, "error replacing variables: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	qm.QueryText = queryText
+
+	sql, err := d.interpolateQuery(&qm, backend.DataQuery{
+		TimeRange:     backend.TimeRange{From: req.Range.From, To: req.Range.To},
+		Interval:      time.Duration(req.IntervalMs) * time.Millisecond,
+		MaxDataPoints: req.MaxDataPoints,
+	})
+	if err != nil {
+		http.Error(w, "error interpolating query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if sql, err = d.applyMandatoryFilter(sql); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params := qm.Params
+	if params == nil {
+		params = []interface{}{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(interpolateResponse{SQL: sql, Params: params}); err != nil {
+		d.logger.Error("Failed to write interpolated query", "error", err)
+	}
+}
+
+// explainRequest is the body of an /explain request.
+type explainRequest struct {
+	SQL string `json:"sql"`
+}
+
+// handleExplain runs EXPLAIN QUERY PLAN for the single statement in the POSTed {sql} and
+// returns the plan rows as JSON objects keyed by column (id, parent, notused, detail).
+// The statement passes the same length and read-only checks as a query, so the editor
+// can't use it to reach statements a panel couldn't run.
+func (d *Datasource) handleExplain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if (d.settings.AccountID == "" && d.settings.NeedsAccountID()) || d.settings.DatabaseID == "" {
+		http.Error(w, "account ID and database ID must be configured", http.StatusBadRequest)
+		return
+	}
+	var req explainRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	statements := splitStatements(req.SQL)
+	if len(statements) != 1 {
+		http.Error(w, fmt.Sprintf("expected exactly one statement to explain, got %d", len(statements)), http.StatusBadRequest)
+		return
+	}
+	if d.settings.ReadOnly {
+		if err := checkReadOnly(statements[0].text); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := d.checkAllowedQuery(statements[0].text); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	statement, err := d.applyMandatoryFilter(statements[0].text)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sql := "EXPLAIN QUERY PLAN " + statement
+	if err := d.checkSQLLength(sql); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(d.settings.QueryTimeoutSeconds)*time.Second)
+	defer cancel()
+	apiResp, err := d.sendLookup(ctx, models.D1QueryRequest{SQL: sql})
+	if err != nil {
+		d.logger.Error("Failed to explain query", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	resp, err := decodeD1Response(endpointRaw, apiResp.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error unmarshalling D1 API response (status %s): %v", apiResp.Status, err), http.StatusBadGateway)
+		return
+	}
+	if apiResp.StatusCode != http.StatusOK || !resp.Success {
+		http.Error(w, "D1 API error: "+formatD1Errors(resp.Errors), http.StatusBadRequest)
+		return
+	}
+
+	plan := []map[string]interface{}{}
+	if len(resp.Result) > 0 && resp.Result[0].Results != nil {
+		result := resp.Result[0].Results
+		for _, row := range result.Rows {
+			step := make(map[string]interface{}, len(result.Columns))
+			for i, col := range result.Columns {
+				if i < len(row) {
+					step[col] = row[i]
+				}
+			}
+			plan = append(plan, step)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(plan); err != nil {
+		d.logger.Error("Failed to write query plan", "error", err)
+	}
+}
+
+// listDatabases fetches every page of the account's D1 database list.
+func (d *Datasource) listDatabases(ctx context.Context) ([]models.D1Database, error) {
+	databases := []models.D1Database{}
+	for page := 1; ; page++ {
+		query := url.Values{}
+		query.Set("page", strconv.Itoa(page))
+		query.Set("per_page", strconv.Itoa(databaseListPageSize))
+
+		var pageDatabases []models.D1Database
+		info, err := d.apiGet(ctx, d.accountPath("/d1/database"), query, &pageDatabases)
+		if err != nil {
+			return nil, err
+		}
+		databases = append(databases, pageDatabases...)
+
+		if len(pageDatabases) == 0 || info.TotalCount == 0 || len(databases) >= info.TotalCount {
+			return databases, nil
+		}
+	}
+}
+
+// cloudflareAPIError is returned by apiGet when the API answered with an unsuccessful
+// response, as opposed to the request failing to complete.
+type cloudflareAPIError struct {
+	StatusCode int
+	Errors     []models.D1Error
+}
+
+func (e *cloudflareAPIError) Error() string {
+	if len(e.Errors) > 0 {
+		return formatD1Errors(e.Errors)
+	}
+	return fmt.Sprintf("Cloudflare API returned status %d", e.StatusCode)
+}
+
+// accountPath returns the API path of suffix below the configured account.
+func (d *Datasource) accountPath(suffix string) string {
+	return "/accounts/" + url.PathEscape(d.settings.AccountID) + suffix
+}
+
+// apiGet sends a GET request for path below the API base URL, e.g. "/user/tokens/verify",
+// and decodes the result of the Cloudflare response envelope into result. The envelope's
+// pagination metadata is returned; unsuccessful responses are returned as a
+// *cloudflareAPIError.
+func (d *Datasource) apiGet(ctx context.Context, path string, query url.Values, result interface{}) (models.D1ResultInfo, error) {
+	apiURL := d.baseURL + path
+	if len(query) > 0 {
+		apiURL += "?" + query.Encode()
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return models.D1ResultInfo{}, fmt.Errorf("error creating HTTP request for Cloudflare API: %w", err)
+	}
+	setRequestHeaders(httpReq, d.settings)
+
+	// The request is bounded by the deadline of ctx, which callers derive from the query timeout.
+	httpClient := &http.Client{Transport: d.transport}
+	httpResp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return models.D1ResultInfo{}, fmt.Errorf("error executing Cloudflare API request: %w", err)
+	}
+	defer httpResp.Body.Close()
+
+	body, err := readResponseBody(httpResp, responseSizeLimit(d.settings))
+	if err != nil {
+		return models.D1ResultInfo{}, fmt.Errorf("error reading Cloudflare API response: %w", err)
+	}
+	var resp models.CloudflareResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return models.D1ResultInfo{}, fmt.Errorf("error unmarshalling Cloudflare API response (status %d): %w", httpResp.StatusCode, err)
+	}
+	if httpResp.StatusCode != http.StatusOK || !resp.Success {
+		return models.D1ResultInfo{}, &cloudflareAPIError{StatusCode: httpResp.StatusCode, Errors: resp.Errors}
+	}
+	if err := json.Unmarshal(resp.Result, result); err != nil {
+		return models.D1ResultInfo{}, fmt.Errorf("error unmarshalling Cloudflare API result: %w", err)
+	}
+	return resp.ResultInfo, nil
+}
@@ -0,0 +1,311 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/olipayne/grafana-cloudflare-d1-datasource/pkg/models"
+)
+
+// callResource sends a GET for path to the datasource's resource handler.
+func callResource(t *testing.T, ds *Datasource, path string) *backend.CallResourceResponse {
+	t.Helper()
+	return sendResource(t, ds, http.MethodGet, path, nil)
+}
+
+// postResource POSTs body to path of the datasource's resource handler.
+func postResource(t *testing.T, ds *Datasource, path string, body string) *backend.CallResourceResponse {
+	t.Helper()
+	return sendResource(t, ds, http.MethodPost, path, []byte(body))
+}
+
+func sendResource(t *testing.T, ds *Datasource, method, path string, body []byte) *backend.CallResourceResponse {
+	t.Helper()
+	var res *backend.CallResourceResponse
+	err := ds.CallResource(context.Background(), &backend.CallResourceRequest{
+		Path:   path,
+		Method: method,
+		URL:    path,
+		Body:   body,
+	}, backend.CallResourceResponseSenderFunc(func(r *backend.CallResourceResponse) error {
+		res = r
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("CallResource returned error: %v", err)
+	}
+	if res == nil {
+		t.Fatal("no resource response was sent")
+	}
+	return res
+}
+
+func TestDatabasesResourcePaginates(t *testing.T) {
+	pages := map[string][]models.D1Database{
+		"1": {{UUID: "uuid-1", Name: "first"}, {UUID: "uuid-2", Name: "second"}},
+		"2": {{UUID: "uuid-3", Name: "third"}},
+	}
+	var requested []string
+	ds := newTestDatasource(t, `{"accountId":"acc"}`, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/accounts/acc/d1/database" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer test-token" {
+			t.Errorf("unexpected Authorization header %q", got)
+		}
+		page := r.URL.Query().Get("page")
+		requested = append(requested, page)
+		n, _ := strconv.Atoi(page)
+		result, _ := json.Marshal(pages[page])
+		_ = json.NewEncoder(w).Encode(models.CloudflareResponse{
+			Success:    true,
+			Result:     result,
+			ResultInfo: models.D1ResultInfo{Page: n, PerPage: 2, Count: len(pages[page]), TotalCount: 3},
+		})
+	})
+
+	res := callResource(t, ds, "databases")
+	if res.Status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.Status, res.Body)
+	}
+	var databases []models.D1Database
+	if err := json.Unmarshal(res.Body, &databases); err != nil {
+		t.Fatalf("invalid response body %s: %v", res.Body, err)
+	}
+	if len(databases) != 3 || databases[0].UUID != "uuid-1" || databases[2].Name != "third" {
+		t.Errorf("unexpected databases: %+v", databases)
+	}
+	if len(requested) != 2 {
+		t.Errorf("expected 2 page requests, got %v", requested)
+	}
+}
+
+func TestDatabasesResourceErrors(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc"}`, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"success":false,"errors":[{"code":10000,"message":"Authentication error"}]}`))
+	})
+	res := callResource(t, ds, "databases")
+	if res.Status != http.StatusBadGateway {
+		t.Errorf("expected status 502, got %d", res.Status)
+	}
+	if got := string(res.Body); got != "Code 10000: Authentication error\n" {
+		t.Errorf("unexpected error body %q", got)
+	}
+
+	ds = newTestDatasource(t, `{}`, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("no request expected without an account ID")
+	})
+	if res := callResource(t, ds, "databases"); res.Status != http.StatusBadRequest {
+		t.Errorf("expected status 400 without an account ID, got %d", res.Status)
+	}
+}
+
+func TestExplainResourceReturnsPlan(t *testing.T) {
+	var sent models.D1QueryRequest
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","readOnly":true}`, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/accounts/acc/d1/database/db/raw" {
+			t.Errorf("unexpected request path %s", r.URL.Path)
+		}
+		_ = json.NewDecoder(r.Body).Decode(&sent)
+		rawResponse([]string{"id", "parent", "notused", "detail"}, [][]interface{}{
+			{float64(2), float64(0), float64(0), "SEARCH events USING INDEX idx_events_host (host=?)"},
+			{float64(7), float64(0), float64(0), "USE TEMP B-TREE FOR ORDER BY"},
+		})(w, r)
+	})
+
+	res := postResource(t, ds, "explain", `{"sql":"SELECT * FROM events WHERE host = 'a' ORDER BY ts;"}`)
+	if res.Status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.Status, res.Body)
+	}
+	if want := "EXPLAIN QUERY PLAN SELECT * FROM events WHERE host = 'a' ORDER BY ts"; sent.SQL != want {
+		t.Errorf("expected %q to be sent, got %q", want, sent.SQL)
+	}
+	var plan []map[string]interface{}
+	if err := json.Unmarshal(res.Body, &plan); err != nil {
+		t.Fatalf("invalid response body %s: %v", res.Body, err)
+	}
+	if len(plan) != 2 || plan[0]["id"] != float64(2) || plan[1]["detail"] != "USE TEMP B-TREE FOR ORDER BY" {
+		t.Errorf("unexpected plan: %v", plan)
+	}
+}
+
+func TestExplainResourceRejectsInvalidRequests(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db","readOnly":true,"maxSqlLength":60}`, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("no request expected, got %s", r.URL.Path)
+	})
+	tests := map[string]string{
+		"not json":            `SELECT 1`,
+		"no statement":        `{"sql":"  "}`,
+		"several statements":  `{"sql":"SELECT 1; SELECT 2"}`,
+		"write in read-only":  `{"sql":"DELETE FROM events"}`,
+		"longer than allowed": `{"sql":"SELECT * FROM events WHERE host = 'a-rather-long-host-name'"}`,
+	}
+	for name, body := range tests {
+		if res := postResource(t, ds, "explain", body); res.Status != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d: %s", name, res.Status, res.Body)
+		}
+	}
+	if res := callResource(t, ds, "explain"); res.Status != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405 for GET, got %d", res.Status)
+	}
+}
+
+func TestExplainResourceReportsD1Errors(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"success":false,"errors":[{"code":7500,"message":"no such table: nope"}]}`))
+	})
+	res := postResource(t, ds, "explain", `{"sql":"SELECT * FROM nope"}`)
+	if res.Status != http.StatusBadRequest || !strings.Contains(string(res.Body), "no such table: nope") {
+		t.Errorf("expected the D1 error with status 400, got %d: %s", res.Status, res.Body)
+	}
+}
+
+func TestMetricsResourceCountsRows(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(models.D1RawAPIResponse{
+			Success: true,
+			Result: []models.D1RawResultItem{{
+				Success: true,
+				Results: &models.D1RawQueryActualResult{Columns: []string{"n"}, Rows: [][]interface{}{{1.0}}},
+				Meta:    models.D1Meta{RowsRead: 40, RowsWritten: 2},
+			}},
+		})
+	})
+
+	metrics := func() usageSnapshot {
+		t.Helper()
+		res := callResource(t, ds, "/metrics")
+		if res.Status != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", res.Status, res.Body)
+		}
+		var got usageSnapshot
+		if err := json.Unmarshal(res.Body, &got); err != nil {
+			t.Fatalf("invalid metrics response %s: %v", res.Body, err)
+		}
+		return got
+	}
+
+	if got := metrics(); got != (usageSnapshot{}) {
+		t.Errorf("expected zero counters before any query, got %+v", got)
+	}
+	for i := 0; i < 3; i++ {
+		if res := runQuery(t, ds, `{"queryText":"SELECT 1 AS n"}`); res.Error != nil {
+			t.Fatalf("unexpected error: %v", res.Error)
+		}
+	}
+	if got, want := metrics(), (usageSnapshot{Statements: 3, RowsRead: 120, RowsWritten: 6}); got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+	if res := callResource(t, ds, "/metrics"); !strings.Contains(string(res.Body), `"rowsRead":120`) {
+		t.Errorf("expected JSON counters, got %s", res.Body)
+	}
+
+	ds.Dispose()
+	if got := metrics(); got != (usageSnapshot{}) {
+		t.Errorf("expected counters to reset on Dispose, got %+v", got)
+	}
+}
+
+func TestInterpolateMatchesSentSQL(t *testing.T) {
+	client := &fakeD1Client{responses: []*D1Response{cannedResponse(t, http.StatusOK, models.D1RawAPIResponse{
+		Success: true,
+		Result:  []models.D1RawResultItem{{Success: true, Results: &models.D1RawQueryActualResult{Columns: []string{"id"}, Rows: [][]interface{}{}}}},
+	})}}
+	ds := newFakeDatasource(t, `{"accountId":"acc","databaseId":"db"}`, client)
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+
+	res := postResource(t, ds, "/interpolate", `{
+		"query": {"queryText": "SELECT id FROM events WHERE id > ? AND $__timeFilter(ts) AND host = '${host}' AND $__in(status, $status)", "params": [5]},
+		"scopedVars": {"host": {"text": "web", "value": "web"}, "status": {"text": "open + a,b", "value": ["open", "a,b"]}},
+		"range": {"from": "2024-01-01T00:00:00Z", "to": "2024-01-01T01:00:00Z"}
+	}`)
+	if res.Status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.Status, res.Body)
+	}
+	var got interpolateResponse
+	if err := json.Unmarshal(res.Body, &got); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+
+	// The query as the editor sends it, with its variables replaced.
+	sent, _ := json.Marshal(map[string]interface{}{
+		"queryText": `SELECT id FROM events WHERE id > ? AND $__timeFilter(ts) AND host = 'web' AND $__in(status,["open","a\u002cb"])`,
+		"params":    []interface{}{5},
+	})
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{{
+		RefID: "A", JSON: sent, TimeRange: backend.TimeRange{From: from, To: to},
+	}}})
+	if err != nil || resp.Responses["A"].Error != nil {
+		t.Fatalf("unexpected error: %v %v", err, resp.Responses["A"].Error)
+	}
+	payload := client.payloads[0]
+	if got.SQL != payload.SQL {
+		t.Errorf("expected the interpolated SQL to match the sent SQL\n got: %s\nsent: %s", got.SQL, payload.SQL)
+	}
+	if !reflect.DeepEqual(got.Params, payload.Params) {
+		t.Errorf("expected params %v, got %v", payload.Params, got.Params)
+	}
+	if !strings.Contains(got.SQL, "id > ?1") || !strings.Contains(got.SQL, "status IN (?2, ?3)") {
+		t.Errorf("expected $__in to bind the variable's values, got %s", got.SQL)
+	}
+}
+
+func TestApplyScopedVarsFormats(t *testing.T) {
+	vars := map[string]scopedVar{
+		"host": {Text: "Web", Value: "web's"},
+		"env":  {Text: "a + b", Value: []interface{}{"a", "b"}},
+	}
+	tests := []struct {
+		sql  string
+		want string
+	}{
+		{"SELECT ${env}", "SELECT a,b"},
+		{"SELECT ${env:csv}", "SELECT a,b"},
+		{"SELECT ${env:pipe}", "SELECT a|b"},
+		{"SELECT ${env:json}", `SELECT ["a","b"]`},
+		{"SELECT ${host:json}", `SELECT "web's"`},
+		{"SELECT ${host:singlequote}", `SELECT 'web\'s'`},
+		{"SELECT ${host:doublequote}", `SELECT "web's"`},
+		{"SELECT ${env:sqlstring}, ${host:sqlstring}", "SELECT 'a','b', 'web''s'"},
+		{"SELECT ${host:raw}", "SELECT web's"},
+		{"SELECT ${env:text}", "SELECT a + b"},
+		{"SELECT * FROM t WHERE $__in(h, ${env})", `SELECT * FROM t WHERE $__in(h, ["a","b"])`},
+		{"SELECT * FROM t WHERE $__in(h, ${env:pipe})", "SELECT * FROM t WHERE $__in(h, a|b)"},
+		{"SELECT ${other:regex}", "SELECT ${other:regex}"},
+	}
+	for _, tt := range tests {
+		got, err := applyScopedVars(tt.sql, vars)
+		if err != nil {
+			t.Errorf("applyScopedVars(%q) error: %v", tt.sql, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("applyScopedVars(%q) = %q, want %q", tt.sql, got, tt.want)
+		}
+	}
+
+	for _, sql := range []string{"SELECT ${host:regex}", "SELECT * FROM t WHERE $__in(h, ${env:percentencode})"} {
+		if _, err := applyScopedVars(sql, vars); err == nil || !strings.Contains(err.Error(), "is not supported") {
+			t.Errorf("applyScopedVars(%q) error = %v, want unsupported format", sql, err)
+		}
+	}
+
+	ds := newFakeDatasource(t, `{"accountId":"acc","databaseId":"db"}`, &fakeD1Client{})
+	res := postResource(t, ds, "/interpolate", `{
+		"query": {"queryText": "SELECT * FROM logs WHERE host ~ '${host:regex}'"},
+		"scopedVars": {"host": {"text": "web", "value": "web"}}
+	}`)
+	if res.Status != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an unsupported format, got %d: %s", res.Status, res.Body)
+	}
+}
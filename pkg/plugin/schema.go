@@ -0,0 +1,114 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/olipayne/grafana-cloudflare-d1-datasource/pkg/models"
+)
+
+// declaredTypeKind maps a column type declared in a CREATE TABLE statement to a column
+// kind, following SQLite's type affinity rules. Declared date and time types have
+// NUMERIC affinity but usually hold text timestamps, so they are left to value-based
+// inference, as are columns declared without a type.
+func declaredTypeKind(declared string) (columnKind, bool) {
+	upper := strings.ToUpper(declared)
+	switch {
+	case upper == "":
+		return kindString, false
+	case strings.Contains(upper, "INT"):
+		return kindInt64, true
+	case strings.Contains(upper, "CHAR"), strings.Contains(upper, "CLOB"), strings.Contains(upper, "TEXT"):
+		return kindString, true
+	case strings.Contains(upper, "BLOB"):
+		return kindString, true
+	case strings.Contains(upper, "DATE"), strings.Contains(upper, "TIME"):
+		return kindString, false
+	default:
+		// REAL, FLOAT, DOUBLE and everything else with NUMERIC affinity.
+		return kindFloat64, true
+	}
+}
+
+// schemaKinds looks up the declared column types of the single table sql reads from
+// with PRAGMA table_info and returns the kinds they map to, keyed by column name. It
+// returns nil when the table can't be determined or the lookup fails, in which case
+// the caller falls back to value-based inference.
+func (d *Datasource) schemaKinds(ctx context.Context, sql string) map[string]columnKind {
+	table, ok := singleTableName(sql)
+	if !ok {
+		d.logger.Debug("Schema types unavailable: no single table detected")
+		return nil
+	}
+
+	pragma := models.D1QueryRequest{SQL: fmt.Sprintf("PRAGMA table_info(%s)", QuoteIdentifier(table))}
+	apiResp, err := d.sendLookup(ctx, pragma)
+	if err != nil || apiResp.StatusCode != http.StatusOK {
+		d.logger.Debug("Schema types unavailable: PRAGMA table_info failed", "table", table, "error", err)
+		return nil
+	}
+	resp, err := decodeD1Response(endpointRaw, apiResp.Body)
+	if err != nil || !resp.Success || len(resp.Result) == 0 || resp.Result[0].Results == nil {
+		d.logger.Debug("Schema types unavailable: unexpected PRAGMA table_info response", "table", table, "error", err)
+		return nil
+	}
+
+	info := resp.Result[0].Results
+	nameIdx, typeIdx := -1, -1
+	for i, col := range info.Columns {
+		switch col {
+		case "name":
+			nameIdx = i
+		case "type":
+			typeIdx = i
+		}
+	}
+	if nameIdx < 0 || typeIdx < 0 {
+		return nil
+	}
+
+	kinds := map[string]columnKind{}
+	for _, row := range info.Rows {
+		if nameIdx >= len(row) || typeIdx >= len(row) {
+			continue
+		}
+		name, _ := row[nameIdx].(string)
+		declared, _ := row[typeIdx].(string)
+		if kind, ok := declaredTypeKind(declared); ok && name != "" {
+			kinds[name] = kind
+		}
+	}
+	return kinds
+}
+
+// tableRowCount counts the rows of the single table sql reads from, so an empty result
+// can say how many rows its filters excluded. ok is false when the table can't be
+// determined or the count fails.
+func (d *Datasource) tableRowCount(ctx context.Context, sql string) (table string, count int64, ok bool) {
+	table, ok = singleTableName(sql)
+	if !ok {
+		d.logger.Debug("Row count unavailable: no single table detected")
+		return "", 0, false
+	}
+
+	// Only the rows the mandatory filter lets the query see are counted.
+	countSQL, err := d.applyMandatoryFilter(fmt.Sprintf("SELECT COUNT(*) FROM %s", QuoteIdentifier(table)))
+	if err != nil {
+		return "", 0, false
+	}
+	apiResp, err := d.sendLookup(ctx, models.D1QueryRequest{SQL: countSQL})
+	if err != nil || apiResp.StatusCode != http.StatusOK {
+		d.logger.Debug("Row count unavailable: COUNT(*) failed", "table", table, "error", err)
+		return "", 0, false
+	}
+	resp, err := decodeD1Response(endpointRaw, apiResp.Body)
+	if err != nil || !resp.Success || len(resp.Result) == 0 || resp.Result[0].Results == nil ||
+		len(resp.Result[0].Results.Rows) != 1 || len(resp.Result[0].Results.Rows[0]) != 1 {
+		d.logger.Debug("Row count unavailable: unexpected COUNT(*) response", "table", table, "error", err)
+		return "", 0, false
+	}
+	count, ok = toInt64(resp.Result[0].Results.Rows[0][0])
+	return table, count, ok
+}
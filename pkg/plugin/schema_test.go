@@ -0,0 +1,111 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/olipayne/grafana-cloudflare-d1-datasource/pkg/models"
+)
+
+func TestDeclaredTypeKind(t *testing.T) {
+	tests := []struct {
+		declared string
+		want     columnKind
+		ok       bool
+	}{
+		{"INTEGER", kindInt64, true},
+		{"BIGINT", kindInt64, true},
+		{"REAL", kindFloat64, true},
+		{"DOUBLE PRECISION", kindFloat64, true},
+		{"NUMERIC", kindFloat64, true},
+		{"DECIMAL(10,2)", kindFloat64, true},
+		{"TEXT", kindString, true},
+		{"VARCHAR(255)", kindString, true},
+		{"BLOB", kindString, true},
+		{"DATETIME", kindString, false},
+		{"", kindString, false},
+	}
+	for _, tt := range tests {
+		got, ok := declaredTypeKind(tt.declared)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("%q: expected (%s, %t), got (%s, %t)", tt.declared, tt.want, tt.ok, got, ok)
+		}
+	}
+}
+
+func TestQueryUseSchemaTypes(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		var sent models.D1QueryRequest
+		_ = json.NewDecoder(r.Body).Decode(&sent)
+		if strings.HasPrefix(sent.SQL, "PRAGMA table_info(") {
+			rawResponse([]string{"cid", "name", "type", "notnull", "dflt_value", "pk"}, [][]interface{}{
+				{float64(0), "id", "INTEGER", float64(1), nil, float64(1)},
+				{float64(1), "price", "REAL", float64(0), nil, float64(0)},
+				{float64(2), "code", "TEXT", float64(0), nil, float64(0)},
+				{float64(3), "payload", "BLOB", float64(0), nil, float64(0)},
+				{float64(4), "amount", "NUMERIC", float64(0), nil, float64(0)},
+				{float64(5), "created", "DATETIME", float64(0), nil, float64(0)},
+			})(w, r)
+			return
+		}
+		// Values chosen so that value-based inference would pick different types.
+		rawResponse([]string{"id", "price", "code", "payload", "amount", "created"}, [][]interface{}{
+			{float64(1), float64(10), "007", "AQID", float64(3), "2024-01-15 10:00:00"},
+		})(w, r)
+	}
+	want := []data.FieldType{
+		data.FieldTypeNullableInt64,
+		data.FieldTypeNullableFloat64,
+		data.FieldTypeNullableString,
+		data.FieldTypeNullableString,
+		data.FieldTypeNullableFloat64,
+		data.FieldTypeNullableTime,
+	}
+
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, handler)
+	res := runQuery(t, ds, `{"queryText":"SELECT * FROM products WHERE id > 0","useSchemaTypes":true}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	for i, w := range want {
+		if got := res.Frames[0].Fields[i].Type(); got != w {
+			t.Errorf("field %s: expected %s, got %s", res.Frames[0].Fields[i].Name, w, got)
+		}
+	}
+
+	// Without a single detectable table, inference decides: price is a whole number.
+	res = runQuery(t, ds, `{"queryText":"SELECT * FROM products p JOIN stock s ON s.id = p.id","useSchemaTypes":true}`)
+	if res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+	if got := res.Frames[0].Fields[1].Type(); got != data.FieldTypeNullableInt64 {
+		t.Errorf("expected inferred int64 price without schema types, got %s", got)
+	}
+}
+
+func TestSchemaKindsQuotesTableName(t *testing.T) {
+	tests := map[string]string{
+		"SELECT * FROM events":                `PRAGMA table_info("events")`,
+		`SELECT * FROM "order ""items"""`:     `PRAGMA table_info("order ""items""")`,
+		"SELECT * FROM [données]":             `PRAGMA table_info("données")`,
+		"SELECT * FROM `weird\"name` WHERE 1": `PRAGMA table_info("weird""name")`,
+	}
+	for query, want := range tests {
+		var pragma string
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			var sent models.D1QueryRequest
+			_ = json.NewDecoder(r.Body).Decode(&sent)
+			pragma = sent.SQL
+			rawResponse([]string{"cid", "name", "type"}, nil)(w, r)
+		}
+		ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, handler)
+		ds.schemaKinds(context.Background(), query)
+		if pragma != want {
+			t.Errorf("%s: expected %s, got %s", query, want, pragma)
+		}
+	}
+}
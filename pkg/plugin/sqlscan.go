@@ -0,0 +1,608 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// tokenKind classifies the lexical tokens produced by tokenizeSQL.
+type tokenKind int
+
+const (
+	tokenWord        tokenKind = iota // keyword or bare identifier
+	tokenQuotedIdent                  // "ident", `ident` or [ident]
+	tokenString                       // 'literal'
+	tokenNumber
+	tokenParam // ?, ?NNN, :name, @name or $name
+	tokenPunct
+)
+
+// sqlToken is a lexical token of an SQLite statement. Comments and whitespace are
+// dropped. depth is the parenthesis nesting level the token appears at.
+type sqlToken struct {
+	kind  tokenKind
+	text  string
+	start int // byte offset of the token in the scanned SQL
+	end   int
+	depth int
+}
+
+// is reports whether t is a bare word equal to keyword, ignoring case.
+func (t sqlToken) is(keyword string) bool {
+	return t.kind == tokenWord && strings.EqualFold(t.text, keyword)
+}
+
+// sqlStatement is one statement of a possibly multi-statement SQL string.
+type sqlStatement struct {
+	text   string
+	tokens []sqlToken
+}
+
+// keyword returns the statement's leading keyword in upper case, or "" if it has none.
+func (s sqlStatement) keyword() string {
+	if len(s.tokens) == 0 || s.tokens[0].kind != tokenWord {
+		return ""
+	}
+	return strings.ToUpper(s.tokens[0].text)
+}
+
+// tokenizeSQL splits sql into tokens following SQLite's lexical rules closely enough
+// to find keywords and statement boundaries: string literals, quoted identifiers and
+// comments never produce keyword tokens.
+func tokenizeSQL(sql string) []sqlToken {
+	var tokens []sqlToken
+	depth := 0
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			i++
+		case c == '-' && i+1 < len(sql) && sql[i+1] == '-':
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(sql) && sql[i+1] == '*':
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += end + 4
+			}
+		case c == '\'' || c == '"' || c == '`':
+			end := scanQuoted(sql, i, c)
+			kind := tokenQuotedIdent
+			if c == '\'' {
+				kind = tokenString
+			}
+			tokens = append(tokens, sqlToken{kind: kind, text: sql[i:end], start: i, end: end, depth: depth})
+			i = end
+		case c == '[':
+			end := strings.IndexByte(sql[i:], ']')
+			if end < 0 {
+				end = len(sql)
+			} else {
+				end += i + 1
+			}
+			tokens = append(tokens, sqlToken{kind: tokenQuotedIdent, text: sql[i:end], start: i, end: end, depth: depth})
+			i = end
+		case isIdentStart(c):
+			end := i + 1
+			for end < len(sql) && isIdentPart(sql[end]) {
+				end++
+			}
+			tokens = append(tokens, sqlToken{kind: tokenWord, text: sql[i:end], start: i, end: end, depth: depth})
+			i = end
+		case isDigit(c) || (c == '.' && i+1 < len(sql) && isDigit(sql[i+1])):
+			end := i + 1
+			for end < len(sql) && (isIdentPart(sql[end]) || sql[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, sqlToken{kind: tokenNumber, text: sql[i:end], start: i, end: end, depth: depth})
+			i = end
+		case c == '?' || ((c == ':' || c == '@' || c == '$') && i+1 < len(sql) && isIdentPart(sql[i+1])):
+			end := i + 1
+			for end < len(sql) && isIdentPart(sql[end]) {
+				end++
+			}
+			tokens = append(tokens, sqlToken{kind: tokenParam, text: sql[i:end], start: i, end: end, depth: depth})
+			i = end
+		default:
+			if c == ')' && depth > 0 {
+				depth--
+			}
+			tokens = append(tokens, sqlToken{kind: tokenPunct, text: sql[i : i+1], start: i, end: i + 1, depth: depth})
+			if c == '(' {
+				depth++
+			}
+			i++
+		}
+	}
+	return tokens
+}
+
+// scanQuoted returns the offset just past the quoted token starting at sql[start].
+// A doubled quote character inside the token is an escaped quote.
+func scanQuoted(sql string, start int, quote byte) int {
+	for i := start + 1; i < len(sql); i++ {
+		if sql[i] == quote {
+			if i+1 < len(sql) && sql[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(sql)
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || isDigit(c) || c == '$'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// splitStatements splits sql on top-level semicolons. Empty statements (for example
+// after a trailing semicolon or consisting only of comments) are dropped.
+func splitStatements(sql string) []sqlStatement {
+	var statements []sqlStatement
+	tokens := tokenizeSQL(sql)
+	begin := 0
+	flush := func(end int) {
+		if begin < end {
+			stmtTokens := tokens[begin:end]
+			text := sql[stmtTokens[0].start:stmtTokens[len(stmtTokens)-1].end]
+			statements = append(statements, sqlStatement{text: text, tokens: stmtTokens})
+		}
+	}
+	for i, tok := range tokens {
+		if tok.kind == tokenPunct && tok.text == ";" {
+			flush(i)
+			begin = i + 1
+		}
+	}
+	flush(len(tokens))
+	return statements
+}
+
+// readOnlyKeywords are the leading keywords of statements allowed in read-only mode.
+var readOnlyKeywords = map[string]bool{
+	"SELECT":  true,
+	"WITH":    true,
+	"PRAGMA":  true,
+	"EXPLAIN": true,
+}
+
+// checkReadOnly returns an error if any statement in sql could modify the database.
+func checkReadOnly(sql string) error {
+	for _, stmt := range splitStatements(sql) {
+		keyword := stmt.keyword()
+		if !readOnlyKeywords[keyword] {
+			if keyword == "" {
+				keyword = "this"
+			}
+			return fmt.Errorf("read-only mode: %s statements are not allowed", keyword)
+		}
+		// A common table expression can prefix a write (WITH x AS (...) DELETE ...); the
+		// first top-level statement keyword after the CTE definitions decides.
+		if keyword == "WITH" {
+			for _, tok := range stmt.tokens[1:] {
+				if tok.depth > 0 {
+					continue
+				}
+				if tok.is("SELECT") || tok.is("VALUES") {
+					break
+				}
+				if tok.is("INSERT") || tok.is("UPDATE") || tok.is("DELETE") || tok.is("REPLACE") {
+					return fmt.Errorf("read-only mode: WITH ... %s statements are not allowed", strings.ToUpper(tok.text))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// countPlaceholders returns the number of bound parameters sql expects, following
+// SQLite's numbering: a bare ? takes the number after the largest one assigned so far
+// and ?NNN uses NNN explicitly.
+func countPlaceholders(sql string) (int, error) {
+	largest := 0
+	for _, tok := range tokenizeSQL(sql) {
+		if tok.kind != tokenParam || tok.text[0] != '?' {
+			continue
+		}
+		if tok.text == "?" {
+			largest++
+			continue
+		}
+		n, err := strconv.Atoi(tok.text[1:])
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("invalid placeholder %s", tok.text)
+		}
+		if n > largest {
+			largest = n
+		}
+	}
+	return largest, nil
+}
+
+// numberPlaceholders rewrites every bare ? in sql as ?NNN with the number SQLite assigns
+// it, so numbered placeholders inserted into the statement later don't change which
+// parameter a ? binds.
+func numberPlaceholders(sql string) string {
+	var b strings.Builder
+	last, largest := 0, 0
+	for _, tok := range tokenizeSQL(sql) {
+		if tok.kind != tokenParam || tok.text[0] != '?' {
+			continue
+		}
+		if tok.text != "?" {
+			if n, err := strconv.Atoi(tok.text[1:]); err == nil && n > largest {
+				largest = n
+			}
+			continue
+		}
+		largest++
+		b.WriteString(sql[last:tok.start])
+		b.WriteString("?" + strconv.Itoa(largest))
+		last = tok.end
+	}
+	b.WriteString(sql[last:])
+	return b.String()
+}
+
+// fromClauseEnd are the keywords that end the FROM clause of a SELECT.
+var fromClauseEnd = map[string]bool{
+	"WHERE":  true,
+	"GROUP":  true,
+	"HAVING": true,
+	"WINDOW": true,
+	"ORDER":  true,
+	"LIMIT":  true,
+}
+
+// singleTableName returns the name of the table a query reads from when it is a single
+// SELECT from exactly one unqualified table, with any identifier quoting removed. Joins,
+// compound selects, subqueries in FROM and schema-qualified names are not detected.
+func singleTableName(sql string) (string, bool) {
+	statements := splitStatements(sql)
+	if len(statements) != 1 || statements[0].keyword() != "SELECT" {
+		return "", false
+	}
+	tokens := statements[0].tokens
+	table := ""
+	inFrom := false
+	for i, tok := range tokens {
+		if tok.depth > 0 {
+			continue
+		}
+		switch {
+		case tok.is("UNION") || tok.is("INTERSECT") || tok.is("EXCEPT"):
+			return "", false
+		case tok.is("FROM"):
+			if table != "" || i+1 >= len(tokens) {
+				return "", false
+			}
+			next := tokens[i+1]
+			if next.kind != tokenWord && next.kind != tokenQuotedIdent {
+				return "", false
+			}
+			if i+2 < len(tokens) && tokens[i+2].kind == tokenPunct && tokens[i+2].text == "." {
+				return "", false
+			}
+			table = unquoteIdentifier(next.text)
+			inFrom = true
+		case inFrom && tok.kind == tokenWord && fromClauseEnd[strings.ToUpper(tok.text)]:
+			inFrom = false
+		case inFrom && (tok.is("JOIN") || (tok.kind == tokenPunct && tok.text == ",")):
+			return "", false
+		}
+	}
+	return table, table != ""
+}
+
+// hasUnboundedSelect reports whether a statement of sql is a SELECT reading from a table
+// without a LIMIT clause, which may return more rows than a panel needs. Only the
+// outermost statement counts: a LIMIT inside a subquery or common table expression
+// doesn't bound it, and one on the outer query bounds it regardless of its subqueries.
+// SELECTs without a FROM, such as SELECT 1, return a single row and are ignored.
+func hasUnboundedSelect(sql string) bool {
+	for _, stmt := range splitStatements(sql) {
+		keyword := stmt.keyword()
+		if keyword != "SELECT" && keyword != "WITH" {
+			continue
+		}
+		// A WITH prefix may also lead into a write (WITH x AS (...) DELETE ...), which is
+		// never reported.
+		isSelect, isWrite, hasFrom, hasLimit := keyword == "SELECT", false, false, false
+		for _, tok := range stmt.tokens {
+			if tok.depth > 0 {
+				continue
+			}
+			switch {
+			case tok.is("SELECT"):
+				isSelect = true
+			case !isSelect && (tok.is("INSERT") || tok.is("UPDATE") || tok.is("DELETE") || tok.is("REPLACE")):
+				isWrite = true
+			case tok.is("FROM"):
+				hasFrom = true
+			case tok.is("LIMIT"):
+				hasLimit = true
+			}
+		}
+		if isSelect && !isWrite && hasFrom && !hasLimit {
+			return true
+		}
+	}
+	return false
+}
+
+// referencedTables returns the tables sql reads or writes, as named after FROM, JOIN,
+// INTO and UPDATE in any statement or subquery, without identifier quoting and in order
+// of first reference. Schema-qualified names keep their schema ("main.events"); aliases,
+// subqueries, table-valued functions such as json_each and the names of common table
+// expressions are left out.
+func referencedTables(sql string) []string {
+	var tables []string
+	seen := map[string]bool{}
+	for _, stmt := range splitStatements(sql) {
+		tokens := stmt.tokens
+		ctes := cteNames(tokens)
+		for i, tok := range tokens {
+			isFrom := tok.is("FROM") || tok.is("JOIN")
+			if !isFrom && !tok.is("INTO") && !tok.is("UPDATE") {
+				continue
+			}
+			j := i + 1
+			if tok.is("UPDATE") && j+1 < len(tokens) && tokens[j].is("OR") {
+				j += 2 // UPDATE OR REPLACE t
+			}
+			for {
+				name, next, ok := tableReference(tokens, j)
+				// A parenthesis after the name of a FROM item makes it a table-valued function.
+				if isFrom && next < len(tokens) && tokens[next].text == "(" {
+					ok = false
+				}
+				if ok && !ctes[strings.ToLower(name)] && !seen[name] {
+					seen[name] = true
+					tables = append(tables, name)
+				}
+				if !isFrom {
+					break
+				}
+				// FROM a [AS] x, b joins further tables with commas.
+				if next < len(tokens) && tokens[next].is("AS") {
+					next++
+				}
+				if next < len(tokens) && tokens[next].kind != tokenPunct && !isClauseKeyword(tokens[next]) {
+					next++
+				}
+				if !ok || next >= len(tokens) || tokens[next].text != "," {
+					break
+				}
+				j = next + 1
+			}
+		}
+	}
+	return tables
+}
+
+// tableReference reads a possibly schema-qualified table name starting at tokens[i]. It
+// returns the name and the index of the token following it.
+func tableReference(tokens []sqlToken, i int) (name string, next int, ok bool) {
+	if i >= len(tokens) || (tokens[i].kind != tokenWord && tokens[i].kind != tokenQuotedIdent) || isClauseKeyword(tokens[i]) {
+		return "", i, false
+	}
+	name = unquoteIdentifier(tokens[i].text)
+	if i+2 < len(tokens) && tokens[i+1].text == "." &&
+		(tokens[i+2].kind == tokenWord || tokens[i+2].kind == tokenQuotedIdent) {
+		return name + "." + unquoteIdentifier(tokens[i+2].text), i + 3, true
+	}
+	return name, i + 1, true
+}
+
+// clauseKeywords are keywords that may follow a table name, so they are never read as
+// a table name or an alias.
+var clauseKeywords = map[string]bool{
+	"SELECT": true, "VALUES": true, "DEFAULT": true, "WHERE": true, "GROUP": true,
+	"HAVING": true, "WINDOW": true, "ORDER": true, "LIMIT": true, "SET": true,
+	"JOIN": true, "INNER": true, "LEFT": true, "RIGHT": true, "FULL": true,
+	"CROSS": true, "NATURAL": true, "OUTER": true, "ON": true, "USING": true,
+	"UNION": true, "INTERSECT": true, "EXCEPT": true, "RETURNING": true,
+	"INDEXED": true, "NOT": true, "AS": true,
+}
+
+func isClauseKeyword(tok sqlToken) bool {
+	return tok.kind == tokenWord && clauseKeywords[strings.ToUpper(tok.text)]
+}
+
+// cteNames returns the lower-cased names of the common table expressions defined by
+// WITH clauses among tokens, at any nesting level.
+func cteNames(tokens []sqlToken) map[string]bool {
+	names := map[string]bool{}
+	for i, with := range tokens {
+		if !with.is("WITH") {
+			continue
+		}
+		// Each definition at the WITH's level starts with its name, after WITH [RECURSIVE]
+		// or a comma; the statement's own keyword ends the list.
+		expectName := true
+		for _, tok := range tokens[i+1:] {
+			if tok.depth > with.depth || tok.is("RECURSIVE") {
+				continue
+			}
+			if tok.depth < with.depth || isStatementKeyword(tok) {
+				break
+			}
+			if tok.text == "," {
+				expectName = true
+			} else if expectName && (tok.kind == tokenWord || tok.kind == tokenQuotedIdent) {
+				names[strings.ToLower(unquoteIdentifier(tok.text))] = true
+				expectName = false
+			}
+		}
+	}
+	return names
+}
+
+// isStatementKeyword reports whether tok starts the main part of a statement after WITH.
+func isStatementKeyword(tok sqlToken) bool {
+	return tok.is("SELECT") || tok.is("VALUES") || tok.is("INSERT") || tok.is("UPDATE") || tok.is("DELETE") || tok.is("REPLACE")
+}
+
+// sqlInsertion is text to insert into an SQL string at byte offset at.
+type sqlInsertion struct {
+	at   int
+	text string
+}
+
+// addFilter adds the condition filter to the outermost WHERE clause of every statement
+// of sql, creating the clause where there is none, e.g. to scope every query to a
+// tenant. An existing condition is parenthesized and combined with the filter by AND, so
+// an OR in either can't widen the result. Each SELECT of a compound statement gets the
+// filter; SELECTs without a FROM are left alone. The filter only scopes the outermost
+// SELECTs, so statements reading rows through a subquery or a WITH clause are rejected,
+// as are statements other than SELECT, since the filter can't scope them.
+func addFilter(sql, filter string) (string, error) {
+	var insertions []sqlInsertion
+	for _, stmt := range splitStatements(sql) {
+		keyword := stmt.keyword()
+		if keyword == "WITH" {
+			return "", errors.New("WITH clauses can't be run with a mandatory filter, which only scopes the outermost SELECT")
+		}
+		if keyword != "SELECT" {
+			return "", fmt.Errorf("only SELECT statements can be run with a mandatory filter, got %s", stmtName(keyword))
+		}
+		var top []sqlToken
+		for _, tok := range stmt.tokens {
+			if tok.depth == 0 {
+				top = append(top, tok)
+			} else if tok.is("SELECT") {
+				return "", errors.New("subqueries can't be run with a mandatory filter, which only scopes the outermost SELECT")
+			}
+		}
+
+		// Split the statement into the SELECTs of a compound select.
+		begin := 0
+		for i := 0; i <= len(top); i++ {
+			if i < len(top) && !top[i].is("UNION") && !top[i].is("INTERSECT") && !top[i].is("EXCEPT") {
+				continue
+			}
+			insertions = append(insertions, filterInsertions(top[begin:i], filter)...)
+			begin = i + 1
+		}
+	}
+
+	// Insert from the end so earlier offsets stay valid.
+	sort.SliceStable(insertions, func(i, j int) bool { return insertions[i].at > insertions[j].at })
+	for _, ins := range insertions {
+		sql = sql[:ins.at] + ins.text + sql[ins.at:]
+	}
+	return sql, nil
+}
+
+// filterInsertions returns the insertions adding filter to the WHERE clause of the
+// single SELECT of tokens, which are the SELECT's top-level tokens. The filter goes after
+// the FROM clause and any WHERE condition, before GROUP BY, HAVING, WINDOW, ORDER BY and
+// LIMIT.
+func filterInsertions(tokens []sqlToken, filter string) []sqlInsertion {
+	from, where, end := -1, -1, len(tokens)
+	for i, tok := range tokens {
+		switch {
+		case tok.is("FROM") && from < 0:
+			from = i
+		case from >= 0 && tok.is("WHERE") && where < 0:
+			where = i
+		case from >= 0 && tok.kind == tokenWord && fromClauseEnd[strings.ToUpper(tok.text)]:
+			end = i
+		}
+		if end < len(tokens) {
+			break
+		}
+	}
+	if from < 0 {
+		return nil
+	}
+	last := tokens[end-1].end
+	if where < 0 || where+1 == end {
+		return []sqlInsertion{{at: last, text: " WHERE (" + filter + ")"}}
+	}
+	return []sqlInsertion{
+		{at: tokens[where+1].start, text: "("},
+		{at: last, text: ") AND (" + filter + ")"},
+	}
+}
+
+// stmtName names a statement by its leading keyword in error messages.
+func stmtName(keyword string) string {
+	if keyword == "" {
+		return "a statement without a leading keyword"
+	}
+	return keyword
+}
+
+// checkFilterExpression returns an error if filter isn't usable as a condition added by
+// addFilter: it must be a non-empty expression with balanced parentheses and without
+// statement separators, comments or placeholders, so it can't escape the parentheses it
+// is wrapped in or change the rest of the statement.
+func checkFilterExpression(filter string) error {
+	// A ) after the filter must survive tokenizing, which an unterminated string, quoted
+	// identifier or comment would swallow.
+	probe := tokenizeSQL(filter + "\n)")
+	if len(probe) == 0 || probe[len(probe)-1].start != len(filter)+1 {
+		return errors.New("filter has an unterminated string, identifier or comment")
+	}
+	tokens := probe[:len(probe)-1]
+	if len(tokens) == 0 {
+		return errors.New("filter is empty")
+	}
+	open := 0
+	for i, tok := range tokens {
+		// Comments are the only text tokenizing drops besides whitespace.
+		if i > 0 && strings.TrimSpace(filter[tokens[i-1].end:tok.start]) != "" {
+			return errors.New("filter must not contain comments")
+		}
+		switch {
+		case tok.kind == tokenParam:
+			return fmt.Errorf("filter must not contain placeholders, got %s", tok.text)
+		case tok.kind == tokenPunct && tok.text == ";":
+			return errors.New("filter must be a single expression without ;")
+		case tok.kind == tokenPunct && tok.text == "(":
+			open++
+		case tok.kind == tokenPunct && tok.text == ")":
+			if open == 0 {
+				return errors.New("filter has unbalanced parentheses")
+			}
+			open--
+		}
+	}
+	if open > 0 {
+		return errors.New("filter has unbalanced parentheses")
+	}
+	if strings.TrimSpace(filter[:tokens[0].start]) != "" || strings.TrimSpace(filter[tokens[len(tokens)-1].end:]) != "" {
+		return errors.New("filter must not contain comments")
+	}
+	return nil
+}
+
+// limitToOneRow wraps the single SELECT of sql so it returns at most one row with the
+// same columns. A subquery is used rather than appending LIMIT 1, which would clash with
+// a LIMIT the query already has.
+func limitToOneRow(sql string) (string, error) {
+	statements := splitStatements(sql)
+	if len(statements) != 1 {
+		return "", fmt.Errorf("expected exactly one statement, got %d", len(statements))
+	}
+	if keyword := statements[0].keyword(); keyword != "SELECT" && keyword != "WITH" {
+		return "", fmt.Errorf("expected a SELECT statement, got %s", stmtName(keyword))
+	}
+	return "SELECT * FROM (" + statements[0].text + ") LIMIT 1", nil
+}
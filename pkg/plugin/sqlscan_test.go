@@ -0,0 +1,229 @@
+package plugin
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	stmts := splitStatements(`-- leading comment
+SELECT 'a;b' FROM t; /* block; */ INSERT INTO t VALUES (1);;  `)
+	if len(stmts) != 2 {
+		t.Fatalf("expected 2 statements, got %d: %+v", len(stmts), stmts)
+	}
+	if stmts[0].text != "SELECT 'a;b' FROM t" {
+		t.Errorf("unexpected first statement %q", stmts[0].text)
+	}
+	if stmts[1].keyword() != "INSERT" {
+		t.Errorf("expected INSERT keyword, got %q", stmts[1].keyword())
+	}
+}
+
+func TestCheckReadOnly(t *testing.T) {
+	allowed := []string{
+		"SELECT * FROM t",
+		"  -- comment\n/* another */ select 1",
+		"WITH x AS (SELECT 1) SELECT * FROM x",
+		"PRAGMA table_info(t)",
+		"EXPLAIN QUERY PLAN SELECT * FROM t",
+		"SELECT 'DELETE FROM t' AS s; SELECT 2;",
+	}
+	for _, sql := range allowed {
+		if err := checkReadOnly(sql); err != nil {
+			t.Errorf("expected %q to be allowed, got %v", sql, err)
+		}
+	}
+
+	blocked := []string{
+		"INSERT INTO t VALUES (1)",
+		"UPDATE t SET a = 1",
+		"DELETE FROM t",
+		"DROP TABLE t",
+		"/* sneaky */ -- comment\n  delete from t",
+		"SELECT 1; DROP TABLE t",
+		"WITH x AS (SELECT 1) DELETE FROM t WHERE id IN (SELECT * FROM x)",
+	}
+	for _, sql := range blocked {
+		if err := checkReadOnly(sql); err == nil {
+			t.Errorf("expected %q to be rejected", sql)
+		}
+	}
+}
+
+func TestCountPlaceholders(t *testing.T) {
+	tests := map[string]int{
+		"SELECT * FROM t":                              0,
+		"SELECT * FROM t WHERE a = ? AND b = ?":        2,
+		"SELECT * FROM t WHERE a = '?' AND b = ?":      1,
+		"SELECT * FROM t WHERE a = ?2 AND b = ?1":      2,
+		"SELECT * FROM t WHERE a = ?3 AND b = ?":       4,
+		"SELECT ? -- a comment with ?\nFROM t /* ? */": 1,
+	}
+	for sql, want := range tests {
+		got, err := countPlaceholders(sql)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", sql, err)
+		}
+		if got != want {
+			t.Errorf("%q: expected %d placeholders, got %d", sql, want, got)
+		}
+	}
+}
+
+func TestNumberPlaceholders(t *testing.T) {
+	tests := map[string]string{
+		"SELECT * FROM t WHERE a = ? AND b = ?":          "SELECT * FROM t WHERE a = ?1 AND b = ?2",
+		"SELECT * FROM t WHERE a = ?3 AND b = ?":         "SELECT * FROM t WHERE a = ?3 AND b = ?4",
+		"SELECT * FROM t WHERE a = '?' AND b = ? -- ?\n": "SELECT * FROM t WHERE a = '?' AND b = ?1 -- ?\n",
+		"SELECT * FROM t WHERE a = :a":                   "SELECT * FROM t WHERE a = :a",
+	}
+	for sql, want := range tests {
+		if got := numberPlaceholders(sql); got != want {
+			t.Errorf("%q: expected %q, got %q", sql, want, got)
+		}
+	}
+}
+
+func TestSingleTableName(t *testing.T) {
+	tests := map[string]string{
+		"SELECT * FROM events":                                 "events",
+		"SELECT a, b FROM events WHERE a IN (SELECT a FROM x)": "events",
+		`SELECT * FROM "my events" e ORDER BY a, b`:            "my events",
+		`SELECT * FROM [weird "name]`:                          `weird "name`,
+		`SELECT * FROM "say ""hi"""`:                           `say "hi"`,
+		"select count(*) from events group by a, b limit 5;":   "events",
+		"SELECT * FROM a, b":                                   "",
+		"SELECT * FROM a JOIN b ON a.id = b.id":                "",
+		"SELECT * FROM main.events":                            "",
+		"SELECT * FROM (SELECT * FROM events)":                 "",
+		"SELECT a FROM x UNION SELECT a FROM y":                "",
+		"SELECT 1":                                             "",
+		"DELETE FROM events":                                   "",
+		"SELECT * FROM events; SELECT * FROM other":            "",
+	}
+	for sql, want := range tests {
+		got, ok := singleTableName(sql)
+		if got != want || ok != (want != "") {
+			t.Errorf("%q: expected %q, got %q (%t)", sql, want, got, ok)
+		}
+	}
+}
+
+func TestHasUnboundedSelect(t *testing.T) {
+	tests := map[string]bool{
+		"SELECT * FROM t":                                        true,
+		"SELECT * FROM t LIMIT 10":                               false,
+		"select a from t order by a limit ? offset ?":            false,
+		"SELECT * FROM t WHERE id IN (SELECT id FROM x LIMIT 5)": true,
+		"SELECT * FROM (SELECT * FROM t) LIMIT 5":                false,
+		"WITH x AS (SELECT * FROM t LIMIT 5) SELECT * FROM x":    true,
+		"WITH x AS (SELECT * FROM t) SELECT * FROM x LIMIT 5":    false,
+		"WITH x AS (SELECT id FROM t) DELETE FROM t":             false,
+		"SELECT replace(a, 'x', 'y') FROM t":                     true,
+		"SELECT 1":                                               false,
+		"SELECT 'no LIMIT here' FROM t -- LIMIT 1":               true,
+		"SELECT * FROM t LIMIT 1; SELECT * FROM u":               true,
+		"INSERT INTO t SELECT * FROM u":                          false,
+		"PRAGMA table_info(t)":                                   false,
+	}
+	for sql, want := range tests {
+		if got := hasUnboundedSelect(sql); got != want {
+			t.Errorf("%q: expected %t, got %t", sql, want, got)
+		}
+	}
+}
+
+func TestReferencedTables(t *testing.T) {
+	tests := map[string][]string{
+		"SELECT 1":             nil,
+		"SELECT * FROM events": {"events"},
+		"SELECT e.id FROM events AS e JOIN users u ON u.id = e.user_id":                                                               {"events", "users"},
+		"SELECT * FROM a x, b y, c WHERE x.id = y.id":                                                                                 {"a", "b", "c"},
+		`SELECT * FROM main.events, "my table" LEFT OUTER JOIN [t2] USING (id)`:                                                       {"main.events", "my table", "t2"},
+		"SELECT * FROM (SELECT id FROM inner_t) s JOIN other o ON o.id = s.id":                                                        {"inner_t", "other"},
+		"SELECT * FROM t WHERE id IN (SELECT id FROM ids)":                                                                            {"t", "ids"},
+		"WITH recent AS (SELECT * FROM events), top(id) AS (SELECT id FROM recent) SELECT * FROM top JOIN users ON users.id = top.id": {"events", "users"},
+		"WITH RECURSIVE n(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM n) SELECT x FROM n":                                             nil,
+		"SELECT value FROM events, json_each(events.tags)":                                                                            {"events"},
+		"INSERT INTO audit (id) SELECT id FROM events; UPDATE OR IGNORE counters SET n = n + 1; DELETE FROM events":                   {"audit", "events", "counters"},
+		"SELECT 'FROM fake' FROM real_t -- JOIN ghost":                                                                                {"real_t"},
+	}
+	for sql, want := range tests {
+		if got := referencedTables(sql); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: expected %v, got %v", sql, want, got)
+		}
+	}
+}
+
+func TestAddFilter(t *testing.T) {
+	const filter = "tenant_id = 'x'"
+	cases := map[string]string{
+		"SELECT * FROM t":                                                "SELECT * FROM t WHERE (tenant_id = 'x')",
+		"SELECT * FROM t WHERE a = 1 OR b = 2":                           "SELECT * FROM t WHERE (a = 1 OR b = 2) AND (tenant_id = 'x')",
+		"SELECT * FROM t ORDER BY ts DESC LIMIT 10":                      "SELECT * FROM t WHERE (tenant_id = 'x') ORDER BY ts DESC LIMIT 10",
+		"SELECT * FROM t WHERE a = 1 ORDER BY ts LIMIT 10":               "SELECT * FROM t WHERE (a = 1) AND (tenant_id = 'x') ORDER BY ts LIMIT 10",
+		"SELECT host, COUNT(*) FROM t GROUP BY host HAVING COUNT(*) > 1": "SELECT host, COUNT(*) FROM t WHERE (tenant_id = 'x') GROUP BY host HAVING COUNT(*) > 1",
+		"SELECT host FROM t WHERE a IN (1, 2) GROUP BY host":             "SELECT host FROM t WHERE (a IN (1, 2)) AND (tenant_id = 'x') GROUP BY host",
+		"SELECT a FROM t UNION ALL SELECT a FROM u WHERE b ORDER BY a":   "SELECT a FROM t WHERE (tenant_id = 'x') UNION ALL SELECT a FROM u WHERE (b) AND (tenant_id = 'x') ORDER BY a",
+		"SELECT 1": "SELECT 1",
+		"SELECT * FROM t -- newest first\nORDER BY ts;": "SELECT * FROM t WHERE (tenant_id = 'x') -- newest first\nORDER BY ts;",
+	}
+	for sql, want := range cases {
+		got, err := addFilter(sql, filter)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", sql, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%q:\n got %q\nwant %q", sql, got, want)
+		}
+	}
+
+	for _, sql := range []string{
+		"DELETE FROM t",
+		"WITH x AS (SELECT 1) DELETE FROM t",
+		"PRAGMA table_info(t)",
+		"SELECT * FROM t; UPDATE t SET a = 1",
+	} {
+		if _, err := addFilter(sql, filter); err == nil {
+			t.Errorf("expected %q to be rejected", sql)
+		}
+	}
+
+	// The filter would only scope the outer SELECT, leaving the nested reads unfiltered.
+	for _, sql := range []string{
+		"SELECT host FROM t WHERE a IN (SELECT a FROM t WHERE b = 1)",
+		"SELECT host, (SELECT COUNT(*) FROM t) AS total FROM t",
+		"SELECT * FROM (SELECT * FROM t ORDER BY ts LIMIT 5) s",
+		"SELECT * FROM t WHERE EXISTS (select 1 FROM t u WHERE u.id = t.id)",
+		"WITH x AS (SELECT * FROM t) SELECT * FROM x LIMIT 1",
+	} {
+		if _, err := addFilter(sql, filter); err == nil || !strings.Contains(err.Error(), "only scopes the outermost SELECT") {
+			t.Errorf("expected %q to be rejected for reading around the filter, got %v", sql, err)
+		}
+	}
+}
+
+func TestCheckFilterExpression(t *testing.T) {
+	for _, filter := range []string{"tenant_id = 'x'", "(a = 1 OR b = 'it''s')", `"tenant id" IN ('a', 'b')`} {
+		if err := checkFilterExpression(filter); err != nil {
+			t.Errorf("expected %q to be accepted, got %v", filter, err)
+		}
+	}
+	for _, filter := range []string{
+		"",
+		"  ",
+		"tenant_id = 'x') OR (1 = 1",
+		"tenant_id = 'x' --",
+		"tenant_id = 'x' /* */ OR 1",
+		"tenant_id = 'x",
+		"tenant_id = ?",
+		"1; DROP TABLE t",
+		"(tenant_id = 'x'",
+	} {
+		if err := checkFilterExpression(filter); err == nil {
+			t.Errorf("expected %q to be rejected", filter)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package plugin
+
+import "strings"
+
+// QuoteIdentifier quotes name as an SQLite identifier: it is wrapped in double quotes
+// and embedded double quotes are doubled, so any name, including keywords and names
+// with spaces or quotes, is safe to splice into SQL.
+func QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// QuoteLiteral quotes s as an SQLite string literal: it is wrapped in single quotes and
+// embedded single quotes are doubled.
+func QuoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// unquoteLiteral returns the string an SQLite string literal quoted by QuoteLiteral
+// stands for. Text that isn't a single-quoted literal is returned as is.
+func unquoteLiteral(literal string) string {
+	if len(literal) < 2 || literal[0] != '\'' || literal[len(literal)-1] != '\'' {
+		return literal
+	}
+	return strings.ReplaceAll(literal[1:len(literal)-1], "''", "'")
+}
+
+// unquoteIdentifier returns the name an identifier token refers to, undoing the "...",
+// `...` and [...] quoting styles SQLite accepts. Bare identifiers are returned as is.
+func unquoteIdentifier(ident string) string {
+	if len(ident) < 2 {
+		return ident
+	}
+	switch first, last := ident[0], ident[len(ident)-1]; {
+	case first == '"' && last == '"':
+		return strings.ReplaceAll(ident[1:len(ident)-1], `""`, `"`)
+	case first == '`' && last == '`':
+		return strings.ReplaceAll(ident[1:len(ident)-1], "``", "`")
+	case first == '[' && last == ']':
+		return ident[1 : len(ident)-1]
+	}
+	return ident
+}
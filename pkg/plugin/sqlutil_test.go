@@ -0,0 +1,89 @@
+package plugin
+
+import "testing"
+
+func TestQuoteIdentifier(t *testing.T) {
+	tests := map[string]string{
+		"events":          `"events"`,
+		"select":          `"select"`,
+		"my table":        `"my table"`,
+		`say "hi"`:        `"say ""hi"""`,
+		`"`:               `""""`,
+		"it's":            `"it's"`,
+		"":                `""`,
+		"données_été":     `"données_été"`,
+		"表":               `"表"`,
+		"emoji 🚀":         `"emoji 🚀"`,
+		"a; DROP TABLE x": `"a; DROP TABLE x"`,
+	}
+	for in, want := range tests {
+		if got := QuoteIdentifier(in); got != want {
+			t.Errorf("QuoteIdentifier(%q): expected %s, got %s", in, want, got)
+		}
+	}
+}
+
+func TestQuoteLiteral(t *testing.T) {
+	tests := map[string]string{
+		"hello":                    `'hello'`,
+		"it's":                     `'it''s'`,
+		"''":                       `''''''`,
+		`say "hi"`:                 `'say "hi"'`,
+		"":                         `''`,
+		"naïve café":               `'naïve café'`,
+		"日本語":                      `'日本語'`,
+		"x'; DROP TABLE events;--": `'x''; DROP TABLE events;--'`,
+	}
+	for in, want := range tests {
+		if got := QuoteLiteral(in); got != want {
+			t.Errorf("QuoteLiteral(%q): expected %s, got %s", in, want, got)
+		}
+	}
+}
+
+// Quoted values must survive the tokenizer as a single token, so they can't break out
+// of their quotes.
+func TestQuotedValuesTokenizeAsOneToken(t *testing.T) {
+	for _, s := range []string{`a"b`, "x'; DROP TABLE events;--", "🚀'\"", ""} {
+		ident := tokenizeSQL(QuoteIdentifier(s))
+		if len(ident) != 1 || ident[0].kind != tokenQuotedIdent || unquoteIdentifier(ident[0].text) != s {
+			t.Errorf("QuoteIdentifier(%q) did not round-trip: %+v", s, ident)
+		}
+		literal := tokenizeSQL(QuoteLiteral(s))
+		if len(literal) != 1 || literal[0].kind != tokenString || unquoteLiteral(literal[0].text) != s {
+			t.Errorf("QuoteLiteral(%q) did not round-trip: %+v", s, literal)
+		}
+	}
+}
+
+func TestUnquoteLiteral(t *testing.T) {
+	tests := map[string]string{
+		"'hello'":  "hello",
+		"'it''s'":  "it's",
+		"''":       "",
+		"'":        "'",
+		"plain":    "plain",
+		`"double"`: `"double"`,
+		"'日本''語'":  "日本'語",
+	}
+	for in, want := range tests {
+		if got := unquoteLiteral(in); got != want {
+			t.Errorf("unquoteLiteral(%q): expected %q, got %q", in, want, got)
+		}
+	}
+}
+
+func TestUnquoteIdentifier(t *testing.T) {
+	tests := map[string]string{
+		"events":         "events",
+		`"my ""table"""`: `my "table"`,
+		"`back``tick`":   "back`tick",
+		"[brackets]":     "brackets",
+		`"`:              `"`,
+	}
+	for in, want := range tests {
+		if got := unquoteIdentifier(in); got != want {
+			t.Errorf("unquoteIdentifier(%q): expected %q, got %q", in, want, got)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// streamPathPrefix is the prefix of the Grafana Live channel paths served by RunStream,
+// e.g. "query/<panel id>". The query itself is sent in the subscription's data.
+const streamPathPrefix = "query"
+
+// Defaults of the stream options.
+const (
+	defaultStreamRefresh = 10 * time.Second
+	minStreamRefresh     = time.Second
+	defaultStreamRange   = time.Hour
+)
+
+// streamQuery holds the options of a live query on top of the usual query model.
+type streamQuery struct {
+	queryModel
+	// RefreshSeconds is how often the query is re-run; at least one second.
+	RefreshSeconds float64 `json:"refreshSeconds,omitempty"`
+	// RangeSeconds is the width of the rolling time range ending now that the time
+	// macros of each run see.
+	RangeSeconds float64 `json:"rangeSeconds,omitempty"`
+}
+
+// refresh returns the interval between runs of the stream.
+func (q streamQuery) refresh() time.Duration {
+	if q.RefreshSeconds <= 0 {
+		return defaultStreamRefresh
+	}
+	if refresh := time.Duration(q.RefreshSeconds * float64(time.Second)); refresh > minStreamRefresh {
+		return refresh
+	}
+	return minStreamRefresh
+}
+
+// timeRange returns the rolling time range of a run at now.
+func (q streamQuery) timeRange(now time.Time) backend.TimeRange {
+	width := defaultStreamRange
+	if q.RangeSeconds > 0 {
+		width = time.Duration(q.RangeSeconds * float64(time.Second))
+	}
+	return backend.TimeRange{From: now.Add(-width), To: now}
+}
+
+// isStreamPath reports whether path is a live query channel.
+func isStreamPath(path string) bool {
+	return path == streamPathPrefix || strings.HasPrefix(path, streamPathPrefix+"/")
+}
+
+// parseStreamQuery decodes the query of a live query channel.
+func parseStreamQuery(raw json.RawMessage) (streamQuery, error) {
+	var q streamQuery
+	if err := json.Unmarshal(raw, &q); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+// SubscribeStream allows subscriptions to live query channels. Streams re-run their
+// statement on every refresh, so only read-only statements may be streamed, whatever
+// the readOnly setting.
+func (d *Datasource) SubscribeStream(_ context.Context, req *backend.SubscribeStreamRequest) (*backend.SubscribeStreamResponse, error) {
+	if !isStreamPath(req.Path) {
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+	}
+	q, err := parseStreamQuery(req.Data)
+	if err != nil || strings.TrimSpace(q.QueryText) == "" {
+		d.logger.Debug("Rejecting live query subscription without a query", "path", req.Path, "error", err)
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+	}
+	if err := checkReadOnly(q.QueryText); err != nil {
+		d.logger.Warn("Rejecting live query subscription", "path", req.Path, "error", err)
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusPermissionDenied}, nil
+	}
+	return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusOK}, nil
+}
+
+// PublishStream rejects publications: live query channels are only written by RunStream.
+func (d *Datasource) PublishStream(_ context.Context, _ *backend.PublishStreamRequest) (*backend.PublishStreamResponse, error) {
+	return &backend.PublishStreamResponse{Status: backend.PublishStreamStatusPermissionDenied}, nil
+}
+
+// RunStream re-runs the channel's query every refresh interval over a rolling time range
+// and publishes the frames that changed. The first frame of each name carries its schema;
+// later ones only their data, unless the schema changes. It returns when ctx is cancelled.
+func (d *Datasource) RunStream(ctx context.Context, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
+	q, err := parseStreamQuery(req.Data)
+	if err != nil {
+		return err
+	}
+	d.logger.Debug("Starting live query", "path", req.Path, "refresh", q.refresh())
+
+	published := map[string]publishedFrame{}
+	ticker := time.NewTicker(q.refresh())
+	defer ticker.Stop()
+	for {
+		res := d.query(ctx, req.PluginContext, backend.DataQuery{
+			RefID:     "A",
+			JSON:      req.Data,
+			TimeRange: q.timeRange(time.Now()),
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+		if res.Error != nil {
+			d.logger.Warn("Live query failed", "path", req.Path, "error", res.Error)
+		}
+		for _, frame := range res.Frames {
+			if err := publishFrame(sender, frame, published); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			d.logger.Debug("Stopping live query", "path", req.Path)
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishedFrame is the last schema and data sent for a frame name.
+type publishedFrame struct {
+	schema []byte
+	data   []byte
+}
+
+// publishFrame sends frame unless its data is unchanged since it was last published,
+// leaving out the schema when that is unchanged too.
+func publishFrame(sender *backend.StreamSender, frame *data.Frame, published map[string]publishedFrame) error {
+	encoded, err := data.FrameToJSONCache(frame)
+	if err != nil {
+		return err
+	}
+	current := publishedFrame{schema: encoded.Bytes(data.IncludeSchemaOnly), data: encoded.Bytes(data.IncludeDataOnly)}
+	last, ok := published[frame.Name]
+	if ok && bytes.Equal(last.data, current.data) && bytes.Equal(last.schema, current.schema) {
+		return nil
+	}
+	include := data.IncludeAll
+	if ok && bytes.Equal(last.schema, current.schema) {
+		include = data.IncludeDataOnly
+	}
+	if err := sender.SendFrame(frame, include); err != nil {
+		return err
+	}
+	published[frame.Name] = current
+	return nil
+}
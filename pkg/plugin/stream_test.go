@@ -0,0 +1,118 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// packetRecorder collects the packets sent to a stream.
+type packetRecorder chan *backend.StreamPacket
+
+func (r packetRecorder) Send(p *backend.StreamPacket) error {
+	r <- p
+	return nil
+}
+
+func TestSubscribeStreamAuthorization(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, nil)
+	tests := []struct {
+		name string
+		path string
+		data string
+		want backend.SubscribeStreamStatus
+	}{
+		{"read query", "query/panel-1", `{"queryText":"SELECT * FROM events WHERE $__timeFilter(ts)"}`, backend.SubscribeStreamStatusOK},
+		{"bare path", "query", `{"queryText":"SELECT 1"}`, backend.SubscribeStreamStatusOK},
+		{"write query", "query/panel-1", `{"queryText":"DELETE FROM events"}`, backend.SubscribeStreamStatusPermissionDenied},
+		{"write after read", "query/panel-1", `{"queryText":"SELECT 1; INSERT INTO t VALUES (1)"}`, backend.SubscribeStreamStatusPermissionDenied},
+		{"unknown path", "other/panel-1", `{"queryText":"SELECT 1"}`, backend.SubscribeStreamStatusNotFound},
+		{"no query", "query/panel-1", `{}`, backend.SubscribeStreamStatusNotFound},
+		{"invalid data", "query/panel-1", `not json`, backend.SubscribeStreamStatusNotFound},
+	}
+	for _, tt := range tests {
+		res, err := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: tt.path, Data: json.RawMessage(tt.data)})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if res.Status != tt.want {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.want, res.Status)
+		}
+	}
+
+	res, err := ds.PublishStream(context.Background(), &backend.PublishStreamRequest{Path: "query/panel-1"})
+	if err != nil || res.Status != backend.PublishStreamStatusPermissionDenied {
+		t.Errorf("expected publishing to be denied, got %v (%v)", res, err)
+	}
+}
+
+func TestRunStreamPublishesFramesUntilCancelled(t *testing.T) {
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, func(w http.ResponseWriter, r *http.Request) {
+		rawResponse([]string{"ts", "value"}, [][]interface{}{{"2024-01-15 10:00:00", float64(1)}})(w, r)
+	})
+	packets := make(packetRecorder, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- ds.RunStream(ctx, &backend.RunStreamRequest{
+			Path: "query/panel-1",
+			Data: json.RawMessage(`{"queryText":"SELECT ts, value FROM events WHERE $__timeFilter(ts)","refreshSeconds":60}`),
+		}, backend.NewStreamSender(packets))
+	}()
+
+	select {
+	case p := <-packets:
+		var frame data.Frame
+		if err := json.Unmarshal(p.Data, &frame); err != nil {
+			t.Fatalf("invalid frame %s: %v", p.Data, err)
+		}
+		if len(frame.Fields) != 2 || frame.Rows() != 1 {
+			t.Errorf("expected the query result, got %d fields and %d rows", len(frame.Fields), frame.Rows())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frame was published")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected RunStream to stop cleanly, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunStream did not stop after cancellation")
+	}
+}
+
+func TestPublishFrameSendsOnlyChanges(t *testing.T) {
+	packets := make(packetRecorder, 10)
+	sender := backend.NewStreamSender(packets)
+	published := map[string]publishedFrame{}
+	frame := func(values ...float64) *data.Frame {
+		return data.NewFrame("A", data.NewField("value", nil, values))
+	}
+
+	for _, f := range []*data.Frame{frame(1), frame(1), frame(1, 2)} {
+		if err := publishFrame(sender, f, published); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if len(packets) != 2 {
+		t.Fatalf("expected the unchanged frame to be skipped, got %d packets", len(packets))
+	}
+
+	var first, second map[string]json.RawMessage
+	_ = json.Unmarshal((<-packets).Data, &first)
+	_ = json.Unmarshal((<-packets).Data, &second)
+	if _, ok := first["schema"]; !ok {
+		t.Error("expected the first packet to carry the schema")
+	}
+	if _, ok := second["schema"]; ok {
+		t.Error("expected later packets to carry only data")
+	}
+}
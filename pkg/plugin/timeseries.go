@@ -0,0 +1,432 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// formatTimeSeries is the query format used by time series panels and alert rules.
+const formatTimeSeries = "time_series"
+
+// formatLong is the query format returning one time, metric, value row per numeric
+// column of each result row.
+const formatLong = "long"
+
+// toTimeSeries converts a table frame into the shape time series panels and alerting
+// expect. With a time column, rows are sorted by time and string or bool columns become
+// labels of the numeric value fields (wide format). Without one, the result is treated
+// as an instant (reduced) query: a numeric long frame with one value per row.
+func toTimeSeries(frame *data.Frame) (*data.Frame, error) {
+	if len(frame.Fields) == 0 {
+		return frame, nil
+	}
+
+	schema := frame.TimeSeriesSchema()
+	if len(frame.TypeIndices(data.FieldTypeTime, data.FieldTypeNullableTime)) == 0 {
+		if !hasNumericField(frame) {
+			return nil, errors.New("time_series format requires a time column or at least one numeric column")
+		}
+		setFrameType(frame, data.FrameTypeNumericLong)
+		return frame, nil
+	}
+	if schema.Type == data.TimeSeriesTypeNot || !hasNumericField(frame) {
+		return nil, errors.New("time_series format requires at least one numeric value column")
+	}
+
+	sorted, dropped := sortByTime(frame, schema.TimeIndex)
+	if dropped > 0 {
+		sorted.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%d rows with a NULL time were dropped from the time series.", dropped),
+		})
+	}
+	if sorted.Rows() == 0 {
+		return sorted, nil
+	}
+
+	if schema.Type == data.TimeSeriesTypeLong {
+		wide, err := data.LongToWide(sorted, nil)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert result to a time series: %w", err)
+		}
+		return wide, nil
+	}
+	setFrameType(sorted, data.FrameTypeTimeSeriesWide)
+	return sorted, nil
+}
+
+// selectTimeColumn returns frame with the time field named column moved first, making it
+// the time column of the time series and long formats, which use the first time field.
+func selectTimeColumn(frame *data.Frame, column string) (*data.Frame, error) {
+	field, idx := frame.FieldByName(column)
+	if idx < 0 {
+		return nil, fmt.Errorf("timeColumn %q is not a column of the result", column)
+	}
+	if t := field.Type(); t != data.FieldTypeTime && t != data.FieldTypeNullableTime {
+		return nil, fmt.Errorf("timeColumn %q is not a time field but %s; declare it as time with columnTypes if it holds timestamps", column, t.NonNullableType().ItemTypeString())
+	}
+	fields := make([]*data.Field, 0, len(frame.Fields))
+	fields = append(fields, field)
+	fields = append(fields, frame.Fields[:idx]...)
+	fields = append(fields, frame.Fields[idx+1:]...)
+	selected := *frame
+	selected.Fields = fields
+	return &selected, nil
+}
+
+// downsampleFrame reduces a wide time series frame of more than target rows to target
+// rows with the largest-triangle-three-buckets algorithm, which keeps the peaks and dips
+// that give the series their shape instead of truncating it. The first and last rows are
+// always kept. With several value fields, a row's weight is the sum of its triangles over
+// all of them. Other frames, such as tables, are returned unchanged.
+func downsampleFrame(frame *data.Frame, target int) *data.Frame {
+	rows := frame.Rows()
+	if target <= 0 || rows <= target || frame.Meta == nil || frame.Meta.Type != data.FrameTypeTimeSeriesWide {
+		return frame
+	}
+	timeIndices := frame.TypeIndices(data.FieldTypeTime, data.FieldTypeNullableTime)
+	if len(timeIndices) == 0 {
+		return frame
+	}
+
+	// Times are measured from the first row so they keep their precision as floats.
+	timeField := frame.Fields[timeIndices[0]]
+	start, _ := timeField.ConcreteAt(0)
+	x := make([]float64, rows)
+	for i := range x {
+		if t, ok := timeField.ConcreteAt(i); ok {
+			x[i] = t.(time.Time).Sub(start.(time.Time)).Seconds()
+		}
+	}
+	var ys [][]float64
+	for _, field := range frame.Fields {
+		if !field.Type().Numeric() {
+			continue
+		}
+		y := make([]float64, rows)
+		for i := range y {
+			// NULL values count as zero when weighing rows.
+			if v, err := field.FloatAt(i); err == nil && !math.IsNaN(v) {
+				y[i] = v
+			}
+		}
+		ys = append(ys, y)
+	}
+
+	sampled := frame.EmptyCopy()
+	sampled.Meta = frame.Meta
+	for _, row := range largestTriangleThreeBuckets(x, ys, target) {
+		sampled.AppendRow(frame.RowCopy(row)...)
+	}
+	sampled.AppendNotices(data.Notice{
+		Severity: data.NoticeSeverityInfo,
+		Text:     fmt.Sprintf("Downsampled %d rows to %d points to fit the panel's max data points.", rows, target),
+	})
+	return sampled
+}
+
+// largestTriangleThreeBuckets returns the indices of the target rows to keep of the series
+// with times x and values ys, in ascending order. len(x) must be more than target.
+func largestTriangleThreeBuckets(x []float64, ys [][]float64, target int) []int {
+	n := len(x)
+	if target < 3 {
+		return []int{0, n - 1}[:target]
+	}
+
+	// The rows between the first and the last are split into target-2 buckets. Each
+	// bucket keeps the row forming the largest triangle with the row kept from the
+	// previous bucket and the average of the next bucket.
+	keep := make([]int, 1, target)
+	bucketSize := float64(n-2) / float64(target-2)
+	prev := 0
+	for b := 0; b < target-2; b++ {
+		from := int(float64(b)*bucketSize) + 1
+		to := int(float64(b+1)*bucketSize) + 1
+		nextTo := int(float64(b+2)*bucketSize) + 1
+		if nextTo > n {
+			nextTo = n
+		}
+
+		avgX := mean(x[to:nextTo])
+		avgYs := make([]float64, len(ys))
+		for j, y := range ys {
+			avgYs[j] = mean(y[to:nextTo])
+		}
+		best, bestArea := from, -1.0
+		for i := from; i < to; i++ {
+			area := 0.0
+			for j, y := range ys {
+				area += math.Abs((x[prev]-avgX)*(y[i]-y[prev]) - (x[prev]-x[i])*(avgYs[j]-y[prev]))
+			}
+			if area > bestArea {
+				best, bestArea = i, area
+			}
+		}
+		keep = append(keep, best)
+		prev = best
+	}
+	return append(keep, n-1)
+}
+
+// mean returns the average of values.
+func mean(values []float64) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// toLongFormat reshapes a wide result into a long time series frame: one row per numeric
+// column of each row, with the time, the column name as metric and its value. Other
+// columns, such as a host, are kept on every row as dimensions. Rows are sorted by time;
+// rows with a NULL time are dropped with a notice.
+func toLongFormat(frame *data.Frame) (*data.Frame, error) {
+	if len(frame.Fields) == 0 {
+		return frame, nil
+	}
+	timeIndices := frame.TypeIndices(data.FieldTypeTime, data.FieldTypeNullableTime)
+	if len(timeIndices) == 0 {
+		return nil, errors.New("long format requires a time column")
+	}
+	if !hasNumericField(frame) {
+		return nil, errors.New("long format requires at least one numeric column")
+	}
+
+	sorted, dropped := sortByTime(frame, timeIndices[0])
+	timeField := sorted.Fields[timeIndices[0]]
+	var metrics, dimensions []*data.Field
+	for i, field := range sorted.Fields {
+		switch {
+		case i == timeIndices[0]:
+		case field.Type().Numeric():
+			metrics = append(metrics, field)
+		default:
+			dimensions = append(dimensions, field)
+		}
+	}
+
+	rows := sorted.Rows() * len(metrics)
+	times := data.NewFieldFromFieldType(data.FieldTypeTime, rows)
+	times.Name = timeField.Name
+	fields := []*data.Field{times}
+	for _, dimension := range dimensions {
+		field := data.NewFieldFromFieldType(dimension.Type(), rows)
+		field.Name = dimension.Name
+		fields = append(fields, field)
+	}
+	metric := data.NewFieldFromFieldType(data.FieldTypeString, rows)
+	metric.Name = "metric"
+	value := data.NewFieldFromFieldType(data.FieldTypeNullableFloat64, rows)
+	value.Name = "value"
+	fields = append(fields, metric, value)
+
+	row := 0
+	for i := 0; i < sorted.Rows(); i++ {
+		t, _ := timeField.ConcreteAt(i)
+		for _, m := range metrics {
+			times.Set(row, t)
+			for j, dimension := range dimensions {
+				fields[j+1].Set(row, dimension.CopyAt(i))
+			}
+			metric.Set(row, m.Name)
+			// FloatAt reports NULL as NaN, so NULL is told from a NaN value by the field itself.
+			if _, ok := m.ConcreteAt(i); ok {
+				if v, err := m.FloatAt(i); err == nil {
+					value.Set(row, &v)
+				}
+			}
+			row++
+		}
+	}
+
+	long := data.NewFrame(frame.Name, fields...)
+	long.Meta = sorted.Meta
+	setFrameType(long, data.FrameTypeTimeSeriesLong)
+	if dropped > 0 {
+		long.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%d rows with a NULL time were dropped from the time series.", dropped),
+		})
+	}
+	return long, nil
+}
+
+// partitionFrame splits frame into one frame per distinct value of column, for panels
+// showing each partition as its own series. column is dropped from the partitions and
+// its value becomes a label of their non-time fields; NULL is labeled with an empty
+// value. Partitions are named after frame with their index, in order of first
+// appearance, and keep the row order of frame. Notices are only kept on the first.
+func partitionFrame(frame *data.Frame, column string) (data.Frames, error) {
+	if frame.Rows() == 0 {
+		return data.Frames{frame}, nil
+	}
+	colIdx := -1
+	for i, field := range frame.Fields {
+		if field.Name == column {
+			colIdx = i
+			break
+		}
+	}
+	if colIdx < 0 {
+		return nil, fmt.Errorf("partitionBy column %q is not a column of the result", column)
+	}
+
+	keyField := frame.Fields[colIdx]
+	var keys []string
+	rowsByKey := map[string][]int{}
+	for i := 0; i < frame.Rows(); i++ {
+		key := ""
+		if v, ok := keyField.ConcreteAt(i); ok {
+			key = fmt.Sprint(v)
+		}
+		if _, seen := rowsByKey[key]; !seen {
+			keys = append(keys, key)
+		}
+		rowsByKey[key] = append(rowsByKey[key], i)
+	}
+
+	partitions := make(data.Frames, 0, len(keys))
+	for p, key := range keys {
+		partition := data.NewFrame(statementFrameName(frame.Name, p))
+		for i, field := range frame.Fields {
+			if i == colIdx {
+				continue
+			}
+			copied := data.NewFieldFromFieldType(field.Type(), 0)
+			copied.Name = field.Name
+			copied.Config = field.Config
+			if !field.Type().Time() {
+				copied.Labels = data.Labels{column: key}
+				for name, value := range field.Labels {
+					copied.Labels[name] = value
+				}
+			}
+			partition.Fields = append(partition.Fields, copied)
+		}
+		for _, row := range rowsByKey[key] {
+			values := frame.RowCopy(row)
+			partition.AppendRow(append(values[:colIdx], values[colIdx+1:]...)...)
+		}
+		if frame.Meta != nil {
+			meta := *frame.Meta
+			if p > 0 {
+				meta.Notices = nil
+			}
+			partition.Meta = &meta
+		}
+		partitions = append(partitions, partition)
+	}
+	return partitions, nil
+}
+
+// preferredVisualization hints the panel type Grafana picks by default for frame: a graph
+// for a time field with numeric values, a table for anything else.
+func preferredVisualization(frame *data.Frame) data.VisType {
+	if len(frame.TypeIndices(data.FieldTypeTime, data.FieldTypeNullableTime)) > 0 && hasNumericField(frame) {
+		return data.VisTypeGraph
+	}
+	return data.VisTypeTable
+}
+
+// hasNumericField reports whether frame has a numeric field to use as a series value.
+func hasNumericField(frame *data.Frame) bool {
+	for _, field := range frame.Fields {
+		if field.Type().Numeric() {
+			return true
+		}
+	}
+	return false
+}
+
+// setFrameType marks frame with a data plane type, keeping any existing metadata.
+func setFrameType(frame *data.Frame, frameType data.FrameType) {
+	if frame.Meta == nil {
+		frame.Meta = &data.FrameMeta{}
+	}
+	frame.Meta.Type = frameType
+	frame.Meta.TypeVersion = data.FrameTypeVersion{0, 1}
+}
+
+// sortByTime returns a copy of frame with rows in ascending order of the time field at
+// timeIdx. Rows with a NULL time can't be placed on a time axis and are dropped; their
+// number is returned.
+func sortByTime(frame *data.Frame, timeIdx int) (*data.Frame, int) {
+	timeField := frame.Fields[timeIdx]
+	times := make([]time.Time, 0, timeField.Len())
+	order := make([]int, 0, timeField.Len())
+	for i := 0; i < timeField.Len(); i++ {
+		t, ok := timeField.ConcreteAt(i)
+		if !ok {
+			continue
+		}
+		times = append(times, t.(time.Time))
+		order = append(order, i)
+	}
+	sort.Stable(byTime{times: times, order: order})
+
+	sorted := frame.EmptyCopy()
+	sorted.Meta = frame.Meta
+	for _, row := range order {
+		sorted.AppendRow(frame.RowCopy(row)...)
+	}
+	return sorted, timeField.Len() - len(order)
+}
+
+// byTime sorts row indices by their time values.
+type byTime struct {
+	times []time.Time
+	order []int
+}
+
+func (b byTime) Len() int           { return len(b.times) }
+func (b byTime) Less(i, j int) bool { return b.times[i].Before(b.times[j]) }
+func (b byTime) Swap(i, j int) {
+	b.times[i], b.times[j] = b.times[j], b.times[i]
+	b.order[i], b.order[j] = b.order[j], b.order[i]
+}
+
+// transposeFrame flips a single-row frame into a two-field frame of column and value
+// pairs, one row per field of frame, for panels showing the details of one record.
+// Columns are named by their display name when one is set. Values are formatted as text,
+// timestamps as RFC 3339, and NULL stays NULL. A frame without rows gives an empty
+// result; one with more rows is rejected.
+func transposeFrame(frame *data.Frame) (*data.Frame, error) {
+	if rows := frame.Rows(); rows > 1 {
+		return nil, fmt.Errorf("transpose needs a result with a single row, got %d rows", rows)
+	}
+	columns := make([]string, 0, len(frame.Fields))
+	values := make([]*string, 0, len(frame.Fields))
+	if frame.Rows() == 1 {
+		for _, field := range frame.Fields {
+			name := field.Name
+			if field.Config != nil && field.Config.DisplayName != "" {
+				name = field.Config.DisplayName
+			} else if field.Config != nil && field.Config.DisplayNameFromDS != "" {
+				name = field.Config.DisplayNameFromDS
+			}
+			columns = append(columns, name)
+			v, ok := field.ConcreteAt(0)
+			if !ok {
+				values = append(values, nil)
+				continue
+			}
+			text := fmt.Sprint(v)
+			if t, isTime := v.(time.Time); isTime {
+				text = t.Format(time.RFC3339Nano)
+			}
+			values = append(values, &text)
+		}
+	}
+	transposed := data.NewFrame(frame.Name,
+		data.NewField("column", nil, columns),
+		data.NewField("value", nil, values),
+	)
+	transposed.Meta = frame.Meta
+	return transposed, nil
+}
@@ -0,0 +1,311 @@
+package plugin
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func ptr[T any](v T) *T { return &v }
+
+func TestToTimeSeriesLongToWide(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	frame := data.NewFrame("A",
+		data.NewField("ts", nil, []*time.Time{ptr(t0.Add(time.Minute)), ptr(t0), nil, ptr(t0)}),
+		data.NewField("host", nil, []*string{ptr("b"), ptr("a"), ptr("a"), ptr("b")}),
+		data.NewField("value", nil, []*float64{ptr(4.0), ptr(1.0), ptr(9.0), ptr(2.0)}),
+	)
+
+	ts, err := toTimeSeries(frame)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ts.Meta == nil || ts.Meta.Type != data.FrameTypeTimeSeriesWide {
+		t.Fatalf("expected a wide time series frame, got meta %+v", ts.Meta)
+	}
+	// One time field plus one value field per host.
+	if len(ts.Fields) != 3 || ts.Fields[0].Type() != data.FieldTypeTime {
+		t.Fatalf("unexpected fields: %v", ts.Fields)
+	}
+	if got := ts.Fields[1].Labels["host"]; got != "a" {
+		t.Errorf("expected first series labelled host=a, got %q", got)
+	}
+	if got := ts.Fields[0].At(0).(time.Time); !got.Equal(t0) {
+		t.Errorf("expected rows sorted by time, first time is %v", got)
+	}
+	if !hasNotice(ts, "1 rows with a NULL time were dropped") {
+		t.Errorf("expected a notice about the dropped row, got %+v", ts.Meta.Notices)
+	}
+}
+
+func TestToTimeSeriesInstant(t *testing.T) {
+	frame := data.NewFrame("A",
+		data.NewField("host", nil, []*string{ptr("a"), ptr("b")}),
+		data.NewField("errors", nil, []*float64{ptr(3.0), ptr(0.0)}),
+	)
+	ts, err := toTimeSeries(frame)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ts.Meta == nil || ts.Meta.Type != data.FrameTypeNumericLong {
+		t.Errorf("expected a numeric long frame, got meta %+v", ts.Meta)
+	}
+}
+
+func TestToTimeSeriesRequiresNumericValue(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	withTime := data.NewFrame("A",
+		data.NewField("ts", nil, []*time.Time{ptr(t0)}),
+		data.NewField("host", nil, []*string{ptr("a")}),
+	)
+	if _, err := toTimeSeries(withTime); err == nil {
+		t.Error("expected an error for a time series without a numeric column")
+	}
+
+	withoutTime := data.NewFrame("A", data.NewField("host", nil, []*string{ptr("a")}))
+	if _, err := toTimeSeries(withoutTime); err == nil {
+		t.Error("expected an error for a result with neither a time nor a numeric column")
+	}
+}
+
+func TestPreferredVisualization(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeSeries := data.NewFrame("A",
+		data.NewField("ts", nil, []*time.Time{ptr(t0)}),
+		data.NewField("value", nil, []*float64{ptr(1.0)}),
+	)
+	if got := preferredVisualization(timeSeries); got != data.VisTypeGraph {
+		t.Errorf("expected %s for a time series shaped frame, got %s", data.VisTypeGraph, got)
+	}
+
+	table := data.NewFrame("A",
+		data.NewField("ts", nil, []*time.Time{ptr(t0)}),
+		data.NewField("name", nil, []*string{ptr("a")}),
+	)
+	if got := preferredVisualization(table); got != data.VisTypeTable {
+		t.Errorf("expected %s for a table shaped frame, got %s", data.VisTypeTable, got)
+	}
+}
+
+func TestPartitionFrame(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	frame := data.NewFrame("A",
+		data.NewField("ts", nil, []*time.Time{ptr(t0.Add(2 * time.Minute)), ptr(t0), ptr(t0.Add(time.Minute)), ptr(t0)}),
+		data.NewField("host", nil, []*string{ptr("b"), ptr("a"), ptr("b"), ptr("a")}),
+		data.NewField("value", nil, []*float64{ptr(4.0), ptr(1.0), ptr(3.0), ptr(2.0)}),
+	)
+	frame.AppendNotices(data.Notice{Text: "note"})
+
+	partitions, err := partitionFrame(frame, "host")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(partitions) != 2 {
+		t.Fatalf("expected 2 frames, got %d", len(partitions))
+	}
+	for i, want := range []struct {
+		name, host string
+		values     []float64
+	}{{"A[0]", "b", []float64{4, 3}}, {"A[1]", "a", []float64{1, 2}}} {
+		p := partitions[i]
+		if p.Name != want.name || len(p.Fields) != 2 || p.Fields[0].Name != "ts" || p.Fields[1].Name != "value" {
+			t.Fatalf("partition %d: unexpected frame %s with fields %v", i, p.Name, p.Fields)
+		}
+		if p.Fields[0].Labels != nil || p.Fields[1].Labels["host"] != want.host {
+			t.Errorf("partition %d: expected only the value labelled host=%s, got %v and %v", i, want.host, p.Fields[0].Labels, p.Fields[1].Labels)
+		}
+		for row, v := range want.values {
+			if got := p.Fields[1].At(row).(*float64); got == nil || *got != v {
+				t.Errorf("partition %d row %d: expected %v, got %v", i, row, v, got)
+			}
+		}
+	}
+	if !hasNotice(partitions[0], "note") || hasNotice(partitions[1], "note") {
+		t.Error("expected the notices on the first partition only")
+	}
+
+	if _, err := partitionFrame(frame, "missing"); err == nil {
+		t.Error("expected an unknown column to be rejected")
+	}
+}
+
+func TestTransposeFrame(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC)
+	frame := data.NewFrame("A",
+		data.NewField("id", nil, []*int64{ptr(int64(7))}),
+		data.NewField("created", nil, []*time.Time{ptr(t0)}),
+		data.NewField("note", nil, []*string{nil}),
+	)
+	frame.Fields[0].Config = &data.FieldConfig{DisplayNameFromDS: "ID"}
+
+	transposed, err := transposeFrame(frame)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if transposed.Name != "A" || len(transposed.Fields) != 2 || transposed.Fields[0].Name != "column" || transposed.Fields[1].Name != "value" {
+		t.Fatalf("unexpected frame %s with fields %v", transposed.Name, transposed.Fields)
+	}
+	for row, want := range []struct {
+		column string
+		value  *string
+	}{{"ID", ptr("7")}, {"created", ptr("2024-01-01T12:30:00Z")}, {"note", nil}} {
+		if got := transposed.Fields[0].At(row).(string); got != want.column {
+			t.Errorf("row %d: expected column %q, got %q", row, want.column, got)
+		}
+		got := transposed.Fields[1].At(row).(*string)
+		if (got == nil) != (want.value == nil) || (got != nil && *got != *want.value) {
+			t.Errorf("row %d: expected value %v, got %v", row, want.value, got)
+		}
+	}
+
+	frame.AppendRow(ptr(int64(8)), ptr(t0), ptr("x"))
+	if _, err := transposeFrame(frame); err == nil || !strings.Contains(err.Error(), "got 2 rows") {
+		t.Errorf("expected a multi-row result to be rejected, got %v", err)
+	}
+}
+
+func TestDownsampleFrame(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	times := make([]time.Time, 1000)
+	values := make([]*float64, 1000)
+	for i := range times {
+		times[i] = t0.Add(time.Duration(i) * time.Second)
+		values[i] = ptr(float64(i % 10))
+	}
+	values[500] = ptr(1000.0)
+	values[501] = nil
+	series := func() *data.Frame {
+		frame := data.NewFrame("A",
+			data.NewField("time", nil, times),
+			data.NewField("value", nil, values),
+		)
+		setFrameType(frame, data.FrameTypeTimeSeriesWide)
+		return frame
+	}
+
+	sampled := downsampleFrame(series(), 100)
+	if sampled.Rows() != 100 {
+		t.Fatalf("expected 100 points, got %d", sampled.Rows())
+	}
+	if first := sampled.Fields[0].At(0).(time.Time); !first.Equal(times[0]) {
+		t.Errorf("expected the first point to be kept, got %v", first)
+	}
+	if last := sampled.Fields[0].At(99).(time.Time); !last.Equal(times[999]) {
+		t.Errorf("expected the last point to be kept, got %v", last)
+	}
+	spike := false
+	for i := 0; i < sampled.Rows(); i++ {
+		if v := sampled.Fields[1].At(i).(*float64); v != nil && *v == 1000 {
+			spike = true
+		}
+	}
+	if !spike {
+		t.Error("expected the spike to survive downsampling")
+	}
+	if !hasNotice(sampled, "Downsampled 1000 rows to 100 points") {
+		t.Errorf("expected a downsampling notice, got %+v", sampled.Meta.Notices)
+	}
+
+	for _, target := range []int{1, 2, 3} {
+		if got := downsampleFrame(series(), target).Rows(); got != target {
+			t.Errorf("target %d: expected %d points, got %d", target, target, got)
+		}
+	}
+	if got := downsampleFrame(series(), 1000).Rows(); got != 1000 {
+		t.Errorf("expected a series within the target to be kept whole, got %d rows", got)
+	}
+	if got := downsampleFrame(series(), 0).Rows(); got != 1000 {
+		t.Errorf("expected no downsampling without a target, got %d rows", got)
+	}
+
+	table := data.NewFrame("A",
+		data.NewField("time", nil, times),
+		data.NewField("value", nil, values),
+	)
+	if got := downsampleFrame(table, 100).Rows(); got != 1000 {
+		t.Errorf("expected a table frame to be left untouched, got %d rows", got)
+	}
+}
+
+func TestToLongFormat(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	frame := data.NewFrame("A",
+		data.NewField("ts", nil, []*time.Time{ptr(t0.Add(time.Minute)), ptr(t0), nil}),
+		data.NewField("host", nil, []*string{ptr("b"), ptr("a"), ptr("c")}),
+		data.NewField("cpu", nil, []*float64{ptr(0.5), ptr(0.25), ptr(1.0)}),
+		data.NewField("mem", nil, []*int64{ptr(int64(512)), nil, ptr(int64(1))}),
+	)
+
+	long, err := toLongFormat(frame)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if long.Meta == nil || long.Meta.Type != data.FrameTypeTimeSeriesLong {
+		t.Fatalf("expected a long time series frame, got meta %+v", long.Meta)
+	}
+	var names []string
+	for _, field := range long.Fields {
+		names = append(names, field.Name)
+	}
+	if want := []string{"ts", "host", "metric", "value"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("expected fields %v, got %v", want, names)
+	}
+
+	type row struct {
+		time   time.Time
+		host   string
+		metric string
+		value  *float64
+	}
+	want := []row{
+		{t0, "a", "cpu", ptr(0.25)},
+		{t0, "a", "mem", nil},
+		{t0.Add(time.Minute), "b", "cpu", ptr(0.5)},
+		{t0.Add(time.Minute), "b", "mem", ptr(512.0)},
+	}
+	if long.Rows() != len(want) {
+		t.Fatalf("expected %d rows, got %d", len(want), long.Rows())
+	}
+	for i, w := range want {
+		got := row{
+			time:   long.Fields[0].At(i).(time.Time),
+			host:   *long.Fields[1].At(i).(*string),
+			metric: long.Fields[2].At(i).(string),
+			value:  long.Fields[3].At(i).(*float64),
+		}
+		if !got.time.Equal(w.time) || got.host != w.host || got.metric != w.metric || !reflect.DeepEqual(got.value, w.value) {
+			t.Errorf("row %d: expected %+v, got %+v", i, w, got)
+		}
+	}
+	if !hasNotice(long, "1 rows with a NULL time were dropped") {
+		t.Errorf("expected a notice about the dropped row, got %+v", long.Meta.Notices)
+	}
+
+	nan := data.NewFrame("A",
+		data.NewField("ts", nil, []time.Time{t0, t0.Add(time.Minute), t0.Add(2 * time.Minute)}),
+		data.NewField("ratio", nil, []*float64{ptr(math.NaN()), nil, ptr(0.0)}),
+	)
+	long, err = toLongFormat(nan)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	values := long.Fields[2]
+	if got := values.At(0).(*float64); got == nil || !math.IsNaN(*got) {
+		t.Errorf("expected a NaN value to be kept, got %v", got)
+	}
+	if got := values.At(1).(*float64); got != nil {
+		t.Errorf("expected a NULL value to stay NULL, got %v", *got)
+	}
+	if got := values.At(2).(*float64); got == nil || *got != 0 {
+		t.Errorf("expected a zero value to be kept, got %v", got)
+	}
+
+	withoutTime := data.NewFrame("A", data.NewField("cpu", nil, []float64{1}))
+	if _, err := toLongFormat(withoutTime); err == nil || !strings.Contains(err.Error(), "requires a time column") {
+		t.Errorf("expected a result without a time column to be rejected, got %v", err)
+	}
+}
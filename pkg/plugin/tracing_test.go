@@ -0,0 +1,80 @@
+package plugin
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// recordSpans installs a default tracer that records finished spans for the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracing.InitDefaultTracer(provider.Tracer("test"))
+	t.Cleanup(func() { tracing.InitDefaultTracer(noop.NewTracerProvider().Tracer("")) })
+	return recorder
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestQueryRecordsSpanAroundRequest(t *testing.T) {
+	recorder := recordSpans(t)
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db-1"}`, rawResponse([]string{"n"}, [][]interface{}{{float64(1)}}))
+
+	if res := runQuery(t, ds, `{"queryText":"SELECT n FROM t WHERE s = 'é'"}`); res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+
+	if len(recorder.Started()) != 1 {
+		t.Fatalf("expected 1 started span, got %d", len(recorder.Started()))
+	}
+	ended := recorder.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("expected 1 ended span, got %d", len(ended))
+	}
+	span := ended[0]
+	if v, _ := spanAttribute(span, "d1.database_id"); v.AsString() != "db-1" {
+		t.Errorf("expected database id attribute, got %q", v.AsString())
+	}
+	// Characters, like maxSqlLength counts them, not bytes.
+	if v, _ := spanAttribute(span, "d1.sql_length"); v.AsInt64() != 29 {
+		t.Errorf("expected an sql length of 29 characters, got %d", v.AsInt64())
+	}
+	if v, _ := spanAttribute(span, "http.status_code"); v.AsInt64() != http.StatusOK {
+		t.Errorf("unexpected status attribute %d", v.AsInt64())
+	}
+	if _, ok := spanAttribute(span, "d1.duration_ms"); !ok {
+		t.Error("expected duration attribute")
+	}
+}
+
+func TestQueryRecordsSpanError(t *testing.T) {
+	recorder := recordSpans(t)
+	ds := newTestDatasource(t, `{"accountId":"acc","databaseId":"db"}`, nil)
+	setBaseURL(ds, "http://127.0.0.1:1") // nothing listens here
+
+	if res := runQuery(t, ds, `{"queryText":"SELECT 1"}`); res.Error == nil {
+		t.Fatal("expected a connection error")
+	}
+	ended := recorder.Ended()
+	if len(ended) != 1 || ended[0].Status().Code != codes.Error {
+		t.Fatalf("expected 1 span with error status, got %+v", ended)
+	}
+	if len(ended[0].Events()) == 0 {
+		t.Error("expected the error to be recorded on the span")
+	}
+}
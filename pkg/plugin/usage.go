@@ -0,0 +1,47 @@
+package plugin
+
+import (
+	"sync"
+
+	"github.com/olipayne/grafana-cloudflare-d1-datasource/pkg/models"
+)
+
+// usageCounters accumulates the D1 usage of a datasource instance, which Cloudflare
+// bills by rows read and written. It is safe for concurrent use; the zero value is
+// ready to use.
+type usageCounters struct {
+	mu    sync.Mutex
+	usage usageSnapshot
+}
+
+// usageSnapshot is the state of usageCounters at one point, as served by /metrics.
+type usageSnapshot struct {
+	Statements  int64 `json:"statements"`
+	RowsRead    int64 `json:"rowsRead"`
+	RowsWritten int64 `json:"rowsWritten"`
+}
+
+// record adds the metadata of the statements of one D1 response.
+func (u *usageCounters) record(results []models.D1RawResultItem) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, result := range results {
+		u.usage.Statements++
+		u.usage.RowsRead += int64(result.Meta.RowsRead)
+		u.usage.RowsWritten += int64(result.Meta.RowsWritten)
+	}
+}
+
+// snapshot returns the current totals.
+func (u *usageCounters) snapshot() usageSnapshot {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.usage
+}
+
+// reset sets all totals back to zero.
+func (u *usageCounters) reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.usage = usageSnapshot{}
+}
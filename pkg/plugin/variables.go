@@ -0,0 +1,157 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// scopedVar is the value of a template variable as Grafana sends it in scopedVars.
+// Value is a string, or a list of strings for multi-value variables.
+type scopedVar struct {
+	Text  interface{} `json:"text"`
+	Value interface{} `json:"value"`
+}
+
+var (
+	// inMacroPattern matches $__in(column, values) like the query editor does.
+	inMacroPattern = regexp.MustCompile(`\$__in\(([^,()]*),([^()]*)\)`)
+	// variablePattern matches ${name}, ${name:format}, [[name]] and $name.
+	variablePattern = regexp.MustCompile(`\$\{(\w+)(?::(\w+))?\}|\[\[(\w+)\]\]|\$(\w+)`)
+)
+
+// applyScopedVars replaces the template variables of sql with their values the way the
+// query editor does before a query reaches the backend. Variables inside $__in become a
+// JSON array the macro binds as params; multi-value variables elsewhere are joined with
+// commas. A format given as ${name:format} takes precedence in both places; formats
+// missing from variableFormats are an error. Unknown variables, including macros, are
+// left as they are.
+func applyScopedVars(sql string, vars map[string]scopedVar) (string, error) {
+	var err error
+	sql = inMacroPattern.ReplaceAllStringFunc(sql, func(macro string) string {
+		parts := inMacroPattern.FindStringSubmatch(macro)
+		values, replaceErr := replaceVariables(parts[2], vars, formatInList)
+		if err == nil {
+			err = replaceErr
+		}
+		return "$__in(" + parts[1] + "," + values + ")"
+	})
+	if err != nil {
+		return "", err
+	}
+	return replaceVariables(sql, vars, func(values []string) string {
+		return strings.Join(values, ",")
+	})
+}
+
+// replaceVariables replaces the variables of text found in vars with their values,
+// formatted with the format the reference names, or by format if it names none.
+func replaceVariables(text string, vars map[string]scopedVar, format func([]string) string) (string, error) {
+	var err error
+	replaced := variablePattern.ReplaceAllStringFunc(text, func(ref string) string {
+		parts := variablePattern.FindStringSubmatch(ref)
+		name := parts[1] + parts[3] + parts[4]
+		v, ok := vars[name]
+		if !ok {
+			return ref
+		}
+		if parts[2] == "" {
+			return format(variableValues(v.Value))
+		}
+		formatted, formatErr := formatVariable(v, parts[2])
+		if formatErr != nil {
+			if err == nil {
+				err = fmt.Errorf("variable %s: %w", name, formatErr)
+			}
+			return ref
+		}
+		return formatted
+	})
+	return replaced, err
+}
+
+// variableFormats are the formats of ${name:format} applied the way Grafana does. Other
+// formats, such as regex or percentencode, are rejected rather than approximated. json
+// and text are handled by formatVariable, as they need more than the values.
+var variableFormats = map[string]func(values []string) string{
+	"csv":  func(values []string) string { return strings.Join(values, ",") },
+	"raw":  func(values []string) string { return strings.Join(values, ",") },
+	"pipe": func(values []string) string { return strings.Join(values, "|") },
+	"singlequote": func(values []string) string {
+		return quoteEach(values, func(value string) string {
+			return "'" + strings.ReplaceAll(value, "'", `\'`) + "'"
+		})
+	},
+	"doublequote": func(values []string) string {
+		return quoteEach(values, func(value string) string {
+			return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+		})
+	},
+	"sqlstring": func(values []string) string { return quoteEach(values, QuoteLiteral) },
+}
+
+// formatVariable formats the value of v as the named format of ${name:format} does.
+func formatVariable(v scopedVar, format string) (string, error) {
+	switch format {
+	case "json":
+		var encoded []byte
+		if _, multi := v.Value.([]interface{}); multi {
+			encoded, _ = json.Marshal(variableValues(v.Value))
+		} else {
+			encoded, _ = json.Marshal(strings.Join(variableValues(v.Value), ""))
+		}
+		return string(encoded), nil
+	case "text":
+		return strings.Join(variableValues(v.Text), " + "), nil
+	}
+	if apply, ok := variableFormats[format]; ok {
+		return apply(variableValues(v.Value)), nil
+	}
+	supported := []string{"json", "text"}
+	for name := range variableFormats {
+		supported = append(supported, name)
+	}
+	sort.Strings(supported)
+	return "", fmt.Errorf("format %q is not supported, use one of %s", format, strings.Join(supported, ", "))
+}
+
+// quoteEach quotes every value with quote and joins them with commas.
+func quoteEach(values []string, quote func(string) string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = quote(value)
+	}
+	return strings.Join(quoted, ",")
+}
+
+// variableValues returns the values of a variable as strings.
+func variableValues(value interface{}) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		values := make([]string, len(v))
+		for i, item := range v {
+			values[i] = fmt.Sprint(item)
+		}
+		return values
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+// inListEscaper escapes the characters sqlutil splits macro arguments at.
+var inListEscaper = strings.NewReplacer(",", `\u002c`, "(", `\u0028`, ")", `\u0029`)
+
+// formatInList formats values as the JSON array of strings parseInValues reads, as the
+// query editor does for variables inside $__in.
+func formatInList(values []string) string {
+	escaped := make([]string, len(values))
+	for i, value := range values {
+		encoded, _ := json.Marshal(value)
+		escaped[i] = inListEscaper.Replace(string(encoded))
+	}
+	return "[" + strings.Join(escaped, ",") + "]"
+}
@@ -3,6 +3,19 @@ import { DataSourceWithBackend, getTemplateSrv } from '@grafana/runtime';
 
 import { MyQuery, MyDataSourceOptions, DEFAULT_QUERY } from './types';
 
+// Matches $__in(column, values), whose values are bound as query params by the backend.
+const IN_MACRO = /\$__in\(([^,()]*),([^()]*)\)/g;
+
+// Formats the values of a variable inside $__in as a JSON array. The backend splits macro
+// arguments at commas and parentheses, so those are escaped inside the strings.
+function formatInList(value: string | string[]): string {
+  const values = Array.isArray(value) ? value : [value];
+  const escaped = values.map((v) =>
+    JSON.stringify(String(v)).replace(/[,()]/g, (c) => '\\u' + c.charCodeAt(0).toString(16).padStart(4, '0'))
+  );
+  return '[' + escaped.join(',') + ']';
+}
+
 export class DataSource extends DataSourceWithBackend<MyQuery, MyDataSourceOptions> {
   accountId?: string;
   databaseId?: string;
@@ -18,9 +31,14 @@ export class DataSource extends DataSourceWithBackend<MyQuery, MyDataSourceOptio
   }
 
   applyTemplateVariables(query: MyQuery, scopedVars: ScopedVars) {
+    const templateSrv = getTemplateSrv();
+    const queryText = (query.queryText ?? '').replace(
+      IN_MACRO,
+      (_, column: string, values: string) => `$__in(${column},${templateSrv.replace(values, scopedVars, formatInList)})`
+    );
     return {
       ...query,
-      queryText: getTemplateSrv().replace(query.queryText, scopedVars),
+      queryText: templateSrv.replace(queryText, scopedVars),
     };
   }
 
@@ -3,6 +3,68 @@ import { DataQuery } from '@grafana/schema';
 
 export interface MyQuery extends DataQuery {
   queryText?: string;
+  /** Columns holding JSON documents that are normalized to compact JSON. */
+  jsonColumns?: string[];
+  /** 0/1 or true/false (any case) columns returned as boolean fields. */
+  boolColumns?: string[];
+  /** Columns of numbers stored as text with the datasource's decimal separator, returned as float64 fields. */
+  numericStringColumns?: string[];
+  /** Field types of columns by name, bypassing inference. */
+  columnTypes?: Record<string, 'string' | 'float64' | 'int64' | 'bool' | 'time'>;
+  /** Display metadata per result column, keyed by column name. */
+  fieldConfig?: Record<string, { unit?: string; displayName?: string }>;
+  /** Values substituted for the $__limit and $__offset macros. */
+  limit?: number;
+  offset?: number;
+  /** Check the SQL with EXPLAIN instead of running it. */
+  validateOnly?: boolean;
+  /** Values bound to ?, ?NNN placeholders in queryText, in order. */
+  params?: unknown[];
+  /** 'table' (default) or 'time_series' for time series panels and alert rules. */
+  format?: 'table' | 'time_series' | 'long';
+  /** Time column of the time_series and long formats; defaults to the first time column. */
+  timeColumn?: string;
+  /** Session bookmark forwarded to D1 so the query reads at least the state it names. */
+  sessionBookmark?: string;
+  /** D1 endpoint the query is sent to; defaults to 'raw'. */
+  endpoint?: 'raw' | 'query';
+  /** Overrides the datasource's query timeout, up to its configured maximum. */
+  timeoutSeconds?: number;
+  /** Type columns by their declared SQLite types (PRAGMA table_info) instead of their values. */
+  useSchemaTypes?: boolean;
+  /** Hide the notice shown when the query doesn't use the dashboard time range. */
+  suppressTimeRangeNotice?: boolean;
+  /** Columns kept as strings even if their values look like timestamps. */
+  noTimeParseColumns?: string[];
+  /** Add a last_row_id frame with the row ID of the last INSERT. */
+  returnLastRowId?: boolean;
+  /** Column whose distinct values split the result into one frame (series) each. */
+  partitionBy?: string;
+  /** Coordinate columns returned as float64 fields the geomap panel recognizes; set both or neither. */
+  latColumn?: string;
+  lonColumn?: string;
+  /** On an empty result, count the rows of the queried table and report how many the filters excluded. */
+  countOnEmpty?: boolean;
+  /** Skip the result cache, replacing the cached result with a fresh one. */
+  noCache?: boolean;
+  /** Return a single-row result as column and value pairs. */
+  transpose?: boolean;
+  /** Return the result's fields and their inferred types without rows. */
+  schemaOnly?: boolean;
+  /** Return every column as strings holding the values as D1 sent them. */
+  rawStrings?: boolean;
+  /** Run the query against each of these databases and merge their rows, adding a __database column. */
+  databaseIds?: string[];
+  /** Parse column names like value{host="a"} into a field name and labels. */
+  columnLabels?: boolean;
+  /** Return a failing query's errors as code and message rows instead of an error. */
+  errorsAsData?: boolean;
+  /** Downsample time series with more rows than the panel's max data points to that many points. */
+  downsample?: boolean;
+  /** Live queries: seconds between runs (at least 1, default 10). */
+  refreshSeconds?: number;
+  /** Live queries: width in seconds of the rolling time range ending now (default 3600). */
+  rangeSeconds?: number;
 }
 
 export const DEFAULT_QUERY: Partial<MyQuery> = {